@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+)
+
+// alias returns the name of the package the named package stands for, or
+// the named package itself when it is not an alias.
+func (b *Builder) alias(pkg string) string {
+	if p, ok := b.aliases[strings.ToLower(pkg)]; ok {
+		return p
+	}
+	return pkg
+}
+
+// canonical returns the name of the named package or alias, as set by the
+// recipe of the package: packages are named case-insensitively.
+func (b *Builder) canonical(pkg string) string {
+	if p, ok := b.names[strings.ToLower(b.alias(pkg))]; ok {
+		return p
+	}
+	return pkg
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// archDetection is the outcome of the detection of the architecture of the
+// current machine, with the evidence it is based on.
+type archDetection struct {
+	arch      string
+	goos      string
+	goarch    string
+	osRelease map[string]string // fields of /etc/os-release, on linux
+	uname     string
+	container string // kind of container aligot runs in, if any
+}
+
+// detectArch returns the architecture string of the current machine, e.g.
+// slc7_x86-64, ubuntu2204_x86-64 or osx_arm64.
+func detectArch(x Executor) (string, error) {
+	d, err := detect(x)
+	return d.arch, err
+}
+
+// detect detects the architecture of the current machine, running its
+// commands with x.
+func detect(x Executor) (archDetection, error) {
+	d := archDetection{
+		goos:      runtime.GOOS,
+		goarch:    runtime.GOARCH,
+		container: detectContainer(),
+	}
+	if out, err := output(x, exec.Command("uname", "-srm")); err == nil {
+		d.uname = strings.TrimSpace(string(out))
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		d.arch = "osx_" + archCPU(runtime.GOOS, runtime.GOARCH)
+		return d, nil
+	case "linux":
+		rel, err := readOSRelease("/etc/os-release")
+		if err != nil {
+			return d, err
+		}
+		d.osRelease = rel
+		platform, err := linuxPlatform(rel)
+		if err != nil {
+			return d, err
+		}
+		d.arch = platform + "_" + archCPU(runtime.GOOS, runtime.GOARCH)
+		return d, nil
+	}
+	return d, fmt.Errorf("unsupported operating system %q", runtime.GOOS)
+}
+
+// detectContainer returns the kind of container aligot runs in, and the
+// evidence of it, or "" if none.
+func detectContainer() string {
+	switch {
+	case exists("/.dockerenv"):
+		return "docker (/.dockerenv)"
+	case exists("/run/.containerenv"):
+		return "podman (/run/.containerenv)"
+	case os.Getenv("container") != "":
+		return os.Getenv("container") + " ($container)"
+	}
+	buf, err := ioutil.ReadFile("/proc/1/cgroup")
+	if err != nil {
+		return ""
+	}
+	for _, kind := range []string{"docker", "kubepods", "lxc", "containerd"} {
+		if bytes.Contains(buf, []byte(kind)) {
+			return kind + " (/proc/1/cgroup)"
+		}
+	}
+	return ""
+}
+
+// archdetect writes the detected architecture to w, and the evidence of its
+// detection to ew, so that scripts can use the output of w as is.
+func archdetect(x Executor, w, ew io.Writer) error {
+	d, err := detect(x)
+	fmt.Fprintf(ew, "os:         %s/%s\n", d.goos, d.goarch)
+	if d.uname != "" {
+		fmt.Fprintf(ew, "uname:      %s\n", d.uname)
+	}
+	for _, k := range []string{"ID", "VERSION_ID", "ID_LIKE", "PRETTY_NAME"} {
+		if v, ok := d.osRelease[k]; ok {
+			fmt.Fprintf(ew, "os-release: %s=%s\n", k, v)
+		}
+	}
+	container := d.container
+	if container == "" {
+		container = "none"
+	}
+	fmt.Fprintf(ew, "container:  %s\n", container)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", d.arch)
+	return err
+}
+
+// archCPU returns the CPU part of an architecture string.
+func archCPU(goos, goarch string) string {
+	switch goarch {
+	case "amd64":
+		return "x86-64"
+	case "arm64":
+		if goos == "darwin" {
+			return "arm64"
+		}
+		return "aarch64"
+	}
+	return goarch
+}
+
+// linuxPlatform returns the platform part of an architecture string, from the
+// fields of /etc/os-release.
+func linuxPlatform(rel map[string]string) (string, error) {
+	id := rel["ID"]
+	vers := rel["VERSION_ID"]
+	major := strings.Split(vers, ".")[0]
+	switch id {
+	case "centos", "rhel", "almalinux", "rocky", "scientific":
+		return "slc" + major, nil
+	case "fedora":
+		return "fedora" + major, nil
+	case "ubuntu":
+		return "ubuntu" + strings.Replace(vers, ".", "", -1), nil
+	case "debian":
+		return "debian" + major, nil
+	case "alpine":
+		// musl-based: binaries are not compatible with glibc-based
+		// distributions, whatever the version.
+		return "alpine", nil
+	}
+	return "", fmt.Errorf("unsupported linux distribution %q (version %q)", id, vers)
+}
+
+// readOSRelease parses an os-release file.
+func readOSRelease(fname string) (map[string]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rel := make(map[string]string)
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		toks := strings.SplitN(line, "=", 2)
+		if len(toks) != 2 {
+			continue
+		}
+		rel[toks[0]] = strings.Trim(toks[1], `"'`)
+	}
+	return rel, scan.Err()
+}
+
+var reArch = regexp.MustCompile(`^([a-z]+?)([0-9]*)_([a-z0-9_-]+)$`)
+
+// platformAliases maps the aliases of platforms to their name in
+// architecture strings.
+var platformAliases = map[string]string{
+	"el":        "slc",
+	"rhel":      "slc",
+	"centos":    "slc",
+	"cs":        "slc",
+	"alma":      "slc",
+	"almalinux": "slc",
+	"rocky":     "slc",
+	"ubuntu":    "ubuntu",
+	"fedora":    "fedora",
+	"debian":    "debian",
+	"slc":       "slc",
+	"alpine":    "alpine",
+	"osx":       "osx",
+	"macos":     "osx",
+}
+
+// cpuAliases maps the aliases of CPUs to their name in architecture strings.
+var cpuAliases = map[string]string{
+	"x86-64":  "x86-64",
+	"x86_64":  "x86-64",
+	"amd64":   "x86-64",
+	"aarch64": "aarch64",
+	"arm64":   "aarch64",
+}
+
+// normalizeArch validates an architecture string against the
+// <platform><version>_<cpu> grammar, e.g. slc9_x86-64, and normalizes the
+// aliases of its platform and CPU, e.g. el9_amd64 into slc9_x86-64.
+func normalizeArch(arch string) (string, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf(
+			"invalid architecture %q: %s\n"+
+				"architectures are <platform><version>_<cpu> (e.g. slc9_x86-64, ubuntu2204_aarch64, osx_arm64),\n"+
+				"with platforms: slcN, fedoraN, debianN, ubuntuNNNN, alpine and osx,\n"+
+				"and cpus: x86-64 and aarch64 (arm64 on osx)",
+			arch, reason,
+		)
+	}
+	m := reArch.FindStringSubmatch(strings.ToLower(arch))
+	if m == nil {
+		return "", invalid("not of the form <platform><version>_<cpu>")
+	}
+	platform, ok := platformAliases[m[1]]
+	if !ok {
+		return "", invalid(fmt.Sprintf("unknown platform %q", m[1]))
+	}
+	cpu, ok := cpuAliases[m[3]]
+	if !ok {
+		return "", invalid(fmt.Sprintf("unknown cpu %q", m[3]))
+	}
+	vers := m[2]
+	switch platform {
+	case "osx", "alpine":
+		if vers != "" {
+			return "", invalid(fmt.Sprintf("%s architectures have no version", platform))
+		}
+	default:
+		if vers == "" {
+			return "", invalid(fmt.Sprintf("no version for platform %q", platform))
+		}
+	}
+	if platform == "osx" && cpu == "aarch64" {
+		cpu = "arm64"
+	}
+	return platform + vers + "_" + cpu, nil
+}
+
+// isDarwin returns whether an architecture string describes a macOS machine.
+func isDarwin(arch string) bool {
+	return strings.HasPrefix(arch, "osx")
+}
+
+// dockerImage returns the name of the builder image for an architecture.
+// no image is available for macOS architectures.
+func dockerImage(arch string) (string, bool) {
+	if isDarwin(arch) {
+		return "", false
+	}
+	return fmt.Sprintf(
+		"alisw/%s-builder",
+		strings.Split(arch, "_")[0],
+	), true
+}
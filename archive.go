@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// sourcesCache returns the directory of the cache of the downloaded source
+// archives and patches.
+//
+// the cache is content-addressed: files are stored under sha256/, by
+// checksum, and the checksums of the files downloaded without a known one
+// under urls/, by URL.
+// the cache may be shared by work directories, with -sources-cache.
+func (b *Builder) sourcesCache() string {
+	if b.cfg.srcCache != "" {
+		return b.cfg.srcCache
+	}
+	return filepath.Join(b.cfg.wdir, "SOURCES", "CACHE")
+}
+
+// archivesDigest returns the digest of the source archives of a spec, "" if
+// it has none.
+func archivesDigest(spec *Spec) string {
+	if len(spec.Sources) == 0 {
+		return ""
+	}
+	var vs []string
+	for _, a := range spec.Sources {
+		vs = append(vs, a.URL, strings.ToLower(a.SHA256))
+	}
+	return digest(vs...)
+}
+
+// archiveNames returns the URLs of the source archives of a spec.
+func archiveNames(spec *Spec) []string {
+	var names []string
+	for _, a := range spec.Sources {
+		names = append(names, a.URL)
+	}
+	return names
+}
+
+// fetchArchives downloads the source archives of a spec, unless cached, and
+// links them into its source directory dir.
+// archives are not extracted: recipes do it.
+func (b *Builder) fetchArchives(spec *Spec, dir string) error {
+	for _, a := range spec.Sources {
+		fname, err := b.fetchCached(a.URL, strings.ToLower(a.SHA256))
+		if err != nil {
+			return err
+		}
+		err = linkFile(fname, filepath.Join(dir, archiveName(a.URL)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveName returns the name of the file of an archive downloaded from url.
+func archiveName(url string) string {
+	name := url
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	return path.Base(name)
+}
+
+// fetchCached returns the file of the sources cache holding the file at url,
+// of checksum sum if known, downloading it if missing.
+func (b *Builder) fetchCached(url, sum string) (string, error) {
+	cache := b.sourcesCache()
+	index := filepath.Join(cache, "urls", digestURL(url))
+	if sum == "" {
+		if buf, err := b.fs.ReadFile(index); err == nil {
+			sum = strings.TrimSpace(string(buf))
+		}
+	}
+	if sum != "" {
+		fname := filepath.Join(cache, "sha256", sum)
+		if _, err := b.fs.Stat(fname); err == nil {
+			msg.Debugf("reusing [%s] from the sources cache\n", url)
+			return fname, nil
+		}
+	}
+
+	err := b.fs.MkdirAll(filepath.Join(cache, "sha256"), 0755)
+	if err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(cache, "sha256", ".download-"+digestURL(url))
+	f, err := b.fs.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	defer b.fs.Remove(tmp)
+	err = b.download(f, url)
+	if err != nil {
+		f.Close()
+		return "", fmt.Errorf("could not download [%s]: %v", url, err)
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	got, err := sha256File(b.fs, tmp)
+	if err != nil {
+		return "", err
+	}
+	if sum != "" && got != sum {
+		return "", fmt.Errorf("checksum mismatch of [%s]: got sha256 %s, want %s", url, got, sum)
+	}
+	fname := filepath.Join(cache, "sha256", got)
+	err = b.fs.Rename(tmp, fname)
+	if err != nil {
+		return "", err
+	}
+	err = b.fs.MkdirAll(filepath.Dir(index), 0755)
+	if err != nil {
+		return "", err
+	}
+	return fname, b.fs.WriteFile(index, []byte(got+"\n"), 0644)
+}
+
+// download writes the file at url to w, with the credentials of its host.
+func (b *Builder) download(w io.Writer, url string) error {
+	msg.Infof("downloading [%s]...\n", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	creds := &credentials{cfg: StoreConfig{URL: url}, exec: b.exec, hosts: b.creds}
+	client := &http.Client{Transport: &store.AuthTransport{Creds: creds, Base: http.DefaultTransport}}
+	resp, err := client.Do(req.WithContext(b.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// digestURL returns the name of the entry of an URL in the sources cache.
+func digestURL(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchCached(t *testing.T) {
+	const data = "archive"
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		io.WriteString(w, data)
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256([]byte(data))
+	digest := hex.EncodeToString(sum[:])
+	for _, tc := range []struct {
+		name   string
+		sum    string
+		cached bool // whether the archive is already in the cache
+		hits   int
+		want   string // error
+	}{
+		{name: "download", sum: digest, hits: 1},
+		{name: "no-checksum", hits: 1},
+		{name: "cached", sum: digest, cached: true},
+		{name: "cached-no-checksum", cached: true},
+		{name: "mismatch", sum: strings.Repeat("0", 64), hits: 1, want: "checksum mismatch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hits = 0
+			b, _, fs := newTestBuilder(t, Config{}, nil)
+			url := srv.URL + "/app-1.0.tar.gz"
+			cache := b.sourcesCache()
+			if tc.cached {
+				for _, f := range []struct{ name, data string }{
+					{filepath.Join(cache, "sha256", digest), data},
+					{filepath.Join(cache, "urls", digestURL(url)), digest + "\n"},
+				} {
+					err := fs.MkdirAll(filepath.Dir(f.name), 0755)
+					if err == nil {
+						err = fs.WriteFile(f.name, []byte(f.data), 0644)
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			fname, err := b.fetchCached(url, tc.sum)
+			if got, want := hits, tc.hits; got != want {
+				t.Fatalf("invalid number of downloads: got=%d, want=%d", got, want)
+			}
+			if tc.want != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want) {
+					t.Fatalf("invalid error: got=%v, want=%q", err, tc.want)
+				}
+				if fis, _ := fs.ReadDir(filepath.Join(cache, "sha256")); len(fis) != 0 {
+					t.Fatalf("download left in the cache: %v", fis)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not fetch: %+v", err)
+			}
+			if got, want := fname, filepath.Join(cache, "sha256", digest); got != want {
+				t.Fatalf("invalid file: got=%q, want=%q", got, want)
+			}
+			buf, err := fs.ReadFile(fname)
+			if err != nil || string(buf) != data {
+				t.Fatalf("invalid content: got=%q (err=%v), want=%q", buf, err, data)
+			}
+			fis, err := fs.ReadDir(filepath.Join(cache, "sha256"))
+			if err != nil || len(fis) != 1 {
+				t.Fatalf("invalid cache: %v (err=%v)", fis, err)
+			}
+		})
+	}
+}
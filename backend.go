@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// newStore returns the store described by sc, nil if it has no URL: a
+// directory (local, or on a network file system), a directory of an ssh
+// host, an HTTP server, a bucket of a cloud object storage, or a store
+// handled by a plugin.
+func (b *Builder) newStore(sc StoreConfig, rw bool) (store.Store, error) {
+	var (
+		url   = sc.URL
+		creds = &credentials{cfg: sc, exec: b.exec, hosts: b.creds}
+		s     store.Store
+	)
+	switch plugin := schemePlugin(url); {
+	case url == "":
+		return nil, nil
+	case plugin != "":
+		s = &pluginStore{url: url, plugin: plugin, rw: rw, creds: creds, exec: b.exec}
+	case store.IsHTTP(url):
+		client := &http.Client{Transport: &store.AuthTransport{Creds: creds, Base: http.DefaultTransport}}
+		s = store.NewHTTP(url, client, b.httpDir)
+	case store.IsBucket(url):
+		bs, err := store.NewBucket(url, sc.Endpoint, rw, creds, b.bw)
+		if err != nil {
+			return nil, err
+		}
+		s = bs
+	case store.IsDir(url):
+		s = store.NewDir(url, rw, b.fs)
+	default:
+		dest := url
+		if sc.User != "" && !strings.Contains(dest, "@") {
+			dest = sc.User + "@" + dest
+		}
+		s = store.NewSSH(dest, sc.Identity, rw, b.exec, b.rsyncLimit())
+	}
+	if sc.Retries > 0 {
+		delay := sc.RetryDelay
+		if delay <= 0 {
+			delay = defaultRetryDelay
+		}
+		s = store.NewRetry(s, sc.Retries, delay)
+	}
+	return s, nil
+}
+
+// pluginStore is a store handled by a plugin.
+// plugin stores can not be listed, nor queried.
+type pluginStore struct {
+	url    string
+	plugin string
+	rw     bool
+	creds  *credentials
+	exec   Executor
+}
+
+func (s *pluginStore) URL() string    { return s.url }
+func (s *pluginStore) Writable() bool { return s.rw }
+
+func (s *pluginStore) List(ctx context.Context, dir string) ([]string, bool, error) {
+	return nil, false, nil
+}
+
+func (s *pluginStore) Exists(ctx context.Context, name string) (bool, error) {
+	return false, nil
+}
+
+func (s *pluginStore) Fetch(ctx context.Context, dir string, names []string, prog store.Progress) error {
+	user, secret, err := s.creds.Get(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = runPlugin(ctx, s.exec, s.plugin, PluginRequest{
+		Kind:   "store",
+		Action: "fetch",
+		URL:    s.url,
+		Dir:    dir,
+		Files:  names,
+		User:   user,
+		Secret: secret,
+	})
+	if err != nil {
+		return err
+	}
+	store.AddSizes(prog, dir, names)
+	return nil
+}
+
+func (s *pluginStore) Upload(ctx context.Context, dir string, names []string) error {
+	if !s.rw {
+		return fmt.Errorf("store [%s] is read-only", s.url)
+	}
+	user, secret, err := s.creds.Get(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = runPlugin(ctx, s.exec, s.plugin, PluginRequest{
+		Kind:   "store",
+		Action: "upload",
+		URL:    s.url,
+		Dir:    dir,
+		Files:  names,
+		User:   user,
+		Secret: secret,
+	})
+	return err
+}
+
+// rsyncLimit returns the bandwidth of each rsync upload, in KiB/s: the
+// bandwidth of the uploads is shared by the concurrent uploads.
+func (b *Builder) rsyncLimit() int64 {
+	if b.cfg.uploadLimit <= 0 {
+		return 0
+	}
+	jobs := int64(b.cfg.uploadJobs)
+	if jobs < 1 {
+		jobs = 1
+	}
+	if v := b.cfg.uploadLimit / 1024 / jobs; v > 0 {
+		return v
+	}
+	return 1
+}
+
+// storeLog reports the messages of the stores with msg.
+type storeLog struct{}
+
+func (storeLog) Debugf(format string, args ...interface{}) { msg.Debugf(format, args...) }
+func (storeLog) Infof(format string, args ...interface{})  { msg.Infof(format, args...) }
+func (storeLog) Warnf(format string, args ...interface{})  { msg.Warnf(format, args...) }
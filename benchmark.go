@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// thresholds above which a package built in both runs of a comparison is
+// reported as slower: both must be exceeded.
+const (
+	slowerRatio = 0.10
+	slowerDelta = time.Second
+)
+
+// runRecord is the record of a run in the history of the work directory.
+type runRecord struct {
+	ID       int          `json:"id"`
+	Package  string       `json:"package"`
+	Defaults string       `json:"defaults"`
+	Arch     string       `json:"arch"`
+	Host     string       `json:"host"`
+	Jobs     int          `json:"jobs"`
+	Started  time.Time    `json:"started"`
+	Duration float64      `json:"duration"` // in seconds
+	Error    string       `json:"error,omitempty"`
+	Packages []runPackage `json:"packages"`
+}
+
+// runPackage is the record of a package in a run.
+type runPackage struct {
+	Package  string  `json:"package"`
+	Version  string  `json:"version"`
+	Hash     string  `json:"hash"`
+	Status   string  `json:"status"`
+	Cache    string  `json:"cache"`              // local, remote, built, failed or none
+	Duration float64 `json:"duration,omitempty"` // in seconds
+	Reason   string  `json:"reason,omitempty"`   // why the package was rebuilt
+	CCache   float64 `json:"ccache,omitempty"`   // compiler cache hit rate, in percent
+	CPU      float64 `json:"cpu,omitempty"`      // CPU time of the recipe, in seconds
+	MaxRSS   int64   `json:"max_rss,omitempty"`  // maximum resident set size of the recipe, in bytes
+}
+
+// reused reports whether a package was reused from the stores.
+func (p runPackage) reused() bool {
+	return p.Cache == "local" || p.Cache == "remote"
+}
+
+// historyFile returns the file of the history of the runs.
+func (b *Builder) historyFile() string {
+	if b.cfg.history != "" {
+		return b.cfg.history
+	}
+	return filepath.Join(b.cfg.wdir, "history.jsonl")
+}
+
+// recordRun appends the record of the run started at start, ended with err,
+// to the history.
+func (b *Builder) recordRun(start time.Time, err error) error {
+	runs, rerr := readHistory(b.historyFile())
+	if rerr != nil && !os.IsNotExist(rerr) {
+		return rerr
+	}
+	rec := runRecord{
+		ID:       len(runs) + 1,
+		Package:  b.pkgs[0],
+		Defaults: b.cfg.defaults,
+		Arch:     b.targetArch(),
+		Host:     runtime.GOOS + "/" + runtime.GOARCH,
+		Jobs:     b.cfg.njobs,
+		Started:  start,
+		Duration: time.Since(start).Seconds(),
+		Packages: []runPackage{},
+	}
+	if len(runs) > 0 {
+		rec.ID = runs[len(runs)-1].ID + 1
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	for _, p := range b.order {
+		spec := b.specs[p]
+		rp := runPackage{
+			Package: p,
+			Version: spec.Version,
+			Hash:    spec.Hash,
+			Status:  b.status[p],
+			Cache:   "none",
+			Reason:  b.rebuilt[p],
+		}
+		switch rp.Status {
+		case statusCached:
+			rp.Cache = "local"
+			if b.fetched[p] {
+				rp.Cache = "remote"
+			}
+		case statusBuilt:
+			rp.Cache = "built"
+		case statusFailed:
+			rp.Cache = "failed"
+		}
+		if d, ok := b.took[p]; ok {
+			rp.Duration = d.Seconds()
+		}
+		if st, ok := b.ccStats[p]; ok {
+			rp.CCache = st.rate()
+		}
+		if u, ok := b.usage[p]; ok {
+			rp.CPU = u.cpu().Seconds()
+			rp.MaxRSS = u.MaxRSS
+		}
+		rec.Packages = append(rec.Packages, rp)
+	}
+
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.historyFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(buf, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readHistory reads the records of the runs of a history file.
+func readHistory(fname string) ([]runRecord, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []runRecord
+	scan := bufio.NewScanner(f)
+	scan.Buffer(nil, 16<<20)
+	for line := 1; scan.Scan(); line++ {
+		if len(scan.Bytes()) == 0 {
+			continue
+		}
+		var rec runRecord
+		err := json.Unmarshal(scan.Bytes(), &rec)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fname, line, err)
+		}
+		runs = append(runs, rec)
+	}
+	return runs, scan.Err()
+}
+
+// findRun returns the run of a history given by its ID, or by its position
+// from the end when negative (-1 is the last run).
+func findRun(runs []runRecord, name string) (runRecord, error) {
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return runRecord{}, fmt.Errorf("invalid run %q (want its ID, or -N for the Nth last run)", name)
+	}
+	if id < 0 {
+		if -id > len(runs) {
+			return runRecord{}, fmt.Errorf("no run %d: the history holds %d runs", id, len(runs))
+		}
+		return runs[len(runs)+id], nil
+	}
+	for _, r := range runs {
+		if r.ID == id {
+			return r, nil
+		}
+	}
+	return runRecord{}, fmt.Errorf("no run %d in the history", id)
+}
+
+// listRuns writes the runs of the history to w.
+func (b *Builder) listRuns(w io.Writer) error {
+	runs, err := readHistory(b.historyFile())
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tSTARTED\tPACKAGE\tDEFAULTS\tARCH\tDURATION\tBUILT\tREUSED\tOUTCOME\n")
+	for _, r := range runs {
+		var built, reused int
+		for _, p := range r.Packages {
+			switch {
+			case p.Cache == "built":
+				built++
+			case p.reused():
+				reused++
+			}
+		}
+		outcome := "ok"
+		if r.Error != "" {
+			outcome = "failed"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			r.ID, r.Started.Format("2006-01-02 15:04"), r.Package, r.Defaults, r.Arch,
+			seconds(r.Duration), built, reused, outcome,
+		)
+	}
+	return tw.Flush()
+}
+
+// benchDiff compares a package in two runs.
+type benchDiff struct {
+	Package string  `json:"package"`
+	Before  string  `json:"before"` // cache behavior of the package in the first run
+	After   string  `json:"after"`
+	Time1   float64 `json:"time1"` // build time in the first run, in seconds
+	Time2   float64 `json:"time2"`
+	Note    string  `json:"note,omitempty"` // slower, faster, new cache miss, new cache hit, new or removed
+}
+
+// regression reports whether a difference is a regression.
+func (d benchDiff) regression() bool {
+	return d.Note == "slower" || d.Note == "new cache miss"
+}
+
+// compareRuns compares the packages of two runs.
+func compareRuns(r1, r2 runRecord) []benchDiff {
+	pkgs1 := make(map[string]runPackage, len(r1.Packages))
+	for _, p := range r1.Packages {
+		pkgs1[p.Package] = p
+	}
+	seen := make(map[string]bool)
+	var diffs []benchDiff
+	for _, p2 := range r2.Packages {
+		seen[p2.Package] = true
+		p1, ok := pkgs1[p2.Package]
+		d := benchDiff{Package: p2.Package, Before: p1.Cache, After: p2.Cache, Time1: p1.Duration, Time2: p2.Duration}
+		switch {
+		case !ok:
+			d.Before = "-"
+			d.Note = "new"
+		case p1.reused() && p2.Cache == "built":
+			d.Note = "new cache miss"
+		case p1.Cache == "built" && p2.reused():
+			d.Note = "new cache hit"
+		case p1.Cache == "built" && p2.Cache == "built":
+			delta := time.Duration((p2.Duration - p1.Duration) * float64(time.Second))
+			switch {
+			case delta > slowerDelta && p2.Duration > p1.Duration*(1+slowerRatio):
+				d.Note = "slower"
+			case -delta > slowerDelta && p1.Duration > p2.Duration*(1+slowerRatio):
+				d.Note = "faster"
+			}
+		}
+		diffs = append(diffs, d)
+	}
+	for _, p1 := range r1.Packages {
+		if !seen[p1.Package] {
+			diffs = append(diffs, benchDiff{Package: p1.Package, Before: p1.Cache, After: "-", Time1: p1.Duration, Note: "removed"})
+		}
+	}
+	sort.SliceStable(diffs, func(i, j int) bool {
+		return diffs[i].regression() && !diffs[j].regression()
+	})
+	return diffs
+}
+
+// benchmarkCompare writes the comparison of two runs of the history to w,
+// and returns an error listing the regressions of the second run, if any.
+func (b *Builder) benchmarkCompare(w io.Writer, run1, run2 string, asJSON bool) error {
+	runs, err := readHistory(b.historyFile())
+	if err != nil {
+		return err
+	}
+	r1, err := findRun(runs, run1)
+	if err != nil {
+		return err
+	}
+	r2, err := findRun(runs, run2)
+	if err != nil {
+		return err
+	}
+	diffs := compareRuns(r1, r2)
+	var regressions []string
+	for _, d := range diffs {
+		if d.regression() {
+			regressions = append(regressions, d.Package+" ("+d.Note+")")
+		}
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(struct {
+			Run1     int         `json:"run1"`
+			Run2     int         `json:"run2"`
+			Time1    float64     `json:"time1"`
+			Time2    float64     `json:"time2"`
+			Packages []benchDiff `json:"packages"`
+		}{r1.ID, r2.ID, r1.Duration, r2.Duration, diffs})
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(w, "run %d (%s, %s) -> run %d (%s, %s)\n",
+			r1.ID, r1.Started.Format("2006-01-02 15:04"), seconds(r1.Duration),
+			r2.ID, r2.Started.Format("2006-01-02 15:04"), seconds(r2.Duration),
+		)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "PACKAGE\tBEFORE\tAFTER\tTIME1\tTIME2\tDELTA\tNOTE\n")
+		for _, d := range diffs {
+			delta := "-"
+			if d.Before == "built" && d.After == "built" {
+				delta = fmt.Sprintf("%+.0f%%", 100*(d.Time2-d.Time1)/maxf(d.Time1, 1e-3))
+			}
+			note := d.Note
+			if d.regression() {
+				note = "!! " + note
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				d.Package, d.Before, d.After, seconds(d.Time1), seconds(d.Time2), delta, note,
+			)
+		}
+		err = tw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	if len(regressions) > 0 {
+		return fmt.Errorf("%d regressions in run %d: %v", len(regressions), r2.ID, regressions)
+	}
+	return nil
+}
+
+// seconds formats a duration given in seconds, "-" if null.
+func seconds(s float64) string {
+	if s == 0 {
+		return "-"
+	}
+	return (time.Duration(s * float64(time.Second))).Round(10 * time.Millisecond).String()
+}
+
+func maxf(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
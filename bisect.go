@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// outcomes of a step of a bisection, as marked with git bisect.
+const (
+	bisectGood = "good"
+	bisectBad  = "bad"
+	bisectSkip = "skip"
+)
+
+// bisect finds the first commit of the recipes repository, between the good
+// and the bad revisions, breaking the build of the package of the run (or
+// its tests, with tests), and reports the steps to w.
+//
+// git bisect runs in a detached worktree of the work directory, so that the
+// checkout of the user is left alone. each step is built as a plain run,
+// reusing the packages of the stores whose recipes did not change; steps
+// whose sources can not be fetched are skipped.
+// git, and the builds of the steps, are run with x.
+func bisect(cfg Config, x Executor, good, bad string, tests bool, w io.Writer) error {
+	git := func(dir string, args ...string) error {
+		return runWith(interrupts.ctx, x, dir, "git", args...)
+	}
+	dir := filepath.Join(cfg.wdir, "CONFIG", "bisect")
+	if exists(filepath.Join(dir, ".git")) {
+		err := git(cfg.cfgdir, "worktree", "remove", "--force", dir)
+		if err != nil {
+			return fmt.Errorf("could not remove stale bisection worktree: %v", err)
+		}
+	}
+	err := git(cfg.cfgdir, "worktree", "add", "--detach", "--force", dir, bad)
+	if err != nil {
+		return fmt.Errorf("could not check out revision %q of the recipes: %v", bad, err)
+	}
+	defer git(cfg.cfgdir, "worktree", "remove", "--force", dir)
+
+	_, err = gitOutput(x, dir, "bisect", "start", bad, good)
+	if err != nil {
+		return err
+	}
+	defer gitOutput(x, dir, "bisect", "reset")
+
+	cfg.cfgdir = dir
+	for step := 1; ; step++ {
+		out, err := gitOutput(x, dir, "log", "-1", "--format=%h %s")
+		if err != nil {
+			return err
+		}
+		commit := strings.TrimSpace(out)
+		msg.Infof("bisect step %d: building %s with the recipes of %s...\n", step, cfg.pkgs[0], commit)
+
+		mark, reason, err := bisectStep(cfg, x, tests)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%-6s %s", mark, commit)
+		if reason != "" {
+			fmt.Fprintf(w, " (%s)", reason)
+		}
+		fmt.Fprintf(w, "\n")
+
+		out, err = gitOutput(x, dir, "bisect", mark)
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.Contains(out, "is the first bad commit"):
+			first := strings.Fields(out)[0]
+			log, _ := gitOutput(x, dir, "log", "-1", "--stat", first)
+			fmt.Fprintf(w, "\nfirst bad commit of the recipes for %s:\n%s", cfg.pkgs[0], log)
+			return nil
+		case strings.Contains(out, "only 'skip'ped commits left"):
+			fmt.Fprintf(w, "\n%s", out)
+			return fmt.Errorf("could not bisect %s: the remaining commits could not be tested", cfg.pkgs[0])
+		}
+	}
+}
+
+// bisectStep builds the package of the run, and runs its tests with tests,
+// and returns how the step of the bisection is marked, and why.
+// interruptions abort the bisection.
+func bisectStep(cfg Config, x Executor, tests bool) (mark, reason string, err error) {
+	b := newBuilder(cfg)
+	b.exec = x
+	err = b.resolve()
+	if err == nil {
+		err = b.build()
+	}
+	if err == nil && tests {
+		err = b.runTests(ioutil.Discard)
+	}
+	switch {
+	case err == nil:
+		return bisectGood, "", nil
+	case statusOf(err, 0) == exitInterrupted || statusOf(err, 0) == exitTimedOut:
+		return "", "", err
+	}
+	reason = strings.TrimSpace(strings.SplitN(err.Error(), "\n", 2)[0])
+	switch statusOf(err, 0) {
+	case exitFetch:
+		return bisectSkip, reason, nil
+	case exitUpload:
+		// the package was built.
+		return bisectGood, reason, nil
+	}
+	return bisectBad, reason, nil
+}
+
+// gitOutput runs git with the given arguments in dir, with x, and returns its
+// output.
+func gitOutput(x Executor, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(interrupts.ctx, "git", args...)
+	cmd.Dir = dir
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := runCmd(x, cmd)
+	if err != nil {
+		return "", fmt.Errorf("error running 'git %s': %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return out.String(), nil
+}
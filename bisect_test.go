@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBisect(t *testing.T) {
+	cfg := newTestConfig(t, Config{})
+	x := newFakeExecutor()
+	x.fn = func(cmd *exec.Cmd) error {
+		switch line := strings.Join(cmd.Args, " "); line {
+		case "git log -1 --format=%h %s":
+			io.WriteString(cmd.Stdout, "abc1234 update app\n")
+		case "git bisect bad":
+			io.WriteString(cmd.Stdout, "abc1234 is the first bad commit\n")
+		case "git log -1 --stat abc1234":
+			io.WriteString(cmd.Stdout, "commit abc1234\n")
+		}
+		return nil
+	}
+
+	// the recipes of the worktree can not be loaded: the step is bad.
+	w := new(bytes.Buffer)
+	err := bisect(cfg, x, "v1", "v2", false, w)
+	if err != nil {
+		t.Fatalf("could not bisect: %+v", err)
+	}
+	if got, want := w.String(), "bad    abc1234 update app ("; !strings.HasPrefix(got, want) {
+		t.Fatalf("invalid report:\ngot= %q\nwant=%q...", got, want)
+	}
+	if got, want := w.String(), "\nfirst bad commit of the recipes for app:\ncommit abc1234\n"; !strings.HasSuffix(got, want) {
+		t.Fatalf("invalid report:\ngot= %q\nwant=...%q", got, want)
+	}
+
+	dir := filepath.Join(cfg.wdir, "CONFIG", "bisect")
+	want := []string{
+		"(cd /alidist && git worktree add --detach --force " + dir + " v2)",
+		"(cd " + dir + " && git bisect start v2 v1)",
+		"(cd " + dir + " && git log -1 --format=%h %s)",
+		"(cd " + dir + " && git rev-parse HEAD)",
+		"(cd " + dir + " && git bisect bad)",
+		"(cd " + dir + " && git log -1 --stat abc1234)",
+		"(cd " + dir + " && git bisect reset)",
+		"(cd /alidist && git worktree remove --force " + dir + ")",
+	}
+	if got := x.commands(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("invalid commands:\ngot= %q\nwant=%q", got, want)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gonuts/logger"
+)
+
+// boardRefresh is the interval between the redraws of the progress board.
+const boardRefresh = 250 * time.Millisecond
+
+// board is the live status board of the builds, drawn on an interactive
+// terminal: one line per in-flight package, with its phase, elapsed time
+// and the last line of its build log, below the overall progress.
+//
+// the informational logs are silenced while the board is drawn: warnings
+// and errors are still printed, and the summaries of the run follow the
+// board.
+// a nil board draws nothing.
+type board struct {
+	w     *os.File
+	start time.Time
+
+	mu       sync.Mutex
+	total    int
+	done     int
+	failed   int
+	inflight map[string]*boardEntry
+	lines    int // number of lines of the last drawing
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// boardEntry is an in-flight package of the board.
+type boardEntry struct {
+	since    time.Time
+	phase    string
+	building bool
+	log      string // build log of the package
+}
+
+// startBoard starts drawing the progress board of the packages of the run on
+// stderr, unless it is not a terminal, or -no-progress or -d was given.
+func (b *Builder) startBoard() *board {
+	if b.cfg.noProgress || b.cfg.debug || !isTerminal(os.Stderr) || os.Getenv("TERM") == "dumb" {
+		return nil
+	}
+	bd := &board{
+		w:        os.Stderr,
+		start:    time.Now(),
+		total:    len(b.order),
+		inflight: make(map[string]*boardEntry),
+		stop:     make(chan struct{}),
+	}
+	msg.SetLevel(logger.WARNING)
+	bd.wg.Add(1)
+	go func() {
+		defer bd.wg.Done()
+		tick := time.NewTicker(boardRefresh)
+		defer tick.Stop()
+		for {
+			select {
+			case <-bd.stop:
+				return
+			case <-tick.C:
+				bd.draw()
+			}
+		}
+	}()
+	return bd
+}
+
+// close erases the board, and restores the logs.
+func (bd *board) close() {
+	if bd == nil {
+		return
+	}
+	close(bd.stop)
+	bd.wg.Wait()
+	bd.mu.Lock()
+	bd.erase()
+	bd.mu.Unlock()
+	msg.SetLevel(logger.INFO)
+}
+
+// enter records that a package enters a phase.
+func (bd *board) enter(pkg, phase, log string) {
+	if bd == nil || pkg == "" {
+		return
+	}
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	e := bd.entry(pkg)
+	e.phase, e.log = phase, log
+}
+
+// leave records that a package leaves its phase: it leaves the board unless
+// it is being built.
+func (bd *board) leave(pkg string) {
+	if bd == nil || pkg == "" {
+		return
+	}
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	e, ok := bd.inflight[pkg]
+	if !ok {
+		return
+	}
+	e.phase = ""
+	if !e.building {
+		delete(bd.inflight, pkg)
+	}
+}
+
+// setStatus records the status of a package.
+func (bd *board) setStatus(pkg, status string) {
+	if bd == nil {
+		return
+	}
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	switch status {
+	case statusBuilding:
+		bd.entry(pkg).building = true
+		return
+	case statusFailed, statusStopped:
+		bd.failed++
+	}
+	bd.done++
+	delete(bd.inflight, pkg)
+}
+
+func (bd *board) entry(pkg string) *boardEntry {
+	e, ok := bd.inflight[pkg]
+	if !ok {
+		e = &boardEntry{since: time.Now()}
+		bd.inflight[pkg] = e
+	}
+	return e
+}
+
+// draw redraws the board in place.
+func (bd *board) draw() {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+
+	width := terminalWidth(bd.w)
+	clip := func(s string) string {
+		if len(s) > width-1 {
+			s = s[:width-1]
+		}
+		return s
+	}
+	now := time.Now()
+	lines := []string{clip(fmt.Sprintf("[%d/%d] %d in flight, %d failed, elapsed %v",
+		bd.done, bd.total, len(bd.inflight), bd.failed, now.Sub(bd.start).Round(time.Second),
+	))}
+	var pkgs []string
+	for p := range bd.inflight {
+		pkgs = append(pkgs, p)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return bd.inflight[pkgs[i]].since.Before(bd.inflight[pkgs[j]].since)
+	})
+	for _, p := range pkgs {
+		e := bd.inflight[p]
+		phase := e.phase
+		if phase == "" {
+			phase = "building"
+		}
+		line := fmt.Sprintf("  %-24s %-9s %8v", p, phase, now.Sub(e.since).Round(time.Second))
+		if e.phase == "recipe" {
+			line += "  " + logTail(e.log)
+		}
+		lines = append(lines, clip(line))
+	}
+
+	o := new(strings.Builder)
+	if bd.lines > 1 {
+		fmt.Fprintf(o, "\x1b[%dA", bd.lines-1)
+	}
+	for i, line := range lines {
+		if i > 0 {
+			o.WriteString("\n")
+		}
+		fmt.Fprintf(o, "\r\x1b[K%s", line)
+	}
+	o.WriteString("\x1b[J")
+	io.WriteString(bd.w, o.String())
+	bd.lines = len(lines)
+}
+
+// erase erases the last drawing of the board.
+func (bd *board) erase() {
+	if bd.lines == 0 {
+		return
+	}
+	if bd.lines > 1 {
+		fmt.Fprintf(bd.w, "\x1b[%dA", bd.lines-1)
+	}
+	fmt.Fprintf(bd.w, "\r\x1b[J")
+	bd.lines = 0
+}
+
+// logTail returns the last line of a log file, stripped of its control
+// characters, "" if it can not be read.
+func logTail(fname string) string {
+	f, err := os.Open(fname)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	const tail = 4096
+	if fi, err := f.Stat(); err == nil && fi.Size() > tail {
+		f.Seek(-tail, io.SeekEnd)
+	}
+	buf := make([]byte, tail)
+	n, _ := io.ReadFull(f, buf)
+	line := lastLine(buf[:n])
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// terminalWidth returns the number of columns of the terminal f, 80 if
+// unknown.
+func terminalWidth(f *os.File) int {
+	var ws struct {
+		row, col, xpixel, ypixel uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.col == 0 {
+		return 80
+	}
+	return int(ws.col)
+}
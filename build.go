@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+// buildDir returns the directory where a spec is built, in its scratch
+// directory.
+// development packages are always built in the same directory, so that
+// they can be rebuilt incrementally.
+func (b *Builder) buildDir(spec *Spec) string {
+	return buildDirIn(b.scratchDir(spec), spec, b.isDevel(spec.Package))
+}
+
+// logDir returns the directory of the build logs of a spec, in the work
+// directory.
+func (b *Builder) logDir(spec *Spec) string {
+	return buildDirIn(b.cfg.wdir, spec, b.isDevel(spec.Package))
+}
+
+func buildDirIn(root string, spec *Spec, devel bool) string {
+	if devel {
+		return filepath.Join(root, "BUILD", "devel", spec.Package)
+	}
+	return filepath.Join(root, "BUILD", spec.Hash, spec.Package)
+}
+
+// installRoot returns the directory where the recipe of a spec installs its
+// files, before they are packed into a tarball.
+func (b *Builder) installRoot(spec *Spec) string {
+	return filepath.Join(
+		b.cfg.wdir, "INSTALLROOT", spec.Hash,
+		spec.arch, spec.Package, spec.Version+"-"+spec.Revision,
+	)
+}
+
+// installDir returns the directory where a spec is finally installed.
+func (b *Builder) installDir(spec *Spec) string {
+	return filepath.Join(
+		b.cfg.wdir, spec.arch,
+		spec.Package, spec.Version+"-"+spec.Revision,
+	)
+}
+
+// tarball returns the file name of the tarball of a spec.
+func (b *Builder) tarball(spec *Spec) string {
+	return fmt.Sprintf("%s-%s-%s.%s%s",
+		spec.Package, spec.Version, spec.Revision, spec.arch,
+		spec.tar.compression.Ext,
+	)
+}
+
+// buildPackage checks out the sources of a spec, runs its recipe and packs
+// the installed files into a tarball in the local store.
+func (b *Builder) buildPackage(spec *Spec) error {
+	start := time.Now()
+	ph := b.phase(spec.Package, "checkout")
+	err := b.checkout(spec)
+	ph.finish(err)
+	if err != nil {
+		return failure(exitFetch, fmt.Errorf("could not checkout sources: %v", err))
+	}
+	b.commitStatus(spec, commitPending)
+
+	dirs := []string{b.buildDir(spec), b.installRoot(spec)}
+	if b.incremental(spec) {
+		msg.Infof("rebuilding %s incrementally\n", spec.Package)
+		dirs = dirs[1:]
+	}
+	if root := b.recipeInstallRoot(spec); root != b.installRoot(spec) {
+		dirs = append(dirs, root)
+	}
+	for _, dir := range dirs {
+		err = b.fs.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		err = b.fs.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	script, err := b.writeScript(spec)
+	if err != nil {
+		return fmt.Errorf("could not generate build script: %v", err)
+	}
+
+	done := b.snapshotCompilerCache(spec)
+	ph = b.phase(spec.Package, "recipe")
+	err = b.runRecipe(spec, script)
+	ph.finish(err)
+	done()
+	if err != nil {
+		return err
+	}
+	err = b.copyBack(spec)
+	if err != nil {
+		return fmt.Errorf("could not copy back the installed files: %v", err)
+	}
+	if b.isDevel(spec.Package) {
+		err = b.fs.WriteFile(filepath.Join(b.buildDir(spec), incrementalMarker), nil, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	// new tarballs use the configured compression.
+	spec.tar.compression = b.tarCompressions()[0]
+
+	if b.cfg.splitDebug {
+		err = b.splitDebug(spec)
+		if err != nil {
+			return fmt.Errorf("could not split debug symbols: %v", err)
+		}
+	}
+
+	if b.stripped(spec) {
+		err = b.strip(spec)
+		if err != nil {
+			return fmt.Errorf("could not strip binaries: %v", err)
+		}
+	}
+
+	ph = b.phase(spec.Package, "pack")
+	err = b.pack(spec)
+	ph.finish(err)
+	if err != nil {
+		return fmt.Errorf("could not create tarball: %v", err)
+	}
+
+	end := time.Now()
+	err = b.attest(spec, start, end)
+	if err != nil {
+		return fmt.Errorf("could not create provenance attestation: %v", err)
+	}
+
+	err = b.writeManifest(spec, start, end)
+	if err != nil {
+		return fmt.Errorf("could not create manifest: %v", err)
+	}
+
+	err = b.install(spec)
+	if err != nil {
+		return err
+	}
+	if b.cfg.cleanup {
+		err = b.cleanup(spec)
+		if err != nil {
+			msg.Warnf("could not clean up build trees of %s: %v\n", spec.Package, err)
+		}
+	}
+	return nil
+}
+
+// checkout clones the sources of a spec, using the reference mirror if any,
+// checks out its tag, downloads its source archives, and applies its
+// patches.
+func (b *Builder) checkout(spec *Spec) error {
+	if spec.Source == "" && len(spec.Sources) == 0 {
+		return nil
+	}
+	dir := b.sourceDir(spec)
+	if _, err := b.fs.Stat(dir); err == nil {
+		msg.Debugf("sources for %s already in [%s]\n", spec.Package, dir)
+		return nil
+	}
+
+	err := b.fs.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return err
+	}
+
+	if spec.Source != "" {
+		err = b.fetchSources(spec, dir)
+	} else {
+		err = b.fs.MkdirAll(dir, 0755)
+	}
+	if err == nil {
+		err = b.fetchArchives(spec, dir)
+	}
+	if err == nil {
+		err = b.applyPatches(spec, dir)
+	}
+	if err != nil {
+		// sources are checked out, and patched, again by the next build.
+		b.fs.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// fetchSources checks out the sources of a spec in dir.
+func (b *Builder) fetchSources(spec *Spec, dir string) error {
+	if plugin := schemePlugin(spec.Source); plugin != "" {
+		_, err := runPlugin(b.ctx, b.exec, plugin, PluginRequest{
+			Kind:   "source",
+			Action: "checkout",
+			URL:    spec.Source,
+			Dir:    dir,
+			Tag:    spec.Tag,
+		})
+		return err
+	}
+
+	args := []string{"clone"}
+	mirror := b.mirrorDir(spec)
+	if _, err := b.fs.Stat(mirror); err == nil {
+		args = append(args, "--reference", mirror)
+	}
+	args = append(args, spec.Source, dir)
+	env, err := b.gitEnv(spec.Source)
+	if err != nil {
+		return err
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	// Git LFS objects are fetched once checked out, from the mirror first.
+	noSmudge := append(env[:len(env):len(env)], "GIT_LFS_SKIP_SMUDGE=1")
+	err = runWithEnv(b.ctx, b.exec, "", noSmudge, "git", args...)
+	if err != nil {
+		return err
+	}
+	err = runWithEnv(b.ctx, b.exec, dir, noSmudge, "git", "checkout", "-q", spec.Tag)
+	if err != nil {
+		return err
+	}
+	return b.checkoutLFS(spec, dir, env)
+}
+
+// envName returns the name of the environment variable prefix for a package.
+func envName(pkg string) string {
+	return strings.ToUpper(strings.Replace(pkg, "-", "_", -1))
+}
+
+// recipeJobs returns the number of parallel jobs of the recipe of a spec:
+// the global number of jobs, overridden or scaled by the jobs of the spec
+// and capped by its max_jobs.
+func (b *Builder) recipeJobs(spec *Spec) int {
+	n, _ := recipe.ScaleJobs(spec.Jobs, b.distJobs())
+	if spec.MaxJobs > 0 && n > spec.MaxJobs {
+		n = spec.MaxJobs
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// writeScript generates the build script of a spec, setting up the build
+// environment and running the recipe.
+func (b *Builder) writeScript(spec *Spec) (string, error) {
+	dir := filepath.Join(b.sdir, spec.arch, spec.Package, spec.Version+"-"+spec.Revision)
+	err := b.fs.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "#!/bin/bash -e\n")
+	for _, kv := range [][2]string{
+		{"ARCHITECTURE", spec.arch},
+		{"WORK_DIR", b.cfg.wdir},
+		{"CONFIG_DIR", b.cfg.cfgdir},
+		{"PKGNAME", spec.Package},
+		{"PKGVERSION", spec.Version},
+		{"PKGREVISION", spec.Revision},
+		{"PKGHASH", spec.Hash},
+		{"GIT_TAG", spec.Tag},
+		{"COMMIT_HASH", spec.CommitHash},
+		{"SOURCEDIR", b.sourceDir(spec)},
+		{"BUILDDIR", b.buildDir(spec)},
+		{"INSTALLROOT", b.recipeInstallRoot(spec)},
+		{"JOBS", fmt.Sprintf("%d", b.recipeJobs(spec))},
+	} {
+		fmt.Fprintf(o, "export %s=%q\n", kv[0], kv[1])
+	}
+	for _, kv := range b.crossEnv(spec) {
+		fmt.Fprintf(o, "export %s=%q\n", kv[0], kv[1])
+	}
+
+	b.exportEnv(o, spec, b.buildEnvRequires(spec))
+	b.exportToolchainEnv(o, spec)
+	b.exportHomebrewEnv(o, spec)
+	b.exportCompilerCacheEnv(o, spec)
+	b.exportDistCCEnv(o, spec)
+	b.exportJobserverEnv(o, spec)
+	b.exportBuildTypeEnv(o, spec)
+	b.exportSanitizerEnv(o, spec)
+
+	fmt.Fprintf(o, "cd \"$BUILDDIR\"\n")
+	recipe := spec.Recipe
+	if b.incremental(spec) {
+		recipe = spec.IncrementalRecipe
+	}
+	fmt.Fprintf(o, "%s\n", recipe)
+
+	fname := filepath.Join(dir, "build.sh")
+	err = b.fs.WriteFile(fname, o.Bytes(), 0755)
+	if err != nil {
+		return "", err
+	}
+	return fname, nil
+}
+
+// exportEnv writes the shell commands setting up the environment of the
+// installed dependencies deps of a spec, and the environment of the spec
+// itself.
+func (b *Builder) exportEnv(o io.Writer, spec *Spec, deps []string) {
+	// the dependencies are prepended to the search paths in build order:
+	// dependents come first.
+	dirs := make([][]string, len(searchPaths))
+	for _, dep := range deps {
+		ds, ok := b.specs[dep]
+		if !ok {
+			continue
+		}
+		root := b.installDir(ds)
+		fmt.Fprintf(o, "export %s_ROOT=%q\n", envName(ds.Package), root)
+		fmt.Fprintf(o, "export %s_VERSION=%q\n", envName(ds.Package), ds.Version)
+		for i, v := range searchPaths {
+			dirs[i] = append([]string{filepath.Join(root, v[1])}, dirs[i]...)
+		}
+	}
+	for i, v := range searchPaths {
+		if len(dirs[i]) == 0 {
+			continue
+		}
+		fmt.Fprintf(o, "export %[1]s=\"%[2]s${%[1]s:+:$%[1]s}\"\n", v[0], strings.Join(uniq(dirs[i]), ":"))
+	}
+
+	keys := make([]string, 0, len(spec.Env))
+	for k := range spec.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(o, "export %s=\"%s\"\n", k, spec.Env[k])
+	}
+	for _, k := range spec.Unset {
+		fmt.Fprintf(o, "unset %s\n", k)
+	}
+
+	for _, v := range b.cfg.env {
+		fmt.Fprintf(o, "export %s\n", v)
+	}
+
+	// the entries repeated by the environments of the specs, or already in
+	// the inherited search paths, are removed.
+	fmt.Fprintf(o, "%s\n", dedupPathFunc)
+	for _, v := range searchPaths {
+		fmt.Fprintf(o, "if [ -n \"${%[1]s:-}\" ]; then export %[1]s=\"$(aligot_dedup_path \"$%[1]s\")\"; fi\n", v[0])
+	}
+}
+
+// runRecipe runs the build script of a spec, natively or inside a docker
+// container, and logs its output under the build directory.
+func (b *Builder) runRecipe(spec *Spec, script string) error {
+	err := b.fs.MkdirAll(b.logDir(spec), 0755)
+	if err != nil {
+		return err
+	}
+	fname := filepath.Join(b.logDir(spec), "log")
+	log, err := b.fs.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+
+	var (
+		cmd       *exec.Cmd
+		container string
+	)
+	switch b.cfg.docker {
+	case "":
+		args := []string{"bash", "-e", "-x", script}
+		if b.cfg.sandbox || b.cfg.noNetwork {
+			args, err = b.sandboxArgs(spec, args)
+			if err != nil {
+				return err
+			}
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+		cmd.Env = b.recipeEnviron(spec)
+		if b.cfg.jobserver != nil {
+			cmd.ExtraFiles = b.cfg.jobserver.files()
+		}
+	default:
+		b.pullOnce.Do(func() { b.pullErr = b.pullImage(b.cfg.docker) })
+		if b.pullErr != nil {
+			return b.pullErr
+		}
+		// containers do not inherit the environment of the docker client.
+		container = fmt.Sprintf("aligot-%s-%d", spec.Hash[:12], os.Getpid())
+		args := []string{
+			"run", "--rm", "--name", container,
+			"-v", b.cfg.wdir + ":" + b.cfg.wdir,
+			"-v", b.cfg.cfgdir + ":" + b.cfg.cfgdir,
+		}
+		if dir := b.scratchDir(spec); dir != b.cfg.wdir {
+			args = append(args, "-v", dir+":"+dir)
+		}
+		for _, v := range b.cfg.volumes {
+			args = append(args, "-v", v)
+		}
+		switch {
+		case b.cfg.noNetwork:
+			args = append(args, "--network", "none")
+		case b.distributed():
+			// the compile daemons of the host and of the cluster are reached
+			// through the network of the host.
+			args = append(args, "--network", "host")
+		}
+		if b.cfg.hermetic {
+			for _, k := range b.keepEnv(spec) {
+				args = append(args, "-e", k)
+			}
+		}
+		args = append(args, b.cfg.docker, "bash", "-c", cgroupUsageScript, "aligot-recipe", script, b.usageFile(spec))
+		cmd = exec.Command("docker", args...)
+		os.Remove(b.usageFile(spec))
+	}
+
+	var w io.Writer = log
+	if b.cfg.debug {
+		w = io.MultiWriter(log, os.Stdout)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	err = interrupts.run(b.ctx, b.exec, cmd, container)
+	b.recordUsage(spec, cmd)
+	if err == errInterrupted || err == errTimedOut {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error while building %s (see log [%s]): %v",
+			spec.Package, fname, err,
+		)
+	}
+	return nil
+}
+
+// pack creates the tarball of a spec in the local store, and links it from
+// the per-package directory.
+func (b *Builder) pack(spec *Spec) error {
+	err := b.fs.MkdirAll(spec.tar.hashDir, 0755)
+	if err != nil {
+		return err
+	}
+	err = b.fs.WriteFile(
+		filepath.Join(b.installRoot(spec), installRootFile),
+		[]byte(b.recipeInstallRoot(spec)+"\n"), 0644,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = b.createTarball(
+		spec, filepath.Join(spec.tar.hashDir, b.tarball(spec)),
+		filepath.Join(b.cfg.wdir, "INSTALLROOT", spec.Hash),
+	)
+	if err != nil {
+		return err
+	}
+
+	return b.link(spec)
+}
+
+// createTarball creates the named tarball, with the compression of a spec,
+// holding the installation directory of the spec under top.
+func (b *Builder) createTarball(spec *Spec, fname, top string) error {
+	args := []string{"-c", "-f", fname}
+	if flag := spec.tar.compression.Flag; flag != "" {
+		args = append([]string{flag}, args...)
+	}
+	args = append(args, filepath.Join(spec.arch, spec.Package, spec.Version+"-"+spec.Revision))
+	return b.run(top, "tar", args...)
+}
+
+// link links the tarball of a spec from the per-package directory.
+func (b *Builder) link(spec *Spec) error {
+	err := b.fs.MkdirAll(spec.tar.linkDir, 0755)
+	if err != nil {
+		return err
+	}
+	name := b.tarball(spec)
+	link := filepath.Join(spec.tar.linkDir, name)
+	dst, err := filepath.Rel(spec.tar.linkDir, filepath.Join(spec.tar.hashDir, name))
+	if err != nil {
+		return err
+	}
+	b.fs.Remove(link)
+	return b.fs.Symlink(dst, link)
+}
+
+// install unpacks the tarball of a spec into the work directory, and writes
+// its modulefile and init script.
+// a different build of the same package version and revision, already
+// installed, is replaced.
+func (b *Builder) install(spec *Spec) error {
+	dir := b.installDir(spec)
+	hashFile := filepath.Join(dir, installHashFile)
+	if buf, err := b.fs.ReadFile(hashFile); err == nil && strings.TrimSpace(string(buf)) == spec.Hash {
+		return b.writeRuntimeEnv(spec)
+	}
+	if _, err := b.fs.Stat(dir); err == nil {
+		// another build of the same version and revision.
+		msg.Debugf("replacing %s installed in [%s]\n", spec.Package, dir)
+		err = b.fs.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	tarball := filepath.Join(spec.tar.hashDir, b.tarball(spec))
+	// tar detects the compression of the tarball.
+	err := b.run(b.cfg.wdir, "tar", "xf", tarball)
+	if err != nil {
+		return err
+	}
+	err = b.relocate(spec)
+	if err != nil {
+		return err
+	}
+	err = b.fs.WriteFile(hashFile, []byte(spec.Hash+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	if b.cfg.dedup {
+		_, err = dedupTree(objectsDir(b.cfg.wdir), dir)
+		if err != nil {
+			return err
+		}
+	}
+	return b.writeRuntimeEnv(spec)
+}
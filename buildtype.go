@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// buildTypes are the supported build types, following the CMAKE_BUILD_TYPE
+// convention.
+var buildTypes = []string{"Release", "Debug", "RelWithDebInfo"}
+
+// parseBuildType parses a build type, case-insensitively.
+func parseBuildType(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	for _, bt := range buildTypes {
+		if strings.EqualFold(s, bt) {
+			return bt, nil
+		}
+	}
+	return "", fmt.Errorf("unknown build type %q (valid build types: %s)", s, strings.Join(buildTypes, ", "))
+}
+
+// buildTypeSuffix returns the suffix of the architecture of the packages
+// built with the given build type, e.g. -debug.
+// Release builds keep the plain architecture.
+func buildTypeSuffix(bt string) string {
+	if bt == "" || bt == "Release" {
+		return ""
+	}
+	return "-" + strings.ToLower(bt)
+}
+
+// exportBuildTypeEnv writes the shell commands exporting the build type of
+// the target packages to their recipe.
+func (b *Builder) exportBuildTypeEnv(o io.Writer, spec *Spec) {
+	if b.cfg.buildType == "" || spec.arch != b.targetArch() {
+		return
+	}
+	fmt.Fprintf(o, "export BUILD_TYPE=%q\n", b.cfg.buildType)
+	fmt.Fprintf(o, "export CMAKE_BUILD_TYPE=%q\n", b.cfg.buildType)
+}
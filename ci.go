@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ciJob is a job of a CI pipeline, building some packages of the graph.
+type ciJob struct {
+	name  string
+	level int      // layer of the graph of the packages
+	pkgs  []string // packages built by the job, in build order
+	needs []string // jobs the job depends on
+}
+
+// ciJobName returns a CI job name for a package, valid for all the
+// supported CI systems.
+func ciJobName(pkg string) string {
+	return reCIJobName.ReplaceAllString(pkg, "_")
+}
+
+var reCIJobName = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// ciJobs partitions the build graph into CI jobs: one job per package, or
+// one job per layer of the graph when perLevel is true.
+func (b *Builder) ciJobs(perLevel bool) []ciJob {
+	var jobs []ciJob
+	layers := b.layers()
+	if perLevel {
+		for i, layer := range layers {
+			job := ciJob{
+				name:  fmt.Sprintf("level-%d", i),
+				level: i,
+				pkgs:  b.inOrder(toSet(layer)),
+			}
+			if i > 0 {
+				job.needs = []string{fmt.Sprintf("level-%d", i-1)}
+			}
+			jobs = append(jobs, job)
+		}
+		return jobs
+	}
+
+	level := make(map[string]int, len(b.order))
+	for i, layer := range layers {
+		for _, p := range layer {
+			level[p] = i
+		}
+	}
+	for _, p := range b.order {
+		job := ciJob{
+			name:  ciJobName(p),
+			level: level[p],
+			pkgs:  []string{p},
+		}
+		for _, dep := range b.specs[p].Requires {
+			if _, ok := b.specs[dep]; ok {
+				job.needs = append(job.needs, ciJobName(dep))
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// toSet returns the set of the given strings.
+func toSet(vs []string) map[string]bool {
+	set := make(map[string]bool, len(vs))
+	for _, v := range vs {
+		set[v] = true
+	}
+	return set
+}
+
+// ciScript returns the commands of a CI job.
+// packages are fetched from and uploaded to the stores given by the
+// ALIGOT_REMOTE_STORE and ALIGOT_WRITE_STORE variables of the pipeline, so
+// the jobs share the packages they build.
+func (b *Builder) ciScript(job ciJob) []string {
+	cmds := make([]string, 0, len(job.pkgs))
+	for _, p := range job.pkgs {
+		cmds = append(cmds, fmt.Sprintf(
+			"aligot -c %s -a %s -defaults %s -remote-store \"$ALIGOT_REMOTE_STORE\" -write-store \"$ALIGOT_WRITE_STORE\" build %s",
+			b.cfg.cfgdir, b.cfg.arch, b.cfg.defaults, p,
+		))
+	}
+	return cmds
+}
+
+// ciVariables returns the variables of a CI pipeline.
+func (b *Builder) ciVariables() yaml.MapSlice {
+	return yaml.MapSlice{
+		{Key: "ALIGOT_REMOTE_STORE", Value: b.cfg.remoteStore},
+		{Key: "ALIGOT_WRITE_STORE", Value: b.cfg.writeStore},
+	}
+}
+
+// ciPipeline writes to w the definition of a CI pipeline building the
+// requested package, for the named CI system (gitlab or github).
+//
+// each job runs on the runners tagged (gitlab), or labelled (github), with the
+// architecture of the packages.
+func (b *Builder) ciPipeline(w io.Writer, format string, perLevel bool) error {
+	switch format {
+	case "gitlab", "github":
+		// ok
+	default:
+		return fmt.Errorf("unknown CI format %q (valid formats: gitlab, github)", format)
+	}
+	if b.cfg.writeStore == "" {
+		return fmt.Errorf("CI jobs share their packages through the stores: a write store is needed (use -write-store)")
+	}
+	if b.cfg.remoteStore == "" {
+		b.cfg.remoteStore = b.cfg.writeStore
+	}
+
+	jobs := b.ciJobs(perLevel)
+	var doc yaml.MapSlice
+	switch format {
+	case "gitlab":
+		var stages []string
+		for i := range b.layers() {
+			stages = append(stages, fmt.Sprintf("level-%d", i))
+		}
+		doc = yaml.MapSlice{
+			{Key: "variables", Value: b.ciVariables()},
+			{Key: "stages", Value: stages},
+		}
+		for _, job := range jobs {
+			def := yaml.MapSlice{
+				{Key: "stage", Value: fmt.Sprintf("level-%d", job.level)},
+				{Key: "tags", Value: []string{b.cfg.arch}},
+			}
+			if len(job.needs) > 0 {
+				def = append(def, yaml.MapItem{Key: "needs", Value: job.needs})
+			}
+			def = append(def, yaml.MapItem{Key: "script", Value: b.ciScript(job)})
+			doc = append(doc, yaml.MapItem{Key: job.name, Value: def})
+		}
+
+	case "github":
+		var defs yaml.MapSlice
+		for _, job := range jobs {
+			def := yaml.MapSlice{
+				{Key: "runs-on", Value: []string{"self-hosted", b.cfg.arch}},
+			}
+			if len(job.needs) > 0 {
+				def = append(def, yaml.MapItem{Key: "needs", Value: job.needs})
+			}
+			steps := []yaml.MapSlice{
+				{{Key: "uses", Value: "actions/checkout@v4"}},
+			}
+			for _, cmd := range b.ciScript(job) {
+				steps = append(steps, yaml.MapSlice{{Key: "run", Value: cmd}})
+			}
+			def = append(def, yaml.MapItem{Key: "steps", Value: steps})
+			defs = append(defs, yaml.MapItem{Key: job.name, Value: def})
+		}
+		doc = yaml.MapSlice{
+			{Key: "name", Value: "aligot " + b.pkgs[0]},
+			{Key: "on", Value: []string{"push", "workflow_dispatch"}},
+			{Key: "env", Value: b.ciVariables()},
+			{Key: "jobs", Value: defs},
+		}
+	}
+
+	buf, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// cleanup removes the intermediate build trees of a spec, once it is packed
+// and installed: its build directory, but for its logs, and its install root.
+// the build trees of development packages are kept for their incremental
+// rebuilds.
+func (b *Builder) cleanup(spec *Spec) error {
+	if b.isDevel(spec.Package) {
+		return nil
+	}
+	dir := b.buildDir(spec)
+	if dir != b.logDir(spec) {
+		// built in a scratch directory.
+		return b.fs.RemoveAll(dir)
+	}
+	fis, err := b.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Name() == "log" {
+			continue
+		}
+		err = b.fs.RemoveAll(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return b.fs.RemoveAll(filepath.Join(b.cfg.wdir, "INSTALLROOT", spec.Hash))
+}
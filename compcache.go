@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cacheStats are the statistics of a compiler cache.
+type cacheStats struct {
+	hits   int
+	misses int
+}
+
+// rate returns the hit rate, in percent.
+func (st cacheStats) rate() float64 {
+	n := st.hits + st.misses
+	if n == 0 {
+		return 0
+	}
+	return 100 * float64(st.hits) / float64(n)
+}
+
+// compilerCacheDir returns the directory of the compiler cache, shared by
+// all the builds of the work directory.
+func (b *Builder) compilerCacheDir() string {
+	return filepath.Join(b.cfg.wdir, strings.ToUpper(b.cfg.compilerCache))
+}
+
+// compilerCacheEnv returns the environment of the compiler cache.
+func (b *Builder) compilerCacheEnv() [][2]string {
+	switch b.cfg.compilerCache {
+	case "ccache":
+		return [][2]string{{"CCACHE_DIR", b.compilerCacheDir()}}
+	case "sccache":
+		return [][2]string{{"SCCACHE_DIR", b.compilerCacheDir()}}
+	}
+	return nil
+}
+
+// exportCompilerCacheEnv writes the shell commands enabling the compiler
+// cache in the recipe of a spec.
+func (b *Builder) exportCompilerCacheEnv(o io.Writer, spec *Spec) {
+	if b.cfg.compilerCache == "" {
+		return
+	}
+	for _, kv := range b.compilerCacheEnv() {
+		fmt.Fprintf(o, "export %s=%q\n", kv[0], kv[1])
+	}
+	fmt.Fprintf(o, "export COMPILER_CACHE=%q\n", b.cfg.compilerCache)
+	fmt.Fprintf(o, "export CMAKE_C_COMPILER_LAUNCHER=%q\n", b.cfg.compilerCache)
+	fmt.Fprintf(o, "export CMAKE_CXX_COMPILER_LAUNCHER=%q\n", b.cfg.compilerCache)
+}
+
+// compilerCacheStats returns the current statistics of the compiler cache.
+func (b *Builder) compilerCacheStats() (cacheStats, error) {
+	var (
+		st   cacheStats
+		args []string
+	)
+	switch b.cfg.compilerCache {
+	case "ccache":
+		args = []string{"--print-stats"}
+	case "sccache":
+		args = []string{"--show-stats", "--stats-format=json"}
+	default:
+		return st, fmt.Errorf("unknown compiler cache %q", b.cfg.compilerCache)
+	}
+
+	cmd := exec.CommandContext(b.ctx, b.cfg.compilerCache, args...)
+	cmd.Env = os.Environ()
+	for _, kv := range b.compilerCacheEnv() {
+		cmd.Env = append(cmd.Env, kv[0]+"="+kv[1])
+	}
+	out, err := output(b.exec, cmd)
+	if err != nil {
+		return st, err
+	}
+
+	switch b.cfg.compilerCache {
+	case "ccache":
+		return parseCcacheStats(out)
+	default:
+		return parseSccacheStats(out)
+	}
+}
+
+// parseCcacheStats parses the machine-readable statistics of ccache.
+func parseCcacheStats(out []byte) (cacheStats, error) {
+	var st cacheStats
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		toks := strings.Fields(scan.Text())
+		if len(toks) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(toks[1])
+		if err != nil {
+			continue
+		}
+		switch toks[0] {
+		case "direct_cache_hit", "preprocessed_cache_hit",
+			"cache_hit_direct", "cache_hit_preprocessed":
+			st.hits += n
+		case "cache_miss":
+			st.misses += n
+		}
+	}
+	return st, scan.Err()
+}
+
+// parseSccacheStats parses the JSON statistics of sccache.
+func parseSccacheStats(out []byte) (cacheStats, error) {
+	var (
+		st  cacheStats
+		raw struct {
+			Stats struct {
+				Hits   struct{ Counts map[string]int } `json:"cache_hits"`
+				Misses struct{ Counts map[string]int } `json:"cache_misses"`
+			} `json:"stats"`
+		}
+	)
+	err := json.Unmarshal(out, &raw)
+	if err != nil {
+		return st, err
+	}
+	for _, n := range raw.Stats.Hits.Counts {
+		st.hits += n
+	}
+	for _, n := range raw.Stats.Misses.Counts {
+		st.misses += n
+	}
+	return st, nil
+}
+
+// snapshotCompilerCache returns a function recording the statistics of the
+// compiler cache during the build of a spec, from the call to
+// snapshotCompilerCache.
+// failures to get statistics are not fatal.
+func (b *Builder) snapshotCompilerCache(spec *Spec) func() {
+	if b.cfg.compilerCache == "" {
+		return func() {}
+	}
+	before, err := b.compilerCacheStats()
+	if err != nil {
+		msg.Warnf("could not get %s statistics: %v\n", b.cfg.compilerCache, err)
+		return func() {}
+	}
+	return func() {
+		after, err := b.compilerCacheStats()
+		if err != nil {
+			msg.Warnf("could not get %s statistics: %v\n", b.cfg.compilerCache, err)
+			return
+		}
+		b.ccStats[spec.Package] = cacheStats{
+			hits:   after.hits - before.hits,
+			misses: after.misses - before.misses,
+		}
+	}
+}
+
+// compilerCacheSummary reports the hit rates of the compiler cache of the
+// packages built during the run.
+func (b *Builder) compilerCacheSummary() {
+	if len(b.ccStats) == 0 {
+		return
+	}
+	var total cacheStats
+	msg.Infof("%s statistics:\n", b.cfg.compilerCache)
+	for _, p := range b.order {
+		st, ok := b.ccStats[p]
+		if !ok {
+			continue
+		}
+		msg.Infof("  %-24s hits=%-6d misses=%-6d (%.1f%%)\n", p, st.hits, st.misses, st.rate())
+		total.hits += st.hits
+		total.misses += st.misses
+	}
+	msg.Infof("  %-24s hits=%-6d misses=%-6d (%.1f%%)\n", "total", total.hits, total.misses, total.rate())
+}
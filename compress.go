@@ -0,0 +1,103 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Compression describes a compression of tarballs.
+type Compression struct {
+	Name      string // name of the compression, as given to -compression
+	Ext       string // extension of the compressed tarballs
+	Flag      string // tar flag creating compressed tarballs
+	MediaType string // OCI media type of the compressed tarballs
+}
+
+// compressions lists the supported compressions of tarballs.
+var compressions = []Compression{
+	{"gzip", ".tar.gz", "-z", "application/vnd.oci.image.layer.v1.tar+gzip"},
+	{"zstd", ".tar.zst", "--zstd", "application/vnd.oci.image.layer.v1.tar+zstd"},
+	{"none", ".tar", "", "application/vnd.oci.image.layer.v1.tar"},
+}
+
+// compressionByName returns the named compression.
+func compressionByName(name string) (Compression, error) {
+	for _, c := range compressions {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return Compression{}, fmt.Errorf("unknown compression %q", name)
+}
+
+// tarCompressions returns the compressions of the tarballs to look for in
+// the stores, the configured one first.
+// tarballs of other compressions are reused as well: stores may hold
+// tarballs created with different compressions.
+func (b *Builder) tarCompressions() []Compression {
+	cs := make([]Compression, 0, len(compressions))
+	for _, c := range compressions {
+		if c.Name == b.cfg.compression {
+			cs = append([]Compression{c}, cs...)
+			continue
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// locate looks for the tarball of a spec in the local store, whatever its
+// compression, and updates the compression of the spec accordingly.
+func (b *Builder) locate(spec *Spec) bool {
+	for _, c := range b.tarCompressions() {
+		spec.tar.compression = c
+		if _, err := b.fs.Stat(filepath.Join(spec.tar.hashDir, b.tarball(spec))); err == nil {
+			return true
+		}
+	}
+	spec.tar.compression = b.tarCompressions()[0]
+	return false
+}
+
+// uncompressedDigest returns the SHA-256 digest of the uncompressed content
+// of the named tarball.
+func uncompressedDigest(x Executor, fname string, c Compression) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	switch c.Name {
+	case "gzip":
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, zr)
+		if err != nil {
+			return "", err
+		}
+	case "zstd":
+		cmd := exec.Command("zstd", "-d", "-c")
+		cmd.Stdin = f
+		cmd.Stdout = h
+		err = runCmd(x, cmd)
+		if err != nil {
+			return "", fmt.Errorf("could not decompress [%s]: %v", fname, err)
+		}
+	default:
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
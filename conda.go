@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// condaIndex is the content of the info/index.json file of a conda package.
+type condaIndex struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	Build       string   `json:"build"`
+	BuildNumber int      `json:"build_number"`
+	Depends     []string `json:"depends"`
+	License     string   `json:"license,omitempty"`
+	Subdir      string   `json:"subdir"`
+	Timestamp   int64    `json:"timestamp"`
+
+	// fields only present in repodata.json
+	MD5    string `json:"md5,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// condaSubdir returns the conda channel sub-directory of an architecture.
+func condaSubdir(arch string) string {
+	toks := strings.SplitN(baseArch(arch), "_", 2)
+	cpu := toks[len(toks)-1]
+	platform := "linux"
+	if isDarwin(arch) {
+		platform = "osx"
+	}
+	switch cpu {
+	case "x86-64":
+		return platform + "-64"
+	}
+	return platform + "-" + cpu
+}
+
+// condaVersion returns a version string valid for conda.
+func condaVersion(v string) string {
+	return strings.Replace(v, "-", "_", -1)
+}
+
+// condaBuild returns the build string of the conda package of a spec.
+func condaBuild(spec *Spec) string {
+	return spec.Hash[:7] + "_" + spec.Revision
+}
+
+// exportConda wraps the installed files of the requested packages, and of
+// their runtime closure, into conda packages and (re-)indexes the channel.
+func (b *Builder) exportConda(channel string) error {
+	subdir := filepath.Join(channel, condaSubdir(b.cfg.arch))
+	err := os.MkdirAll(subdir, 0755)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, pkg := range b.pkgs {
+		for _, p := range b.runtimeClosure(pkg) {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			fname, err := b.createConda(b.specs[p], subdir)
+			if err != nil {
+				return fmt.Errorf("could not export %s: %v", p, err)
+			}
+			msg.Infof("created conda package [%s]\n", fname)
+		}
+	}
+
+	// conda clients need the noarch sub-directory to be indexed as well.
+	for _, dir := range []string{subdir, filepath.Join(channel, "noarch")} {
+		err = indexConda(dir)
+		if err != nil {
+			return fmt.Errorf("could not index [%s]: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// createConda creates the conda package of a spec under the subdir channel
+// directory.
+//
+// files of the package are installed at the root of the conda environment.
+// files referencing the installation directory of the package are listed in
+// info/has_prefix so conda relocates them at installation time.
+func (b *Builder) createConda(spec *Spec, subdir string) (string, error) {
+	top := filepath.Join(filepath.Dir(subdir), ".build", spec.Package)
+	err := os.RemoveAll(top)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(top)
+
+	err = os.MkdirAll(top, 0755)
+	if err != nil {
+		return "", err
+	}
+	err = b.run("", "cp", "-a", b.installDir(spec)+"/.", top)
+	if err != nil {
+		return "", err
+	}
+	os.Remove(filepath.Join(top, installRootFile))
+
+	var (
+		files  []string
+		prefix []string
+		root   = []byte(b.installDir(spec))
+	)
+	err = filepath.Walk(top, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(top, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(buf, root) {
+			mode := "text"
+			if bytes.IndexByte(buf, 0) >= 0 {
+				mode = "binary"
+			}
+			prefix = append(prefix, fmt.Sprintf("%s %s %s", root, mode, rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	num, err := strconv.Atoi(spec.Revision)
+	if err != nil {
+		return "", fmt.Errorf("invalid revision %q: %v", spec.Revision, err)
+	}
+
+	idx := condaIndex{
+		Name:        pkgName(spec),
+		Version:     condaVersion(spec.Version),
+		Build:       condaBuild(spec),
+		BuildNumber: num,
+		Depends:     []string{},
+		License:     spec.License,
+		Subdir:      filepath.Base(subdir),
+		Timestamp:   time.Now().Unix() * 1000,
+	}
+	for _, dep := range b.pkgDeps(spec) {
+		idx.Depends = append(idx.Depends, fmt.Sprintf("%s ==%s %s",
+			pkgName(dep), condaVersion(dep.Version), condaBuild(dep),
+		))
+	}
+
+	meta := map[string]interface{}{
+		"package": map[string]string{
+			"name":    idx.Name,
+			"version": idx.Version,
+		},
+		"build": map[string]interface{}{
+			"number": idx.BuildNumber,
+			"string": idx.Build,
+		},
+		"requirements": map[string][]string{
+			"run": idx.Depends,
+		},
+		"about": map[string]string{
+			"license": spec.License,
+			"summary": fmt.Sprintf("%s %s built with aligot (%s)", spec.Package, spec.Version, spec.Hash),
+		},
+	}
+
+	info := filepath.Join(top, "info")
+	err = os.MkdirAll(filepath.Join(info, "recipe"), 0755)
+	if err != nil {
+		return "", err
+	}
+	idxbuf, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	metabuf, err := yaml.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range []struct {
+		name string
+		data []byte
+	}{
+		{"index.json", idxbuf},
+		{"files", []byte(strings.Join(files, "\n") + "\n")},
+		{"has_prefix", []byte(strings.Join(prefix, "\n") + "\n")},
+		{filepath.Join("recipe", "meta.yaml"), metabuf},
+	} {
+		if v.name == "has_prefix" && len(prefix) == 0 {
+			continue
+		}
+		err = ioutil.WriteFile(filepath.Join(info, v.name), v.data, 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(top)
+	if err != nil {
+		return "", err
+	}
+	fname := filepath.Join(subdir, fmt.Sprintf("%s-%s-%s.tar.bz2", idx.Name, idx.Version, idx.Build))
+	args := []string{"cjf", fname}
+	for _, fi := range entries {
+		args = append(args, fi.Name())
+	}
+	err = b.run(top, "tar", args...)
+	if err != nil {
+		return "", err
+	}
+	return fname, nil
+}
+
+// indexConda (re-)generates the repodata.json file of a conda channel
+// sub-directory from the packages it holds.
+func indexConda(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	pkgs := make(map[string]condaIndex)
+	fnames, err := filepath.Glob(filepath.Join(dir, "*.tar.bz2"))
+	if err != nil {
+		return err
+	}
+	for _, fname := range fnames {
+		idx, err := readCondaIndex(fname)
+		if err != nil {
+			return fmt.Errorf("could not read index of [%s]: %v", fname, err)
+		}
+		pkgs[filepath.Base(fname)] = idx
+	}
+
+	repo := map[string]interface{}{
+		"info":             map[string]string{"subdir": filepath.Base(dir)},
+		"packages":         pkgs,
+		"repodata_version": 1,
+	}
+	buf, err := json.MarshalIndent(repo, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "repodata.json"), buf, 0644)
+}
+
+// readCondaIndex reads the info/index.json file of the named conda package,
+// completed with the digests and the size of the package.
+func readCondaIndex(fname string) (condaIndex, error) {
+	var idx condaIndex
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return idx, err
+	}
+
+	tr := tar.NewReader(bzip2.NewReader(bytes.NewReader(buf)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return idx, fmt.Errorf("no info/index.json")
+		}
+		if err != nil {
+			return idx, err
+		}
+		if strings.TrimPrefix(hdr.Name, "./") != "info/index.json" {
+			continue
+		}
+		err = json.NewDecoder(tr).Decode(&idx)
+		if err != nil {
+			return idx, err
+		}
+		break
+	}
+
+	sum := md5.Sum(buf)
+	idx.MD5 = hex.EncodeToString(sum[:])
+	idx.SHA256, err = sha256File(hostFS{}, fname)
+	idx.Size = int64(len(buf))
+	return idx, err
+}
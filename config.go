@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigFile describes the content of the aligot configuration file.
+//
+// Example:
+//
+//	sign:
+//	  key: builder@example.org
+//	verify:
+//	  keyring: /etc/aligot/trusted.gpg
+//	  digests: /etc/aligot/trusted.sha256
+//	  require-signed: true
+//	grid:
+//	  url: https://alimonitor.cern.ch/packman
+//	  cert: /etc/aligot/usercert.pem
+//	  key: /etc/aligot/userkey.pem
+//	status:
+//	  github:
+//	    token: ghp_xxx
+//	  gitlab:
+//	    token: glpat-xxx
+//	    hosts: [gitlab.cern.ch]
+//	  log-url: https://ci.example.org/logs/{arch}/{package}/{hash}
+//	notify:
+//	  slack: https://hooks.slack.com/services/XXX
+//	  email:
+//	    smtp: smtp.example.org:25
+//	    from: aligot@example.org
+//	    to: [builder@example.org]
+//	  milestones: true
+//	arch-fallbacks:
+//	  slc8_x86-64: [slc7_x86-64]
+//	aliases:
+//	  o2: O2Suite
+//	stores:
+//	  cern:
+//	    url: https://s3.cern.ch/swift/v1/alibuild-repo
+//	    concurrency: 8
+//	    retries: 3
+//	  local:
+//	    url: ssh://builder@cache.example.org/data/aligot
+//	    identity: /etc/aligot/id_ed25519
+//	  private:
+//	    url: https://cache.example.org/aligot
+//	    user: builder
+//	    credential-helper: pass show aligot/cache
+//	credentials:
+//	  helper: git credential-cache
+//	  netrc: /etc/aligot/netrc
+//	sources-cache: /data/aligot/sources
+type ConfigFile struct {
+	Sign struct {
+		Key string `yaml:"key"` // GPG key used to sign uploaded tarballs
+	} `yaml:"sign"`
+	Verify struct {
+		Keyring       string `yaml:"keyring"` // GPG keyring with the trusted keys
+		Digests       string `yaml:"digests"` // file with trusted SHA-256 digests
+		RequireSigned bool   `yaml:"require-signed"`
+	} `yaml:"verify"`
+	Grid struct {
+		URL  string `yaml:"url"`  // endpoint of the grid package manager
+		Cert string `yaml:"cert"` // grid certificate
+		Key  string `yaml:"key"`  // key of the grid certificate
+		CA   string `yaml:"ca"`   // CA bundle of the grid package manager
+	} `yaml:"grid"`
+	Status struct {
+		GitHub struct {
+			Token string `yaml:"token"`
+			API   string `yaml:"api"` // endpoint of the GitHub API (default: https://api.github.com)
+		} `yaml:"github"`
+		GitLab struct {
+			Token string   `yaml:"token"`
+			Hosts []string `yaml:"hosts"` // hosts of the GitLab instances, besides gitlab.com
+		} `yaml:"gitlab"`
+		LogURL string `yaml:"log-url"` // link to the build logs, with {arch}, {package}, {version} and {hash} placeholders
+	} `yaml:"status"`
+	Notify NotifyConfig `yaml:"notify"`
+
+	// architectures whose tarballs may be reused, when the stores hold none
+	// for an architecture.
+	ArchFallbacks map[string][]string `yaml:"arch-fallbacks"`
+
+	// alternative names of packages, besides those of the defaults.
+	Aliases map[string]string `yaml:"aliases"`
+
+	// stores, referred to by their name from -remote-store and -write-store.
+	Stores map[string]StoreConfig `yaml:"stores"`
+
+	// credentials of the hosts of the private git sources, HTTP stores and
+	// container registries.
+	Credentials struct {
+		Helper string `yaml:"helper"` // git credential helper (e.g. git credential-osxkeychain)
+		Netrc  string `yaml:"netrc"`  // netrc file (default: $NETRC or ~/.netrc)
+	} `yaml:"credentials"`
+
+	// cache of the downloaded source archives, shared by the work
+	// directories.
+	SourcesCache string `yaml:"sources-cache"`
+}
+
+// StoreConfig describes a store, and how to access it.
+type StoreConfig struct {
+	URL              string        `yaml:"url"`      // location of the store, as given to -remote-store
+	Endpoint         string        `yaml:"endpoint"` // endpoint of the storage service of gs:// and az:// stores, if not the public one
+	User             string        `yaml:"user"`
+	Password         string        `yaml:"password"`
+	Token            string        `yaml:"token"`             // bearer token of HTTP stores
+	Identity         string        `yaml:"identity"`          // private key of ssh stores
+	CredentialHelper string        `yaml:"credential-helper"` // command printing the password (or the token) of the store
+	Concurrency      int           `yaml:"concurrency"`       // concurrent downloads (default: -fetch-jobs)
+	Retries          int           `yaml:"retries"`           // attempts after a failed transfer
+	RetryDelay       time.Duration `yaml:"retry-delay"`       // delay between the attempts (default: 1s)
+}
+
+// NotifyConfig describes the channels notified at the end of the runs.
+type NotifyConfig struct {
+	Slack      string `yaml:"slack"`      // Slack incoming webhook
+	Mattermost string `yaml:"mattermost"` // Mattermost incoming webhook
+	Email      struct {
+		SMTP     string   `yaml:"smtp"` // address of the SMTP server (host:port)
+		User     string   `yaml:"user"`
+		Password string   `yaml:"password"`
+		From     string   `yaml:"from"`
+		To       []string `yaml:"to"`
+	} `yaml:"email"`
+	Milestones bool `yaml:"milestones"` // also notify when the main package is built
+}
+
+// defaultConfigFile returns the path to the default configuration file.
+func defaultConfigFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".aligot.yml")
+}
+
+// loadConfigFile reads and decodes the named configuration file.
+// a missing file is not an error when optional is true.
+func loadConfigFile(fname string, optional bool) (ConfigFile, error) {
+	var cfg ConfigFile
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	err = yaml.Unmarshal(buf, &cfg)
+	return cfg, err
+}
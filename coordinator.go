@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sbinet/aligot/farmpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccreds "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// farmMaxAttempts is the maximum number of attempts at building a
+	// package on the build farm.
+	farmMaxAttempts = 3
+
+	// farmHeartbeat is the interval between the heartbeats of the workers.
+	// workers missing 3 heartbeats are considered lost, and their jobs are
+	// dispatched to other workers.
+	farmHeartbeat = 10 * time.Second
+
+	// farmPoll is the maximum duration of a request for a job.
+	farmPoll = 30 * time.Second
+
+	// farmArchWait is the maximum duration a job ready to be built waits for
+	// a worker of its architecture to join the build farm.
+	farmArchWait = 10 * time.Minute
+)
+
+// states of the jobs of the build farm.
+const (
+	farmPending = "pending"
+	farmRunning = "running"
+	farmDone    = "done"
+	farmFailed  = "failed"
+)
+
+// Coordinator partitions the dependency graphs of the requested packages
+// into jobs, and dispatches them to the workers of the build farm, over gRPC
+// (see the farmpb package).
+//
+// the RPCs are served over TLS, and the workers authenticate with the token
+// shared by the farm, sent with each of their requests.
+//
+// a package is dispatched to a worker of its architecture once all its
+// dependencies are built: the worker fetches them from the shared store, and
+// uploads the package to it.
+// jobs of lost workers, and failed jobs, are dispatched to other workers, up
+// to farmMaxAttempts times.
+// jobs waiting for more than farmArchWait for a worker of their architecture
+// fail.
+// the workers stream the build logs of their jobs back to the coordinator.
+type Coordinator struct {
+	farmpb.UnimplementedCoordinatorServer
+
+	mu       sync.Mutex
+	jobs     []*farmJob
+	workers  map[int32]*farmWorker
+	nextID   int32
+	seen     map[string]time.Time // last time a worker of each architecture was part of the farm
+	archWait time.Duration        // maximum wait for a worker of the architecture of a job
+	changed  chan struct{}        // closed when the state of the farm changes
+	done     chan struct{}        // closed when all the jobs are done, or one failed
+	err      error
+	logDir   string // directory of the build logs streamed by the workers
+	token    string // token shared by the workers of the farm
+}
+
+type farmJob struct {
+	*farmpb.Job
+	deps     []int32 // IDs of the jobs of the dependencies
+	state    string
+	worker   int32 // ID of the worker running the job
+	attempts int
+	avoid    map[int32]bool // workers which failed to run the job
+	host     string         // host of the worker which ran the job
+}
+
+type farmWorker struct {
+	host     string
+	arch     string // architecture the worker builds for
+	capacity int32  // maximum number of concurrent jobs of the worker
+	lastSeen time.Time
+	jobs     int32 // number of running jobs
+}
+
+// newCoordinator returns a coordinator of the builds of the packages
+// resolved by the given builders.
+func newCoordinator(builders []*Builder, logDir, token string) (*Coordinator, error) {
+	c := &Coordinator{
+		workers:  make(map[int32]*farmWorker),
+		seen:     make(map[string]time.Time),
+		archWait: farmArchWait,
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+		logDir:   logDir,
+		token:    token,
+	}
+	now := time.Now()
+	for _, b := range builders {
+		if b.cfg.writeStore == "" {
+			return nil, fmt.Errorf("a shared write store is needed (use -write-store)")
+		}
+		ids := make(map[string]int32, len(b.order))
+		for _, p := range b.order {
+			spec := b.specs[p]
+			job := &farmJob{
+				Job: &farmpb.Job{
+					Id:       int32(len(c.jobs) + 1),
+					Arch:     baseArch(spec.arch),
+					Package:  spec.Package,
+					Defaults: b.cfg.defaults,
+					Hash:     spec.Hash,
+					Store:    b.cfg.writeStore,
+
+					Toolchain: b.cfg.toolchain,
+				},
+				state: farmPending,
+				avoid: make(map[int32]bool),
+			}
+			if spec.arch == b.targetArch() {
+				job.BuildType = b.cfg.buildType
+			}
+			if b.sanitized(spec) {
+				job.Sanitizers = b.cfg.sanitizers
+			}
+			for _, dep := range spec.FullRequires {
+				if id, ok := ids[dep]; ok {
+					job.deps = append(job.deps, id)
+				}
+			}
+			ids[p] = job.Id
+			c.jobs = append(c.jobs, job)
+			c.seen[job.Arch] = now
+		}
+	}
+	return c, nil
+}
+
+// notify wakes up the pending job requests.
+// notify must be called with c.mu held.
+func (c *Coordinator) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// finish ends the coordination, with the given error.
+// finish must be called with c.mu held.
+func (c *Coordinator) finish(err error) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	close(c.done)
+	c.notify()
+}
+
+// Register registers a worker with the build farm.
+func (c *Coordinator) Register(ctx context.Context, req *farmpb.RegisterRequest) (*farmpb.RegisterReply, error) {
+	capacity := req.Capacity
+	if capacity < 1 {
+		capacity = 1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	c.workers[c.nextID] = &farmWorker{
+		host:     req.Host,
+		arch:     req.Arch,
+		capacity: capacity,
+		lastSeen: time.Now(),
+	}
+	msg.Infof("worker #%d joined (host=%s, arch=%s, capacity=%d)\n",
+		c.nextID, req.Host, req.Arch, capacity,
+	)
+	c.notify()
+	return &farmpb.RegisterReply{
+		WorkerId:    c.nextID,
+		HeartbeatMs: farmHeartbeat.Milliseconds(),
+	}, nil
+}
+
+// Heartbeat records that a worker is alive.
+func (c *Coordinator) Heartbeat(ctx context.Context, req *farmpb.HeartbeatRequest) (*farmpb.HeartbeatReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.workers[req.WorkerId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown worker #%d", req.WorkerId)
+	}
+	w.lastSeen = time.Now()
+	return &farmpb.HeartbeatReply{}, nil
+}
+
+// Next dispatches a job to a worker, waiting for one to be ready.
+func (c *Coordinator) Next(ctx context.Context, req *farmpb.NextRequest) (*farmpb.NextReply, error) {
+	timeout := time.NewTimer(farmPoll)
+	defer timeout.Stop()
+	for {
+		c.mu.Lock()
+		w, ok := c.workers[req.WorkerId]
+		if !ok {
+			c.mu.Unlock()
+			return nil, status.Errorf(codes.NotFound, "unknown worker #%d", req.WorkerId)
+		}
+		w.lastSeen = time.Now()
+		select {
+		case <-c.done:
+			c.mu.Unlock()
+			return &farmpb.NextReply{Exit: true}, nil
+		default:
+		}
+
+		if w.jobs < w.capacity {
+			if job := c.ready(req.WorkerId, w); job != nil {
+				job.state = farmRunning
+				job.worker = req.WorkerId
+				job.host = w.host
+				job.attempts++
+				w.jobs++
+				msg.Infof("dispatching %s (%s) to worker #%d (attempt %d)\n",
+					job.Package, job.Arch, req.WorkerId, job.attempts,
+				)
+				attempts := job.attempts
+				c.mu.Unlock()
+				c.appendLog(job.Job, []byte(fmt.Sprintf(
+					"### attempt %d on worker #%d (host=%s)\n",
+					attempts, req.WorkerId, w.host,
+				)))
+				return &farmpb.NextReply{Job: job.Job}, nil
+			}
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return &farmpb.NextReply{}, nil
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// ready returns a job ready to be run by a worker, or nil.
+// ready must be called with c.mu held.
+func (c *Coordinator) ready(id int32, w *farmWorker) *farmJob {
+	var avoided *farmJob
+	for _, job := range c.jobs {
+		if job.Arch != w.arch || !c.runnable(job) {
+			continue
+		}
+		if !job.avoid[id] {
+			return job
+		}
+		if avoided == nil {
+			avoided = job
+		}
+	}
+	if avoided == nil {
+		return nil
+	}
+
+	// jobs are only given again to a worker which failed to run them when
+	// no other worker of their architecture can run them.
+	for wid, o := range c.workers {
+		if wid != id && o.arch == w.arch && !avoided.avoid[wid] {
+			return nil
+		}
+	}
+	return avoided
+}
+
+// runnable returns whether a job is pending, with all its dependencies
+// built.
+// runnable must be called with c.mu held.
+func (c *Coordinator) runnable(job *farmJob) bool {
+	if job.state != farmPending {
+		return false
+	}
+	for _, dep := range job.deps {
+		if c.jobs[dep-1].state != farmDone {
+			return false
+		}
+	}
+	return true
+}
+
+// job returns the job with the given ID, running on the given worker.
+// job must be called with c.mu held.
+func (c *Coordinator) job(id, worker int32) (*farmJob, error) {
+	if id < 1 || int(id) > len(c.jobs) {
+		return nil, status.Errorf(codes.NotFound, "unknown job #%d", id)
+	}
+	job := c.jobs[id-1]
+	if job.state != farmRunning || job.worker != worker {
+		// the job was dispatched to another worker in the meantime.
+		return nil, nil
+	}
+	return job, nil
+}
+
+// Log appends a chunk of the build log of a job to its log file.
+func (c *Coordinator) Log(ctx context.Context, req *farmpb.LogRequest) (*farmpb.LogReply, error) {
+	c.mu.Lock()
+	job, err := c.job(req.JobId, req.WorkerId)
+	c.mu.Unlock()
+	if err != nil || job == nil {
+		return &farmpb.LogReply{}, err
+	}
+
+	err = c.appendLog(job.Job, req.Data)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not write log of %s: %v", job.Package, err)
+	}
+	return &farmpb.LogReply{}, nil
+}
+
+// logFile returns the name of the log file of a job.
+func (c *Coordinator) logFile(job *farmpb.Job) string {
+	return filepath.Join(c.logDir, job.Arch, job.Package+".log")
+}
+
+// appendLog appends data to the log file of a job.
+func (c *Coordinator) appendLog(job *farmpb.Job, data []byte) error {
+	fname := c.logFile(job)
+	err := os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Done records the outcome of a job.
+func (c *Coordinator) Done(ctx context.Context, req *farmpb.DoneRequest) (*farmpb.DoneReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job, err := c.job(req.JobId, req.WorkerId)
+	if err != nil || job == nil {
+		return &farmpb.DoneReply{}, err
+	}
+	if w, ok := c.workers[req.WorkerId]; ok {
+		w.jobs--
+		w.lastSeen = time.Now()
+	}
+
+	if req.Error == "" {
+		job.state = farmDone
+		msg.Infof("%s (%s) built by worker #%d\n", job.Package, job.Arch, req.WorkerId)
+		if c.completed() {
+			c.finish(nil)
+		}
+		c.notify()
+		return &farmpb.DoneReply{}, nil
+	}
+
+	msg.Warnf("worker #%d failed to build %s (%s): %s\n",
+		req.WorkerId, job.Package, job.Arch, req.Error,
+	)
+	job.avoid[req.WorkerId] = true
+	c.retry(job, fmt.Errorf("could not build %s (%s): %s", job.Package, job.Arch, req.Error))
+	return &farmpb.DoneReply{}, nil
+}
+
+// retry dispatches again a job, unless it was attempted too many times.
+// retry must be called with c.mu held.
+func (c *Coordinator) retry(job *farmJob, err error) {
+	job.worker = 0
+	if job.attempts >= farmMaxAttempts {
+		job.state = farmFailed
+		c.finish(fmt.Errorf("%v (after %d attempts)", err, job.attempts))
+		return
+	}
+	job.state = farmPending
+	c.notify()
+}
+
+// completed reports whether all the jobs are done.
+// completed must be called with c.mu held.
+func (c *Coordinator) completed() bool {
+	for _, job := range c.jobs {
+		if job.state != farmDone {
+			return false
+		}
+	}
+	return true
+}
+
+// reap periodically checks the workers and the jobs of the build farm (see
+// check), until the coordination is done.
+func (c *Coordinator) reap() {
+	tick := time.NewTicker(farmHeartbeat)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-tick.C:
+			c.check(now)
+		}
+	}
+}
+
+// check removes the workers which missed their heartbeats, and dispatches
+// their jobs to other workers.
+// it then fails the jobs ready to be built, which waited for more than
+// c.archWait for a worker of their architecture.
+func (c *Coordinator) check(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, w := range c.workers {
+		if w.lastSeen.After(c.seen[w.arch]) {
+			c.seen[w.arch] = w.lastSeen
+		}
+		if now.Sub(w.lastSeen) < 3*farmHeartbeat {
+			continue
+		}
+		msg.Warnf("worker #%d (host=%s) lost\n", id, w.host)
+		delete(c.workers, id)
+		for _, job := range c.jobs {
+			if job.state == farmRunning && job.worker == id {
+				c.retry(job, fmt.Errorf("could not build %s (%s): worker #%d lost", job.Package, job.Arch, id))
+			}
+		}
+	}
+
+	for _, job := range c.jobs {
+		if !c.runnable(job) || now.Sub(c.seen[job.Arch]) < c.archWait {
+			continue
+		}
+		job.state = farmFailed
+		c.finish(fmt.Errorf(
+			"could not build %s (%s): no worker of architecture %s in the build farm for %v",
+			job.Package, job.Arch, job.Arch, c.archWait,
+		))
+		return
+	}
+}
+
+// authorize rejects the requests not holding the token of the farm, as an
+// "authorization: Bearer <token>" metadata.
+func (c *Coordinator) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get("authorization")
+	if len(auth) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	tok := strings.TrimPrefix(auth[0], "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(tok), []byte(c.token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return handler(ctx, req)
+}
+
+// serve dispatches the jobs to the workers connecting to the listener, over
+// TLS with the given certificate, until all the jobs are done or one of them
+// failed.
+func (c *Coordinator) serve(l net.Listener, cert tls.Certificate) error {
+	srv := grpc.NewServer(
+		grpc.Creds(grpccreds.NewServerTLSFromCert(&cert)),
+		grpc.UnaryInterceptor(c.authorize),
+	)
+	farmpb.RegisterCoordinatorServer(srv, c)
+	go srv.Serve(l)
+	go c.reap()
+
+	c.mu.Lock()
+	if c.completed() {
+		c.finish(nil)
+	}
+	c.mu.Unlock()
+
+	<-c.done
+	// leave some time to the workers to learn about the end of the builds.
+	time.Sleep(time.Second)
+	srv.Stop()
+	return c.err
+}
+
+// farmToken sends the token of the farm with the requests of a worker.
+type farmToken string
+
+func (tok farmToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(tok)}, nil
+}
+
+func (farmToken) RequireTransportSecurity() bool { return true }
+
+// farmCert returns the TLS certificate of the coordinator, from the given
+// certificate and key files.
+// when they are empty, a self-signed certificate for the hosts of addr is
+// loaded from dir, or generated there: workers verify the coordinator with
+// its cert.pem file (see -tls-ca).
+func farmCert(certFile, keyFile, dir, addr string) (tls.Certificate, error) {
+	if certFile != "" || keyFile != "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		msg.Infof("TLS certificate of the build farm: %s\n", certFile)
+		return cert, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"aligot build farm"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if host, err := os.Hostname(); err == nil {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	switch ip := net.ParseIP(host); {
+	case host == "" || ip != nil && ip.IsUnspecified():
+		// the coordinator listens on all the interfaces.
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ipnet.IP)
+			}
+		}
+	case ip != nil:
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	default:
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	err = ioutil.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	msg.Infof("generated the TLS certificate of the build farm: %s\n", certFile)
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// report writes the outcome of the jobs to w.
+func (c *Coordinator) report(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PACKAGE\tARCH\tSTATE\tATTEMPTS\tHOST\n")
+	for _, job := range c.jobs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n",
+			job.Package, job.Arch, job.state, job.attempts, job.host,
+		)
+	}
+	return tw.Flush()
+}
+
+// coordinate resolves the requested package for each of the given
+// architectures, and coordinates their builds by the workers of the build
+// farm joining on addr with the given token.
+// a random token is generated, and logged, when it is empty.
+// the coordinator serves TLS with the given certificate and key files, or
+// with a self-signed certificate when they are empty (see farmCert).
+func coordinate(cfg Config, archs []string, addr, token, certFile, keyFile string, w io.Writer) error {
+	var builders []*Builder
+	for _, arch := range archs {
+		c := cfg
+		c.arch = strings.TrimSpace(arch)
+		b := newBuilder(c)
+		err := b.resolve()
+		if err != nil {
+			return fmt.Errorf("could not resolve %s for %s: %v", cfg.pkgs[0], c.arch, err)
+		}
+		builders = append(builders, b)
+	}
+
+	logDir := filepath.Join(cfg.wdir, "FARM", "logs")
+	err := os.RemoveAll(logDir)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		token, err = randomToken()
+		if err != nil {
+			return err
+		}
+		msg.Infof("token of the build farm: %s\n", token)
+	}
+	c, err := newCoordinator(builders, logDir, token)
+	if err != nil {
+		return err
+	}
+	cert, err := farmCert(certFile, keyFile, filepath.Join(cfg.wdir, "FARM", "tls"), addr)
+	if err != nil {
+		return fmt.Errorf("could not load the TLS certificate of the build farm: %v", err)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	msg.Infof("coordinating the builds of %d packages on [%s] (logs in [%s])...\n", len(c.jobs), l.Addr(), logDir)
+	err = c.serve(l, cert)
+	if e := c.report(w); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
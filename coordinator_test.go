@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sbinet/aligot/farmpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testJob describes a job of a test coordinator: its package, architecture,
+// and the IDs of the jobs of its dependencies.
+type testJob struct {
+	pkg  string
+	arch string
+	deps []int32
+}
+
+func newTestCoordinator(t *testing.T, jobs ...testJob) *Coordinator {
+	t.Helper()
+	c := &Coordinator{
+		workers:  make(map[int32]*farmWorker),
+		seen:     make(map[string]time.Time),
+		archWait: farmArchWait,
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+		logDir:   t.TempDir(),
+		token:    "secret",
+	}
+	now := time.Now()
+	for i, j := range jobs {
+		c.jobs = append(c.jobs, &farmJob{
+			Job:   &farmpb.Job{Id: int32(i + 1), Arch: j.arch, Package: j.pkg},
+			deps:  j.deps,
+			state: farmPending,
+			avoid: make(map[int32]bool),
+		})
+		c.seen[j.arch] = now
+	}
+	return c
+}
+
+func register(t *testing.T, c *Coordinator, arch string, capacity int32) int32 {
+	t.Helper()
+	reply, err := c.Register(context.Background(), &farmpb.RegisterRequest{
+		Host:     "host-" + arch,
+		Arch:     arch,
+		Capacity: capacity,
+	})
+	if err != nil {
+		t.Fatalf("could not register worker: %v", err)
+	}
+	return reply.WorkerId
+}
+
+func TestCoordinatorReady(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		jobs  []testJob
+		done  []int32          // IDs of the jobs already built
+		avoid map[int32]int32  // IDs of the jobs avoided by a worker
+		archs map[int32]string // architectures of the workers
+		want  map[int32]string // package dispatched to each worker
+	}{
+		{
+			name:  "arch",
+			jobs:  []testJob{{pkg: "a", arch: "slc7_x86-64"}, {pkg: "b", arch: "slc7_aarch64"}},
+			archs: map[int32]string{1: "slc7_aarch64", 2: "osx_arm64"},
+			want:  map[int32]string{1: "b", 2: ""},
+		},
+		{
+			name:  "deps-pending",
+			jobs:  []testJob{{pkg: "zlib", arch: "x"}, {pkg: "app", arch: "x", deps: []int32{1}}},
+			archs: map[int32]string{1: "x"},
+			want:  map[int32]string{1: "zlib"},
+		},
+		{
+			name:  "deps-built",
+			jobs:  []testJob{{pkg: "zlib", arch: "x"}, {pkg: "app", arch: "x", deps: []int32{1}}},
+			done:  []int32{1},
+			archs: map[int32]string{1: "x"},
+			want:  map[int32]string{1: "app"},
+		},
+		{
+			name:  "all-built",
+			jobs:  []testJob{{pkg: "zlib", arch: "x"}},
+			done:  []int32{1},
+			archs: map[int32]string{1: "x"},
+			want:  map[int32]string{1: ""},
+		},
+		{
+			name:  "avoided",
+			jobs:  []testJob{{pkg: "zlib", arch: "x"}},
+			avoid: map[int32]int32{1: 1},
+			archs: map[int32]string{1: "x", 2: "x"},
+			want:  map[int32]string{1: "", 2: "zlib"},
+		},
+		{
+			name:  "avoided-by-all",
+			jobs:  []testJob{{pkg: "zlib", arch: "x"}},
+			avoid: map[int32]int32{1: 1, 2: 1},
+			archs: map[int32]string{1: "x", 2: "x"},
+			want:  map[int32]string{1: "zlib", 2: "zlib"},
+		},
+		{
+			name:  "avoided-other-arch",
+			jobs:  []testJob{{pkg: "zlib", arch: "x"}},
+			avoid: map[int32]int32{1: 1},
+			archs: map[int32]string{1: "x", 2: "y"},
+			want:  map[int32]string{1: "zlib", 2: ""},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCoordinator(t, tc.jobs...)
+			for _, id := range tc.done {
+				c.jobs[id-1].state = farmDone
+			}
+			for wid, id := range tc.avoid {
+				c.jobs[id-1].avoid[wid] = true
+			}
+			for wid, arch := range tc.archs {
+				c.workers[wid] = &farmWorker{arch: arch, capacity: 1}
+			}
+			for wid, want := range tc.want {
+				got := ""
+				if job := c.ready(wid, c.workers[wid]); job != nil {
+					got = job.Package
+				}
+				if got != want {
+					t.Fatalf("worker #%d: got job %q, want %q", wid, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCoordinatorDispatch(t *testing.T) {
+	c := newTestCoordinator(t,
+		testJob{pkg: "zlib", arch: "x"},
+		testJob{pkg: "bz2", arch: "x"},
+		testJob{pkg: "app", arch: "x", deps: []int32{1, 2}},
+	)
+	ctx := context.Background()
+	w := register(t, c, "x", 2)
+
+	var built []string
+	for len(built) < 3 {
+		var jobs []*farmpb.Job
+		for len(jobs) < 2 {
+			c.mu.Lock()
+			ready := c.ready(w, c.workers[w]) != nil
+			c.mu.Unlock()
+			if !ready {
+				break
+			}
+			next, err := c.Next(ctx, &farmpb.NextRequest{WorkerId: w})
+			if err != nil {
+				t.Fatalf("could not get job: %v", err)
+			}
+			jobs = append(jobs, next.Job)
+		}
+		if len(jobs) == 0 {
+			t.Fatalf("no job ready (built: %v)", built)
+		}
+		if got := c.workers[w].jobs; got != int32(len(jobs)) {
+			t.Fatalf("invalid number of running jobs: got=%d, want=%d", got, len(jobs))
+		}
+		for _, job := range jobs {
+			_, err := c.Log(ctx, &farmpb.LogRequest{WorkerId: w, JobId: job.Id, Data: []byte("building " + job.Package + "\n")})
+			if err != nil {
+				t.Fatalf("could not stream log: %v", err)
+			}
+			_, err = c.Done(ctx, &farmpb.DoneRequest{WorkerId: w, JobId: job.Id})
+			if err != nil {
+				t.Fatalf("could not report job: %v", err)
+			}
+			built = append(built, job.Package)
+		}
+	}
+
+	if got, want := strings.Join(built, ","), "zlib,bz2,app"; got != want {
+		t.Fatalf("invalid build order: got=%q, want=%q", got, want)
+	}
+	next, err := c.Next(ctx, &farmpb.NextRequest{WorkerId: w})
+	if err != nil {
+		t.Fatalf("could not get job: %v", err)
+	}
+	if !next.Exit {
+		t.Fatalf("coordinator not done")
+	}
+	if c.err != nil {
+		t.Fatalf("unexpected error: %v", c.err)
+	}
+
+	log, err := ioutil.ReadFile(filepath.Join(c.logDir, "x", "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "### attempt 1 on worker #1 (host=host-x)\nbuilding app\n"; string(log) != want {
+		t.Fatalf("invalid log:\ngot:\n%s\nwant:\n%s", log, want)
+	}
+}
+
+func TestCoordinatorRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		errs     []string // outcome of each attempt
+		state    string
+		attempts int
+		hosts    []string // hosts of the worker of each attempt
+		err      string
+	}{
+		{
+			name:     "ok",
+			errs:     []string{""},
+			state:    farmDone,
+			attempts: 1,
+			hosts:    []string{"a"},
+		},
+		{
+			name:     "retried",
+			errs:     []string{"boom", ""},
+			state:    farmDone,
+			attempts: 2,
+			hosts:    []string{"a", "b"},
+		},
+		{
+			name:     "failed",
+			errs:     []string{"boom", "boom", "bang"},
+			state:    farmFailed,
+			attempts: 3,
+			hosts:    []string{"a", "b", "a"},
+			err:      "could not build zlib (x): bang (after 3 attempts)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCoordinator(t, testJob{pkg: "zlib", arch: "x"})
+			ctx := context.Background()
+			hosts := make(map[int32]string)
+			for _, host := range []string{"a", "b"} {
+				reply, err := c.Register(ctx, &farmpb.RegisterRequest{Host: host, Arch: "x"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				hosts[reply.WorkerId] = host
+			}
+
+			var got []string
+			for _, e := range tc.errs {
+				var next *farmpb.NextReply
+				for _, w := range []int32{1, 2} {
+					c.mu.Lock()
+					ready := c.ready(w, c.workers[w]) != nil
+					c.mu.Unlock()
+					if !ready {
+						continue
+					}
+					var err error
+					next, err = c.Next(ctx, &farmpb.NextRequest{WorkerId: w})
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, hosts[w])
+					_, err = c.Done(ctx, &farmpb.DoneRequest{WorkerId: w, JobId: next.Job.Id, Error: e})
+					if err != nil {
+						t.Fatal(err)
+					}
+					break
+				}
+				if next == nil {
+					t.Fatalf("job not dispatched")
+				}
+			}
+
+			job := c.jobs[0]
+			if job.state != tc.state {
+				t.Fatalf("invalid state: got=%q, want=%q", job.state, tc.state)
+			}
+			if job.attempts != tc.attempts {
+				t.Fatalf("invalid attempts: got=%d, want=%d", job.attempts, tc.attempts)
+			}
+			if g, w := strings.Join(got, ","), strings.Join(tc.hosts, ","); g != w {
+				t.Fatalf("invalid hosts: got=%q, want=%q", g, w)
+			}
+			err := ""
+			if c.err != nil {
+				err = c.err.Error()
+			}
+			if err != tc.err {
+				t.Fatalf("invalid error: got=%q, want=%q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCoordinatorCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		workers []string      // architectures of the workers
+		elapsed time.Duration // time since the last heartbeat of the first worker
+		running bool          // whether the job runs on the first worker
+		state   string
+		err     string
+	}{
+		{
+			name:    "alive",
+			workers: []string{"x"},
+			elapsed: farmHeartbeat,
+			running: true,
+			state:   farmRunning,
+		},
+		{
+			name:    "lost",
+			workers: []string{"x", "x"},
+			elapsed: 3 * farmHeartbeat,
+			running: true,
+			state:   farmPending,
+		},
+		{
+			name:    "waiting",
+			workers: []string{"x"},
+			elapsed: 2 * farmHeartbeat,
+			state:   farmPending,
+		},
+		{
+			name:    "no-worker",
+			workers: []string{"y"},
+			state:   farmFailed,
+			err:     "could not build zlib (x): no worker of architecture x in the build farm for 1m0s",
+		},
+		{
+			name:    "all-lost",
+			workers: []string{"x"},
+			elapsed: 3 * farmHeartbeat,
+			running: true,
+			state:   farmPending,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCoordinator(t, testJob{pkg: "zlib", arch: "x"})
+			c.archWait = time.Minute
+			start := time.Now()
+			c.seen["x"] = start.Add(-2 * time.Minute)
+			for _, arch := range tc.workers {
+				register(t, c, arch, 1)
+			}
+			for id, w := range c.workers {
+				w.lastSeen = start.Add(tc.elapsed)
+				if id == 1 {
+					w.lastSeen = start
+				}
+			}
+			if tc.running {
+				job := c.jobs[0]
+				job.state = farmRunning
+				job.worker = 1
+				job.attempts = 1
+				c.workers[1].jobs = 1
+			}
+
+			c.check(start.Add(tc.elapsed))
+			if got := c.jobs[0].state; got != tc.state {
+				t.Fatalf("invalid state: got=%q, want=%q", got, tc.state)
+			}
+			err := ""
+			if c.err != nil {
+				err = c.err.Error()
+			}
+			if err != tc.err {
+				t.Fatalf("invalid error: got=%q, want=%q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCoordinatorAuth(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := farmCert("", "", dir, l.Addr().String())
+	if err != nil {
+		t.Fatalf("could not generate certificate: %v", err)
+	}
+
+	c := newTestCoordinator(t, testJob{pkg: "zlib", arch: "x"})
+	served := make(chan error)
+	go func() { served <- c.serve(l, cert) }()
+	defer func() {
+		c.mu.Lock()
+		c.finish(nil)
+		c.mu.Unlock()
+		if err := <-served; err != nil {
+			t.Fatalf("could not serve: %v", err)
+		}
+	}()
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		ca    string
+		code  codes.Code
+	}{
+		{name: "ok", token: "secret", ca: filepath.Join(dir, "cert.pem"), code: codes.OK},
+		{name: "invalid-token", token: "guess", ca: filepath.Join(dir, "cert.pem"), code: codes.Unauthenticated},
+		{name: "no-token", ca: filepath.Join(dir, "cert.pem"), code: codes.Unauthenticated},
+		{name: "untrusted", token: "secret", code: codes.Unavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, err := farmDial(l.Addr().String(), tc.token, tc.ca)
+			if err != nil {
+				t.Fatalf("could not dial: %v", err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err = farmpb.NewCoordinatorClient(conn).Register(ctx, &farmpb.RegisterRequest{Arch: "x"})
+			if got := status.Code(err); got != tc.code {
+				t.Fatalf("invalid code: got=%v, want=%v (err=%v)", got, tc.code, err)
+			}
+		})
+	}
+}
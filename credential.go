@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// hostCredentials are the credentials of the hosts of the private git
+// sources, HTTP stores and container registries.
+// they are looked up, in order, in:
+//   - the ALIGOT_TOKEN_<HOST>, or ALIGOT_USER_<HOST> and ALIGOT_PASSWORD_<HOST>,
+//     environment variables, where HOST is the uppercase host with its other
+//     characters replaced by underscores (e.g. ALIGOT_TOKEN_GITLAB_CERN_CH),
+//   - the credential helper, speaking the protocol of git credential helpers
+//     (e.g. "git credential-osxkeychain"),
+//   - the netrc file ($NETRC, or ~/.netrc).
+type hostCredentials struct {
+	helper string // command of the credential helper, if any
+	netrc  string // netrc file
+	exec   Executor
+
+	mu    sync.Mutex
+	cache map[string]hostCreds
+}
+
+// hostCreds are the credentials of a host.
+type hostCreds struct {
+	user   string
+	secret string // password, or token when there is no user
+	ok     bool
+}
+
+// newHostCredentials returns the credentials of the hosts, given by the
+// credential helper and the netrc file (the default one if empty).
+func newHostCredentials(helper, netrc string, x Executor) *hostCredentials {
+	if netrc == "" {
+		netrc = os.Getenv("NETRC")
+	}
+	if netrc == "" {
+		netrc = filepath.Join(os.Getenv("HOME"), ".netrc")
+	}
+	return &hostCredentials{helper: helper, netrc: netrc, exec: x, cache: make(map[string]hostCreds)}
+}
+
+var reNotAlnum = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// lookup returns the credentials of a host, and whether there are any.
+// the credentials of each host are only looked up once.
+func (hc *hostCredentials) lookup(ctx context.Context, host string) (string, string, bool, error) {
+	if hc == nil || host == "" {
+		return "", "", false, nil
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if c, ok := hc.cache[host]; ok {
+		return c.user, c.secret, c.ok, nil
+	}
+
+	var c hostCreds
+	name := reNotAlnum.ReplaceAllString(strings.ToUpper(host), "_")
+	switch {
+	case os.Getenv("ALIGOT_TOKEN_"+name) != "":
+		c = hostCreds{secret: os.Getenv("ALIGOT_TOKEN_" + name), ok: true}
+	case os.Getenv("ALIGOT_PASSWORD_"+name) != "":
+		c = hostCreds{user: os.Getenv("ALIGOT_USER_" + name), secret: os.Getenv("ALIGOT_PASSWORD_" + name), ok: true}
+	}
+	if !c.ok && hc.helper != "" {
+		var err error
+		c, err = hc.runHelper(ctx, host)
+		if err != nil {
+			return "", "", false, err
+		}
+	}
+	if !c.ok {
+		c = readNetrc(hc.netrc, host)
+	}
+	hc.cache[host] = c
+	return c.user, c.secret, c.ok, nil
+}
+
+// runHelper asks the credential helper for the credentials of a host.
+func (hc *hostCredentials) runHelper(ctx context.Context, host string) (hostCreds, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hc.helper+" get")
+	cmd.Stdin = strings.NewReader("protocol=https\nhost=" + host + "\n\n")
+	cmd.Stderr = os.Stderr
+	out, err := output(hc.exec, cmd)
+	if err != nil {
+		return hostCreds{}, fmt.Errorf("could not get credentials of [%s] from credential helper: %v", host, err)
+	}
+	var c hostCreds
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		kv := strings.SplitN(scan.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "username":
+			c.user = kv[1]
+		case "password":
+			c.secret = kv[1]
+			c.ok = true
+		}
+	}
+	return c, nil
+}
+
+// readNetrc returns the credentials of a host from a netrc file: those of
+// its machine entry, or else of the default entry.
+func readNetrc(fname, host string) hostCreds {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return hostCreds{}
+	}
+	var (
+		found, def hostCreds
+		cur        *hostCreds
+		toks       = strings.Fields(string(buf))
+	)
+	for i := 0; i < len(toks); i++ {
+		next := func() string {
+			if i+1 < len(toks) {
+				i++
+				return toks[i]
+			}
+			return ""
+		}
+		switch toks[i] {
+		case "machine":
+			cur = nil
+			if next() == host && !found.ok {
+				found.ok = true
+				cur = &found
+			}
+		case "default":
+			cur = nil
+			if !def.ok {
+				def.ok = true
+				cur = &def
+			}
+		case "login":
+			if v := next(); cur != nil {
+				cur.user = v
+			}
+		case "password":
+			if v := next(); cur != nil {
+				cur.secret = v
+			}
+		case "account":
+			next()
+		case "macdef":
+			// macros run up to the next empty line, which strings.Fields
+			// does not keep: they are not supported.
+			cur = nil
+		}
+	}
+	if found.ok {
+		return found
+	}
+	return def
+}
+
+// urlHost returns the host of an URL, "" if it has none.
+func urlHost(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// gitEnv returns the environment of the git commands accessing the
+// repository at source: the credentials of its host are passed to git as an
+// HTTP header, through its environment rather than its command line.
+func (b *Builder) gitEnv(source string) ([]string, error) {
+	if !store.IsHTTP(source) {
+		return nil, nil
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.User != nil {
+		// credentials given by the URL take precedence.
+		return nil, nil
+	}
+	user, secret, ok, err := b.creds.lookup(b.ctx, u.Hostname())
+	if err != nil || !ok {
+		return nil, err
+	}
+	if user == "" {
+		// git hosting services (GitHub, GitLab, ...) accept tokens as the
+		// password of any user.
+		user = "aligot"
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + secret))
+	return append(os.Environ(),
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http."+u.Scheme+"://"+u.Host+"/.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		"GIT_TERMINAL_PROMPT=0",
+	), nil
+}
+
+// registryHost returns the host of the registry of a container image, as
+// named by docker.
+func registryHost(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return "docker.io"
+	}
+	host := image[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "docker.io"
+	}
+	return host
+}
+
+// pullImage pulls the docker image of the builds, with the credentials of its
+// registry, if any: they are written to a temporary docker configuration,
+// rather than stored by "docker login".
+// images from registries without credentials are pulled by docker run.
+func (b *Builder) pullImage(image string) error {
+	host := registryHost(image)
+	user, secret, ok, err := b.creds.lookup(b.ctx, host)
+	if err != nil || !ok {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "aligot-docker-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	key := host
+	if host == "docker.io" {
+		key = "https://index.docker.io/v1/"
+	}
+	cfg := map[string]interface{}{
+		"auths": map[string]interface{}{
+			key: map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte(user + ":" + secret)),
+			},
+		},
+	}
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "config.json"), buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	msg.Infof("pulling image [%s] from [%s]...\n", image, host)
+	cmd := exec.CommandContext(b.ctx, "docker", "pull", "-q", image)
+	cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+dir)
+	out, err := combinedOutput(b.exec, cmd)
+	if err != nil {
+		return fmt.Errorf("could not pull image [%s]: %v\n%s", image, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+// assignArchs assigns to each spec the architecture it is built for.
+//
+// the requested packages and their runtime requirements are built for the
+// target architecture, while packages only needed at build time are built
+// for (and run on) the host architecture.
+// a package needed both at runtime and at build time is built for the target.
+// packages built for the target architecture with a build type or with
+// sanitizers get their own architecture (see targetArch).
+func (b *Builder) assignArchs() {
+	target := make(map[string]bool)
+	for _, pkg := range b.pkgs {
+		for _, p := range b.runtimeClosure(pkg) {
+			target[p] = true
+		}
+	}
+
+	for _, p := range b.order {
+		spec := b.specs[p]
+		spec.arch = b.targetArch()
+		if !target[p] {
+			spec.arch = b.cfg.hostArch
+		}
+		if spec.arch != b.targetArch() {
+			msg.Debugf("%s built for host architecture %s\n", p, spec.arch)
+		}
+	}
+}
+
+// crossCompiled returns whether a spec is cross-compiled.
+func (b *Builder) crossCompiled(spec *Spec) bool {
+	return baseArch(spec.arch) != b.cfg.hostArch
+}
+
+// crossEnv returns the toolchain and sysroot environment of a cross-compiled
+// spec.
+func (b *Builder) crossEnv(spec *Spec) [][2]string {
+	if !b.crossCompiled(spec) {
+		return nil
+	}
+	env := [][2]string{
+		{"HOST_ARCHITECTURE", b.cfg.hostArch},
+		{"TARGET_ARCHITECTURE", spec.arch},
+	}
+	if pfx := b.cfg.crossPrefix; pfx != "" {
+		env = append(env,
+			[2]string{"CROSS_COMPILE", pfx},
+			[2]string{"CC", pfx + "gcc"},
+			[2]string{"CXX", pfx + "g++"},
+			[2]string{"FC", pfx + "gfortran"},
+			[2]string{"AR", pfx + "ar"},
+			[2]string{"LD", pfx + "ld"},
+			[2]string{"RANLIB", pfx + "ranlib"},
+			[2]string{"STRIP", pfx + "strip"},
+		)
+	}
+	if b.cfg.sysroot != "" {
+		env = append(env,
+			[2]string{"SYSROOT", b.cfg.sysroot},
+			[2]string{"PKG_CONFIG_SYSROOT_DIR", b.cfg.sysroot},
+		)
+	}
+	return env
+}
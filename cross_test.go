@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestAssignArchs(t *testing.T) {
+	recipes := map[string]string{
+		"defaults-release": testDefaults,
+		"app":              testRecipe("app", "v1", []string{"requires: [lib]", "build_requires: [cmake, tool]"}, ""),
+		"lib":              testRecipe("lib", "v1", []string{"requires: [zlib]", "build_requires: [cmake]"}, ""),
+		"cmake":            testRecipe("cmake", "v1", []string{"requires: [zlib]"}, ""),
+		"tool":             testRecipe("tool", "v1", []string{"requires: [zlib]"}, ""),
+		"zlib":             testRecipe("zlib", "v1", nil, ""),
+	}
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		archs map[string]string
+	}{
+		{
+			name: "native",
+			cfg:  Config{arch: "slc7_x86-64"},
+			archs: map[string]string{
+				"defaults-release": "slc7_x86-64",
+				"app":              "slc7_x86-64",
+				"lib":              "slc7_x86-64",
+				"zlib":             "slc7_x86-64",
+				"cmake":            "slc7_x86-64",
+				"tool":             "slc7_x86-64",
+			},
+		},
+		{
+			// zlib is needed both at runtime and at build time: it is
+			// built for the target.
+			name: "cross",
+			cfg:  Config{arch: "ubuntu2204_aarch64", hostArch: "slc7_x86-64"},
+			archs: map[string]string{
+				"defaults-release": "slc7_x86-64",
+				"app":              "ubuntu2204_aarch64",
+				"lib":              "ubuntu2204_aarch64",
+				"zlib":             "ubuntu2204_aarch64",
+				"cmake":            "slc7_x86-64",
+				"tool":             "slc7_x86-64",
+			},
+		},
+		{
+			name: "build-type",
+			cfg:  Config{arch: "slc7_x86-64", buildType: "Debug"},
+			archs: map[string]string{
+				"defaults-release": "slc7_x86-64",
+				"app":              "slc7_x86-64-debug",
+				"lib":              "slc7_x86-64-debug",
+				"zlib":             "slc7_x86-64-debug",
+				"cmake":            "slc7_x86-64",
+				"tool":             "slc7_x86-64",
+			},
+		},
+		{
+			name: "sanitizers",
+			cfg:  Config{arch: "ubuntu2204_aarch64", hostArch: "slc7_x86-64", sanitizers: []string{"asan", "ubsan"}},
+			archs: map[string]string{
+				"defaults-release": "slc7_x86-64",
+				"app":              "ubuntu2204_aarch64-asan-ubsan",
+				"lib":              "ubuntu2204_aarch64-asan-ubsan",
+				"zlib":             "ubuntu2204_aarch64-asan-ubsan",
+				"cmake":            "slc7_x86-64",
+				"tool":             "slc7_x86-64",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.pkgs = []string{"app"}
+			b, _, _ := newTestBuilder(t, tc.cfg, recipes)
+			err := b.resolve()
+			if err != nil {
+				t.Fatalf("could not resolve: %+v", err)
+			}
+			if got, want := len(b.order), len(tc.archs); got != want {
+				t.Fatalf("invalid number of packages: got=%d, want=%d (%q)", got, want, b.order)
+			}
+			for pkg, want := range tc.archs {
+				if got := b.specs[pkg].arch; got != want {
+					t.Errorf("invalid architecture of %s: got=%q, want=%q", pkg, got, want)
+				}
+			}
+		})
+	}
+}
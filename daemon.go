@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sbinet/aligot/recipe"
+	"github.com/sbinet/aligot/store"
+)
+
+// defaultDaemonTTL is the time the daemon keeps the git refs, the listings
+// of the remote store and the resolved graphs, before refreshing them.
+const defaultDaemonTTL = 5 * time.Minute
+
+// daemonSocket returns the socket of the daemon of a configuration.
+func daemonSocket(cfg Config) string {
+	if cfg.daemonSock != "" {
+		return cfg.daemonSock
+	}
+	return filepath.Join(cfg.wdir, "daemon.sock")
+}
+
+// resolveKey returns the digest of the options of a configuration the
+// resolution of its packages depends on: the daemon only resolves packages
+// for the runs whose key is the one of its own configuration.
+func resolveKey(cfg Config) string {
+	vs := []string{
+		cfg.cfgdir, cfg.configRef, cfg.overrides, cfg.wdir, cfg.docker,
+		cfg.arch, cfg.hostArch, cfg.crossPrefix, cfg.sysroot,
+		cfg.refsrc, strconv.FormatBool(cfg.fetchMirrors),
+		cfg.remoteStore, cfg.writeStore, cfg.compression,
+		cfg.buildType, cfg.toolchain, cfg.defaults,
+		strings.Join(cfg.env, "\x00"),
+		strings.Join(cfg.sanitizers, ","),
+		strings.Join(cfg.keepEnv, ","), cfg.hermeticPath,
+		fmt.Sprint(cfg.splitDebug, cfg.strip, cfg.hermetic, cfg.lenient),
+		fmt.Sprint(cfg.disable), fmt.Sprint(cfg.archFallbacks), fmt.Sprint(cfg.aliases),
+	}
+	if len(cfg.devel) > 0 {
+		// development packages are found in the current directory.
+		cwd, _ := os.Getwd()
+		vs = append(vs, strings.Join(cfg.devel, ","), cwd)
+	}
+	return digest(vs...)
+}
+
+// ResolveArgs is a request to the daemon for the resolution of a package.
+type ResolveArgs struct {
+	Key     string // resolveKey of the configuration of the run
+	Package string
+}
+
+// ResolveReply is the resolution of a package by the daemon.
+type ResolveReply struct {
+	Mismatch   bool // the daemon serves another configuration
+	Resolution Resolution
+}
+
+// Resolution is the state of a resolved builder.
+type Resolution struct {
+	Pkgs    []string
+	Specs   []ResolvedSpec
+	Order   []string
+	Names   map[string]string
+	Aliases map[string]string
+	Main    string
+	CfgHash string
+
+	// listings of the directories of the remote store of the packages.
+	Listings map[string][]string
+}
+
+// ResolvedSpec is a resolved spec.
+type ResolvedSpec struct {
+	Spec recipe.Spec
+	Arch string
+	LFS  string
+}
+
+// resolution returns the state of a resolved builder.
+func (b *Builder) resolution() Resolution {
+	r := Resolution{
+		Pkgs:     b.pkgs,
+		Order:    b.order,
+		Names:    b.names,
+		Aliases:  b.aliases,
+		Main:     b.main,
+		CfgHash:  b.cfghash,
+		Listings: make(map[string][]string),
+	}
+	for _, p := range b.order {
+		spec := b.specs[p]
+		r.Specs = append(r.Specs, ResolvedSpec{Spec: spec.Spec, Arch: spec.arch, LFS: spec.lfs})
+	}
+	return r
+}
+
+// restore sets the state of a builder to a resolution.
+func (b *Builder) restore(r Resolution) error {
+	tc, err := newToolchain(b.cfg, b.exec)
+	if err != nil {
+		return err
+	}
+	b.pkgs = r.Pkgs
+	b.order = r.Order
+	b.names = r.Names
+	b.aliases = r.Aliases
+	b.main = r.Main
+	b.cfghash = r.CfgHash
+	b.specs = make(map[string]*Spec, len(r.Specs))
+	for _, rs := range r.Specs {
+		b.specs[rs.Spec.Package] = &Spec{Spec: rs.Spec, lfs: rs.LFS}
+	}
+	if tc != nil && tc.pkg != "" {
+		tc.pkg = b.canonical(tc.pkg)
+	}
+	b.toolchain = tc
+	for _, rs := range r.Specs {
+		b.setArch(b.specs[rs.Spec.Package], rs.Arch)
+	}
+	if b.remote != nil {
+		warm := newWarmCache(defaultDaemonTTL)
+		for dir, names := range r.Listings {
+			warm.putList(b.remote.URL(), dir, names)
+		}
+		b.remote = &warmStore{Store: b.remote, warm: warm}
+	}
+	return nil
+}
+
+// resolveWithDaemon resolves the requested package with the daemon serving
+// the configuration of the builder, if any, or else resolves it.
+func (b *Builder) resolveWithDaemon() error {
+	sock := daemonSocket(b.cfg)
+	if b.cfg.noDaemon {
+		return b.resolve()
+	}
+	if _, err := os.Stat(sock); err != nil {
+		return b.resolve()
+	}
+	client, err := rpc.Dial("unix", sock)
+	if err != nil {
+		msg.Debugf("could not connect to daemon [%s]: %v\n", sock, err)
+		return b.resolve()
+	}
+	defer client.Close()
+
+	var reply ResolveReply
+	err = client.Call("Daemon.Resolve", ResolveArgs{Key: resolveKey(b.cfg), Package: b.pkgs[0]}, &reply)
+	switch {
+	case err != nil:
+		return err
+	case reply.Mismatch:
+		msg.Infof("daemon [%s] serves another configuration: resolving locally\n", sock)
+		return b.resolve()
+	}
+	msg.Debugf("resolved %s with daemon [%s]\n", b.pkgs[0], sock)
+	return b.restore(reply.Resolution)
+}
+
+// Daemon resolves the packages of a configuration, for the runs of the same
+// configuration, keeping the resolved graphs, the git refs of the sources
+// and the listings of the remote store warm.
+type Daemon struct {
+	cfg  Config
+	key  string
+	warm *warmCache
+
+	metrics *metrics // metrics of the resolutions, if exposed
+
+	mu     sync.Mutex
+	graphs map[string]*warmGraph // resolved graphs, by package
+}
+
+// warmGraph is a resolved graph of the daemon.
+type warmGraph struct {
+	recipes  string            // fingerprint of the recipes
+	devel    map[string]string // hashes of the development packages
+	resolved time.Time
+	res      Resolution
+}
+
+// Resolve resolves a package, or returns its cached resolution when its
+// recipes and development packages did not change, and it is recent enough.
+func (d *Daemon) Resolve(args ResolveArgs, reply *ResolveReply) error {
+	if args.Key != d.key {
+		reply.Mismatch = true
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	recipes, err := recipesFingerprint(d.cfg)
+	if err != nil {
+		return err
+	}
+	pkg := strings.ToLower(args.Package)
+	if g, ok := d.graphs[pkg]; ok && g.recipes == recipes && time.Since(g.resolved) < d.warm.ttl {
+		b := d.builder(args.Package)
+		if d.develUnchanged(b, g) {
+			msg.Debugf("serving cached resolution of %s\n", args.Package)
+			reply.Resolution = g.res
+			return nil
+		}
+	}
+
+	start := time.Now()
+	b := d.builder(args.Package)
+	ph := b.phase("", "resolve")
+	err = b.resolve()
+	ph.finish(err)
+	if err != nil {
+		return err
+	}
+	res := b.resolution()
+	d.listRemote(b, res.Listings)
+
+	g := &warmGraph{recipes: recipes, devel: make(map[string]string), resolved: start, res: res}
+	for _, p := range b.cfg.devel {
+		if spec, ok := b.specs[b.canonical(p)]; ok {
+			g.devel[spec.Package] = spec.CommitHash
+		}
+	}
+	d.graphs[pkg] = g
+	msg.Infof("resolved %s (%d packages) in %v\n", args.Package, len(b.order), time.Since(start).Round(time.Millisecond))
+	reply.Resolution = res
+	return nil
+}
+
+// builder returns a builder of the named package, sharing the warm caches of
+// the daemon.
+func (d *Daemon) builder(pkg string) *Builder {
+	cfg := d.cfg
+	cfg.pkgs = []string{pkg}
+	b := newBuilder(cfg)
+	b.warm = d.warm
+	b.metrics = d.metrics
+	if b.remote != nil {
+		b.remote = &warmStore{Store: b.remote, warm: d.warm}
+	}
+	return b
+}
+
+// develUnchanged reports whether the sources of the development packages of
+// a graph did not change since it was resolved.
+func (d *Daemon) develUnchanged(b *Builder, g *warmGraph) bool {
+	for pkg, hash := range g.devel {
+		h, err := b.develHash(&Spec{Spec: recipe.Spec{Package: pkg}})
+		if err != nil || h != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// listRemote lists the directories of the remote store holding the tarballs
+// of the resolved packages, and their links, into listings.
+func (d *Daemon) listRemote(b *Builder, listings map[string][]string) {
+	if b.remote == nil {
+		return
+	}
+	var dirs []string
+	for _, p := range b.order {
+		spec := b.specs[p]
+		dirs = append(dirs, spec.tar.storePath, spec.tar.linksPath)
+	}
+	names := make([][]string, len(dirs))
+	oks := make([]bool, len(dirs))
+	forEach(len(dirs), b.storeJobs(), func(i int) {
+		var err error
+		names[i], oks[i], err = b.remote.List(b.ctx, dirs[i])
+		oks[i] = oks[i] && err == nil
+	})
+	for i, dir := range dirs {
+		if oks[i] {
+			listings[dir] = names[i]
+		}
+	}
+}
+
+// recipesFingerprint returns the fingerprint of the recipes of a
+// configuration: the names, sizes and modification times of the files of
+// the configuration and override directories.
+func recipesFingerprint(cfg Config) (string, error) {
+	var vs []string
+	for _, dir := range []string{cfg.cfgdir, cfg.overrides} {
+		if dir == "" {
+			continue
+		}
+		err := filepath.Walk(dir, func(fname string, fi os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				return err
+			case fi.IsDir() && fi.Name() == ".git":
+				return filepath.SkipDir
+			case fi.IsDir():
+				return nil
+			}
+			vs = append(vs, fname, strconv.FormatInt(fi.Size(), 10), strconv.FormatInt(fi.ModTime().UnixNano(), 10))
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	// the commit of the recipes repository enters the hashes.
+	head, _ := ioutil.ReadFile(filepath.Join(cfg.cfgdir, ".git", "HEAD"))
+	return digest(append(vs, string(head))...), nil
+}
+
+// runDaemon serves the resolutions of the packages of a configuration on a
+// local socket, until interrupted.
+func runDaemon(cfg Config, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = defaultDaemonTTL
+	}
+	sock := daemonSocket(cfg)
+	if c, err := net.Dial("unix", sock); err == nil {
+		c.Close()
+		return fmt.Errorf("a daemon already serves [%s]", sock)
+	}
+	os.Remove(sock)
+	err := os.MkdirAll(filepath.Dir(sock), 0755)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	d := &Daemon{
+		cfg:    cfg,
+		key:    resolveKey(cfg),
+		warm:   newWarmCache(ttl),
+		graphs: make(map[string]*warmGraph),
+	}
+	if cfg.metricsAddr != "" {
+		d.metrics = newMetrics()
+		serveMetrics(d.metrics, cfg.metricsAddr)
+	}
+	srv := rpc.NewServer()
+	err = srv.RegisterName("Daemon", d)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		msg.Infof("received %v: stopping the daemon\n", sig)
+		l.Close()
+	}()
+
+	msg.Infof("serving the resolutions of [%s] on [%s]...\n", cfg.cfgdir, sock)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// warmCache caches the git refs of the sources, the updates of the reference
+// mirrors and the listings of the remote store, for ttl.
+type warmCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	refs    map[string]warmEntry // output of git ls-remote, by source
+	mirrors map[string]time.Time // last update of the reference mirrors
+	lists   map[string]warmEntry // listings of the remote store, by store and directory
+}
+
+type warmEntry struct {
+	at    time.Time
+	data  []byte
+	names []string
+}
+
+func newWarmCache(ttl time.Duration) *warmCache {
+	return &warmCache{
+		ttl:     ttl,
+		refs:    make(map[string]warmEntry),
+		mirrors: make(map[string]time.Time),
+		lists:   make(map[string]warmEntry),
+	}
+}
+
+// getRefs returns the cached refs of a git source, if any.
+func (w *warmCache) getRefs(source string) ([]byte, bool) {
+	if w == nil {
+		return nil, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.refs[source]
+	if !ok || time.Since(e.at) > w.ttl {
+		return nil, false
+	}
+	return e.data, true
+}
+
+func (w *warmCache) putRefs(source string, refs []byte) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.refs[source] = warmEntry{at: time.Now(), data: refs}
+}
+
+// mirrorFresh reports whether a reference mirror was updated recently, and
+// records its update otherwise.
+func (w *warmCache) mirrorFresh(mirror string) bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t, ok := w.mirrors[mirror]; ok && time.Since(t) < w.ttl {
+		return true
+	}
+	w.mirrors[mirror] = time.Now()
+	return false
+}
+
+func (w *warmCache) getList(store, dir string) ([]string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.lists[store+"\x00"+dir]
+	if !ok || time.Since(e.at) > w.ttl {
+		return nil, false
+	}
+	return e.names, true
+}
+
+func (w *warmCache) putList(store, dir string, names []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lists[store+"\x00"+dir] = warmEntry{at: time.Now(), names: names}
+}
+
+// warmStore caches the listings of a store.
+type warmStore struct {
+	store.Store
+	warm *warmCache
+}
+
+func (s *warmStore) List(ctx context.Context, dir string) ([]string, bool, error) {
+	if names, ok := s.warm.getList(s.URL(), dir); ok {
+		return names, true, nil
+	}
+	names, listed, err := s.Store.List(ctx, dir)
+	if err == nil && listed {
+		s.warm.putList(s.URL(), dir, names)
+	}
+	return names, listed, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+var debFormat = pkgFormat{
+	name:   "DEB",
+	dir:    "DEBS",
+	create: (*Builder).createDEB,
+}
+
+// debVersion returns a version string valid for Debian packages, which must
+// start with a digit.
+func debVersion(spec *Spec) string {
+	v := strings.Replace(spec.Version, "_", ".", -1)
+	if v == "" || !unicode.IsDigit(rune(v[0])) {
+		v = "0+" + v
+	}
+	return v + "-" + spec.Revision
+}
+
+// debArch returns the Debian architecture of a spec.
+func debArch(spec *Spec) string {
+	toks := strings.SplitN(baseArch(spec.arch), "_", 2)
+	cpu := toks[len(toks)-1]
+	switch cpu {
+	case "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "ppc64le":
+		return "ppc64el"
+	}
+	return cpu
+}
+
+// createDEB creates a Debian package holding the installed files of a spec.
+// Debian packages are not relocatable: the files are installed under the
+// installation prefix, and relocated there by the post-installation script.
+func (b *Builder) createDEB(spec *Spec, opts pkgOptions, outdir string) (string, error) {
+	top := filepath.Join(outdir, ".build", spec.Package)
+	err := os.RemoveAll(top)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(top)
+
+	path := pkgInstallPath(spec)
+	dst := filepath.Join(top, opts.prefix, path)
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = b.run("", "cp", "-a", b.installDir(spec), dst)
+	if err != nil {
+		return "", err
+	}
+
+	debian := filepath.Join(top, "DEBIAN")
+	err = os.MkdirAll(debian, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	var deps []string
+	for _, dep := range b.pkgDeps(spec) {
+		deps = append(deps, fmt.Sprintf("%s (= %s)", pkgName(dep), debVersion(dep)))
+	}
+
+	ctl := new(bytes.Buffer)
+	fmt.Fprintf(ctl, "Package: %s\n", pkgName(spec))
+	fmt.Fprintf(ctl, "Version: %s\n", debVersion(spec))
+	fmt.Fprintf(ctl, "Architecture: %s\n", debArch(spec))
+	fmt.Fprintf(ctl, "Maintainer: aligot <%s>\n", builderID())
+	if len(deps) > 0 {
+		fmt.Fprintf(ctl, "Depends: %s\n", strings.Join(deps, ", "))
+	}
+	fmt.Fprintf(ctl, "Description: %s %s built with aligot\n", spec.Package, spec.Version)
+	fmt.Fprintf(ctl, " hash %s.\n", spec.Hash)
+	err = ioutil.WriteFile(filepath.Join(debian, "control"), ctl.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	post := new(bytes.Buffer)
+	fmt.Fprintf(post, "#!/bin/sh\nset -e\nPREFIX=%q\n", opts.prefix)
+	fmt.Fprintf(post, "%s", b.relocScript(spec, "PREFIX"))
+	err = ioutil.WriteFile(filepath.Join(debian, "postinst"), post.Bytes(), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	fname := filepath.Join(outdir, fmt.Sprintf("%s_%s_%s.deb",
+		pkgName(spec), debVersion(spec), debArch(spec),
+	))
+	err = b.run("", "dpkg-deb", "--root-owner-group", "--build", top, fname)
+	if err != nil {
+		return "", err
+	}
+	return fname, nil
+}
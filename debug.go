@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// debugSuffix is the suffix of the name of the tarballs holding the debug
+// symbols of a package, before the extension of the compression.
+const debugSuffix = ".dbg"
+
+// debugTarball returns the file name of the tarball of the debug symbols of
+// a spec.
+func (b *Builder) debugTarball(spec *Spec) string {
+	name := b.tarball(spec)
+	ext := spec.tar.compression.Ext
+	return strings.TrimSuffix(name, ext) + debugSuffix + ext
+}
+
+// debugRoot returns the directory where the debug symbols of a spec are
+// extracted, before they are packed into their own tarball.
+func (b *Builder) debugRoot(spec *Spec) string {
+	return filepath.Join(
+		b.cfg.wdir, "INSTALLROOT", spec.Hash+debugSuffix,
+		spec.arch, spec.Package, spec.Version+"-"+spec.Revision,
+	)
+}
+
+// walkBinaries calls fn for each ELF or Mach-O file under dir.
+func walkBinaries(dir string, fn func(path string, macho bool) error) error {
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		magic := make([]byte, 4)
+		_, err = io.ReadFull(f, magic)
+		f.Close()
+		if err != nil {
+			// too small to be a binary.
+			return nil
+		}
+		switch {
+		case isELF(magic):
+			return fn(path, false)
+		case isMachO(magic):
+			return fn(path, true)
+		}
+		return nil
+	})
+}
+
+// splitDebug moves the debug symbols of the binaries installed by the recipe
+// of a spec into a companion tarball, stored next to the tarball of the spec.
+//
+// on linux, the debug symbols of bin/foo are moved to bin/.debug/foo.debug,
+// and bin/foo is linked to them with a .gnu_debuglink section, as expected by
+// gdb.
+// on macOS, the debug symbols of bin/foo are moved to the bin/foo.dSYM
+// bundle, as expected by lldb.
+// unpacking the companion tarball over the installed package thus makes the
+// debug symbols available to the debuggers.
+func (b *Builder) splitDebug(spec *Spec) error {
+	root := b.installRoot(spec)
+	dbg := b.debugRoot(spec)
+	err := os.RemoveAll(dbg)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	err = walkBinaries(root, func(path string, macho bool) error {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(rel, ".dSYM"+string(filepath.Separator)) {
+			return nil
+		}
+		dir := filepath.Join(dbg, filepath.Dir(rel))
+		switch {
+		case macho:
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				return err
+			}
+			err = b.run("", "dsymutil", path, "-o", filepath.Join(dbg, rel+".dSYM"))
+			if err != nil {
+				return err
+			}
+			err = b.run("", "strip", "-S", path)
+		default:
+			dir = filepath.Join(dir, ".debug")
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				return err
+			}
+			sym := filepath.Join(dir, filepath.Base(path)+".debug")
+			err = b.run("", "objcopy", "--only-keep-debug", path, sym)
+			if err != nil {
+				return err
+			}
+			err = b.run("", "objcopy", "--strip-debug", "--add-gnu-debuglink="+sym, path)
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+
+	msg.Debugf("split debug symbols of %d binaries of %s\n", n, spec.Package)
+	err = os.MkdirAll(spec.tar.hashDir, 0755)
+	if err != nil {
+		return err
+	}
+	return b.createTarball(
+		spec, filepath.Join(spec.tar.hashDir, b.debugTarball(spec)),
+		filepath.Join(b.cfg.wdir, "INSTALLROOT", spec.Hash+debugSuffix),
+	)
+}
+
+// installSymbols fetches, if needed, and unpacks the debug symbols of a spec
+// over its installation directory.
+// installSymbols reports whether the spec has debug symbols.
+func (b *Builder) installSymbols(spec *Spec) (bool, error) {
+	name := b.debugTarball(spec)
+	fname := filepath.Join(spec.tar.hashDir, name)
+	if !exists(fname) && b.cfg.remoteStore != "" {
+		_, err := b.fetchFile(spec, name)
+		if err != nil {
+			return false, err
+		}
+	}
+	if !exists(fname) {
+		return false, nil
+	}
+
+	err := b.verifyTarball(fname)
+	if err != nil {
+		return false, err
+	}
+	err = b.run(b.cfg.wdir, "tar", "xf", fname)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// objectsDir returns the directory of the content-addressed object store of a
+// work directory.
+func objectsDir(wdir string) string {
+	return filepath.Join(wdir, ".objects")
+}
+
+// dedupSkip lists the directories of a work directory which are not
+// deduplicated: their files are modified in place.
+var dedupSkip = map[string]bool{
+	".objects":    true,
+	"BUILD":       true,
+	"INSTALLROOT": true,
+	"MIRROR":      true,
+	"SOURCES":     true,
+	"SPECS":       true,
+}
+
+// dedupTree replaces the regular files under dir by hard links to the
+// identical files of the content-addressed object store under objs, adding
+// the missing ones to the object store.
+// files are only shared when they have the same content and the same
+// permissions.
+// dedupTree returns the number of bytes reclaimed.
+func dedupTree(objs, dir string) (int64, error) {
+	var saved int64
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() == 0 {
+			return err
+		}
+		sum, err := sha256File(hostFS{}, path)
+		if err != nil {
+			return err
+		}
+		obj := filepath.Join(objs, sum[:2], fmt.Sprintf("%s-%o", sum, fi.Mode().Perm()))
+		ofi, err := os.Stat(obj)
+		switch {
+		case os.IsNotExist(err):
+			err = os.MkdirAll(filepath.Dir(obj), 0755)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(path, obj); err != nil {
+				msg.Debugf("could not add [%s] to object store: %v\n", path, err)
+			}
+			return nil
+		case err != nil:
+			return err
+		case os.SameFile(fi, ofi):
+			return nil
+		}
+
+		tmp := path + ".dedup"
+		if err := os.Link(obj, tmp); err != nil {
+			// e.g. the object store is on another file system.
+			msg.Debugf("could not link [%s]: %v\n", path, err)
+			return nil
+		}
+		err = os.Rename(tmp, path)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		saved += fi.Size()
+		return nil
+	})
+	return saved, err
+}
+
+// dedupWorkDir re-links the identical files of the installed packages and of
+// the local store of a work directory, and removes the unused objects of its
+// object store.
+func dedupWorkDir(wdir string) error {
+	objs := objectsDir(wdir)
+	entries, err := ioutil.ReadDir(wdir)
+	if err != nil {
+		return err
+	}
+
+	var saved int64
+	for _, e := range entries {
+		if !e.IsDir() || dedupSkip[e.Name()] {
+			continue
+		}
+		n, err := dedupTree(objs, filepath.Join(wdir, e.Name()))
+		if err != nil {
+			return err
+		}
+		saved += n
+	}
+
+	// objects only linked from the object store are not used anymore.
+	var nobjs int
+	err = filepath.Walk(objs, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && uint64(st.Nlink) == 1 {
+			nobjs++
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	msg.Infof("reclaimed %s (%d unused objects removed)\n", humanBytes(saved), nobjs)
+	return nil
+}
+
+// linkFile hard links the file src to dst, replacing dst.
+// linkFile falls back to copying src when it can not be linked, e.g. across
+// file systems.
+func linkFile(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return run("", "cp", "-a", src, dst)
+}
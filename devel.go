@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// isDevel reports whether the named package is a development package.
+func (b *Builder) isDevel(pkg string) bool {
+	for _, p := range b.cfg.devel {
+		if strings.EqualFold(p, pkg) {
+			return true
+		}
+	}
+	return false
+}
+
+// develDir returns the source tree of the named development package: its
+// checkout in the current directory, under the name of the package.
+func develDir(pkg string) string {
+	dir, err := filepath.Abs(pkg)
+	if err != nil {
+		return pkg
+	}
+	return dir
+}
+
+// develHash returns the hash of the working tree of a development package:
+// the tracked files, and the diff of their uncommitted changes.
+// the hash only changes when the sources of the package do, so that an
+// unchanged development package is not rebuilt.
+func (b *Builder) develHash(spec *Spec) (string, error) {
+	dir := develDir(spec.Package)
+	if _, err := b.fs.Stat(dir); err != nil {
+		return "", fmt.Errorf("no source tree for development package %s in [%s]", spec.Package, dir)
+	}
+
+	hash := sha1.New()
+	for _, args := range [][]string{
+		{"ls-files", "--stage"},
+		{"diff", "--binary", "HEAD"},
+	} {
+		cmd := exec.CommandContext(b.ctx, "git", args...)
+		cmd.Dir = dir
+		out, err := output(b.exec, cmd)
+		if err != nil {
+			return "", fmt.Errorf("could not run 'git %s' in [%s]: %v",
+				strings.Join(args, " "), dir, err,
+			)
+		}
+		hash.Write(out)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// distCompilers are the supported distributed compilation tools, with the
+// name of their compiler wrapper.
+var distCompilers = map[string]string{
+	"distcc":   "distcc",
+	"icecream": "icecc",
+}
+
+// distributed reports whether the recipes compile on the local cluster.
+func (b *Builder) distributed() bool {
+	return b.cfg.distCC != ""
+}
+
+// distJobs returns the number of compile jobs of the recipes.
+func (b *Builder) distJobs() int {
+	if b.distributed() && b.cfg.distJobs > 0 {
+		return b.cfg.distJobs
+	}
+	return b.cfg.njobs
+}
+
+// exportDistCCEnv writes the shell commands configuring the distributed
+// compilation of the recipe of a spec.
+//
+// the compiler wrapper is run by the compiler cache when there is one, and
+// else is the launcher of the compilers of CMake builds.
+func (b *Builder) exportDistCCEnv(o io.Writer, spec *Spec) {
+	if !b.distributed() {
+		return
+	}
+	wrapper := distCompilers[b.cfg.distCC]
+	hosts := strings.Join(b.cfg.distHosts, " ")
+	switch b.cfg.distCC {
+	case "distcc":
+		if hosts != "" {
+			fmt.Fprintf(o, "export DISTCC_HOSTS=%q\n", hosts)
+		}
+	case "icecream":
+		if hosts != "" {
+			fmt.Fprintf(o, "export ICECC_SCHEDULER_HOST=%q\n", b.cfg.distHosts[0])
+		}
+	}
+	switch b.cfg.compilerCache {
+	case "ccache":
+		fmt.Fprintf(o, "export CCACHE_PREFIX=%q\n", wrapper)
+	case "sccache":
+		// sccache distributes compilations with its own scheduler.
+	default:
+		fmt.Fprintf(o, "export CMAKE_C_COMPILER_LAUNCHER=%q\n", wrapper)
+		fmt.Fprintf(o, "export CMAKE_CXX_COMPILER_LAUNCHER=%q\n", wrapper)
+	}
+	if b.cfg.jobserver == nil {
+		// the jobserver, when there is one, has the job slots.
+		fmt.Fprintf(o, "export MAKEFLAGS=\"-j%d${MAKEFLAGS:+ $MAKEFLAGS}\"\n", b.recipeJobs(spec))
+	}
+}
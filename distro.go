@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// distroInstallers are the commands installing packages, by distribution.
+var distroInstallers = map[string]string{
+	"alma":   "dnf install -y",
+	"fedora": "dnf install -y",
+	"ubuntu": "apt install -y",
+	"arch":   "pacman -S --needed",
+	"osx":    "brew install",
+}
+
+// distroIDs maps the IDs of os-release files, and the platforms of the
+// architectures, to the distributions of the package mappings.
+var distroIDs = map[string]string{
+	"alma":       "alma",
+	"almalinux":  "alma",
+	"centos":     "alma",
+	"rhel":       "alma",
+	"rocky":      "alma",
+	"scientific": "alma",
+	"slc":        "alma",
+	"fedora":     "fedora",
+	"ubuntu":     "ubuntu",
+	"debian":     "ubuntu",
+	"arch":       "arch",
+	"manjaro":    "arch",
+	"osx":        "osx",
+}
+
+// distroPackages are the packages of the distributions providing the common
+// system requirements, by lowercase requirement.
+// recipes may give their own with system_packages.
+var distroPackages = map[string]map[string][]string{
+	"autotools": {
+		"alma":   {"autoconf", "automake", "libtool", "make"},
+		"fedora": {"autoconf", "automake", "libtool", "make"},
+		"ubuntu": {"autoconf", "automake", "libtool", "make"},
+		"arch":   {"autoconf", "automake", "libtool", "make"},
+	},
+	"bz2": {
+		"alma":   {"bzip2-devel"},
+		"fedora": {"bzip2-devel"},
+		"ubuntu": {"libbz2-dev"},
+		"arch":   {"bzip2"},
+	},
+	"cmake": {
+		"alma":   {"cmake"},
+		"fedora": {"cmake"},
+		"ubuntu": {"cmake"},
+		"arch":   {"cmake"},
+	},
+	"curl": {
+		"alma":   {"libcurl-devel"},
+		"fedora": {"libcurl-devel"},
+		"ubuntu": {"libcurl4-openssl-dev"},
+		"arch":   {"curl"},
+	},
+	"flex": {
+		"alma":   {"flex"},
+		"fedora": {"flex"},
+		"ubuntu": {"flex"},
+		"arch":   {"flex"},
+	},
+	"freetype": {
+		"alma":   {"freetype-devel"},
+		"fedora": {"freetype-devel"},
+		"ubuntu": {"libfreetype-dev"},
+		"arch":   {"freetype2"},
+	},
+	"gcc-toolchain": {
+		"alma":   {"gcc", "gcc-c++", "gcc-gfortran"},
+		"fedora": {"gcc", "gcc-c++", "gcc-gfortran"},
+		"ubuntu": {"gcc", "g++", "gfortran"},
+		"arch":   {"gcc", "gcc-fortran"},
+	},
+	"git": {
+		"alma":   {"git"},
+		"fedora": {"git"},
+		"ubuntu": {"git"},
+		"arch":   {"git"},
+	},
+	"libffi": {
+		"alma":   {"libffi-devel"},
+		"fedora": {"libffi-devel"},
+		"ubuntu": {"libffi-dev"},
+		"arch":   {"libffi"},
+	},
+	"libpng": {
+		"alma":   {"libpng-devel"},
+		"fedora": {"libpng-devel"},
+		"ubuntu": {"libpng-dev"},
+		"arch":   {"libpng"},
+	},
+	"libxml2": {
+		"alma":   {"libxml2-devel"},
+		"fedora": {"libxml2-devel"},
+		"ubuntu": {"libxml2-dev"},
+		"arch":   {"libxml2"},
+	},
+	"lzma": {
+		"alma":   {"xz-devel"},
+		"fedora": {"xz-devel"},
+		"ubuntu": {"liblzma-dev"},
+		"arch":   {"xz"},
+	},
+	"ncurses": {
+		"alma":   {"ncurses-devel"},
+		"fedora": {"ncurses-devel"},
+		"ubuntu": {"libncurses-dev"},
+		"arch":   {"ncurses"},
+	},
+	"openssl": {
+		"alma":   {"openssl-devel"},
+		"fedora": {"openssl-devel"},
+		"ubuntu": {"libssl-dev"},
+		"arch":   {"openssl"},
+	},
+	"perl": {
+		"alma":   {"perl", "perl-ExtUtils-MakeMaker"},
+		"fedora": {"perl", "perl-ExtUtils-MakeMaker"},
+		"ubuntu": {"perl"},
+		"arch":   {"perl"},
+	},
+	"python": {
+		"alma":   {"python3-devel", "python3-pip"},
+		"fedora": {"python3-devel", "python3-pip"},
+		"ubuntu": {"python3-dev", "python3-pip", "python3-venv"},
+		"arch":   {"python", "python-pip"},
+	},
+	"readline": {
+		"alma":   {"readline-devel"},
+		"fedora": {"readline-devel"},
+		"ubuntu": {"libreadline-dev"},
+		"arch":   {"readline"},
+	},
+	"sqlite": {
+		"alma":   {"sqlite-devel"},
+		"fedora": {"sqlite-devel"},
+		"ubuntu": {"libsqlite3-dev"},
+		"arch":   {"sqlite"},
+	},
+	"x11": {
+		"alma":   {"libX11-devel", "libXpm-devel", "libXft-devel", "libXext-devel"},
+		"fedora": {"libX11-devel", "libXpm-devel", "libXft-devel", "libXext-devel"},
+		"ubuntu": {"libx11-dev", "libxpm-dev", "libxft-dev", "libxext-dev"},
+		"arch":   {"libx11", "libxpm", "libxft", "libxext"},
+	},
+	"zlib": {
+		"alma":   {"zlib-devel"},
+		"fedora": {"zlib-devel"},
+		"ubuntu": {"zlib1g-dev"},
+		"arch":   {"zlib"},
+	},
+}
+
+// distro returns the distribution the system requirements are installed on,
+// "" if unknown: the distribution of the host, or of the builder image when
+// building in docker.
+func (b *Builder) distro() string {
+	if isDarwin(b.cfg.hostArch) {
+		return "osx"
+	}
+	if b.cfg.docker == "" && runtime.GOOS == "linux" {
+		if rel, err := readOSRelease("/etc/os-release"); err == nil {
+			for _, id := range append([]string{rel["ID"]}, strings.Fields(rel["ID_LIKE"])...) {
+				if d, ok := distroIDs[id]; ok {
+					return d
+				}
+			}
+		}
+	}
+	if m := reArch.FindStringSubmatch(b.cfg.hostArch); m != nil {
+		return distroIDs[m[1]]
+	}
+	return ""
+}
+
+// distroPackagesOf returns the packages of a distribution providing a system
+// requirement, if known.
+func distroPackagesOf(spec *Spec, distro string) []string {
+	if distro == "osx" {
+		if len(spec.Homebrew) > 0 {
+			return spec.Homebrew
+		}
+		return []string{strings.ToLower(spec.Package)}
+	}
+	if pkgs, ok := spec.SystemPackages[distro]; ok {
+		return pkgs
+	}
+	return distroPackages[strings.ToLower(spec.Package)][distro]
+}
+
+// installHint returns the command installing the packages of the
+// distribution providing the missing system requirements, and the missing
+// requirements no package is known for.
+func installHint(res []sysResult, distro string) (string, []string) {
+	var (
+		pkgs    []string
+		unknown []string
+		seen    = make(map[string]bool)
+	)
+	for _, r := range res {
+		if r.OK {
+			continue
+		}
+		if len(r.DistroPackages) == 0 {
+			unknown = append(unknown, r.Package)
+			continue
+		}
+		for _, p := range r.DistroPackages {
+			if !seen[p] {
+				seen[p] = true
+				pkgs = append(pkgs, p)
+			}
+		}
+	}
+	installer, ok := distroInstallers[distro]
+	if !ok || len(pkgs) == 0 {
+		return "", unknown
+	}
+	if distro != "osx" && os.Geteuid() != 0 {
+		installer = "sudo " + installer
+	}
+	return fmt.Sprintf("%s %s", installer, strings.Join(pkgs, " ")), unknown
+}
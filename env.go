@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// hermeticPath is the PATH recipes start from in hermetic mode, unless
+// -hermetic-path pins the directories of the tools they may run.
+const hermeticPath = "/usr/local/bin:/usr/bin:/bin:/usr/local/sbin:/usr/sbin:/sbin"
+
+// hermeticKeep are the variables always kept from the user's environment in
+// hermetic mode.
+var hermeticKeep = []string{"HOME"}
+
+// searchPaths are the search paths the installed packages are prepended to,
+// with the directory of the packages they point to.
+var searchPaths = [][2]string{
+	{"PATH", "bin"},
+	{"LD_LIBRARY_PATH", "lib"},
+}
+
+// dedupPathFunc is the shell function removing the empty and the repeated
+// entries of a search path, keeping the first occurrence of each entry.
+// it is run in a subshell, and not traced in the build logs.
+const dedupPathFunc = `aligot_dedup_path() {
+	set +x -f
+	local IFS=: out= d
+	for d in $1; do
+		[ -n "$d" ] || continue
+		case ":$out:" in
+		*":$d:"*) ;;
+		*) out="${out:+$out:}$d" ;;
+		esac
+	done
+	printf '%s' "$out"
+}`
+
+// uniq returns the values of vs, without the repeated ones, keeping the
+// first occurrence of each value.
+func uniq(vs []string) []string {
+	seen := make(map[string]bool, len(vs))
+	o := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		o = append(o, v)
+	}
+	return o
+}
+
+// recipeEnviron returns the environment inherited by the recipes of a spec.
+//
+// in hermetic mode, recipes run in an empty environment, as under "env -i":
+// only HOME, a PATH to the pinned tools, and the variables of the allow-list
+// and of the keep_env of the spec are kept from the user's environment.
+// all the other variables are set by the build script itself.
+func (b *Builder) recipeEnviron(spec *Spec) []string {
+	if !b.cfg.hermetic {
+		return os.Environ()
+	}
+
+	path := b.cfg.hermeticPath
+	if path == "" {
+		path = hermeticPath
+	}
+	env := []string{"PATH=" + path}
+	keep := append(hermeticKeep[:len(hermeticKeep):len(hermeticKeep)], b.keepEnv(spec)...)
+	for _, k := range uniq(keep) {
+		v, ok := os.LookupEnv(k)
+		if !ok {
+			continue
+		}
+		if k == "PATH" {
+			env[0] = "PATH=" + v
+			continue
+		}
+		env = append(env, k+"="+v)
+	}
+	msg.Debugf("hermetic environment of %s: %s\n", spec.Package, strings.Join(env, " "))
+	return env
+}
+
+// keepEnv returns the variables of the allow-list kept from the user's
+// environment by the recipes of a spec, in hermetic mode: the ones of
+// -keep-env, and the ones of the keep_env of the spec.
+func (b *Builder) keepEnv(spec *Spec) []string {
+	keep := append([]string{}, b.cfg.keepEnv...)
+	return uniq(append(keep, spec.KeepEnv...))
+}
+
+// listFlag is a command line flag which may be given several times.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
+
+var reEnvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// readEnvFile reads the variables of a dotenv file, as KEY=VALUE entries
+// whose values are quoted for the build scripts: values are taken literally,
+// without expanding the variables they refer to.
+//
+// a line holds a KEY=VALUE assignment, optionally preceded by "export", a
+// comment starting with "#", or nothing.
+// single-quoted values are kept as is, double-quoted values may hold the
+// \n, \t, \" and \\ escapes, and unquoted values end at the first " #".
+func readEnvFile(fname string) ([]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	scan := bufio.NewScanner(f)
+	for n := 1; scan.Scan(); n++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: no KEY=VALUE assignment", fname, n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !reEnvKey.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: invalid variable name %q", fname, n, key)
+		}
+		val, err := envValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", fname, n, err)
+		}
+		env = append(env, key+"="+shellQuote(val))
+	}
+	return env, scan.Err()
+}
+
+// shellQuote quotes s for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// envValue returns the value of a dotenv assignment.
+func envValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "'"):
+		end := strings.Index(v[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single-quoted value")
+		}
+		return v[1 : end+1], trailing(v[end+2:])
+	case strings.HasPrefix(v, `"`):
+		var o strings.Builder
+		for i := 1; i < len(v); i++ {
+			switch c := v[i]; c {
+			case '"':
+				return o.String(), trailing(v[i+1:])
+			case '\\':
+				i++
+				if i == len(v) {
+					break
+				}
+				switch v[i] {
+				case 'n':
+					o.WriteByte('\n')
+				case 't':
+					o.WriteByte('\t')
+				default:
+					o.WriteByte(v[i])
+				}
+			default:
+				o.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double-quoted value")
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v), nil
+}
+
+// trailing checks the end of a line, after a quoted value, only holds a
+// comment.
+func trailing(s string) error {
+	if s = strings.TrimSpace(s); s != "" && !strings.HasPrefix(s, "#") {
+		return fmt.Errorf("unexpected %q after quoted value", s)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// exit statuses of aligot: wrapper scripts and CI jobs can tell the class of
+// a failure from them, without parsing the logs.
+const (
+	exitFailure     = 1   // any other failure
+	exitUsage       = 2   // invalid command line, or configuration file
+	exitResolve     = 3   // the recipes could not be resolved into a graph
+	exitFetch       = 4   // the sources of a package could not be fetched
+	exitBuild       = 5   // the recipe of a package failed
+	exitUpload      = 6   // a tarball could not be uploaded to the write store
+	exitTimedOut    = 124 // the run timed out (see -timeout)
+	exitInterrupted = 130 // the run was interrupted
+)
+
+// exitError is a failure of the class of its exit status.
+type exitError struct {
+	status int
+	err    error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// failure returns err as a failure of the class of status, unless it already
+// is of a class.
+func failure(status int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{status: statusOf(err, status), err: err}
+}
+
+// statusOf returns the exit status of the class of err, or def when err is
+// not of a class.
+func statusOf(err error, def int) int {
+	if err, ok := err.(*exitError); ok {
+		return err.status
+	}
+	switch err {
+	case errInterrupted:
+		return exitInterrupted
+	case errTimedOut:
+		return exitTimedOut
+	}
+	return def
+}
+
+// exit reports err, if any, and exits with the status of its class.
+func exit(err error) {
+	if err == nil {
+		return
+	}
+	msg.Errorf("%v\n", err)
+	os.Exit(statusOf(err, exitFailure))
+}
+
+// usagef reports an invalid command line, and exits with exitUsage.
+func usagef(format string, args ...interface{}) {
+	msg.Errorf(format, args...)
+	os.Exit(exitUsage)
+}
+
+// usage prints the usage of aligot, with its exit statuses.
+func usage() {
+	o := flag.CommandLine.Output()
+	fmt.Fprintf(o, "Usage: aligot [options] <action> <package>\n\noptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(o, `
+exit status:
+  0    success
+  %-4d failure
+  %-4d invalid command line, or configuration file
+  %-4d the recipes could not be resolved
+  %-4d the sources of a package could not be fetched
+  %-4d the recipe of a package failed
+  %-4d a tarball could not be uploaded to the write store
+  %-4d the run timed out
+  %-4d the run was interrupted
+`,
+		exitFailure, exitUsage, exitResolve, exitFetch, exitBuild,
+		exitUpload, exitTimedOut, exitInterrupted,
+	)
+}
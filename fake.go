@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeExecutor is an Executor recording the commands it is given, without
+// running any of them, for dry-runs and tests.
+//
+// commands succeed with an empty output, unless they have a canned output
+// or error, keyed by their command line, or are simulated by fn.
+type fakeExecutor struct {
+	mu   sync.Mutex
+	cmds []string              // command lines, in order
+	out  map[string]string     // standard output of commands
+	errs map[string]error      // errors of commands
+	fn   func(*exec.Cmd) error // simulates the commands without a canned output or error, if not nil
+
+	pending map[*exec.Cmd]error
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{
+		out:     make(map[string]string),
+		errs:    make(map[string]error),
+		pending: make(map[*exec.Cmd]error),
+	}
+}
+
+// cmdline returns the command line of cmd, prefixed by its directory.
+func cmdline(cmd *exec.Cmd) string {
+	line := strings.Join(cmd.Args, " ")
+	if cmd.Dir != "" {
+		line = "(cd " + cmd.Dir + " && " + line + ")"
+	}
+	return line
+}
+
+func (x *fakeExecutor) Start(cmd *exec.Cmd) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	line := strings.Join(cmd.Args, " ")
+	x.cmds = append(x.cmds, cmdline(cmd))
+	if out, ok := x.out[line]; ok && cmd.Stdout != nil {
+		io.WriteString(cmd.Stdout, out)
+	}
+	err, ok := x.errs[line]
+	if _, canned := x.out[line]; !ok && !canned && x.fn != nil {
+		err = x.fn(cmd)
+	}
+	x.pending[cmd] = err
+	return nil
+}
+
+func (x *fakeExecutor) Wait(cmd *exec.Cmd) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	err, ok := x.pending[cmd]
+	if !ok {
+		return fmt.Errorf("exec: %s not started", cmd.Args[0])
+	}
+	delete(x.pending, cmd)
+	return err
+}
+
+// commands returns the command lines run so far.
+func (x *fakeExecutor) commands() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return append([]string(nil), x.cmds...)
+}
+
+// memFS is an in-memory FS, for dry-runs and tests.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data  []byte
+	mode  os.FileMode
+	link  string // target of symbolic links
+	mtime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memFile{
+		"/": {mode: os.ModeDir | 0755},
+	}}
+}
+
+func (fs *memFS) clean(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// lookup returns the named file, following symbolic links.
+func (fs *memFS) lookup(name string) (string, *memFile, bool) {
+	name = fs.clean(name)
+	for i := 0; i < 16; i++ {
+		f, ok := fs.files[name]
+		if !ok || f.link == "" {
+			return name, f, ok
+		}
+		target := f.link
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		name = fs.clean(target)
+	}
+	return name, nil, false
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fname, f, ok := fs.lookup(name)
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memFileInfo{name: path.Base(fname), f: f}, nil
+}
+
+func (fs *memFS) ReadFile(name string) ([]byte, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_, f, ok := fs.lookup(name)
+	switch {
+	case !ok:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case f.mode.IsDir():
+		return nil, &os.PathError{Op: "read", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+func (fs *memFS) Open(name string) (io.ReadCloser, error) {
+	buf, err := fs.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (fs *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	dir, f, ok := fs.lookup(name)
+	switch {
+	case !ok:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !f.mode.IsDir():
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	var fis []os.FileInfo
+	for fname, f := range fs.files {
+		if fname != dir && path.Dir(fname) == dir {
+			fis = append(fis, memFileInfo{name: path.Base(fname), f: f})
+		}
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+func (fs *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.write(name, data, perm)
+}
+
+func (fs *memFS) write(name string, data []byte, perm os.FileMode) error {
+	fname, f, ok := fs.lookup(name)
+	if ok && f.mode.IsDir() {
+		return &os.PathError{Op: "open", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	if dir, ok := fs.files[path.Dir(fname)]; !ok || !dir.mode.IsDir() {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	fs.files[fname] = &memFile{
+		data:  append([]byte(nil), data...),
+		mode:  perm,
+		mtime: time.Now(),
+	}
+	return nil
+}
+
+func (fs *memFS) Create(name string) (io.WriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err := fs.write(name, nil, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &memWriter{fs: fs, name: name}, nil
+}
+
+func (fs *memFS) MkdirAll(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = fs.clean(name)
+	var parts []string
+	for dir := name; dir != "/"; dir = path.Dir(dir) {
+		parts = append(parts, dir)
+	}
+	for i := len(parts) - 1; i >= 0; i-- {
+		dir := parts[i]
+		if f, ok := fs.files[dir]; ok {
+			if !f.mode.IsDir() && f.link == "" {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: fmt.Errorf("not a directory")}
+			}
+			continue
+		}
+		fs.files[dir] = &memFile{mode: os.ModeDir | perm, mtime: time.Now()}
+	}
+	return nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = fs.clean(name)
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for fname := range fs.files {
+		if strings.HasPrefix(fname, name+"/") {
+			return &os.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+		}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *memFS) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = fs.clean(name)
+	for fname := range fs.files {
+		if fname == name || strings.HasPrefix(fname, name+"/") {
+			delete(fs.files, fname)
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	src, dst := fs.clean(oldpath), fs.clean(newpath)
+	f, ok := fs.files[src]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if dir, ok := fs.files[path.Dir(dst)]; !ok || !dir.mode.IsDir() {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	for fname, f := range fs.files {
+		if strings.HasPrefix(fname, src+"/") {
+			delete(fs.files, fname)
+			fs.files[dst+strings.TrimPrefix(fname, src)] = f
+		}
+	}
+	delete(fs.files, src)
+	fs.files[dst] = f
+	return nil
+}
+
+func (fs *memFS) Symlink(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name := fs.clean(newname)
+	if _, ok := fs.files[name]; ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	fs.files[name] = &memFile{mode: os.ModeSymlink | 0777, link: oldname, mtime: time.Now()}
+	return nil
+}
+
+func (fs *memFS) Readlink(name string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[fs.clean(name)]
+	if !ok || f.link == "" {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: fmt.Errorf("invalid argument")}
+	}
+	return f.link, nil
+}
+
+// names returns the names of all the files and directories of fs.
+func (fs *memFS) names() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	names := make([]string, 0, len(fs.files))
+	for name := range fs.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memWriter writes a file of a memFS when it is closed.
+type memWriter struct {
+	bytes.Buffer
+	fs   *memFS
+	name string
+}
+
+func (w *memWriter) Close() error {
+	return w.fs.WriteFile(w.name, w.Bytes(), 0666)
+}
+
+type memFileInfo struct {
+	name string
+	f    *memFile
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.f.data)) }
+func (fi memFileInfo) Mode() os.FileMode  { return fi.f.mode }
+func (fi memFileInfo) ModTime() time.Time { return fi.f.mtime }
+func (fi memFileInfo) IsDir() bool        { return fi.f.mode.IsDir() }
+func (fi memFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fallbackRecord records that the tarball of a package was taken from a
+// compatible architecture.
+type fallbackRecord struct {
+	Package  string    `json:"package"`
+	Version  string    `json:"version"`
+	Hash     string    `json:"hash"`
+	Arch     string    `json:"arch"`     // architecture the package was requested for
+	Fallback string    `json:"fallback"` // architecture of the reused tarball
+	Store    string    `json:"store"`
+	Time     time.Time `json:"time"`
+}
+
+// archCandidates returns the architectures whose tarballs a spec may use:
+// its own, then the compatible ones of the configured fallbacks.
+func (b *Builder) archCandidates(spec *Spec) []string {
+	return append([]string{spec.arch}, b.cfg.archFallbacks[spec.arch]...)
+}
+
+// fallbackFile returns the file recording the architecture fallback of a
+// spec, in the local store of its native architecture.
+func (b *Builder) fallbackFile(spec *Spec, native string) string {
+	return filepath.Join(b.cfg.wdir, "TARS", native, "fallbacks", spec.Package+"-"+spec.Hash+".json")
+}
+
+// recordFallback records, in the local store, that the tarball of a spec
+// built for the native architecture is taken from its current architecture.
+func (b *Builder) recordFallback(spec *Spec, native string) error {
+	msg.Infof("using %s tarball of %s@%s for %s (architecture fallback)\n",
+		spec.arch, spec.Package, spec.Version, native,
+	)
+	buf, err := json.MarshalIndent(fallbackRecord{
+		Package:  spec.Package,
+		Version:  spec.Version,
+		Hash:     spec.Hash,
+		Arch:     native,
+		Fallback: spec.arch,
+		Store:    b.cfg.remoteStore,
+		Time:     time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fname := b.fallbackFile(spec, native)
+	err = os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, buf, 0644)
+}
@@ -0,0 +1,746 @@
+// Protocol of the aligot build farm: the workers join a coordinator, which
+// dispatches them the builds of the packages of its dependency graphs.
+//
+// the requests of the workers hold the token of the farm, as an
+// "authorization: Bearer <token>" metadata.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v5.28.3
+// source: farm.proto
+
+package farmpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Job is the build of a package, dispatched by the coordinator to a worker.
+type Job struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Arch          string                 `protobuf:"bytes,2,opt,name=arch,proto3" json:"arch,omitempty"` // architecture the package is built for
+	Package       string                 `protobuf:"bytes,3,opt,name=package,proto3" json:"package,omitempty"`
+	Defaults      string                 `protobuf:"bytes,4,opt,name=defaults,proto3" json:"defaults,omitempty"`
+	Hash          string                 `protobuf:"bytes,5,opt,name=hash,proto3" json:"hash,omitempty"`                            // hash of the package, as resolved by the coordinator
+	Store         string                 `protobuf:"bytes,6,opt,name=store,proto3" json:"store,omitempty"`                          // store the worker fetches the dependencies from, and uploads the package to
+	Toolchain     string                 `protobuf:"bytes,7,opt,name=toolchain,proto3" json:"toolchain,omitempty"`                  // toolchain the package is built with
+	BuildType     string                 `protobuf:"bytes,8,opt,name=build_type,json=buildType,proto3" json:"build_type,omitempty"` // build type the package is built with
+	Sanitizers    []string               `protobuf:"bytes,9,rep,name=sanitizers,proto3" json:"sanitizers,omitempty"`                // sanitizers the package is built with
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Job) Reset() {
+	*x = Job{}
+	mi := &file_farm_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Job) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Job) ProtoMessage() {}
+
+func (x *Job) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Job.ProtoReflect.Descriptor instead.
+func (*Job) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Job) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Job) GetArch() string {
+	if x != nil {
+		return x.Arch
+	}
+	return ""
+}
+
+func (x *Job) GetPackage() string {
+	if x != nil {
+		return x.Package
+	}
+	return ""
+}
+
+func (x *Job) GetDefaults() string {
+	if x != nil {
+		return x.Defaults
+	}
+	return ""
+}
+
+func (x *Job) GetHash() string {
+	if x != nil {
+		return x.Hash
+	}
+	return ""
+}
+
+func (x *Job) GetStore() string {
+	if x != nil {
+		return x.Store
+	}
+	return ""
+}
+
+func (x *Job) GetToolchain() string {
+	if x != nil {
+		return x.Toolchain
+	}
+	return ""
+}
+
+func (x *Job) GetBuildType() string {
+	if x != nil {
+		return x.BuildType
+	}
+	return ""
+}
+
+func (x *Job) GetSanitizers() []string {
+	if x != nil {
+		return x.Sanitizers
+	}
+	return nil
+}
+
+// RegisterRequest describes a worker joining the build farm.
+type RegisterRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Host          string                 `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	Arch          string                 `protobuf:"bytes,2,opt,name=arch,proto3" json:"arch,omitempty"`          // architecture the worker builds for
+	Capacity      int32                  `protobuf:"varint,3,opt,name=capacity,proto3" json:"capacity,omitempty"` // maximum number of concurrent jobs of the worker
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterRequest) Reset() {
+	*x = RegisterRequest{}
+	mi := &file_farm_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterRequest) ProtoMessage() {}
+
+func (x *RegisterRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterRequest.ProtoReflect.Descriptor instead.
+func (*RegisterRequest) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *RegisterRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetArch() string {
+	if x != nil {
+		return x.Arch
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetCapacity() int32 {
+	if x != nil {
+		return x.Capacity
+	}
+	return 0
+}
+
+// RegisterReply is the reply of the coordinator to a joining worker.
+type RegisterReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId      int32                  `protobuf:"varint,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	HeartbeatMs   int64                  `protobuf:"varint,2,opt,name=heartbeat_ms,json=heartbeatMs,proto3" json:"heartbeat_ms,omitempty"` // interval between the heartbeats of the worker, in milliseconds
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterReply) Reset() {
+	*x = RegisterReply{}
+	mi := &file_farm_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterReply) ProtoMessage() {}
+
+func (x *RegisterReply) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterReply.ProtoReflect.Descriptor instead.
+func (*RegisterReply) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RegisterReply) GetWorkerId() int32 {
+	if x != nil {
+		return x.WorkerId
+	}
+	return 0
+}
+
+func (x *RegisterReply) GetHeartbeatMs() int64 {
+	if x != nil {
+		return x.HeartbeatMs
+	}
+	return 0
+}
+
+// HeartbeatRequest reports that a worker is alive.
+type HeartbeatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId      int32                  `protobuf:"varint,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeartbeatRequest) Reset() {
+	*x = HeartbeatRequest{}
+	mi := &file_farm_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeartbeatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeartbeatRequest) ProtoMessage() {}
+
+func (x *HeartbeatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeartbeatRequest.ProtoReflect.Descriptor instead.
+func (*HeartbeatRequest) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *HeartbeatRequest) GetWorkerId() int32 {
+	if x != nil {
+		return x.WorkerId
+	}
+	return 0
+}
+
+type HeartbeatReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *HeartbeatReply) Reset() {
+	*x = HeartbeatReply{}
+	mi := &file_farm_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HeartbeatReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HeartbeatReply) ProtoMessage() {}
+
+func (x *HeartbeatReply) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HeartbeatReply.ProtoReflect.Descriptor instead.
+func (*HeartbeatReply) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{4}
+}
+
+// NextRequest is a request for a job.
+type NextRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId      int32                  `protobuf:"varint,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NextRequest) Reset() {
+	*x = NextRequest{}
+	mi := &file_farm_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NextRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NextRequest) ProtoMessage() {}
+
+func (x *NextRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NextRequest.ProtoReflect.Descriptor instead.
+func (*NextRequest) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *NextRequest) GetWorkerId() int32 {
+	if x != nil {
+		return x.WorkerId
+	}
+	return 0
+}
+
+// NextReply is the reply of the coordinator to a request for a job.
+type NextReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Job           *Job                   `protobuf:"bytes,1,opt,name=job,proto3" json:"job,omitempty"`    // job dispatched to the worker, if any
+	Exit          bool                   `protobuf:"varint,2,opt,name=exit,proto3" json:"exit,omitempty"` // whether the coordinator is done
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *NextReply) Reset() {
+	*x = NextReply{}
+	mi := &file_farm_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NextReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NextReply) ProtoMessage() {}
+
+func (x *NextReply) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NextReply.ProtoReflect.Descriptor instead.
+func (*NextReply) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *NextReply) GetJob() *Job {
+	if x != nil {
+		return x.Job
+	}
+	return nil
+}
+
+func (x *NextReply) GetExit() bool {
+	if x != nil {
+		return x.Exit
+	}
+	return false
+}
+
+// LogRequest holds a chunk of the build log of a job.
+type LogRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId      int32                  `protobuf:"varint,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	JobId         int32                  `protobuf:"varint,2,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Data          []byte                 `protobuf:"bytes,3,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogRequest) Reset() {
+	*x = LogRequest{}
+	mi := &file_farm_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogRequest) ProtoMessage() {}
+
+func (x *LogRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogRequest.ProtoReflect.Descriptor instead.
+func (*LogRequest) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *LogRequest) GetWorkerId() int32 {
+	if x != nil {
+		return x.WorkerId
+	}
+	return 0
+}
+
+func (x *LogRequest) GetJobId() int32 {
+	if x != nil {
+		return x.JobId
+	}
+	return 0
+}
+
+func (x *LogRequest) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type LogReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogReply) Reset() {
+	*x = LogReply{}
+	mi := &file_farm_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogReply) ProtoMessage() {}
+
+func (x *LogReply) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogReply.ProtoReflect.Descriptor instead.
+func (*LogReply) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{8}
+}
+
+// DoneRequest reports the outcome of a job.
+type DoneRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	WorkerId      int32                  `protobuf:"varint,1,opt,name=worker_id,json=workerId,proto3" json:"worker_id,omitempty"`
+	JobId         int32                  `protobuf:"varint,2,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	Error         string                 `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"` // error message, if the build failed
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DoneRequest) Reset() {
+	*x = DoneRequest{}
+	mi := &file_farm_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DoneRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DoneRequest) ProtoMessage() {}
+
+func (x *DoneRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DoneRequest.ProtoReflect.Descriptor instead.
+func (*DoneRequest) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *DoneRequest) GetWorkerId() int32 {
+	if x != nil {
+		return x.WorkerId
+	}
+	return 0
+}
+
+func (x *DoneRequest) GetJobId() int32 {
+	if x != nil {
+		return x.JobId
+	}
+	return 0
+}
+
+func (x *DoneRequest) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type DoneReply struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DoneReply) Reset() {
+	*x = DoneReply{}
+	mi := &file_farm_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DoneReply) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DoneReply) ProtoMessage() {}
+
+func (x *DoneReply) ProtoReflect() protoreflect.Message {
+	mi := &file_farm_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DoneReply.ProtoReflect.Descriptor instead.
+func (*DoneReply) Descriptor() ([]byte, []int) {
+	return file_farm_proto_rawDescGZIP(), []int{10}
+}
+
+var File_farm_proto protoreflect.FileDescriptor
+
+const file_farm_proto_rawDesc = "" +
+	"\n" +
+	"\n" +
+	"farm.proto\x12\valigot.farm\"\xe6\x01\n" +
+	"\x03Job\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x12\n" +
+	"\x04arch\x18\x02 \x01(\tR\x04arch\x12\x18\n" +
+	"\apackage\x18\x03 \x01(\tR\apackage\x12\x1a\n" +
+	"\bdefaults\x18\x04 \x01(\tR\bdefaults\x12\x12\n" +
+	"\x04hash\x18\x05 \x01(\tR\x04hash\x12\x14\n" +
+	"\x05store\x18\x06 \x01(\tR\x05store\x12\x1c\n" +
+	"\ttoolchain\x18\a \x01(\tR\ttoolchain\x12\x1d\n" +
+	"\n" +
+	"build_type\x18\b \x01(\tR\tbuildType\x12\x1e\n" +
+	"\n" +
+	"sanitizers\x18\t \x03(\tR\n" +
+	"sanitizers\"U\n" +
+	"\x0fRegisterRequest\x12\x12\n" +
+	"\x04host\x18\x01 \x01(\tR\x04host\x12\x12\n" +
+	"\x04arch\x18\x02 \x01(\tR\x04arch\x12\x1a\n" +
+	"\bcapacity\x18\x03 \x01(\x05R\bcapacity\"O\n" +
+	"\rRegisterReply\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\x05R\bworkerId\x12!\n" +
+	"\fheartbeat_ms\x18\x02 \x01(\x03R\vheartbeatMs\"/\n" +
+	"\x10HeartbeatRequest\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\x05R\bworkerId\"\x10\n" +
+	"\x0eHeartbeatReply\"*\n" +
+	"\vNextRequest\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\x05R\bworkerId\"C\n" +
+	"\tNextReply\x12\"\n" +
+	"\x03job\x18\x01 \x01(\v2\x10.aligot.farm.JobR\x03job\x12\x12\n" +
+	"\x04exit\x18\x02 \x01(\bR\x04exit\"T\n" +
+	"\n" +
+	"LogRequest\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\x05R\bworkerId\x12\x15\n" +
+	"\x06job_id\x18\x02 \x01(\x05R\x05jobId\x12\x12\n" +
+	"\x04data\x18\x03 \x01(\fR\x04data\"\n" +
+	"\n" +
+	"\bLogReply\"W\n" +
+	"\vDoneRequest\x12\x1b\n" +
+	"\tworker_id\x18\x01 \x01(\x05R\bworkerId\x12\x15\n" +
+	"\x06job_id\x18\x02 \x01(\x05R\x05jobId\x12\x14\n" +
+	"\x05error\x18\x03 \x01(\tR\x05error\"\v\n" +
+	"\tDoneReply2\xc7\x02\n" +
+	"\vCoordinator\x12D\n" +
+	"\bRegister\x12\x1c.aligot.farm.RegisterRequest\x1a\x1a.aligot.farm.RegisterReply\x12G\n" +
+	"\tHeartbeat\x12\x1d.aligot.farm.HeartbeatRequest\x1a\x1b.aligot.farm.HeartbeatReply\x128\n" +
+	"\x04Next\x12\x18.aligot.farm.NextRequest\x1a\x16.aligot.farm.NextReply\x125\n" +
+	"\x03Log\x12\x17.aligot.farm.LogRequest\x1a\x15.aligot.farm.LogReply\x128\n" +
+	"\x04Done\x12\x18.aligot.farm.DoneRequest\x1a\x16.aligot.farm.DoneReplyB!Z\x1fgithub.com/sbinet/aligot/farmpbb\x06proto3"
+
+var (
+	file_farm_proto_rawDescOnce sync.Once
+	file_farm_proto_rawDescData []byte
+)
+
+func file_farm_proto_rawDescGZIP() []byte {
+	file_farm_proto_rawDescOnce.Do(func() {
+		file_farm_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_farm_proto_rawDesc), len(file_farm_proto_rawDesc)))
+	})
+	return file_farm_proto_rawDescData
+}
+
+var file_farm_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_farm_proto_goTypes = []any{
+	(*Job)(nil),              // 0: aligot.farm.Job
+	(*RegisterRequest)(nil),  // 1: aligot.farm.RegisterRequest
+	(*RegisterReply)(nil),    // 2: aligot.farm.RegisterReply
+	(*HeartbeatRequest)(nil), // 3: aligot.farm.HeartbeatRequest
+	(*HeartbeatReply)(nil),   // 4: aligot.farm.HeartbeatReply
+	(*NextRequest)(nil),      // 5: aligot.farm.NextRequest
+	(*NextReply)(nil),        // 6: aligot.farm.NextReply
+	(*LogRequest)(nil),       // 7: aligot.farm.LogRequest
+	(*LogReply)(nil),         // 8: aligot.farm.LogReply
+	(*DoneRequest)(nil),      // 9: aligot.farm.DoneRequest
+	(*DoneReply)(nil),        // 10: aligot.farm.DoneReply
+}
+var file_farm_proto_depIdxs = []int32{
+	0,  // 0: aligot.farm.NextReply.job:type_name -> aligot.farm.Job
+	1,  // 1: aligot.farm.Coordinator.Register:input_type -> aligot.farm.RegisterRequest
+	3,  // 2: aligot.farm.Coordinator.Heartbeat:input_type -> aligot.farm.HeartbeatRequest
+	5,  // 3: aligot.farm.Coordinator.Next:input_type -> aligot.farm.NextRequest
+	7,  // 4: aligot.farm.Coordinator.Log:input_type -> aligot.farm.LogRequest
+	9,  // 5: aligot.farm.Coordinator.Done:input_type -> aligot.farm.DoneRequest
+	2,  // 6: aligot.farm.Coordinator.Register:output_type -> aligot.farm.RegisterReply
+	4,  // 7: aligot.farm.Coordinator.Heartbeat:output_type -> aligot.farm.HeartbeatReply
+	6,  // 8: aligot.farm.Coordinator.Next:output_type -> aligot.farm.NextReply
+	8,  // 9: aligot.farm.Coordinator.Log:output_type -> aligot.farm.LogReply
+	10, // 10: aligot.farm.Coordinator.Done:output_type -> aligot.farm.DoneReply
+	6,  // [6:11] is the sub-list for method output_type
+	1,  // [1:6] is the sub-list for method input_type
+	1,  // [1:1] is the sub-list for extension type_name
+	1,  // [1:1] is the sub-list for extension extendee
+	0,  // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_farm_proto_init() }
+func file_farm_proto_init() {
+	if File_farm_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_farm_proto_rawDesc), len(file_farm_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_farm_proto_goTypes,
+		DependencyIndexes: file_farm_proto_depIdxs,
+		MessageInfos:      file_farm_proto_msgTypes,
+	}.Build()
+	File_farm_proto = out.File
+	file_farm_proto_goTypes = nil
+	file_farm_proto_depIdxs = nil
+}
@@ -0,0 +1,5 @@
+// Package farmpb holds the protocol buffers and gRPC service of the aligot
+// build farm.
+package farmpb // import "github.com/sbinet/aligot/farmpb"
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative farm.proto
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// gridVO is the virtual organization packages are registered under.
+const gridVO = "VO_ALICE"
+
+// GridPackage describes the registration of a package with the grid package
+// manager.
+type GridPackage struct {
+	Name         string   `json:"name"` // e.g. VO_ALICE@ROOT::v6-08-06-1
+	Package      string   `json:"package"`
+	Version      string   `json:"version"`
+	Platform     string   `json:"platform"`
+	Hash         string   `json:"hash"`
+	Dependencies []string `json:"dependencies"`
+	Tarball      string   `json:"tarball"`
+	SHA256       string   `json:"sha256"`
+}
+
+// gridName returns the grid package name of a spec.
+func gridName(spec *Spec) string {
+	return fmt.Sprintf("%s@%s::%s-%s", gridVO, spec.Package, spec.Version, spec.Revision)
+}
+
+// publishGrid registers the tarball of a spec, as uploaded to the write store,
+// with the grid package manager.
+// packages already registered are not an error.
+func (b *Builder) publishGrid(spec *Spec) error {
+	if b.cfg.gridURL == "" || b.cfg.writeStore == "" {
+		return nil
+	}
+
+	name := b.tarball(spec)
+	sum, err := sha256File(hostFS{}, filepath.Join(spec.tar.hashDir, name))
+	if err != nil {
+		return err
+	}
+
+	pkg := GridPackage{
+		Name:         gridName(spec),
+		Package:      spec.Package,
+		Version:      spec.Version + "-" + spec.Revision,
+		Platform:     spec.arch,
+		Hash:         spec.Hash,
+		Dependencies: []string{},
+		Tarball:      b.cfg.writeStore + "/" + filepath.ToSlash(filepath.Join(spec.tar.storePath, name)),
+		SHA256:       sum,
+	}
+	for _, dep := range b.pkgDeps(spec) {
+		pkg.Dependencies = append(pkg.Dependencies, gridName(dep))
+	}
+
+	buf, err := json.Marshal(pkg)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.gridClient()
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(b.cfg.gridURL, "/") + "/packages"
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		msg.Infof("%s already registered with the grid\n", pkg.Name)
+		return nil
+	case resp.StatusCode/100 == 2:
+		msg.Infof("registered %s with the grid [%s]\n", pkg.Name, b.cfg.gridURL)
+		return nil
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("could not register %s: %s\n%s", pkg.Name, resp.Status, body)
+}
+
+// gridClient returns the HTTP client used to talk to the grid package
+// manager, authenticated with the grid certificate if one is configured.
+func (b *Builder) gridClient() (*http.Client, error) {
+	if b.cfg.gridCert == "" {
+		return http.DefaultClient, nil
+	}
+
+	key := b.cfg.gridKey
+	if key == "" {
+		key = b.cfg.gridCert
+	}
+	cert, err := tls.LoadX509KeyPair(b.cfg.gridCert, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not load grid certificate: %v", err)
+	}
+	tlscfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if b.cfg.gridCA != "" {
+		pem, err := ioutil.ReadFile(b.cfg.gridCA)
+		if err != nil {
+			return nil, err
+		}
+		tlscfg.RootCAs = x509.NewCertPool()
+		if !tlscfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in [%s]", b.cfg.gridCA)
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlscfg},
+	}, nil
+}
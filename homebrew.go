@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// brewPaths are the default locations of brew, on Apple silicon and on Intel
+// macs.
+var brewPaths = []string{"/opt/homebrew/bin/brew", "/usr/local/bin/brew"}
+
+// homebrew is the Homebrew installation of a macOS host.
+type homebrew struct {
+	prefix   string            // e.g. /opt/homebrew
+	formulae map[string]string // versions of the installed formulae, by name
+}
+
+// homebrew returns the Homebrew installation of the host, or nil when the
+// host is not a mac or Homebrew is not installed.
+// Homebrew is only detected once.
+func (b *Builder) homebrew() *homebrew {
+	if !isDarwin(b.cfg.hostArch) {
+		return nil
+	}
+	b.brewOnce.Do(func() {
+		prefix := os.Getenv("HOMEBREW_PREFIX")
+		if prefix == "" {
+			brew, err := exec.LookPath("brew")
+			if err != nil {
+				for _, p := range brewPaths {
+					if exists(p) {
+						brew = p
+						break
+					}
+				}
+			}
+			if brew == "" {
+				msg.Debugf("Homebrew not found\n")
+				return
+			}
+			out, err := output(b.exec, exec.CommandContext(b.ctx, brew, "--prefix"))
+			if err != nil {
+				msg.Warnf("could not get the prefix of Homebrew [%s]: %v\n", brew, err)
+				return
+			}
+			prefix = strings.TrimSpace(string(out))
+		}
+		brew, err := readHomebrew(prefix)
+		if err != nil {
+			msg.Warnf("could not read the Homebrew installation [%s]: %v\n", prefix, err)
+			return
+		}
+		msg.Debugf("Homebrew found in [%s]: %d formulae\n", brew.prefix, len(brew.formulae))
+		b.brew = brew
+	})
+	return b.brew
+}
+
+// readHomebrew reads the formulae installed in a Homebrew prefix: each one
+// is linked from <prefix>/opt/<formula>, keg-only ones included, to its
+// installed version in the cellar.
+func readHomebrew(prefix string) (*homebrew, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(prefix, "opt"))
+	if err != nil {
+		return nil, err
+	}
+	brew := &homebrew{prefix: prefix, formulae: make(map[string]string, len(fis))}
+	for _, fi := range fis {
+		dst, err := os.Readlink(filepath.Join(prefix, "opt", fi.Name()))
+		if err != nil {
+			continue
+		}
+		brew.formulae[fi.Name()] = filepath.Base(dst)
+	}
+	return brew, nil
+}
+
+// optDir returns the installation prefix of a formula.
+func (brew *homebrew) optDir(formula string) string {
+	return filepath.Join(brew.prefix, "opt", formula)
+}
+
+// brewFormulae returns the Homebrew formulae providing a system requirement:
+// the formulae of its recipe, or else the formula named after the package,
+// when installed.
+func (brew *homebrew) brewFormulae(spec *Spec) []string {
+	if len(spec.Homebrew) > 0 {
+		return spec.Homebrew
+	}
+	if name := strings.ToLower(spec.Package); brew.formulae[name] != "" {
+		return []string{name}
+	}
+	return nil
+}
+
+// probeHomebrew looks for an installed Homebrew formula.
+func (brew *homebrew) probeHomebrew(formula string) sysProbe {
+	probe := sysProbe{Kind: "homebrew", Module: formula}
+	version, ok := brew.formulae[formula]
+	if !ok {
+		probe.Error = fmt.Sprintf("not installed (brew install %s)", formula)
+		return probe
+	}
+	probe.Found = true
+	probe.Version = version
+	return probe
+}
+
+// homebrewEnv returns the environment of the probes of a system requirement
+// provided by the Homebrew formulae of prefixes: keg-only formulae are not
+// in the default search paths of pkg-config and CMake.
+func homebrewEnv(prefixes []string) []string {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	env := os.Environ()
+	for _, v := range brewSearchPaths {
+		var dirs []string
+		for _, p := range prefixes {
+			dirs = append(dirs, filepath.Join(p, v[1]))
+		}
+		if old := os.Getenv(v[0]); old != "" {
+			dirs = append(dirs, old)
+		}
+		env = append(env, v[0]+"="+strings.Join(dirs, ":"))
+	}
+	return env
+}
+
+// brewSearchPaths are the search paths the prefixes of Homebrew formulae are
+// prepended to.
+var brewSearchPaths = [][2]string{
+	{"PATH", "bin"},
+	{"PKG_CONFIG_PATH", "lib/pkgconfig"},
+	{"CMAKE_PREFIX_PATH", ""},
+}
+
+// exportHomebrewEnv writes the shell commands pointing the build of a spec
+// at the Homebrew formulae providing its system requirements: their
+// <PACKAGE>_ROOT is the prefix of their first formula.
+func (b *Builder) exportHomebrewEnv(o io.Writer, spec *Spec) {
+	dirs := make([][]string, len(brewSearchPaths))
+	for _, dep := range b.buildEnvRequires(spec) {
+		r, ok := b.system[dep]
+		if !ok || len(r.Prefixes) == 0 {
+			continue
+		}
+		fmt.Fprintf(o, "export %s_ROOT=%q\n", envName(dep), r.Prefixes[0])
+		for i, v := range brewSearchPaths {
+			for _, p := range r.Prefixes {
+				dirs[i] = append(dirs[i], filepath.Join(p, v[1]))
+			}
+		}
+	}
+	for i, v := range brewSearchPaths {
+		if len(dirs[i]) == 0 {
+			continue
+		}
+		fmt.Fprintf(o, "export %[1]s=\"%[2]s${%[1]s:+:$%[1]s}\"\n", v[0], strings.Join(uniq(dirs[i]), ":"))
+	}
+}
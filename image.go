@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociDescriptor is an OCI content descriptor.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// image assembles an OCI image layout holding the runtime closure of the
+// named package, with its runtime environment.
+//
+// the tarballs of the local store are reused as image layers: packages are
+// thus installed under /<arch>/<package>/<version>-<revision> in the image.
+// an additional layer holds the relocated version of the files which
+// hard-code the paths of the work directory.
+func (b *Builder) image(pkg, tag string) (string, error) {
+	spec, ok := b.specs[pkg]
+	if !ok {
+		return "", fmt.Errorf("no such package %q", pkg)
+	}
+	if isDarwin(spec.arch) {
+		return "", fmt.Errorf("no OCI image for architecture %q", spec.arch)
+	}
+	if tag == "" {
+		tag = strings.ToLower(spec.Package) + ":" + spec.Version + "-" + spec.Revision
+	}
+
+	dir := filepath.Join(b.cfg.wdir, "IMAGES", fmt.Sprintf("%s-%s-%s.%s",
+		spec.Package, spec.Version, spec.Revision, spec.arch,
+	))
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	err = os.MkdirAll(blobs, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		layers  []ociDescriptor
+		diffIDs []string
+		env     []string
+		paths   []string
+		libs    []string
+		reloc   = new(bytes.Buffer)
+	)
+	closure := b.runtimeClosure(pkg)
+	for _, p := range closure {
+		dep := b.specs[p]
+		tarball := filepath.Join(dep.tar.hashDir, b.tarball(dep))
+		desc, diffID, err := ociAddLayer(b.exec, blobs, tarball, dep.tar.compression)
+		if err != nil {
+			return "", fmt.Errorf("could not add layer for %s: %v", p, err)
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, diffID)
+
+		root := "/" + pkgInstallPath(dep)
+		env = append(env,
+			envName(dep.Package)+"_ROOT="+root,
+			envName(dep.Package)+"_VERSION="+dep.Version,
+		)
+		paths = append([]string{root + "/bin"}, paths...)
+		libs = append([]string{root + "/lib"}, libs...)
+	}
+	env = append(env,
+		"PATH="+strings.Join(append(paths, "/usr/local/bin:/usr/bin:/bin"), ":"),
+		"LD_LIBRARY_PATH="+strings.Join(libs, ":"),
+	)
+
+	err = b.relocLayer(reloc, closure)
+	if err != nil {
+		return "", fmt.Errorf("could not create relocation layer: %v", err)
+	}
+	fname := filepath.Join(dir, "reloc.tar.gz")
+	err = ioutil.WriteFile(fname, reloc.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+	gz, _ := compressionByName("gzip")
+	desc, diffID, err := ociAddLayer(b.exec, blobs, fname, gz)
+	os.Remove(fname)
+	if err != nil {
+		return "", err
+	}
+	layers = append(layers, desc)
+	diffIDs = append(diffIDs, diffID)
+
+	cfg := map[string]interface{}{
+		"architecture": ociArch(spec.arch),
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Env": env,
+			"Labels": map[string]string{
+				"org.alice.aligot.package": spec.Package,
+				"org.alice.aligot.version": spec.Version,
+				"org.alice.aligot.hash":    spec.Hash,
+			},
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIDs,
+		},
+	}
+	cdesc, err := ociAddJSON(blobs, "application/vnd.oci.image.config.v1+json", cfg)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        cdesc,
+		"layers":        layers,
+	}
+	mdesc, err := ociAddJSON(blobs, "application/vnd.oci.image.manifest.v1+json", manifest)
+	if err != nil {
+		return "", err
+	}
+	mdesc.Annotations = map[string]string{"org.opencontainers.image.ref.name": tag}
+
+	for _, v := range []struct {
+		name string
+		data interface{}
+	}{
+		{"oci-layout", map[string]string{"imageLayoutVersion": "1.0.0"}},
+		{"index.json", map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests":     []ociDescriptor{mdesc},
+		}},
+	} {
+		buf, err := json.Marshal(v.data)
+		if err != nil {
+			return "", err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, v.name), buf, 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+// ociArch returns the OCI (GOARCH-like) name of the CPU of an architecture.
+func ociArch(arch string) string {
+	toks := strings.SplitN(baseArch(arch), "_", 2)
+	switch cpu := toks[len(toks)-1]; cpu {
+	case "x86-64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	default:
+		return cpu
+	}
+}
+
+// relocLayer writes into w a gzipped tar layer holding the text files of the
+// installed packages which reference the work directory, with these
+// references rewritten to the root of the image.
+func (b *Builder) relocLayer(w io.Writer, pkgs []string) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	old := []byte(b.cfg.wdir + "/")
+
+	for _, p := range pkgs {
+		spec := b.specs[p]
+		top := b.cfg.wdir
+		err := filepath.Walk(b.installDir(spec), func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if !bytes.Contains(buf, old) || bytes.IndexByte(buf, 0) >= 0 {
+				return nil
+			}
+			buf = bytes.Replace(buf, old, []byte("/"), -1)
+			rel, err := filepath.Rel(top, path)
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = rel
+			hdr.Size = int64(len(buf))
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(buf)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ociAddLayer adds the named tarball as a layer blob, and returns its
+// descriptor and its diff-id.
+func ociAddLayer(x Executor, blobs, fname string, c Compression) (ociDescriptor, string, error) {
+	var desc ociDescriptor
+	diffID, err := uncompressedDigest(x, fname, c)
+	if err != nil {
+		return desc, "", err
+	}
+
+	sum, err := sha256File(hostFS{}, fname)
+	if err != nil {
+		return desc, "", err
+	}
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return desc, "", err
+	}
+
+	err = linkFile(fname, filepath.Join(blobs, sum))
+	if err != nil {
+		return desc, "", err
+	}
+
+	desc = ociDescriptor{
+		MediaType: c.MediaType,
+		Digest:    "sha256:" + sum,
+		Size:      fi.Size(),
+	}
+	return desc, "sha256:" + diffID, nil
+}
+
+// ociAddJSON adds the JSON encoding of v as a blob of the given media type.
+func ociAddJSON(blobs, mediaType string, v interface{}) (ociDescriptor, error) {
+	var desc ociDescriptor
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return desc, err
+	}
+	sum := sha256.Sum256(buf)
+	digest := hex.EncodeToString(sum[:])
+	err = ioutil.WriteFile(filepath.Join(blobs, digest), buf, 0644)
+	if err != nil {
+		return desc, err
+	}
+	desc = ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + digest,
+		Size:      int64(len(buf)),
+	}
+	return desc, nil
+}
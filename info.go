@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// info writes the resolved spec of the named package to w: its requirements
+// after architecture filtering and defaults, its environment and sources,
+// its hash and where its tarball lives in the stores.
+func (b *Builder) info(w io.Writer, pkg string) error {
+	spec, ok := b.specs[pkg]
+	if !ok {
+		return fmt.Errorf("unknown package %q", pkg)
+	}
+	spec.Revision = b.revision(spec)
+	b.locate(spec)
+
+	list := func(vs []string) string {
+		if len(vs) == 0 {
+			return "-"
+		}
+		return strings.Join(vs, ", ")
+	}
+	orNone := func(v string) string {
+		if v == "" {
+			return "-"
+		}
+		return v
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, kv := range [][2]string{
+		{"package", spec.Package},
+		{"version", spec.Version},
+		{"revision", spec.Revision},
+		{"arch", spec.arch},
+		{"defaults", b.cfg.defaults},
+		{"hash", spec.Hash},
+		{"source", orNone(spec.Source)},
+		{"tag", orNone(spec.Tag)},
+		{"commit", orNone(spec.CommitHash)},
+		{"license", orNone(spec.License)},
+		{"extends", orNone(spec.Extends)},
+		{"include", list(spec.Include)},
+		{"sources", list(archiveNames(spec))},
+		{"patches", list(patchNames(spec))},
+		{"requires", list(spec.RuntimeRequires)},
+		{"build_requires", list(spec.BuildRequires)},
+		{"full_runtime_requires", list(spec.FullRuntimeRequires)},
+		{"full_build_requires", list(spec.FullBuildRequires)},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", kv[0], kv[1])
+	}
+
+	keys := make([]string, 0, len(spec.Env))
+	for k := range spec.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		fmt.Fprintf(tw, "env:\t-\n")
+	}
+	for i, k := range keys {
+		key := ""
+		if i == 0 {
+			key = "env:"
+		}
+		fmt.Fprintf(tw, "%s\t%s=%s\n", key, k, spec.Env[k])
+	}
+	fmt.Fprintf(tw, "unset:\t%s\n", list(spec.Unset))
+	fmt.Fprintf(tw, "keep env:\t%s\n", list(spec.KeepEnv))
+
+	tarball := filepath.Join(spec.tar.storePath, b.tarball(spec))
+	where := "not built"
+	switch {
+	case b.locate(spec):
+		where = "local store"
+	case b.inRemote(spec):
+		where = "remote store"
+	}
+	for _, kv := range [][2]string{
+		{"tarball", tarball},
+		{"local", filepath.Join(b.cfg.wdir, tarball)},
+		{"available", where},
+		{"install", b.installDir(spec)},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", kv[0], kv[1])
+	}
+	if b.cfg.remoteStore != "" {
+		fmt.Fprintf(tw, "remote:\t%s\n", strings.TrimSuffix(b.cfg.remoteStore, "/")+"/"+filepath.ToSlash(tarball))
+	}
+	return tw.Flush()
+}
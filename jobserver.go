@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// jobserver is a GNU make jobserver shared by all the recipes run by aligot,
+// so the total number of compile jobs on the host respects a single limit.
+//
+// the jobserver is a named pipe holding the job tokens: native builds get it
+// as inherited file descriptors, and docker builds through its path, which
+// needs GNU make >= 4.4.
+// recipes running make with an explicit -jN opt out of the jobserver.
+type jobserver struct {
+	fifo string   // path of the named pipe
+	r, w *os.File // read and write ends of the named pipe
+	n    int      // number of job slots
+}
+
+// newJobserver creates a jobserver with n job slots, under dir.
+func newJobserver(dir string, n int) (*jobserver, error) {
+	if n < 1 {
+		n = 1
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	fifo := filepath.Join(dir, fmt.Sprintf(".jobserver-%d", os.Getpid()))
+	os.Remove(fifo)
+	err = syscall.Mkfifo(fifo, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not create jobserver fifo [%s]: %v", fifo, err)
+	}
+
+	// opening both ends read-write does not block, and keeps the tokens in
+	// the pipe for the lifetime of aligot.
+	r, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	w, err := os.OpenFile(fifo, os.O_RDWR, 0)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	// each make holds an implicit job slot.
+	_, err = w.Write(bytes.Repeat([]byte("+"), n-1))
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	return &jobserver{fifo: fifo, r: r, w: w, n: n}, nil
+}
+
+// Close releases the jobserver.
+func (js *jobserver) Close() error {
+	js.r.Close()
+	js.w.Close()
+	return os.Remove(js.fifo)
+}
+
+// files returns the file descriptors of the jobserver passed to native
+// builds, as descriptors 3 and 4.
+func (js *jobserver) files() []*os.File {
+	return []*os.File{js.r, js.w}
+}
+
+// exportJobserverEnv writes the shell commands making the recipe of a spec
+// a client of the jobserver.
+func (b *Builder) exportJobserverEnv(o io.Writer, spec *Spec) {
+	js := b.cfg.jobserver
+	if js == nil {
+		return
+	}
+	auth := "--jobserver-auth=3,4 --jobserver-fds=3,4"
+	if b.cfg.docker != "" {
+		auth = "--jobserver-auth=fifo:" + js.fifo
+	}
+	fmt.Fprintf(o, "export MAKEFLAGS=\"-j%d %s${MAKEFLAGS:+ $MAKEFLAGS}\"\n", js.n, auth)
+}
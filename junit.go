@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// junitSuites is the root of a JUnit XML report.
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string       `xml:"name,attr"`
+	Classname string       `xml:"classname,attr"`
+	Time      string       `xml:"time,attr"`
+	Failure   *junitResult `xml:"failure,omitempty"`
+	Error     *junitResult `xml:"error,omitempty"`
+	Skipped   *junitResult `xml:"skipped,omitempty"`
+	SystemOut string       `xml:"system-out,omitempty"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",cdata"`
+}
+
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// writeJUnit writes the JUnit XML report of the run into the configured
+// file: the build of each package is a test case, and so are the tests of
+// each package, when they were run.
+func (b *Builder) writeJUnit(start time.Time) error {
+	var report junitSuites
+
+	builds := junitSuite{
+		Name:      "aligot.build." + b.pkgs[0],
+		Timestamp: start.UTC().Format("2006-01-02T15:04:05"),
+		Time:      junitTime(time.Since(start)),
+	}
+	for _, p := range b.order {
+		spec := b.specs[p]
+		tc := junitCase{
+			Name:      fmt.Sprintf("%s@%s", spec.Package, spec.Version),
+			Classname: "aligot.build." + spec.arch,
+			Time:      junitTime(b.took[p]),
+		}
+		log := filepath.Join(b.logDir(spec), "log")
+		switch st := b.status[p]; st {
+		case statusBuilt:
+			tc.SystemOut = fmt.Sprintf("built %s (see log [%s])", spec.Hash, log)
+		case statusCached, statusShared:
+			tc.SystemOut = fmt.Sprintf("%s already built (%s)", spec.Hash, st)
+		case statusFailed:
+			text := logExcerpt(log, logExcerptLines)
+			tc.Failure = &junitResult{Message: fmt.Sprintf("%v", b.buildErr), Text: text}
+			builds.Failures++
+		case statusStopped:
+			tc.Error = &junitResult{Message: "build interrupted"}
+			builds.Errors++
+		case statusPruned:
+			tc.Skipped = &junitResult{Message: "not needed: its dependents are available from the stores"}
+			builds.Skipped++
+		default:
+			tc.Skipped = &junitResult{Message: "not built"}
+			builds.Skipped++
+		}
+		builds.Cases = append(builds.Cases, tc)
+	}
+	builds.Tests = len(builds.Cases)
+	report.Suites = append(report.Suites, builds)
+
+	if b.tests != nil {
+		tests := junitSuite{
+			Name:      "aligot.test." + b.pkgs[0],
+			Timestamp: builds.Timestamp,
+		}
+		var total time.Duration
+		for _, r := range b.tests {
+			tc := junitCase{
+				Name:      fmt.Sprintf("%s@%s", r.spec.Package, r.spec.Version),
+				Classname: "aligot.test." + r.spec.arch,
+				Time:      junitTime(r.duration),
+			}
+			if r.err != nil {
+				tc.Failure = &junitResult{Message: r.err.Error(), Text: logExcerpt(r.log, logExcerptLines)}
+				tests.Failures++
+			}
+			total += r.duration
+			tests.Cases = append(tests.Cases, tc)
+		}
+		tests.Tests = len(tests.Cases)
+		tests.Time = junitTime(total)
+		report.Suites = append(report.Suites, tests)
+	}
+
+	buf, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append([]byte(xml.Header), append(buf, '\n')...)
+	fname := b.cfg.junit
+	err = b.fs.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	return b.fs.WriteFile(fname, buf, 0644)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// usesLFS reports whether the checkout in dir stores files in Git LFS: one
+// of its .gitattributes files declares the lfs filter.
+func usesLFS(dir string) bool {
+	err := filepath.Walk(dir, func(fname string, fi os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case fi.IsDir() && fi.Name() == ".git":
+			return filepath.SkipDir
+		case fi.Name() != ".gitattributes":
+			return nil
+		}
+		buf, err := ioutil.ReadFile(fname)
+		if err == nil && bytes.Contains(buf, []byte("filter=lfs")) {
+			return errLFS
+		}
+		return nil
+	})
+	return err == errLFS
+}
+
+var errLFS = errors.New("lfs filter found")
+
+// checkLFS returns an error if git-lfs is not installed.
+func (b *Builder) checkLFS(spec *Spec) error {
+	err := b.run("", "git", "lfs", "version")
+	if err != nil {
+		return fmt.Errorf("sources of %s use Git LFS, which is not installed: %v", spec.Package, err)
+	}
+	return nil
+}
+
+// checkoutLFS fetches and checks out the Git LFS objects of the sources of a
+// spec in dir, if they use any.
+// the objects are first fetched from the reference mirror, when there is
+// one, and those it lacks from the repository of the sources.
+func (b *Builder) checkoutLFS(spec *Spec, dir string, env []string) error {
+	if !usesLFS(dir) {
+		return nil
+	}
+	err := b.checkLFS(spec)
+	if err != nil {
+		return err
+	}
+	msg.Debugf("fetching Git LFS objects of %s...\n", spec.Package)
+	mirror := b.mirrorDir(spec)
+	if _, err := b.fs.Stat(mirror); err == nil {
+		err = b.run(dir, "git", "lfs", "fetch", "file://"+mirror, spec.Tag)
+		if err != nil {
+			// the mirror may not hold all the objects: they are fetched
+			// from the repository below.
+			msg.Debugf("could not fetch Git LFS objects of %s from mirror [%s]: %v\n", spec.Package, mirror, err)
+		}
+	}
+	err = runWithEnv(b.ctx, b.exec, dir, env, "git", "lfs", "fetch", "origin", spec.Tag)
+	if err != nil {
+		return err
+	}
+	return b.run(dir, "git", "lfs", "checkout")
+}
+
+// lfsIdentity returns the identity of the Git LFS objects of the sources of a
+// spec at their tag, "" if they use none: the hash of their paths and object
+// IDs.
+// sources are only checked out by the build, after they have been hashed:
+// the objects are listed from the reference mirror, up to date with
+// -fetch-mirrors, and only when it holds the tag. otherwise, the commit of
+// the sources, holding the LFS pointers, identifies them.
+func (b *Builder) lfsIdentity(spec *Spec) (string, error) {
+	if spec.Source == "" || schemePlugin(spec.Source) != "" {
+		return "", nil
+	}
+	mirror := b.mirrorDir(spec)
+	if _, err := b.fs.Stat(mirror); err != nil {
+		return "", nil
+	}
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(b.ctx, "git", args...)
+		cmd.Dir = mirror
+		return output(b.exec, cmd)
+	}
+	rev := spec.Tag + "^{commit}"
+	if _, err := git("rev-parse", "-q", "--verify", rev); err != nil {
+		return "", nil
+	}
+	files, err := git("ls-tree", "-r", "--name-only", rev)
+	if err != nil {
+		return "", fmt.Errorf("could not list sources of %s in mirror [%s]: %v", spec.Package, mirror, err)
+	}
+	lfs := false
+	scan := bufio.NewScanner(bytes.NewReader(files))
+	for scan.Scan() && !lfs {
+		fname := scan.Text()
+		if path.Base(fname) != ".gitattributes" {
+			continue
+		}
+		buf, err := git("show", spec.Tag+":"+fname)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s of %s in mirror [%s]: %v", fname, spec.Package, mirror, err)
+		}
+		lfs = bytes.Contains(buf, []byte("filter=lfs"))
+	}
+	if !lfs {
+		return "", nil
+	}
+	err = b.checkLFS(spec)
+	if err != nil {
+		return "", err
+	}
+	out, err := git("lfs", "ls-files", "--long", spec.Tag)
+	if err != nil {
+		return "", fmt.Errorf("could not list Git LFS objects of %s in mirror [%s]: %v", spec.Package, mirror, err)
+	}
+	sum := sha1.Sum(out)
+	return hex.EncodeToString(sum[:]), nil
+}
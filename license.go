@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// licenseFiles is the list of file names (in lower case) which are inspected
+// to detect the license of a package from its sources.
+var licenseFiles = []string{
+	"license",
+	"license.txt",
+	"license.md",
+	"licence",
+	"licence.txt",
+	"copying",
+	"copying.txt",
+	"copying.lesser",
+	"copyright",
+}
+
+// licenseMarkers associates a snippet of a license text with its SPDX
+// identifier.
+// markers are tried in order (more specific ones come first) and are
+// matched against the license text with all whitespace collapsed.
+var licenseMarkers = []struct {
+	text string
+	spdx string
+}{
+	{"GNU LESSER GENERAL PUBLIC LICENSE Version 3", "LGPL-3.0"},
+	{"GNU LESSER GENERAL PUBLIC LICENSE", "LGPL-2.1"},
+	{"GNU LIBRARY GENERAL PUBLIC LICENSE", "LGPL-2.0"},
+	{"GNU AFFERO GENERAL PUBLIC LICENSE", "AGPL-3.0"},
+	{"GNU GENERAL PUBLIC LICENSE Version 3", "GPL-3.0"},
+	{"GNU GENERAL PUBLIC LICENSE", "GPL-2.0"},
+	{"Apache License Version 2.0", "Apache-2.0"},
+	{"Apache License, Version 2.0", "Apache-2.0"},
+	{"Mozilla Public License Version 2.0", "MPL-2.0"},
+	{"Boost Software License - Version 1.0", "BSL-1.0"},
+	{"Permission is hereby granted, free of charge", "MIT"},
+	{"Neither the name", "BSD-3-Clause"},
+	{"Redistribution and use in source and binary forms", "BSD-2-Clause"},
+}
+
+// License describes the license of a package, as declared by its recipe
+// and as detected from its sources.
+type License struct {
+	Package  string
+	Version  string
+	Declared string // license declared in the recipe
+	Detected string // license detected from the sources
+	File     string // file from which the license was detected
+}
+
+// Unknown returns whether no license could be associated with the package.
+func (lic License) Unknown() bool {
+	return lic.Declared == "" && lic.Detected == ""
+}
+
+// Conflict returns whether the declared and detected licenses disagree.
+//
+// licenses are compared by SPDX identifier: only the -only and -or-later
+// variants of a license, e.g. "GPL-3.0-or-later", agree with the license
+// detected from its text ("GPL-3.0").
+func (lic License) Conflict() bool {
+	if lic.Declared == "" || lic.Detected == "" {
+		return false
+	}
+	return spdxBase(lic.Declared) != spdxBase(lic.Detected)
+}
+
+// spdxBase returns the SPDX identifier of a license, in lower case, without
+// its -only or -or-later suffix.
+func spdxBase(id string) string {
+	id = strings.ToLower(strings.TrimSpace(id))
+	for _, suffix := range []string{"-only", "-or-later"} {
+		id = strings.TrimSuffix(id, suffix)
+	}
+	return id
+}
+
+// licenses writes a consolidated license report for the whole build closure
+// of the requested packages.
+func (b *Builder) licenses(w io.Writer) error {
+	var (
+		lics []License
+		bad  []string
+	)
+	for _, p := range b.order {
+		spec := b.specs[p]
+		lic := License{
+			Package:  spec.Package,
+			Version:  spec.Version,
+			Declared: spec.License,
+		}
+		lic.Detected, lic.File = detectLicense(b.sourceDir(spec))
+		lics = append(lics, lic)
+	}
+
+	sort.Slice(lics, func(i, j int) bool {
+		return lics[i].Package < lics[j].Package
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PACKAGE\tVERSION\tDECLARED\tDETECTED\tSTATUS\n")
+	for _, lic := range lics {
+		status := "ok"
+		switch {
+		case lic.Unknown():
+			status = "UNKNOWN"
+			bad = append(bad, lic.Package)
+		case lic.Conflict():
+			status = "CONFLICT"
+			bad = append(bad, lic.Package)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			lic.Package, lic.Version,
+			orNone(lic.Declared), orNone(lic.Detected),
+			status,
+		)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if len(bad) > 0 {
+		msg.Warnf("%d package(s) with unknown or conflicting licenses: %v\n",
+			len(bad), bad,
+		)
+	}
+	return nil
+}
+
+// detectLicense inspects the top-level license files of a source directory
+// and returns the SPDX identifier of the first recognized license, together
+// with the name of the file it was found in.
+// detectLicense returns empty strings if the sources are not available or
+// if no license could be recognized.
+func detectLicense(dir string) (string, string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", ""
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !isLicenseFile(fi.Name()) {
+			continue
+		}
+		fname := filepath.Join(dir, fi.Name())
+		buf, err := ioutil.ReadFile(fname)
+		if err != nil {
+			msg.Debugf("could not read license file [%s]: %v\n", fname, err)
+			continue
+		}
+		buf = bytes.Join(bytes.Fields(buf), []byte(" "))
+		for _, m := range licenseMarkers {
+			if bytes.Contains(buf, []byte(m.text)) {
+				return m.spdx, fname
+			}
+		}
+	}
+	return "", ""
+}
+
+func isLicenseFile(name string) bool {
+	name = strings.ToLower(name)
+	for _, v := range licenseFiles {
+		if name == v {
+			return true
+		}
+	}
+	return false
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestLicenseConflict(t *testing.T) {
+	for _, tc := range []struct {
+		declared string
+		detected string
+		want     bool
+	}{
+		{"", "MIT", false},
+		{"MIT", "", false},
+		{"MIT", "MIT", false},
+		{"mit", "MIT", false},
+		{"GPL-3.0-or-later", "GPL-3.0", false},
+		{"GPL-3.0-only", "GPL-3.0", false},
+		{"LGPL-2.1-only", "LGPL-2.1", false},
+		{"GPL-2.0", "GPL-3.0", true},
+		{"GPL-2.0-or-later", "GPL-3.0", true},
+		{"MIT-0", "MIT", true},
+		{"MITX", "MIT", true},
+		{"GPL-2.01", "GPL-2.0", true},
+		{"GPL", "GPL-2.0", true},
+		{"LGPL-2.1", "GPL-2.0", true},
+		{"BSD-3-Clause-LBNL", "BSD-3-Clause", true},
+		{"Apache-2.0 WITH LLVM-exception", "Apache-2.0", true},
+	} {
+		lic := License{Declared: tc.declared, Detected: tc.detected}
+		if got := lic.Conflict(); got != tc.want {
+			t.Errorf("invalid conflict of %q with %q: got=%v, want=%v", tc.declared, tc.detected, got, tc.want)
+		}
+	}
+}
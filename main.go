@@ -3,20 +3,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gonuts/logger"
-	"gopkg.in/yaml.v2"
+	"github.com/sbinet/aligot/recipe"
+	"github.com/sbinet/aligot/resolve"
+	"github.com/sbinet/aligot/store"
 )
 
 var (
@@ -28,80 +32,287 @@ var (
 )
 
 type Config struct {
-	action      string
-	pkgs        []string
-	cfgdir      string
-	devel       []string
-	docker      string
-	wdir        string
-	arch        string
-	env         []string
-	volumes     []string
-	njobs       int
-	refsrc      string
-	remoteStore string
-	writeStore  string
-	disable     map[string]struct{}
-	defaults    string
-	debug       bool
+	action        string
+	pkgs          []string
+	cfgdir        string
+	configRef     string // revision of the recipes pinned with -config-ref
+	overrides     string // directory of recipes shadowing those of cfgdir
+	devel         []string
+	docker        string
+	wdir          string
+	arch          string
+	hostArch      string
+	crossPrefix   string
+	sysroot       string
+	env           []string
+	volumes       []string
+	dedup         bool // hard link the identical files of installed packages
+	njobs         int
+	refsrc        string
+	fetchMirrors  bool   // create and update the reference mirrors of the git sources
+	daemonSock    string // socket of the daemon resolving the packages (default: <wdir>/daemon.sock)
+	noDaemon      bool   // resolve the packages without the daemon
+	srcCache      string // cache of the downloaded source archives, if not in the work directory
+	history       string // history of the runs, compared by benchmark (default: <wdir>/history.jsonl)
+	otlpEndpoint  string // OpenTelemetry collector the spans of the run are exported to
+	metricsAddr   string // address of the /metrics endpoint of the run, if any
+	noProgress    bool   // print plain logs, rather than the progress board, on terminals
+	remoteStore   string
+	writeStore    string
+	compression   string   // compression of the created tarballs
+	splitDebug    bool     // split debug symbols into companion tarballs
+	strip         bool     // strip binaries before packing them
+	cleanup       bool     // remove the build trees of the packages once installed
+	buildDir      string   // scratch directory of the builds, if not the work directory
+	buildType     string   // build type of the target packages (Release, Debug, RelWithDebInfo)
+	sanitizers    []string // sanitizers the target packages are built with
+	toolchain     string   // toolchain (system, gccNN, clangNN) the packages are built with
+	compilerCache string   // compiler cache (ccache, sccache) the recipes use, if any
+	fetchJobs     int      // number of concurrent downloads from the remote store
+	uploadJobs    int      // number of concurrent uploads to the write store
+	uploadLimit   int64    // bandwidth of the uploads to the write store, in bytes per second (0 if unlimited)
+	disable       map[string]struct{}
+	defaults      string
+	debug         bool
+	signKey       string
+
+	requireSigned  bool
+	trustedKeys    string // GPG keyring holding the trusted keys
+	trustedDigests string // file holding the trusted SHA-256 digests
+
+	hermetic     bool     // run recipes in a sanitized environment
+	keepEnv      []string // variables kept from the environment in hermetic mode
+	hermeticPath string   // PATH of the recipes in hermetic mode, to the pinned tools (default: the system directories)
+
+	sandbox   bool // run native builds in a sandbox
+	noNetwork bool // disable network access during builds
+
+	distCC    string   // distributed compilation tool (distcc, icecream), if any
+	distHosts []string // distcc hosts, or icecream scheduler
+	distJobs  int      // number of compile jobs with distributed compilation
+
+	jobserver *jobserver // jobserver shared by the recipes, if any
+
+	noLocalBuild  bool                   // only install prebuilt tarballs
+	archFallbacks map[string][]string    // compatible architectures of each architecture
+	aliases       map[string]string      // packages of the alternative names of packages
+	stores        map[string]StoreConfig // stores of the configuration file, by name
+	credHelper    string                 // git credential helper giving the credentials of the hosts, if any
+	netrc         string                 // netrc file giving the credentials of the hosts (default: $NETRC or ~/.netrc)
+	lenient       bool                   // report the problems of the recipes as warnings
+	report        string                 // HTML report of the run, if any
+	junit         string                 // JUnit XML report of the run, if any
+
+	notifiers []string // notifier plugins
+
+	gridURL  string // endpoint of the grid package manager
+	gridCert string // grid certificate (PEM)
+	gridKey  string // key of the grid certificate (PEM)
+	gridCA   string // CA bundle of the grid package manager (PEM)
+
+	notifications NotifyConfig // channels notified at the end of the runs
+
+	githubToken  string   // token to report commit statuses to GitHub
+	githubAPI    string   // endpoint of the GitHub API
+	gitlabToken  string   // token to report commit statuses to GitLab
+	gitlabHosts  []string // hosts of the GitLab instances, besides gitlab.com
+	statusLogURL string   // link to the build logs reported with the commit statuses
 }
 
+// Spec is a package of the graph: its recipe, and where it is built.
 type Spec struct {
-	Package           string            `yaml:"package"`
-	Version           string            `yaml:"version"`
-	Requires          []string          `yaml:"requires"`
-	BuildRequires     []string          `yaml:"build_requires"`
-	RuntimeRequires   []string          `yaml:"runtime_requires"`
-	Env               map[string]string `yaml:"env"`
-	Source            string            `yaml:"source"`
-	CommitHash        string            `yaml:"commit_hash"`
-	WriteRepo         string            `yaml:"write_repo"`
-	Tag               string            `yaml:"tag"`
-	Recipe            string            `yaml:"recipe"`
-	IncrementalRecipe string            `yaml:"incremental_recipe"`
-	Hash              string            `yaml:"hash"`
-	Revision          string            `yaml:"revision"`
+	recipe.Spec
+
+	arch string // architecture the package is built for
+	lfs  string // identity of the Git LFS objects of the sources, if known
 
 	tar struct {
 		storePath string
 		linksPath string
 		hashDir   string
 		linkDir   string
+
+		compression Compression
 	}
 }
 
 type Builder struct {
-	cfg   Config
-	pkgs  []string
-	specs map[string]*Spec
-	order []string
-	sdir  string
+	cfg     Config
+	pkgs    []string
+	specs   map[string]*Spec
+	order   []string
+	sdir    string
+	cfghash string            // commit of the recipes repository
+	aliases map[string]string // packages of the aliases, by lowercase alias
+	names   map[string]string // names of the packages, by lowercase name
+	main    string            // main package of the build
+
+	toolchain *toolchain // compiler the packages are built with, if selected
+
+	status   map[string]string        // outcome of the build of each package
+	ccStats  map[string]cacheStats    // compiler cache statistics of each built package
+	usage    map[string]resourceUsage // resource usage of the recipe of each built package
+	started  map[string]time.Time     // start of the build of each package
+	took     map[string]time.Duration // duration of the build of each package
+	fetched  map[string]bool          // packages downloaded from the remote store by the run
+	rebuilt  map[string]string        // why each package built by the run was rebuilt
+	start    time.Time                // start of the run
+	buildErr error                    // outcome of the run
+	tests    []testResult             // outcome of the tests of the run, if run
+	httpDir  string                   // directory of the cache of the metadata of the remote store
+	revs     revisions                // revisions of the packages in the stores
+	matrix   *matrixRevisions         // revisions claimed by the builds of a matrix, if any
+	uploads  *uploadQueue             // uploads of the run to the write store, if any
+	bw       *store.Bandwidth         // bandwidth of the uploads
+	remote   store.Store              // remote store, nil if none
+	creds    *hostCredentials         // credentials of the hosts of the sources, stores and registries
+	pullOnce sync.Once                // pulls the docker image of the builds
+	pullErr  error
+	system   map[string]sysResult // outcome of the checks of the system requirements of the build
+	brew     *homebrew            // Homebrew installation of the host, if any
+	brewOnce sync.Once
+	write    store.Store // write store, nil if none
+	warm     *warmCache  // caches of the daemon, if run by one
+	trace    *tracer     // spans of the phases of the run, if traced
+	metrics  *metrics    // live metrics of the run, if exposed
+	board    *board      // progress board of the run, if drawn
+
+	ctx  context.Context // canceled when the build is interrupted, or times out
+	exec Executor        // runs the external commands
+	fs   FS              // file system of the build
+
+	onStatus func(spec *Spec, status string) // called when the status of a package changes
 }
 
 func main() {
 	var (
-		err          error
-		flagCfgDir   = flag.String("c", "alidist", "configuration directory")
-		flagDevel    = flag.String("devel", "", "comma-separated list of development packages")
-		flagDocker   = flag.Bool("docker", false, "enable/disable build in a docker container")
-		flagWorkDir  = flag.String("w", "sw", "work directory")
-		flagArch     = flag.String("a", "", "architecture to build for")
-		flagEnv      = flag.String("e", "", "environment for the build")
-		flagVols     = flag.String("v", "", "volumes for the docker-based build")
-		flagJobs     = flag.Int("j", 1, "number of build jobs to cary in parallel")
-		flagRefSrc   = flag.String("reference-sources", "sw/MIRROR", "")
-		flagRemote   = flag.String("remote-store", "", "where to find packages already built for reuse")
-		flagWrite    = flag.String("write-store", "", "where to upload the built packages for reuse. Use ssh:// in front for remote store.")
-		flagDisable  = flag.String("disable", "", "comma-separated list of packages (and all of their (unique) dependencies) to NOT build")
-		flagDefaults = flag.String("defaults", "release", "specify which defaults to use")
-		flagDebug    = flag.Bool("d", false, "enable/disable debug outputs")
+		err           error
+		flagCfgDir    = flag.String("c", "alidist", "configuration directory")
+		flagDevel     = flag.String("devel", "", "comma-separated list of development packages")
+		flagDocker    = flag.Bool("docker", false, "enable/disable build in a docker container")
+		flagWorkDir   = flag.String("w", "sw", "work directory")
+		flagArch      = flag.String("a", "", "architecture to build for (default: detected)")
+		flagHostArch  = flag.String("host-arch", "", "architecture of the build host, when cross-compiling (default: same as -a)")
+		flagCrossPfx  = flag.String("cross-prefix", "", "prefix of the cross-compilation toolchain binaries (e.g. aarch64-linux-gnu-)")
+		flagSysroot   = flag.String("sysroot", "", "sysroot of the target architecture, when cross-compiling")
+		flagEnv       = flag.String("e", "", "environment for the build")
+		flagEnvFiles  listFlag
+		flagVols      = flag.String("v", "", "volumes for the docker-based build")
+		flagDedup     = flag.Bool("dedup", false, "hard link the identical files of installed packages")
+		flagJobs      = flag.Int("j", 1, "number of build jobs to cary in parallel")
+		flagRefSrc    = flag.String("reference-sources", "sw/MIRROR", "")
+		flagFetchMirr = flag.Bool("fetch-mirrors", true, "create the missing reference mirrors of the git sources, and update them")
+		flagDaemonSk  = flag.String("daemon-socket", "", "socket of the daemon resolving the packages (default: <work-dir>/daemon.sock)")
+		flagNoDaemon  = flag.Bool("no-daemon", false, "resolve the packages without the daemon, even if one runs")
+		flagDaemonTTL = flag.Duration("daemon-ttl", defaultDaemonTTL, "daemon: time the git refs, remote store listings and resolved graphs are kept")
+		flagNoProg    = flag.Bool("no-progress", false, "print plain logs, rather than a live board of the in-flight packages, on interactive terminals")
+		flagMetrics   = flag.String("metrics-listen", "", "serve live Prometheus metrics of the run (packages pending, building and done, downloaded and uploaded bytes, current phases) on /metrics of this address (e.g. :9100)")
+		flagOTLP      = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint (e.g. http://localhost:4318) of the OpenTelemetry collector receiving the spans of the phases of the run (default: $OTEL_EXPORTER_OTLP_ENDPOINT)")
+		flagHistory   = flag.String("history", "", "file recording the timings and cache behavior of the packages of each run, compared by benchmark (default: <work-dir>/history.jsonl)")
+		flagSrcCache  = flag.String("sources-cache", "", "cache of the downloaded source archives, shareable by work directories (default: <work-dir>/SOURCES/CACHE)")
+		flagRemote    = flag.String("remote-store", "", "where to find packages already built for reuse. Use ::rw at the end to also upload there.")
+		flagCompress  = flag.String("compression", "gzip", "compression of the created tarballs (gzip, zstd or none)")
+		flagSplitDbg  = flag.Bool("split-debug", false, "move the debug symbols of binaries into companion tarballs")
+		flagBuildType = flag.String("build-type", "", "build type (Release, Debug, RelWithDebInfo) of the packages, exported as CMAKE_BUILD_TYPE")
+		flagDistCC    = flag.String("dist-cc", "", "distributed compilation tool (distcc, icecream) of the recipes")
+		flagDistHosts = flag.String("dist-hosts", "", "comma-separated list of distcc hosts (e.g. host1/8,host2/16), or icecream scheduler")
+		flagDistJobs  = flag.Int("dist-jobs", 0, "number of compile jobs of the recipes with distributed compilation (default: -j)")
+		flagNoBuild   = flag.Bool("no-local-build", false, "only install prebuilt tarballs from the stores, never build packages locally")
+		flagJUnit     = flag.String("junit", "", "write a JUnit XML report of the builds and tests of the run to this file")
+		flagReport    = flag.String("report", "", "write a self-contained HTML report of the run to this file")
+		flagLenient   = flag.Bool("lenient", false, "report unknown keys, duplicate keys and invalid values of the recipes as warnings, rather than errors")
+		flagWatch     = flag.Bool("watch", false, "rebuild the development packages, and their dependents, when their sources change")
+		flagWatchIvl  = flag.Duration("watch-interval", 2*time.Second, "interval between the checks of the sources of the development packages, with -watch")
+		flagFetch     = flag.Bool("fetch-repos", false, "fast-forward the checkouts of the recipes and of the development packages before the run (see also the update action)")
+		flagCfgRef    = flag.String("config-ref", "", "build with the recipes of this revision (tag, branch or commit) of the recipes repository, checked out in the work directory")
+		flagOverride  = flag.String("recipes-override", "", "directory of recipes (.sh files) shadowing the recipes of the same name of the configuration directory")
+		flagJobsrv    = flag.Bool("jobserver", false, "share a GNU make jobserver of -j job slots across all the recipes")
+		flagTimeout   = flag.Duration("timeout", 0, "abort the run after this duration (e.g. 2h), stopping the running recipes and downloads")
+		flagCompCache = flag.String("compiler-cache", "", "compiler cache (ccache, sccache) to build the packages with")
+		flagToolchain = flag.String("toolchain", "", "toolchain (system, gcc13, clang17, ...) to build the packages with")
+		flagSanitize  = flag.String("sanitizer", "", "comma-separated list of sanitizers (asan, tsan, ubsan) to build the packages with")
+		flagBuildDir  = flag.String("build-dir", "", "scratch directory (e.g. on a fast local disk) where the recipes compile and install, before their files are copied back to the work directory")
+		flagCleanup   = flag.Bool("aggressive-cleanup", false, "remove the build directory (but for its log) and install root of each package once installed, except for development packages")
+		flagStrip     = flag.Bool("strip", false, "strip binaries and shared libraries before packing them (unless no_strip is set by their recipe)")
+		flagFetchJob  = flag.Int("fetch-jobs", 4, "number of concurrent downloads from the remote store")
+		flagRepair    = flag.Bool("repair", false, "verify-store: remove the inconsistent files of the store")
+		flagJSON      = flag.Bool("json", false, "store stats, doctor, benchmark: print the report as JSON")
+		flagUpJobs    = flag.Int("upload-jobs", 2, "number of concurrent uploads to the write store")
+		flagCredHelp  = flag.String("credential-helper", "", "git credential helper (e.g. 'git credential-osxkeychain') giving the credentials of private git sources, HTTP stores and container registries")
+		flagUpLimit   = flag.String("upload-limit", "", "bandwidth cap of the uploads to the write store, in bytes per second (e.g. 500k, 10M)")
+		flagWrite     = flag.String("write-store", "", "where to upload the built packages for reuse. Use ssh:// in front for remote store.")
+		flagDisable   = flag.String("disable", "", "comma-separated list of packages (and all of their (unique) dependencies) to NOT build")
+		flagDefaults  = flag.String("defaults", "release", "specify which defaults to use (comma-separated list to build with several defaults)")
+		flagDebug     = flag.Bool("d", false, "enable/disable debug outputs")
+		flagConfig    = flag.String("config", "", "path to the aligot configuration file (default: $HOME/.aligot.yml)")
+		flagSignKey   = flag.String("sign-key", "", "GPG key used to sign the tarballs uploaded to the write store")
+		flagReqSig    = flag.Bool("require-signed", false, "refuse tarballs from the remote store which can not be verified")
+		flagTrustKey  = flag.String("trusted-keys", "", "GPG keyring with the keys trusted to sign tarballs from the remote store")
+		flagTrustSum  = flag.String("trusted-digests", "", "file with the SHA-256 digests (sha256sum format) of trusted tarballs")
+		flagHermetic  = flag.Bool("hermetic", false, "run recipes in a sanitized environment")
+		flagKeepEnv   = flag.String("keep-env", "", "comma-separated list of environment variables to keep in hermetic mode")
+		flagHermPath  = flag.String("hermetic-path", "", "PATH of the recipes in hermetic mode, to the pinned tools (default: "+hermeticPath+")")
+		flagSandbox   = flag.Bool("sandbox", false, "run native builds in a sandbox only allowed to write to the build and install directories")
+		flagNoNet     = flag.Bool("no-network", false, "disable network access during builds")
+		flagRPM       = flag.Bool("rpm", false, "package: create RPM packages")
+		flagDEB       = flag.Bool("deb", false, "package: create Debian packages")
+		flagClosure   = flag.Bool("closure", false, "package: also package the runtime closure of the package")
+		flagPrefix    = flag.String("prefix", "/opt/alisw", "package: installation prefix of the generated packages")
+		flagConda     = flag.Bool("conda", false, "export: create conda packages")
+		flagChannel   = flag.String("channel", "", "export: conda channel directory (default: <work-dir>/conda)")
+		flagSpack     = flag.Bool("spack", false, "export: create Spack package recipes of the resolved graph")
+		flagSpackDir  = flag.String("spack-repo", "", "export: Spack repository directory (default: <work-dir>/spack)")
+		flagNotify    = flag.String("notify", "", "comma-separated list of notifier plugins (aligot-<name>) told about the status of each package")
+		flagGridURL   = flag.String("grid-publish", "", "endpoint of the grid package manager to register the uploaded packages with")
+		flagAddr      = flag.String("addr", "127.0.0.1:8080", "serve: address of the HTTP API")
+		flagToken     = flag.String("token", "", "serve: bearer token required to resolve plans and submit builds; coordinate, worker: token shared by the build farm (default: $ALIGOT_API_TOKEN, or a random one)")
+		flagListen    = flag.String("listen", "127.0.0.1:7765", "coordinate: address the workers of the build farm join")
+		flagTLSCert   = flag.String("tls-cert", "", "coordinate: TLS certificate of the coordinator (PEM) (default: a self-signed one, in <work-dir>/FARM/tls)")
+		flagTLSKey    = flag.String("tls-key", "", "coordinate: TLS key of the coordinator (PEM)")
+		flagTLSCA     = flag.String("tls-ca", "", "worker: CA bundle the TLS certificate of the coordinator is verified with (PEM) (default: the system one)")
+		flagArchs     = flag.String("archs", "", "coordinate: comma-separated list of architectures to build for (default: -a); mirror: architectures to mirror (default: all)")
+		flagPkgs      = flag.String("packages", "", "mirror: comma-separated list of packages to mirror (default: all)")
+		flagYes       = flag.Bool("yes", false, "upgrade: proceed without confirmation")
+		flagGood      = flag.String("good", "", "bisect: revision of the recipes repository known to build the package")
+		flagBad       = flag.String("bad", "HEAD", "bisect: revision of the recipes repository known to break the package")
+		flagBisTests  = flag.Bool("bisect-tests", false, "bisect: also run the tests of the package and of its runtime dependencies at each step")
+		flagFrom      = flag.String("from", "", "mirror: store to copy the packages from (default: -remote-store)")
+		flagTo        = flag.String("to", "", "mirror: store to copy the packages to (default: -write-store)")
+		flagJoin      = flag.String("join", "", "worker: address of the coordinator of the build farm to join")
+		flagCapacity  = flag.Int("capacity", 1, "worker: maximum number of concurrent jobs")
+		flagCIFormat  = flag.String("format", "gitlab", "ci: format of the generated pipeline (gitlab or github)")
+		flagPerLevel  = flag.Bool("per-level", false, "ci: one job per layer of the dependency graph, rather than per package")
+		flagImageTag  = flag.String("tag", "", "image: reference name of the image (default: <package>:<version>-<revision>)")
 	)
+	flag.Var(&flagEnvFiles, "env-file", "dotenv file holding environment for the build (may be repeated)")
 
+	flag.Usage = usage
 	flag.Parse()
 
-	if flag.NArg() != 2 {
+	// flags may also be given after the action.
+	args := flag.Args()
+	if len(args) > 0 {
+		flag.CommandLine.Parse(args[1:])
+		args = append([]string{args[0]}, flag.Args()...)
+	}
+
+	// maintenance actions do not take a package.
+	// verify-store takes an optional store, store a subcommand and an
+	// optional store, benchmark a subcommand and optional runs.
+	var storeName string
+	if len(args) == 3 && args[0] == "store" {
+		storeName, args = args[2], args[:2]
+	}
+	var benchRuns []string
+	if len(args) > 2 && args[0] == "benchmark" {
+		benchRuns, args = args[2:], args[:2]
+	}
+	if len(args) == 1 && (args[0] == "dedup" || args[0] == "update" || args[0] == "serve" || args[0] == "daemon" || args[0] == "worker" || args[0] == "archdetect" || args[0] == "verify-store" || args[0] == "mirror") {
+		args = append(args, "")
+	}
+	if len(args) != 2 {
 		flag.Usage()
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
 	if *flagDisable != "" {
@@ -111,9 +322,10 @@ func main() {
 		}
 	}
 	cfg.debug = *flagDebug
-	cfg.action = flag.Arg(0)
-	cfg.pkgs = []string{flag.Arg(1)}
+	cfg.action = args[0]
+	cfg.pkgs = []string{args[1]}
 	cfg.cfgdir = *flagCfgDir
+	cfg.overrides = *flagOverride
 	if *flagDevel != "" {
 		for _, v := range strings.Split(*flagDevel, ",") {
 			cfg.devel = append(
@@ -131,6 +343,13 @@ func main() {
 			)
 		}
 	}
+	for _, fname := range flagEnvFiles {
+		env, err := readEnvFile(fname)
+		if err != nil {
+			usagef("could not read env file: %v\n", err)
+		}
+		cfg.env = append(cfg.env, env...)
+	}
 
 	if *flagVols != "" {
 		for _, v := range strings.Split(*flagVols, ",") {
@@ -149,32 +368,170 @@ func main() {
 		)
 	}
 
+	if cfg.action == "archdetect" {
+		err = archdetect(hostExecutor{}, os.Stdout, os.Stderr)
+		if err != nil {
+			msg.Fatalf("could not detect architecture: %v\n", err)
+		}
+		return
+	}
+
 	cfg.arch = *flagArch
+	if cfg.arch != "" {
+		cfg.arch, err = normalizeArch(cfg.arch)
+		if err != nil {
+			usagef("invalid -a: %v\n", err)
+		}
+	}
+	if cfg.arch == "" {
+		cfg.arch, err = detectArch(hostExecutor{})
+		if err != nil {
+			msg.Fatalf("could not detect architecture (use -a): %v\n", err)
+		}
+		msg.Debugf("detected architecture: %s\n", cfg.arch)
+	}
+	cfg.hostArch = *flagHostArch
+	if cfg.hostArch != "" {
+		cfg.hostArch, err = normalizeArch(cfg.hostArch)
+		if err != nil {
+			usagef("invalid -host-arch: %v\n", err)
+		}
+	}
+	if cfg.hostArch == "" {
+		cfg.hostArch = cfg.arch
+	}
+	cfg.crossPrefix = *flagCrossPfx
+	cfg.sysroot = *flagSysroot
+
 	if *flagDocker {
-		cfg.docker = fmt.Sprintf(
-			"alisw/%s-builder",
-			strings.Split(cfg.arch, "_")[0],
-		)
+		// builds run on the host, even when cross-compiling.
+		img, ok := dockerImage(cfg.hostArch)
+		if !ok {
+			msg.Warnf("no docker builder image for %s: building natively\n", cfg.hostArch)
+		}
+		cfg.docker = img
+	}
+
+	cfg.hermetic = *flagHermetic
+	if *flagKeepEnv != "" {
+		for _, v := range strings.Split(*flagKeepEnv, ",") {
+			cfg.keepEnv = append(
+				cfg.keepEnv,
+				strings.TrimSpace(v),
+			)
+		}
+		sort.Strings(cfg.keepEnv)
 	}
+	cfg.hermeticPath = *flagHermPath
 
+	cfg.sandbox = *flagSandbox
+	cfg.noNetwork = *flagNoNet
+
+	cfg.dedup = *flagDedup
 	cfg.njobs = *flagJobs
 	cfg.refsrc = *flagRefSrc
+	cfg.fetchMirrors = *flagFetchMirr
+	cfg.daemonSock = *flagDaemonSk
+	cfg.noDaemon = *flagNoDaemon
 
-	cfg.remoteStore = *flagRemote
-	cfg.writeStore = *flagWrite
+	cfg.fetchJobs = *flagFetchJob
+	cfg.uploadJobs = *flagUpJobs
+	cfg.uploadLimit, err = parseRate(*flagUpLimit)
+	if err != nil {
+		usagef("invalid -upload-limit: %v\n", err)
+	}
+	if _, err := compressionByName(*flagCompress); err != nil {
+		usagef("invalid -compression: %v\n", err)
+	}
+	cfg.compression = *flagCompress
+	cfg.splitDebug = *flagSplitDbg
+	cfg.strip = *flagStrip
+	cfg.cleanup = *flagCleanup
+	if *flagBuildDir != "" {
+		cfg.buildDir, err = filepath.Abs(*flagBuildDir)
+		if err != nil {
+			msg.Fatalf("could not resolve absolute path for [%s]: %v\n", *flagBuildDir, err)
+		}
+	}
+	cfg.toolchain = *flagToolchain
+	if _, ok := distCompilers[*flagDistCC]; !ok && *flagDistCC != "" {
+		usagef("invalid -dist-cc %q (valid tools: distcc, icecream)\n", *flagDistCC)
+	}
+	if *flagDistCC != "" && cfg.noNetwork {
+		usagef("-dist-cc needs network access: it can not be used with -no-network\n")
+	}
+	cfg.noLocalBuild = *flagNoBuild
+	cfg.lenient = *flagLenient
+	cfg.report = *flagReport
+	cfg.junit = *flagJUnit
+	cfg.distCC = *flagDistCC
+	if *flagDistHosts != "" {
+		cfg.distHosts = strings.Split(*flagDistHosts, ",")
+	}
+	cfg.distJobs = *flagDistJobs
+	switch *flagCompCache {
+	case "", "ccache", "sccache":
+		cfg.compilerCache = *flagCompCache
+	default:
+		usagef("invalid -compiler-cache %q (valid compiler caches: ccache, sccache)\n", *flagCompCache)
+	}
+	cfg.buildType, err = parseBuildType(*flagBuildType)
+	if err != nil {
+		usagef("invalid -build-type: %v\n", err)
+	}
+	cfg.sanitizers, err = parseSanitizers(*flagSanitize)
+	if err != nil {
+		usagef("invalid -sanitizer: %v\n", err)
+	}
+	cfg.defaults = *flagDefaults
 
-	cfg.remoteStore = strings.TrimPrefix(cfg.remoteStore, "ssh://")
-	cfg.writeStore = strings.TrimPrefix(cfg.writeStore, "ssh://")
+	cfgFile, err := loadConfigFile(*flagConfig, false)
+	if *flagConfig == "" {
+		cfgFile, err = loadConfigFile(defaultConfigFile(), true)
+	}
+	if err != nil {
+		usagef("could not load configuration file: %v\n", err)
+	}
 
-	if strings.HasSuffix(cfg.remoteStore, "::rw") {
+	// stores are given by their URL, or by their name in the configuration
+	// file.
+	cfg.stores = cfgFile.Stores
+	cfg.credHelper = cfgFile.Credentials.Helper
+	if *flagCredHelp != "" {
+		cfg.credHelper = *flagCredHelp
+	}
+	cfg.netrc = cfgFile.Credentials.Netrc
+	cfg.history = *flagHistory
+	cfg.otlpEndpoint = *flagOTLP
+	cfg.metricsAddr = *flagMetrics
+	cfg.noProgress = *flagNoProg
+	cfg.srcCache = cfgFile.SourcesCache
+	if *flagSrcCache != "" {
+		cfg.srcCache = *flagSrcCache
+	}
+	remote, rw := store.Parse(*flagRemote)
+	cfg.remoteStore = cfg.storeConfig(remote).URL
+	write, _ := store.Parse(*flagWrite)
+	cfg.writeStore = cfg.storeConfig(write).URL
+	if rw {
 		if len(cfg.writeStore) > 0 {
-			msg.Fatalf(
-				"you can NOT specify '::rw' and -write-store at the same time",
+			usagef(
+				"you can NOT specify '::rw' and -write-store at the same time\n",
 			)
 		}
-		cfg.remoteStore = strings.TrimSuffix(cfg.remoteStore, "::rw")
 		cfg.writeStore = cfg.remoteStore
 	}
+	if store.IsHTTP(cfg.writeStore) {
+		usagef("invalid write store [%s]: HTTP stores are read-only\n", cfg.writeStore)
+	}
+	for _, url := range []string{cfg.remoteStore, cfg.writeStore} {
+		if !store.IsBucket(url) {
+			continue
+		}
+		if _, err := store.NewBucket(url, cfg.storeConfig(url).Endpoint, false, nil, nil); err != nil {
+			usagef("%v\n", err)
+		}
+	}
 
 	if len(cfg.devel) > 0 {
 		msg.Infof("write store disabled since -devel option passed")
@@ -182,106 +539,490 @@ func main() {
 		cfg.writeStore = ""
 	}
 
-	cfg.defaults = *flagDefaults
+	cfg.signKey = cfgFile.Sign.Key
+	if *flagSignKey != "" {
+		cfg.signKey = *flagSignKey
+	}
+
+	cfg.requireSigned = *flagReqSig || cfgFile.Verify.RequireSigned
+	cfg.trustedKeys = cfgFile.Verify.Keyring
+	if *flagTrustKey != "" {
+		cfg.trustedKeys = *flagTrustKey
+	}
+	cfg.trustedDigests = cfgFile.Verify.Digests
+	if *flagTrustSum != "" {
+		cfg.trustedDigests = *flagTrustSum
+	}
+
+	if *flagNotify != "" {
+		cfg.notifiers = strings.Split(*flagNotify, ",")
+	}
+
+	cfg.gridURL = cfgFile.Grid.URL
+	if *flagGridURL != "" {
+		cfg.gridURL = *flagGridURL
+	}
+	cfg.gridCert = cfgFile.Grid.Cert
+	cfg.gridKey = cfgFile.Grid.Key
+	cfg.gridCA = cfgFile.Grid.CA
+	cfg.notifications = cfgFile.Notify
+	cfg.archFallbacks = cfgFile.ArchFallbacks
+	cfg.aliases = cfgFile.Aliases
+
+	cfg.githubToken = cfgFile.Status.GitHub.Token
+	cfg.githubAPI = cfgFile.Status.GitHub.API
+	cfg.gitlabToken = cfgFile.Status.GitLab.Token
+	cfg.gitlabHosts = cfgFile.Status.GitLab.Hosts
+	cfg.statusLogURL = cfgFile.Status.LogURL
+
+	if cfg.gridURL != "" && cfg.writeStore == "" {
+		msg.Warnf("no write store: packages will not be registered with the grid\n")
+	}
 
 	if cfg.debug {
 		msg.SetLevel(logger.DEBUG)
 	}
+	store.Log = storeLog{}
 
 	switch cfg.action {
-	case "build":
+	case "build", "install", "update", "archdetect", "manifest", "info", "search", "licenses", "package", "export", "image", "dedup", "symbols", "serve", "daemon", "coordinate", "worker", "ci", "test", "verify-store", "mirror", "store", "doctor", "benchmark", "bisect", "upgrade":
 		// ok
 	default:
-		msg.Fatalf("action [%s] unsupported\n", cfg.action)
+		usagef("action [%s] unsupported\n", cfg.action)
 	}
 
-	b := Builder{
-		cfg:   cfg,
-		pkgs:  []string{cfg.pkgs[0]},
-		specs: make(map[string]*Spec),
-		sdir:  filepath.Join(cfg.wdir, "SPECS"),
+	if cfg.action == "install" {
+		cfg.noLocalBuild = true
 	}
-	err = os.MkdirAll(b.sdir, 0755)
-	if err != nil {
-		msg.Fatalf("could not create spec-dir [%s]: %v\n",
-			b.sdir,
-			err,
-		)
+
+	switch cfg.action {
+	case "build", "install", "test", "worker", "bisect", "upgrade":
+		handleSignals()
 	}
 
-	msg.Debugf("using aligot recipes in %[1]sdist@%[2]s\n",
-		"ali", hashDirectory(cfg.cfgdir),
-	)
+	if *flagJobsrv {
+		n := cfg.njobs
+		if cfg.distCC != "" && cfg.distJobs > 0 {
+			n = cfg.distJobs
+		}
+		cfg.jobserver, err = newJobserver(cfg.wdir, n)
+		if err != nil {
+			msg.Fatalf("could not create jobserver: %v\n", err)
+		}
+		defer cfg.jobserver.Close()
+	}
 
-	pkgs := []string{cfg.pkgs[0]}
-	for len(pkgs) > 0 {
-		pkg := pkgs[0]
-		pkgs = pkgs[1:]
-		if _, ok := b.specs[pkg]; ok {
-			continue
+	// upgrade updates the recipes before rebuilding what changed.
+	if cfg.action == "update" || cfg.action == "upgrade" || *flagFetch {
+		err = fetchRepos(cfg, hostExecutor{})
+		exit(failure(exitFetch, err))
+		if cfg.action == "update" {
+			return
 		}
-		fname := filepath.Join(cfg.cfgdir, strings.ToLower(pkg)) + ".sh"
-		buf, err := ioutil.ReadFile(fname)
+	}
+
+	if *flagCfgRef != "" {
+		cfg.cfgdir, err = configWorktree(cfg, hostExecutor{}, *flagCfgRef)
+		exit(failure(exitResolve, err))
+		cfg.configRef = *flagCfgRef
+	}
+
+	if cfg.action == "search" {
+		err = newBuilder(cfg).search(os.Stdout, cfg.pkgs[0])
 		if err != nil {
-			msg.Fatalf("could not read file [%s]: %v\n",
-				fname,
-				err,
-			)
+			msg.Fatalf("%v\n", err)
 		}
-		tokens := bytes.Split(buf, []byte("---"))
-		hdr := tokens[0]
-		recipe := tokens[1]
+		return
+	}
 
-		var spec Spec
-		err = yaml.Unmarshal(hdr, &spec)
+	if cfg.action == "dedup" {
+		err = dedupWorkDir(cfg.wdir)
 		if err != nil {
-			msg.Fatalf("could not unmarshal YAML document [%s]: %v\n",
-				fname,
-				err,
-			)
+			msg.Fatalf("could not deduplicate [%s]: %v\n", cfg.wdir, err)
 		}
+		return
+	}
 
-		if _, ok := cfg.disable[spec.Package]; ok {
-			continue
+	if cfg.action == "verify-store" {
+		err = newBuilder(cfg).verifyStore(os.Stdout, cfg.pkgs[0], *flagRepair)
+		exit(err)
+		return
+	}
+
+	if cfg.action == "store" {
+		switch cfg.pkgs[0] {
+		case "stats":
+			err = newBuilder(cfg).printStoreStats(os.Stdout, storeName, *flagJSON)
+			exit(err)
+		default:
+			usagef("store subcommand [%s] unsupported (want stats)\n", cfg.pkgs[0])
 		}
+		return
+	}
 
-		// ATM, treat BuildRequires just as requires.
-		fn := func(args []string) []string {
-			archs := filterByArch(cfg.arch, args)
-			o := make([]string, 0, len(archs))
-			for _, v := range archs {
-				if _, ok := cfg.disable[v]; !ok {
-					o = append(o, v)
-				}
+	if cfg.action == "benchmark" {
+		b := newBuilder(cfg)
+		switch cfg.pkgs[0] {
+		case "list":
+			err = b.listRuns(os.Stdout)
+		case "compare":
+			run1, run2 := "-2", "-1"
+			switch len(benchRuns) {
+			case 0:
+			case 2:
+				run1, run2 = benchRuns[0], benchRuns[1]
+			default:
+				usagef("benchmark compare takes two runs, or none to compare the last two runs\n")
 			}
-			return o
+			err = b.benchmarkCompare(os.Stdout, run1, run2, *flagJSON)
+		default:
+			usagef("benchmark subcommand [%s] unsupported (want list, compare)\n", cfg.pkgs[0])
 		}
-		spec.Requires = fn(spec.Requires)
-		spec.BuildRequires = fn(spec.BuildRequires)
-		if spec.Package != "defaults-"+cfg.defaults {
-			spec.BuildRequires = append(spec.BuildRequires,
-				"defaults-"+cfg.defaults,
-			)
+		exit(err)
+		return
+	}
+
+	if cfg.action == "mirror" {
+		from, to := *flagFrom, *flagTo
+		if from == "" {
+			from = cfg.remoteStore
+		}
+		if to == "" {
+			to = cfg.writeStore
+		}
+		var archs, pkgs []string
+		if *flagArchs != "" {
+			archs = strings.Split(*flagArchs, ",")
+		}
+		if *flagPkgs != "" {
+			pkgs = strings.Split(*flagPkgs, ",")
+		}
+		err = newBuilder(cfg).mirror(os.Stdout, from, to, archs, pkgs)
+		exit(err)
+		return
+	}
+
+	token := *flagToken
+	if token == "" {
+		token = os.Getenv("ALIGOT_API_TOKEN")
+	}
+
+	if cfg.action == "serve" {
+		err = serve(cfg, *flagAddr, token)
+		if err != nil {
+			msg.Fatalf("could not serve the aligot API: %v\n", err)
+		}
+		return
+	}
+
+	if cfg.action == "daemon" {
+		err = runDaemon(cfg, *flagDaemonTTL)
+		if err != nil {
+			msg.Fatalf("could not run the daemon: %v\n", err)
+		}
+		return
+	}
+
+	if cfg.action == "worker" {
+		if *flagJoin == "" {
+			usagef("no coordinator to join (use -join)\n")
+		}
+		if token == "" {
+			usagef("no token of the build farm (use -token)\n")
+		}
+		err = work(cfg, *flagJoin, token, *flagTLSCA, *flagCapacity)
+		exit(err)
+		return
+	}
+
+	if cfg.action == "coordinate" {
+		archs := []string{cfg.arch}
+		if *flagArchs != "" {
+			archs = strings.Split(*flagArchs, ",")
+		}
+		for i, arch := range archs {
+			archs[i], err = normalizeArch(arch)
+			if err != nil {
+				usagef("invalid -archs: %v\n", err)
+			}
+		}
+		err = coordinate(cfg, archs, *flagListen, token, *flagTLSCert, *flagTLSKey, os.Stdout)
+		if err != nil {
+			msg.Fatalf("%v\n", err)
+		}
+		return
+	}
+
+	if cfg.action == "bisect" {
+		if *flagGood == "" {
+			usagef("no good revision of the recipes to bisect from (use -good)\n")
+		}
+		err = bisect(cfg, hostExecutor{}, *flagGood, *flagBad, *flagBisTests, os.Stdout)
+		exit(err)
+		return
+	}
+
+	if defaults := strings.Split(cfg.defaults, ","); len(defaults) > 1 {
+		if cfg.action != "build" && cfg.action != "install" {
+			usagef("action [%s] does not support several defaults\n", cfg.action)
+		}
+		err = buildMatrix(cfg, defaults, os.Stdout)
+		exit(err)
+		return
+	}
+
+	b := newBuilder(cfg)
+	b.trace = newTracer(cfg)
+	if cfg.metricsAddr != "" {
+		b.metrics = newMetrics()
+		serveMetrics(b.metrics, cfg.metricsAddr)
+	}
+	if *flagTimeout > 0 {
+		ctx, cancel := context.WithTimeout(b.ctx, *flagTimeout)
+		defer cancel()
+		b.ctx = ctx
+	}
+	ph := b.phase("", "resolve")
+	err = b.resolveWithDaemon()
+	ph.finish(err)
+	if err != nil {
+		b.exportTrace(err)
+		exit(failure(exitResolve, err))
+	}
+
+	switch cfg.action {
+	case "build", "install":
+		if *flagWatch {
+			if len(cfg.devel) == 0 {
+				usagef("-watch needs development packages (use -devel)\n")
+			}
+			err = watch(b, *flagWatchIvl)
+			exit(err)
+			break
+		}
+		err = b.build()
+		exit(err)
+	case "upgrade":
+		err = b.upgrade(os.Stdout, *flagYes)
+		exit(err)
+	case "info":
+		err = b.info(os.Stdout, b.pkgs[0])
+		if err != nil {
+			msg.Fatalf("%v\n", err)
+		}
+	case "manifest":
+		err = b.printManifest(os.Stdout, b.pkgs[0])
+		if err != nil {
+			msg.Fatalf("could not read manifest: %v\n", err)
+		}
+	case "doctor":
+		err = b.doctor(os.Stdout, *flagJSON)
+		exit(err)
+	case "licenses":
+		err = b.licenses(os.Stdout)
+		if err != nil {
+			msg.Fatalf("could not produce license report: %v\n", err)
+		}
+	case "package":
+		opts := pkgOptions{
+			closure: *flagClosure,
+			prefix:  *flagPrefix,
+		}
+		var formats []pkgFormat
+		if *flagRPM {
+			formats = append(formats, rpmFormat)
+		}
+		if *flagDEB {
+			formats = append(formats, debFormat)
+		}
+		if len(formats) == 0 {
+			usagef("no package format selected (use -rpm or -deb)\n")
+		}
+		err = b.build()
+		exit(err)
+		for _, format := range formats {
+			err = b.packageAs(format, opts)
+			if err != nil {
+				msg.Fatalf("could not create %s packages: %v\n", format.name, err)
+			}
+		}
+	case "export":
+		if !*flagConda && !*flagSpack {
+			usagef("no export format selected (use -conda or -spack)\n")
+		}
+		if *flagSpack {
+			dir := *flagSpackDir
+			if dir == "" {
+				dir = filepath.Join(cfg.wdir, "spack")
+			}
+			err = b.exportSpack(dir)
+			if err != nil {
+				msg.Fatalf("could not export Spack recipes: %v\n", err)
+			}
+		}
+		if *flagConda {
+			err = b.build()
+			exit(err)
+			channel := *flagChannel
+			if channel == "" {
+				channel = filepath.Join(cfg.wdir, "conda")
+			}
+			err = b.exportConda(channel)
+			if err != nil {
+				msg.Fatalf("could not export conda packages: %v\n", err)
+			}
 		}
-		spec.RuntimeRequires = make([]string, len(spec.Requires))
-		copy(spec.RuntimeRequires, spec.Requires)
-		spec.Requires = append([]string{}, spec.RuntimeRequires...)
-		spec.Requires = append(spec.Requires, spec.BuildRequires...)
-		if spec.Tag == "" {
-			spec.Tag = spec.Version
+	case "symbols":
+		err = b.build()
+		exit(err)
+		for _, p := range b.runtimeClosure(b.pkgs[0]) {
+			ok, err := b.installSymbols(b.specs[p])
+			if err != nil {
+				msg.Fatalf("could not install debug symbols of %s: %v\n", p, err)
+			}
+			if ok {
+				msg.Infof("installed debug symbols of %s\n", p)
+			}
 		}
-		spec.Version = strings.Replace(spec.Version, "/", "_", -1)
+	case "test":
+		err = b.build()
+		exit(err)
+		err = b.runTests(os.Stdout)
+		exit(err)
+	case "ci":
+		err = b.ciPipeline(os.Stdout, *flagCIFormat, *flagPerLevel)
+		if err != nil {
+			msg.Fatalf("could not generate CI pipeline: %v\n", err)
+		}
+	case "image":
+		err = b.build()
+		exit(err)
+		for _, pkg := range b.pkgs {
+			dir, err := b.image(pkg, *flagImageTag)
+			if err != nil {
+				msg.Fatalf("could not create image of %s: %v\n", pkg, err)
+			}
+			msg.Infof("created OCI image layout [%s] (push it with e.g. 'skopeo copy oci:%s docker://<registry>/<name>')\n", dir, dir)
+		}
+	}
+}
 
-		msg.Debugf("spec[%s]: %v\n", pkg, spec.Requires)
-		spec.Recipe = string(recipe)
-		b.specs[spec.Package] = &spec
-		pkgs = append(pkgs, spec.Requires...)
+func newBuilder(cfg Config) *Builder {
+	b := &Builder{
+		cfg:     cfg,
+		pkgs:    []string{cfg.pkgs[0]},
+		specs:   make(map[string]*Spec),
+		names:   make(map[string]string),
+		status:  make(map[string]string),
+		ccStats: make(map[string]cacheStats),
+		usage:   make(map[string]resourceUsage),
+		started: make(map[string]time.Time),
+		took:    make(map[string]time.Duration),
+		fetched: make(map[string]bool),
+		rebuilt: make(map[string]string),
+		httpDir: filepath.Join(cfg.wdir, "TARS", ".cache", "http"),
+		sdir:    filepath.Join(cfg.wdir, "SPECS"),
+		ctx:     interrupts.ctx,
+		exec:    hostExecutor{},
+		fs:      hostFS{},
+	}
+	b.bw = store.NewBandwidth(cfg.uploadLimit)
+	b.creds = newHostCredentials(cfg.credHelper, cfg.netrc, b.exec)
+	var err error
+	b.remote, err = b.newStore(cfg.storeConfig(cfg.remoteStore), cfg.remoteStore == cfg.writeStore)
+	if err != nil {
+		msg.Fatalf("%v\n", err)
+	}
+	b.write, err = b.newStore(cfg.storeConfig(cfg.writeStore), true)
+	if err != nil {
+		msg.Fatalf("%v\n", err)
+	}
+	err = os.MkdirAll(b.sdir, 0755)
+	if err != nil {
+		msg.Fatalf("could not create spec-dir [%s]: %v\n",
+			b.sdir,
+			err,
+		)
+	}
+	return b
+}
+
+// resolve loads the recipes of the requested packages and of all their
+// dependencies, computes the build order and the hash of each package.
+func (b *Builder) resolve() error {
+	var (
+		cfg = b.cfg
+		err error
+	)
+
+	b.cfghash, err = b.hashDirectory(cfg.cfgdir)
+	if err != nil {
+		return fmt.Errorf("could not identify the recipes in [%s]: %v", cfg.cfgdir, err)
+	}
+	msg.Debugf("using aligot recipes in %[1]sdist@%[2]s\n",
+		"ali", b.cfghash,
+	)
+
+	tc, err := newToolchain(cfg, b.exec)
+	if err != nil {
+		return err
+	}
+	b.toolchain = tc
+
+	// the specs of the loaded recipes, by the recipe.Spec the resolver
+	// handles.
+	var (
+		mu    sync.Mutex
+		specs = make(map[*recipe.Spec]*Spec)
+	)
+	r := resolve.Resolver{
+		Arch:     cfg.arch,
+		HostArch: cfg.hostArch,
+		Defaults: cfg.defaults,
+		Aliases:  cfg.aliases,
+		Disable:  cfg.disable,
+		Load: func(pkg string) (*recipe.Spec, error) {
+			spec, err := b.loadSpec(pkg)
+			if err != nil || spec == nil {
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			specs[&spec.Spec] = spec
+			return &spec.Spec, nil
+		},
+	}
+	if tc != nil {
+		r.Toolchain = tc.pkg
+	}
+	g, err := r.Resolve(b.pkgs...)
+	if err != nil {
+		return err
 	}
 
-	b.order = topoSort(b.specs)
+	// the requested packages are named as in their recipe.
+	for i, pkg := range b.pkgs {
+		if g.Packages[i] != pkg {
+			msg.Infof("%s resolved to %s\n", pkg, g.Packages[i])
+		}
+	}
+	b.pkgs = g.Packages
+	if tc != nil && tc.pkg != "" {
+		tc.pkg = g.Toolchain
+	}
+	b.aliases = g.Aliases
+	b.names = g.Names
+	b.order = g.Order
+	b.specs = make(map[string]*Spec, len(g.Specs))
+	for p, spec := range g.Specs {
+		b.specs[p] = specs[spec]
+	}
 	msg.Debugf("build order: %v\n", b.order)
 
+	b.assignArchs()
+
 	// resolve the tag to the actual commit ref
+	now := time.Now()
 	for _, pkg := range b.order {
 		spec := b.specs[pkg]
 		spec.CommitHash = "0"
@@ -289,6 +1030,30 @@ func main() {
 			// TODO(sbinet)
 
 			spec.CommitHash = spec.Tag
+			if pattern := tagPattern(spec); pattern != "" {
+				err := b.resolveTag(spec, pattern)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if b.isDevel(spec.Package) {
+			hash, err := b.develHash(spec)
+			if err != nil {
+				return err
+			}
+			spec.CommitHash = hash
+			msg.Debugf("working tree of development package %s: %s\n", pkg, hash)
+		}
+		b.updateMirror(spec)
+		lfs, err := b.lfsIdentity(spec)
+		if err != nil {
+			return err
+		}
+		spec.lfs = lfs
+		err = b.expandVersion(spec, now)
+		if err != nil {
+			return err
 		}
 
 	}
@@ -319,6 +1084,7 @@ func main() {
 		mainPkg = hasMainPkgs[len(hasMainPkgs)-1]
 	}
 	mainHash := b.specs[mainPkg].CommitHash
+	b.main = mainPkg
 
 	msg.Debugf("main package is %s@%s\n", mainPkg, mainHash)
 
@@ -342,66 +1108,271 @@ func main() {
 	// safely assume that's unique and therefore we can avoid putting the
 	// repository or the name of the branch in the hash.
 	msg.Debugf("calculating hashes.\n")
+	ph := b.phase("", "hash")
+	for _, layer := range b.layers() {
+		forEach(len(layer), runtime.NumCPU(), func(i int) {
+			spec := b.specs[layer[i]]
+			spec.Hash = b.hash(spec)
+		})
+	}
+	ph.finish(nil)
 	for _, p := range b.order {
-		spec := b.specs[p]
-		hash := sha1.New()
-		fct := func(s string) []byte {
-			if s == "" {
-				s = "none"
-			}
-			return []byte(s)
-		}
-		hash.Write(fct(spec.Recipe))
-		hash.Write(fct(spec.Version))
-		hash.Write(fct(spec.Package))
-		hash.Write(fct(spec.CommitHash))
-		// FIXME(sbinet)
-		//hash.write(fct(spec.Env))
-		//hash.Write(fct(spec.AppendPath))
-		//hash.Write(fct(spec.PrependPath))
-		//...
-
-		spec.Hash = hex.EncodeToString(hash.Sum(nil))
-		msg.Debugf("hash for recipe %s is %s\n", p, spec.Hash)
+		msg.Debugf("hash for recipe %s is %s\n", p, b.specs[p].Hash)
 	}
 
 	// this adds to the spec where it should find, localy or remotely, the
 	// various tarballs and links.
 	for _, p := range b.order {
-		spec := b.specs[p]
-		prefix := string(spec.Hash[:2])
-		join := filepath.Join
-		spec.tar.storePath = join("TARS", cfg.arch, "store", prefix, spec.Hash)
-		spec.tar.linkDir = join("TARS", cfg.arch, spec.Package)
-		spec.tar.hashDir = join(cfg.wdir, "TARS", cfg.arch, "store", prefix, cfg.arch)
-		spec.tar.linkDir = join(cfg.wdir, "TARS", cfg.arch, spec.Package)
+		b.setArch(b.specs[p], b.specs[p].arch)
+	}
+	return nil
+}
 
+// setArch sets the architecture of a spec, and the paths of its tarballs in
+// the stores.
+func (b *Builder) setArch(spec *Spec, arch string) {
+	spec.arch = arch
+	prefix := string(spec.Hash[:2])
+	join := filepath.Join
+	spec.tar.storePath = join("TARS", spec.arch, "store", prefix, spec.Hash)
+	spec.tar.linksPath = join("TARS", spec.arch, spec.Package)
+	spec.tar.hashDir = join(b.cfg.wdir, spec.tar.storePath)
+	spec.tar.linkDir = join(b.cfg.wdir, spec.tar.linksPath)
+	spec.tar.compression = b.tarCompressions()[0]
+}
+
+// loadSpec reads and parses the recipe of the named package.
+// loadSpec returns a nil spec for disabled packages.
+func (b *Builder) loadSpec(pkg string) (*Spec, error) {
+	cfg := b.cfg
+	loader := recipe.Loader{
+		Dir:       cfg.cfgdir,
+		Overrides: cfg.overrides,
+		ReadFile:  b.fs.ReadFile,
+		Lenient:   cfg.lenient,
+	}
+	rs, diags, err := loader.Load(pkg)
+	for _, d := range diags {
+		msg.Warnf("%v\n", d)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rs.Overrides) > 0 {
+		msg.Warnf("recipe of %s overridden by %v\n", rs.Package, rs.Overrides)
+	}
+	spec := Spec{Spec: *rs}
+	err = checkScratch(&spec)
+	if err != nil {
+		return nil, err
 	}
 
-	// we recursively calculate the full set of requires FullRequires,
-	// including BuildRequires and the subset of them which are needed at
-	// runtime: FullRuntimeRequires.
+	if _, ok := cfg.disable[spec.Package]; ok {
+		return nil, nil
+	}
+	return &spec, nil
+}
+
+// hash computes the hash of a spec.
+func (b *Builder) hash(spec *Spec) string {
+	hash := sha1.New()
+	fct := func(s string) []byte {
+		if s == "" {
+			s = "none"
+		}
+		return []byte(s)
+	}
+	hash.Write(fct(spec.Recipe))
+	hash.Write(fct(spec.Version))
+	hash.Write(fct(spec.Package))
+	hash.Write(fct(spec.CommitHash))
+	if spec.lfs != "" {
+		hash.Write([]byte("lfs:" + spec.lfs))
+	}
+	if d := archivesDigest(spec); d != "" {
+		hash.Write([]byte("archives:" + d))
+	}
+	if d := patchesDigest(spec); d != "" {
+		hash.Write([]byte("patches:" + d))
+	}
+	// packages are rebuilt when any of their dependencies is (e.g. when the
+	// sources of a development package change): the hashes of the
+	// dependencies, computed first, enter the hash, in build order.
+	for _, dep := range spec.FullRequires {
+		hash.Write([]byte("requires:" + dep + ":" + b.specs[dep].Hash))
+	}
+	for _, opt := range b.hashOptions(spec) {
+		hash.Write([]byte(opt))
+	}
 	// FIXME(sbinet)
+	//hash.write(fct(spec.Env))
+	//hash.Write(fct(spec.AppendPath))
+	//hash.Write(fct(spec.PrependPath))
+	//...
 
-	msg.Debugf("build order: %v\n", b.order)
+	return hex.EncodeToString(hash.Sum(nil))
+}
 
+// hashOptions returns the options of the run, and of the build environment,
+// entering the hash of a spec.
+func (b *Builder) hashOptions(spec *Spec) []string {
+	cfg := b.cfg
+	var opts []string
+	// packages built from pinned recipes are identified by their revision.
+	if cfg.configRef != "" {
+		opts = append(opts, "recipes:"+b.cfghash)
+	}
+	if cfg.hermetic {
+		opts = append(opts, "hermetic:"+strings.Join(cfg.keepEnv, ","))
+		if cfg.hermeticPath != "" {
+			opts = append(opts, "hermetic-path:"+cfg.hermeticPath)
+		}
+		if len(spec.KeepEnv) > 0 {
+			opts = append(opts, "keep-env:"+strings.Join(spec.KeepEnv, ","))
+		}
+	}
+	if b.crossCompiled(spec) {
+		opts = append(opts, "cross:"+cfg.hostArch+":"+cfg.crossPrefix+":"+cfg.sysroot)
+	}
+	if cfg.splitDebug {
+		opts = append(opts, "split-debug")
+	}
+	if b.stripped(spec) {
+		opts = append(opts, "strip")
+	}
+	if b.usesToolchain(spec) {
+		opts = append(opts, "toolchain:"+b.toolchainID())
+	}
+	if cfg.buildType != "" && spec.arch == b.targetArch() {
+		opts = append(opts, "build-type:"+cfg.buildType)
+	}
+	if b.sanitized(spec) {
+		opts = append(opts, "sanitizers:"+strings.Join(cfg.sanitizers, ","))
+	}
+	return opts
+}
+
+// layers splits the build order into layers of packages whose requirements
+// are all in previous layers.
+// packages of a layer are sorted in build order.
+func (b *Builder) layers() [][]string {
+	var (
+		layers [][]string
+		depth  = make(map[string]int, len(b.order))
+	)
+	for _, p := range b.order {
+		d := 0
+		for _, dep := range b.specs[p].Requires {
+			if v, ok := depth[dep]; ok && v+1 > d {
+				d = v + 1
+			}
+		}
+		depth[p] = d
+		if d == len(layers) {
+			layers = append(layers, nil)
+		}
+		layers[d] = append(layers[d], p)
+	}
+	return layers
+}
+
+// build iterates on all the packages, in build order.
+// the outcome of each package is recorded in b.status.
+func (b *Builder) build() error {
+	start := time.Now()
+	b.metrics.begin(b.order)
+	b.resumeState()
+	b.board = b.startBoard()
+	err := b.buildAll()
+	if uerr := b.waitUploads(); err == nil {
+		err = uerr
+	}
+	b.board.close()
+	b.board = nil
+	b.start, b.buildErr = start, err
+	switch err {
+	case nil:
+		os.Remove(b.stateFile())
+	case errInterrupted, errTimedOut:
+		if err := b.saveState(); err != nil {
+			msg.Warnf("could not save progress of the run: %v\n", err)
+		} else {
+			msg.Infof("progress saved in [%s]: run again to resume\n", b.stateFile())
+		}
+	}
+	b.cacheSummary()
+	b.compilerCacheSummary()
+	b.usageSummary()
+	if err := b.recordRun(start, err); err != nil {
+		msg.Warnf("could not record run in [%s]: %v\n", b.historyFile(), err)
+	}
+	if b.cfg.report != "" {
+		if err := b.writeReport(start, err); err != nil {
+			msg.Warnf("could not write report [%s]: %v\n", b.cfg.report, err)
+		}
+	}
+	if b.cfg.junit != "" {
+		if err := b.writeJUnit(start); err != nil {
+			msg.Warnf("could not write JUnit report [%s]: %v\n", b.cfg.junit, err)
+		}
+	}
+	b.notifyRun(start, err)
+	b.exportTrace(err)
+	return err
+}
+
+// buildAll builds, or fetches, all the packages in build order.
+func (b *Builder) buildAll() error {
 	// we now iterate on all the packages, making sure we build correctly every
 	// single one of them.
 	// this is done this way so that the second time we run we can check if the
 	// build was consistent and if it is, we bail out.
 	niter := make(map[string]int)
 	build := b.order
+
+	sys, err := b.checkSystem()
+	if err == nil {
+		err = b.systemError(sys)
+	}
+	if err != nil {
+		return failure(exitResolve, err)
+	}
+
+	// packages whose dependents are all available are pruned, and the
+	// tarballs available from the remote store are all fetched upfront.
+	needed := b.plan()
+	if b.cfg.remoteStore != "" {
+		err := b.prefetch(needed)
+		if err != nil {
+			return err
+		}
+	}
+	if b.cfg.noLocalBuild {
+		err := b.checkPrebuilt(needed)
+		if err != nil {
+			return err
+		}
+	}
+
 	for len(build) > 0 {
+		if err := canceled(b.ctx); err != nil {
+			return err
+		}
 		p := build[0]
 		build = build[1:]
 		niter[p]++
 		if niter[p] > 20 {
-			msg.Fatalf(
-				"too many attempts at building %s. Something wrong with the repository?\n",
+			return fmt.Errorf(
+				"too many attempts at building %s. Something wrong with the repository?",
 				p,
 			)
 		}
 		spec := b.specs[p]
+		if !needed[p] {
+			msg.Debugf("%s not needed\n", spec.Package)
+			b.setStatus(spec, statusPruned)
+			continue
+		}
 		msg.Debugf(">>> %v...\n", spec.Package)
 
 		// since we can execute this multiple times for a given package, in
@@ -428,78 +1399,141 @@ func main() {
 		// directory.
 		// here, we simply store the fact that we can reuse the contents of
 		// cached-tarball.
-		if *flagRemote != "" {
-			msg.Debugf("updating remote store for package %s@%s\n",
-				spec.Package, spec.Hash,
-			)
-			panic("not implemented")
-		}
+		spec.Revision = b.revision(spec)
 
 		// decide how it should be called, based on the hash and what is already
 		// available
 		msg.Debugf("checking for packages already built...\n")
+
+		if b.locate(spec) {
+			msg.Infof("%s@%s already built (%s)\n", spec.Package, spec.Version, spec.Hash)
+			ph := b.phase(spec.Package, "install")
+			err := b.install(spec)
+			ph.finish(err)
+			if err != nil {
+				return fmt.Errorf("could not install %s: %v", spec.Package, err)
+			}
+			b.setStatus(spec, statusCached)
+			continue
+		}
+
+		b.rebuilt[spec.Package] = b.rebuildReason(spec)
+		msg.Infof("building %s@%s (%s)...\n", spec.Package, spec.Version, spec.Hash)
+		b.setStatus(spec, statusBuilding)
+		err := b.buildPackage(spec)
+		if err != nil && b.ctx.Err() != nil {
+			b.setStatus(spec, statusStopped)
+			return canceled(b.ctx)
+		}
+		if err != nil {
+			b.setStatus(spec, statusFailed)
+			return failure(statusOf(err, exitBuild), fmt.Errorf("could not build %s: %v", spec.Package, err))
+		}
+
+		// the next packages are built while the tarball is uploaded.
+		b.setStatus(spec, statusBuilt)
+		b.queueUpload(spec)
+	}
+	return nil
+}
+
+// setStatus records the status of a spec, and reports the outcome of its
+// build to the notifiers and to the repository of its sources.
+func (b *Builder) setStatus(spec *Spec, status string) {
+	b.status[spec.Package] = status
+	b.metrics.setStatus(spec.Package, status)
+	b.board.setStatus(spec.Package, status)
+	if status == statusBuilding {
+		b.started[spec.Package] = time.Now()
+	} else if start, ok := b.started[spec.Package]; ok {
+		b.took[spec.Package] = time.Since(start)
+	}
+	if b.onStatus != nil {
+		b.onStatus(spec, status)
+	}
+	switch status {
+	case statusBuilt, statusCached:
+		b.commitStatus(spec, commitSuccess)
+	case statusFailed:
+		b.commitStatus(spec, commitFailure)
+	}
+	if status == statusBuilt && spec.Package == b.main && spec.Package != b.pkgs[0] {
+		b.notifyMilestone(spec)
+	}
+	if status != statusBuilding {
+		b.notify(spec, status)
+	}
+}
+
+// sourceDir returns the directory where the sources of a spec are checked out.
+func (b *Builder) sourceDir(spec *Spec) string {
+	if b.isDevel(spec.Package) {
+		return develDir(spec.Package)
+	}
+	commit := spec.CommitHash
+	if d := archivesDigest(spec); d != "" {
+		commit += "-archives-" + shortHash(d)
 	}
+	if d := patchesDigest(spec); d != "" {
+		// patched sources are checked out apart from the pristine ones.
+		commit += "-patched-" + shortHash(d)
+	}
+	return filepath.Join(
+		b.cfg.wdir, "SOURCES",
+		spec.Package, spec.Version, commit,
+	)
 }
 
-func hashDirectory(dir string) string {
-	cmd := exec.Command("git", "rev-parse", "HEAD")
+// hashDirectory returns the commit checked out in the git repository dir.
+func (b *Builder) hashDirectory(dir string) (string, error) {
+	cmd := exec.CommandContext(b.ctx, "git", "rev-parse", "HEAD")
 	cmd.Dir = dir
-	out, err := cmd.Output()
+	out, err := output(b.exec, cmd)
 	if err != nil {
-		msg.Fatalf("error running 'git %v': %v\n",
-			strings.Join(cmd.Args, " "),
-			err,
-		)
+		return "", fmt.Errorf("error running '%v': %v", strings.Join(cmd.Args, " "), err)
 	}
-	return string(bytes.TrimSuffix(out, []byte("\n")))
+	return string(bytes.TrimSuffix(out, []byte("\n"))), nil
 }
 
-func filterByArch(arch string, reqs []string) []string {
-	o := make([]string, 0, len(reqs))
-	for _, v := range reqs {
-		var (
-			req     string
-			matcher *regexp.Regexp
-		)
-		if strings.Index(v, ":") > -1 {
-			s := strings.SplitN(v, ":", 1)
-			req = s[0]
-			matcher = regexp.MustCompile(s[1])
-		} else {
-			req = v
-			matcher = regexp.MustCompile(".*")
-		}
-		if matcher.MatchString(arch) {
-			o = append(o, req)
-		}
+// runtimeClosure returns the named package and all the packages it needs at
+// runtime, in build order.
+func (b *Builder) runtimeClosure(pkg string) []string {
+	spec, ok := b.specs[pkg]
+	if !ok {
+		return nil
 	}
-	return o
+	return append(append([]string(nil), spec.FullRuntimeRequires...), pkg)
 }
 
-// topoSort does a topological sort to have the correct build order.
-//
-// adapted from gopl.io/ch5/toposort
-func topoSort(m map[string]*Spec) []string {
-	var order []string
-	seen := make(map[string]bool)
-	var visitAll func(items []string)
-
-	visitAll = func(items []string) {
-		for _, item := range items {
-			if !seen[item] {
-				seen[item] = true
-				visitAll(m[item].Requires)
-				order = append(order, item)
-			}
-		}
+// closure returns the named package and all the packages it needs to be
+// built, in build order.
+func (b *Builder) closure(pkg string) []string {
+	spec, ok := b.specs[pkg]
+	if !ok {
+		return nil
 	}
+	return append(append([]string(nil), spec.FullRequires...), pkg)
+}
 
-	var keys []string
-	for key := range m {
-		keys = append(keys, key)
+// buildEnvRequires returns the packages whose environment is set up to build
+// a spec, in build order: its requirements and their runtime closure.
+func (b *Builder) buildEnvRequires(spec *Spec) []string {
+	set := make(map[string]bool)
+	for _, dep := range spec.Requires {
+		for _, p := range b.runtimeClosure(dep) {
+			set[p] = true
+		}
 	}
+	return b.inOrder(set)
+}
 
-	sort.Strings(keys)
-	visitAll(keys)
-	return order
+// inOrder returns the packages of a set, in build order.
+func (b *Builder) inOrder(set map[string]bool) []string {
+	o := make([]string, 0, len(set))
+	for _, p := range b.order {
+		if set[p] {
+			o = append(o, p)
+		}
+	}
+	return o
 }
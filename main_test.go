@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestBuilder returns a builder of the requested package, reading its
+// recipes from an in-memory configuration directory, and running its
+// commands with a fake executor.
+func newTestBuilder(t *testing.T, cfg Config, recipes map[string]string) (*Builder, *fakeExecutor, *memFS) {
+	t.Helper()
+	cfg = newTestConfig(t, cfg)
+	fs := newTestFS(t, cfg, recipes)
+	x := newFakeExecutor()
+	b := newBuilder(cfg)
+	b.exec = x
+	b.fs = fs
+	return b, x, fs
+}
+
+// newTestConfig returns cfg, completed with the defaults of the tests and a
+// temporary work directory.
+func newTestConfig(t *testing.T, cfg Config) Config {
+	t.Helper()
+	if len(cfg.pkgs) == 0 {
+		cfg.pkgs = []string{"app"}
+	}
+	if cfg.cfgdir == "" {
+		cfg.cfgdir = "/alidist"
+	}
+	if cfg.arch == "" {
+		cfg.arch = "slc7_x86-64"
+	}
+	if cfg.hostArch == "" {
+		cfg.hostArch = cfg.arch
+	}
+	if cfg.defaults == "" {
+		cfg.defaults = "release"
+	}
+	cfg.wdir = t.TempDir()
+	return cfg
+}
+
+// newTestFS returns an in-memory file system holding the given recipes in
+// the configuration directory of cfg.
+func newTestFS(t *testing.T, cfg Config, recipes map[string]string) *memFS {
+	t.Helper()
+	fs := newMemFS()
+	err := fs.MkdirAll(cfg.cfgdir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range recipes {
+		err := fs.WriteFile(filepath.Join(cfg.cfgdir, name+".sh"), []byte(body), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+// testRecipe returns a recipe of the given version, with the given YAML
+// header lines and body.
+func testRecipe(pkg, version string, hdr []string, body string) string {
+	return "package: " + pkg + "\nversion: " + version + "\n" + strings.Join(hdr, "\n") + "\n---\n" + body
+}
+
+var testDefaults = testRecipe("defaults-release", "v1", nil, "")
+
+func TestResolve(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      Config
+		recipes  map[string]string
+		order    []string
+		archs    map[string]string
+		requires map[string][]string
+	}{
+		{
+			name: "chain",
+			cfg:  Config{pkgs: []string{"app"}},
+			recipes: map[string]string{
+				"defaults-release": testDefaults,
+				"app":              testRecipe("app", "v1", []string{"requires: [lib]"}, ""),
+				"lib":              testRecipe("lib", "v1", []string{"requires: [zlib]"}, ""),
+				"zlib":             testRecipe("zlib", "v1", nil, ""),
+			},
+			order: []string{"defaults-release", "zlib", "lib", "app"},
+			requires: map[string][]string{
+				"app":  {"lib", "defaults-release"},
+				"lib":  {"zlib", "defaults-release"},
+				"zlib": {"defaults-release"},
+			},
+		},
+		{
+			name: "case-insensitive",
+			cfg:  Config{pkgs: []string{"App"}},
+			recipes: map[string]string{
+				"defaults-release": testDefaults,
+				"app":              testRecipe("App", "v1", []string{"requires: [ZLib]"}, ""),
+				"zlib":             testRecipe("zlib", "v1", nil, ""),
+			},
+			order: []string{"defaults-release", "zlib", "App"},
+			requires: map[string][]string{
+				"App": {"zlib", "defaults-release"},
+			},
+		},
+		{
+			name: "arch-requires",
+			cfg:  Config{pkgs: []string{"app"}, arch: "osx_arm64"},
+			recipes: map[string]string{
+				"defaults-release": testDefaults,
+				"app":              testRecipe("app", "v1", []string{`requires: ["lib:(?!osx)", "libc++:osx.*"]`}, ""),
+				"lib":              testRecipe("lib", "v1", nil, ""),
+				"libc++":           testRecipe("libc++", "v1", nil, ""),
+			},
+			order: []string{"defaults-release", "libc++", "app"},
+			requires: map[string][]string{
+				"app": {"libc++", "defaults-release"},
+			},
+		},
+		{
+			name: "cross",
+			cfg:  Config{pkgs: []string{"app"}, arch: "ubuntu2204_aarch64", hostArch: "slc7_x86-64"},
+			recipes: map[string]string{
+				"defaults-release": testDefaults,
+				"app":              testRecipe("app", "v1", []string{"requires: [lib]", `build_requires: ["gen:slc7.*", "qemu:ubuntu.*"]`}, ""),
+				"lib":              testRecipe("lib", "v1", []string{`requires: ["zlib:ubuntu.*"]`}, ""),
+				"gen":              testRecipe("gen", "v1", []string{`requires: ["hostlib:slc7.*", "zlib:ubuntu.*"]`}, ""),
+				"zlib":             testRecipe("zlib", "v1", nil, ""),
+				"hostlib":          testRecipe("hostlib", "v1", nil, ""),
+				"qemu":             testRecipe("qemu", "v1", nil, ""),
+			},
+			order: []string{"defaults-release", "zlib", "lib", "hostlib", "gen", "app"},
+			archs: map[string]string{
+				"app":     "ubuntu2204_aarch64",
+				"lib":     "ubuntu2204_aarch64",
+				"zlib":    "ubuntu2204_aarch64",
+				"gen":     "slc7_x86-64",
+				"hostlib": "slc7_x86-64",
+			},
+			requires: map[string][]string{
+				"app": {"lib", "gen", "defaults-release"},
+				"gen": {"hostlib", "defaults-release"},
+			},
+		},
+		{
+			// tool is first needed on the host by app, then on the target
+			// by lib: the requirements selected for the host are dropped.
+			name: "cross-host-then-target",
+			cfg:  Config{pkgs: []string{"app"}, arch: "ubuntu2204_aarch64", hostArch: "slc7_x86-64"},
+			recipes: map[string]string{
+				"defaults-release": testDefaults,
+				"app":              testRecipe("app", "v1", []string{"requires: [lib]", "build_requires: [tool]"}, ""),
+				"lib":              testRecipe("lib", "v1", []string{"requires: [tool]"}, ""),
+				"tool":             testRecipe("tool", "v1", []string{`requires: ["hostlib:slc7.*"]`}, ""),
+				"hostlib":          testRecipe("hostlib", "v1", nil, ""),
+			},
+			order: []string{"defaults-release", "tool", "lib", "app"},
+			archs: map[string]string{
+				"tool": "ubuntu2204_aarch64",
+			},
+			requires: map[string][]string{
+				"tool": {"defaults-release"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _, _ := newTestBuilder(t, tc.cfg, tc.recipes)
+			err := b.resolve()
+			if err != nil {
+				t.Fatalf("could not resolve: %+v", err)
+			}
+			if got, want := b.order, tc.order; !reflect.DeepEqual(got, want) {
+				t.Fatalf("invalid build order:\ngot= %q\nwant=%q", got, want)
+			}
+			for pkg, want := range tc.archs {
+				if got := b.specs[pkg].arch; got != want {
+					t.Errorf("invalid architecture of %s: got=%q, want=%q", pkg, got, want)
+				}
+			}
+			for pkg, want := range tc.requires {
+				if got := b.specs[pkg].Requires; !reflect.DeepEqual(got, want) {
+					t.Errorf("invalid requirements of %s:\ngot= %q\nwant=%q", pkg, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	recipes := func(kvs ...string) map[string]string {
+		m := map[string]string{
+			"defaults-release": testDefaults,
+			"app":              testRecipe("app", "v1", []string{"requires: [lib]"}, "make\n"),
+			"lib":              testRecipe("lib", "v1", nil, "make\n"),
+		}
+		for i := 0; i < len(kvs); i += 2 {
+			m[kvs[i]] = kvs[i+1]
+		}
+		return m
+	}
+	hash := func(t *testing.T, cfg Config, recipes map[string]string) (string, []string) {
+		t.Helper()
+		cfg.pkgs = []string{"app"}
+		b, _, _ := newTestBuilder(t, cfg, recipes)
+		err := b.resolve()
+		if err != nil {
+			t.Fatalf("could not resolve: %+v", err)
+		}
+		spec := b.specs["app"]
+		if got := b.hash(spec); got != spec.Hash {
+			t.Fatalf("hash not reproducible: got=%s, want=%s", got, spec.Hash)
+		}
+		return spec.Hash, b.hashOptions(spec)
+	}
+	ref, opts := hash(t, Config{}, recipes())
+	if len(opts) != 0 {
+		t.Fatalf("invalid hash options: %q", opts)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		recipes map[string]string
+		same    bool
+		opts    []string
+	}{
+		{
+			name:    "same",
+			recipes: recipes(),
+			same:    true,
+		},
+		{
+			name:    "header",
+			recipes: recipes("app", testRecipe("app", "v1", []string{"requires: [lib]", "license: MIT"}, "make\n")),
+			same:    true,
+		},
+		{
+			name:    "body",
+			recipes: recipes("app", testRecipe("app", "v1", []string{"requires: [lib]"}, "make -j1\n")),
+		},
+		{
+			name:    "version",
+			recipes: recipes("app", testRecipe("app", "v2", []string{"requires: [lib]"}, "make\n")),
+		},
+		{
+			name:    "dependency",
+			recipes: recipes("lib", testRecipe("lib", "v1", nil, "make install\n")),
+		},
+		{
+			name:    "hermetic",
+			cfg:     Config{hermetic: true, keepEnv: []string{"LANG"}},
+			recipes: recipes(),
+			opts:    []string{"hermetic:LANG"},
+		},
+		{
+			name:    "keep-env",
+			cfg:     Config{hermetic: true},
+			recipes: recipes("app", testRecipe("app", "v1", []string{"requires: [lib]", "keep_env: [SSH_AUTH_SOCK]"}, "make\n")),
+			opts:    []string{"hermetic:", "keep-env:SSH_AUTH_SOCK"},
+		},
+		{
+			name:    "split-debug",
+			cfg:     Config{splitDebug: true},
+			recipes: recipes(),
+			opts:    []string{"split-debug"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, opts := hash(t, tc.cfg, tc.recipes)
+			if same := got == ref; same != tc.same {
+				t.Fatalf("invalid hash: got=%s, ref=%s (same=%v, want=%v)", got, ref, same, tc.same)
+			}
+			for _, opt := range tc.opts {
+				if !contains(opts, opt) {
+					t.Errorf("missing hash option %q: %q", opt, opts)
+				}
+			}
+		})
+	}
+}
+
+func TestDryBuild(t *testing.T) {
+	b, x, fs := newTestBuilder(t, Config{pkgs: []string{"app"}}, map[string]string{
+		"defaults-release": testDefaults,
+		"app":              testRecipe("app", "v1", []string{"requires: [lib]"}, "echo app\n"),
+		"lib":              testRecipe("lib", "v1", nil, "echo lib\n"),
+	})
+	err := b.resolve()
+	if err != nil {
+		t.Fatalf("could not resolve: %+v", err)
+	}
+	x.fn = fakeTar(fs)
+
+	err = b.build()
+	if err != nil {
+		t.Fatalf("could not build: %+v", err)
+	}
+
+	var scripts []string
+	for _, cmd := range x.commands() {
+		if strings.HasPrefix(cmd, "bash -e -x ") {
+			scripts = append(scripts, strings.TrimPrefix(cmd, "bash -e -x "))
+		}
+	}
+	if got, want := len(scripts), len(b.order); got != want {
+		t.Fatalf("invalid number of recipes run: got=%d, want=%d\n%q", got, want, x.commands())
+	}
+	for i, pkg := range b.order {
+		spec := b.specs[pkg]
+		script := scripts[i]
+		if !strings.Contains(script, "/"+pkg+"/") {
+			t.Errorf("recipe #%d: got=%s, want %s", i, script, pkg)
+		}
+		buf, err := fs.ReadFile(script)
+		if err != nil {
+			t.Fatalf("could not read build script of %s: %+v", pkg, err)
+		}
+		for _, want := range []string{
+			fmt.Sprintf("export PKGNAME=%q\n", pkg),
+			fmt.Sprintf("export PKGHASH=%q\n", spec.Hash),
+			spec.Recipe,
+		} {
+			if !strings.Contains(string(buf), want) {
+				t.Errorf("build script of %s does not hold %q:\n%s", pkg, want, buf)
+			}
+		}
+
+		buf, err = fs.ReadFile(filepath.Join(b.installDir(spec), installHashFile))
+		if err != nil {
+			t.Fatalf("%s not installed: %+v", pkg, err)
+		}
+		if got, want := strings.TrimSpace(string(buf)), spec.Hash; got != want {
+			t.Errorf("invalid installed build of %s: got=%s, want=%s", pkg, got, want)
+		}
+		if got, want := b.status[pkg], statusBuilt; got != want {
+			t.Errorf("invalid status of %s: got=%q, want=%q", pkg, got, want)
+		}
+	}
+}
+
+// fakeTar returns a simulation of the tar commands creating and extracting
+// tarballs of the files of fs.
+func fakeTar(fs *memFS) func(cmd *exec.Cmd) error {
+	type entry struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}
+	var (
+		mu       sync.Mutex
+		tarballs = make(map[string][]entry)
+	)
+	return func(cmd *exec.Cmd) error {
+		if cmd.Args[0] != "tar" {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		args := cmd.Args[1:]
+		if args[0] != "-c" && args[0] != "xf" {
+			args = args[1:] // compression
+		}
+		switch args[0] {
+		case "-c":
+			fname, members := args[2], args[3:]
+			var entries []entry
+			for _, m := range members {
+				err := walkFS(fs, filepath.Join(cmd.Dir, m), func(path string, fi os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+					e := entry{mode: fi.Mode()}
+					e.name, err = filepath.Rel(cmd.Dir, path)
+					if err == nil && fi.Mode().IsRegular() {
+						e.data, err = fs.ReadFile(path)
+					}
+					entries = append(entries, e)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+			}
+			tarballs[fname] = entries
+			return fs.WriteFile(fname, []byte(fname), 0644)
+		case "xf":
+			entries, ok := tarballs[args[1]]
+			if !ok {
+				return fmt.Errorf("tar: %s: no such tarball", args[1])
+			}
+			for _, e := range entries {
+				fname := filepath.Join(cmd.Dir, e.name)
+				var err error
+				switch {
+				case e.mode.IsDir():
+					err = fs.MkdirAll(fname, 0755)
+				default:
+					err = fs.WriteFile(fname, e.data, e.mode)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// manifestExt is the extension of the metadata manifest stored next to each
+// tarball.
+const manifestExt = ".manifest.json"
+
+// Manifest describes the tarball of a package, and how it was built.
+type Manifest struct {
+	Package      string            `json:"package"`
+	Version      string            `json:"version"`
+	Revision     string            `json:"revision"`
+	Arch         string            `json:"arch"`
+	Defaults     string            `json:"defaults"`
+	Hash         string            `json:"hash"`                   // hash of the recipe and its inputs
+	RecipeHash   string            `json:"recipe_hash,omitempty"`  // hash of the recipe alone
+	OptionsHash  string            `json:"options_hash,omitempty"` // hash of the build options entering the hash
+	Source       string            `json:"source,omitempty"`       // repository of the sources
+	Tag          string            `json:"tag,omitempty"`          // tag of the sources
+	Commit       string            `json:"commit,omitempty"`       // commit of the sources
+	Recipes      string            `json:"recipes"`                // commit of the recipes repository
+	RecipesRef   string            `json:"recipes_ref,omitempty"`  // revision of the recipes pinned with -config-ref
+	Dependencies map[string]string `json:"dependencies"`           // hashes of the dependencies
+	Host         string            `json:"host"`                   // identity of the builder
+	StartedOn    time.Time         `json:"started_on"`
+	FinishedOn   time.Time         `json:"finished_on"`
+	Tarball      string            `json:"tarball"`
+	Size         int64             `json:"size"`
+	SHA256       string            `json:"sha256"`
+	Usage        *resourceUsage    `json:"usage,omitempty"` // resource usage of the recipe
+}
+
+// writeManifest writes the manifest of the tarball of a spec next to that
+// tarball, in the local store.
+func (b *Builder) writeManifest(spec *Spec, start, end time.Time) error {
+	name := b.tarball(spec)
+	tarball := filepath.Join(spec.tar.hashDir, name)
+	fi, err := b.fs.Stat(tarball)
+	if err != nil {
+		return err
+	}
+	sum, err := sha256File(b.fs, tarball)
+	if err != nil {
+		return err
+	}
+
+	m := Manifest{
+		Package:      spec.Package,
+		Version:      spec.Version,
+		Revision:     spec.Revision,
+		Arch:         spec.arch,
+		Defaults:     b.cfg.defaults,
+		Hash:         spec.Hash,
+		RecipeHash:   digest(spec.Recipe),
+		OptionsHash:  digest(b.hashOptions(spec)...),
+		Source:       spec.Source,
+		Recipes:      b.cfghash,
+		RecipesRef:   b.cfg.configRef,
+		Dependencies: make(map[string]string, len(spec.FullRequires)),
+		Host:         builderID(),
+		StartedOn:    start.UTC(),
+		FinishedOn:   end.UTC(),
+		Tarball:      name,
+		Size:         fi.Size(),
+		SHA256:       sum,
+	}
+	if spec.Source != "" {
+		m.Tag = spec.Tag
+		m.Commit = spec.CommitHash
+	}
+	for _, dep := range spec.FullRequires {
+		if ds, ok := b.specs[dep]; ok {
+			m.Dependencies[dep] = ds.Hash
+		}
+	}
+	if u, ok := b.usage[spec.Package]; ok {
+		m.Usage = &u
+	}
+
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.fs.WriteFile(tarball+manifestExt, buf, 0644)
+}
+
+// readManifest reads the named manifest file.
+func readManifest(fs FS, fname string) (Manifest, error) {
+	var m Manifest
+	buf, err := fs.ReadFile(fname)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		return m, fmt.Errorf("could not decode manifest [%s]: %v", fname, err)
+	}
+	return m, nil
+}
+
+// manifest returns the manifest of the tarball of a spec, from the local
+// store, or else from the remote store.
+func (b *Builder) manifest(spec *Spec) (Manifest, error) {
+	spec.Revision = b.revision(spec)
+	b.locate(spec)
+	name := b.tarball(spec) + manifestExt
+	fname := filepath.Join(spec.tar.hashDir, name)
+	if !exists(fname) && b.cfg.remoteStore != "" {
+		ok, err := b.fetchFile(spec, name)
+		if err != nil {
+			return Manifest{}, err
+		}
+		if !ok {
+			return Manifest{}, fmt.Errorf("no manifest for %s@%s (%s) in the stores", spec.Package, spec.Version, spec.Hash)
+		}
+	}
+	return readManifest(b.fs, fname)
+}
+
+// printManifest writes the manifest of the tarball of the named package to w.
+func (b *Builder) printManifest(w io.Writer, pkg string) error {
+	spec, ok := b.specs[pkg]
+	if !ok {
+		return fmt.Errorf("unknown package %q", pkg)
+	}
+	m, err := b.manifest(spec)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", buf)
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// outcomes of the build of a package.
+const (
+	statusBuilding = "building" // build in progress
+	statusBuilt    = "built"
+	statusCached   = "cached" // already available from the local or remote store
+	statusShared   = "shared" // built for other defaults of the same matrix
+	statusFailed   = "FAILED"
+	statusStopped  = "interrupted"
+	statusPruned   = "pruned" // not needed: its dependents are available from the stores
+)
+
+// buildMatrix builds the requested packages once for each of the given
+// defaults, and writes the result matrix to w.
+//
+// builds under different defaults share the work directory: sources,
+// mirrors and packages whose hash coincide are only fetched or built once.
+// packages whose hash differ get different revisions.
+// a failed build does not prevent the builds under the other defaults.
+func buildMatrix(cfg Config, defaults []string, w io.Writer) error {
+	var (
+		pkgs     []string
+		seen     = make(map[string]bool)
+		hashes   = make(map[string]bool)
+		builders = make([]*Builder, len(defaults))
+		nfailed  = 0
+		revs     = new(matrixRevisions)
+	)
+	// fail early, rather than after some builds already completed.
+	for _, d := range defaults {
+		fname := filepath.Join(cfg.cfgdir, "defaults-"+strings.ToLower(d)+".sh")
+		if _, err := os.Stat(fname); err != nil {
+			return fmt.Errorf("invalid defaults %q: %v", d, err)
+		}
+	}
+
+	// all the graphs are resolved (and validated) before any build.
+	for i, d := range defaults {
+		c := cfg
+		c.defaults = d
+		builders[i] = newBuilder(c)
+		builders[i].matrix = revs
+		err := builders[i].resolve()
+		if err != nil {
+			return failure(exitResolve, fmt.Errorf("could not resolve %s with defaults %q: %v", cfg.pkgs[0], d, err))
+		}
+	}
+
+	for i, d := range defaults {
+		b := builders[i]
+		msg.Infof("building %s with defaults %q...\n", cfg.pkgs[0], d)
+		err := b.build()
+		if err == errInterrupted || err == errTimedOut {
+			return err
+		}
+		if err != nil {
+			msg.Errorf("build with defaults %q failed: %v\n", d, err)
+			nfailed++
+		}
+		for _, p := range b.order {
+			if !seen[p] {
+				seen[p] = true
+				pkgs = append(pkgs, p)
+			}
+			hash := b.specs[p].Hash
+			switch b.status[p] {
+			case statusCached:
+				if hashes[hash] {
+					b.status[p] = statusShared
+				}
+				hashes[hash] = true
+			case statusBuilt:
+				hashes[hash] = true
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PACKAGE")
+	for _, d := range defaults {
+		fmt.Fprintf(tw, "\t%s", d)
+	}
+	fmt.Fprintf(tw, "\n")
+	for _, p := range pkgs {
+		fmt.Fprintf(tw, "%s", p)
+		for _, b := range builders {
+			spec, ok := b.specs[p]
+			switch {
+			case !ok:
+				fmt.Fprintf(tw, "\t-")
+			case b.status[p] == "":
+				fmt.Fprintf(tw, "\tskipped")
+			default:
+				fmt.Fprintf(tw, "\t%s (%s)", b.status[p], spec.Hash[:7])
+			}
+		}
+		fmt.Fprintf(tw, "\n")
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if nfailed > 0 {
+		return failure(exitBuild, fmt.Errorf("builds failed for %d defaults (out of %d)", nfailed, len(defaults)))
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+func TestMatrixRevisions(t *testing.T) {
+	var m matrixRevisions
+	spec := func(hash string) *Spec {
+		return &Spec{Spec: recipe.Spec{Package: "lib", Version: "v1", Hash: hash}, arch: "slc7_x86-64"}
+	}
+	for _, tc := range []struct {
+		hash  string
+		rev   string
+		built bool
+		want  string
+	}{
+		{hash: "aaa", rev: "1", want: "1"},
+		{hash: "aaa", rev: "1", want: "1"},
+		{hash: "bbb", rev: "1", want: "2"},
+		{hash: "ccc", rev: "1", want: "3"},
+		{hash: "bbb", rev: "1", want: "2"},
+		{hash: "ddd", rev: "1", built: true, want: "1"},
+		{hash: "eee", rev: "4", want: "4"},
+	} {
+		if got := m.claim(spec(tc.hash), tc.rev, tc.built); got != tc.want {
+			t.Errorf("invalid revision of %s: got=%s, want=%s", tc.hash, got, tc.want)
+		}
+	}
+}
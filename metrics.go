@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metrics are the live metrics of the runs of a process, exposed in the
+// Prometheus text format on /metrics, with -metrics-listen or by the server.
+//
+// the gauges describe the current run; the counters accumulate over the
+// runs, as those of the build requests of the server.
+// nil metrics record nothing.
+type metrics struct {
+	mu         sync.Mutex
+	runs       int               // number of runs started
+	started    time.Time         // start of the current run
+	pkgs       []string          // packages of the current run
+	status     map[string]string // status of the packages of the current run
+	phase      map[string]string // current phase of each package, "" for the run itself
+	downloaded int64             // bytes downloaded from the remote store
+	uploaded   int64             // bytes uploaded to the write store
+	builds     map[string]int    // outcomes of the packages, over the runs
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		status: make(map[string]string),
+		phase:  make(map[string]string),
+		builds: make(map[string]int),
+	}
+}
+
+// begin starts a run of the given packages.
+func (m *metrics) begin(pkgs []string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs++
+	m.started = time.Now()
+	m.pkgs = append([]string(nil), pkgs...)
+	m.status = make(map[string]string)
+}
+
+// setStatus records the status of a package of the current run.
+func (m *metrics) setStatus(pkg, status string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status[pkg] = status
+	if status != statusBuilding {
+		m.builds[status]++
+	}
+}
+
+// enter records that a package, or the run if pkg is empty, enters a phase.
+func (m *metrics) enter(pkg, name string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.phase[pkg] = name
+	m.mu.Unlock()
+}
+
+// leave records that a package, or the run, leaves its phase.
+func (m *metrics) leave(pkg string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	delete(m.phase, pkg)
+	m.mu.Unlock()
+}
+
+// addDownloaded records n bytes downloaded from the remote store.
+func (m *metrics) addDownloaded(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.downloaded += n
+	m.mu.Unlock()
+}
+
+// addUploaded records n bytes uploaded to the write store.
+func (m *metrics) addUploaded(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.uploaded += n
+	m.mu.Unlock()
+}
+
+// write writes the metrics to w, in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	states := map[string]int{
+		"pending":  0,
+		"building": 0,
+		"done":     0,
+		"failed":   0,
+	}
+	for _, p := range m.pkgs {
+		switch m.status[p] {
+		case "":
+			states["pending"]++
+		case statusBuilding:
+			states["building"]++
+		case statusFailed, statusStopped:
+			states["failed"]++
+		default:
+			states["done"]++
+		}
+	}
+	fmt.Fprintf(w, "# HELP aligot_packages Packages of the current run, by state.\n")
+	fmt.Fprintf(w, "# TYPE aligot_packages gauge\n")
+	for _, state := range []string{"pending", "building", "done", "failed"} {
+		fmt.Fprintf(w, "aligot_packages{state=%q} %d\n", state, states[state])
+	}
+
+	fmt.Fprintf(w, "# HELP aligot_phase Current phase (resolve, hash, download, checkout, recipe, pack, install, upload) of the packages of the current run.\n")
+	fmt.Fprintf(w, "# TYPE aligot_phase gauge\n")
+	var pkgs []string
+	for p := range m.phase {
+		pkgs = append(pkgs, p)
+	}
+	sort.Strings(pkgs)
+	for _, p := range pkgs {
+		fmt.Fprintf(w, "aligot_phase{package=%q,phase=%q} 1\n", p, m.phase[p])
+	}
+
+	fmt.Fprintf(w, "# HELP aligot_run_start_time_seconds Start of the current run, since the epoch.\n")
+	fmt.Fprintf(w, "# TYPE aligot_run_start_time_seconds gauge\n")
+	start := 0.0
+	if !m.started.IsZero() {
+		start = float64(m.started.UnixNano()) / 1e9
+	}
+	fmt.Fprintf(w, "aligot_run_start_time_seconds %.3f\n", start)
+
+	fmt.Fprintf(w, "# HELP aligot_runs_total Runs started.\n")
+	fmt.Fprintf(w, "# TYPE aligot_runs_total counter\n")
+	fmt.Fprintf(w, "aligot_runs_total %d\n", m.runs)
+
+	fmt.Fprintf(w, "# HELP aligot_package_builds_total Packages built, reused or failed, by outcome.\n")
+	fmt.Fprintf(w, "# TYPE aligot_package_builds_total counter\n")
+	var outcomes []string
+	for o := range m.builds {
+		outcomes = append(outcomes, o)
+	}
+	sort.Strings(outcomes)
+	for _, o := range outcomes {
+		fmt.Fprintf(w, "aligot_package_builds_total{status=%q} %d\n", o, m.builds[o])
+	}
+
+	fmt.Fprintf(w, "# HELP aligot_downloaded_bytes_total Bytes downloaded from the remote store.\n")
+	fmt.Fprintf(w, "# TYPE aligot_downloaded_bytes_total counter\n")
+	fmt.Fprintf(w, "aligot_downloaded_bytes_total %d\n", m.downloaded)
+	fmt.Fprintf(w, "# HELP aligot_uploaded_bytes_total Bytes uploaded to the write store.\n")
+	fmt.Fprintf(w, "# TYPE aligot_uploaded_bytes_total counter\n")
+	fmt.Fprintf(w, "aligot_uploaded_bytes_total %d\n", m.uploaded)
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// serveMetrics serves the metrics on /metrics of addr, in the background.
+func serveMetrics(m *metrics, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	msg.Infof("serving metrics on [%s/metrics]...\n", addr)
+	go func() {
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			msg.Warnf("could not serve metrics on [%s]: %v\n", addr, err)
+		}
+	}()
+}
+
+// phase is a phase of a package, or of the run, traced, exposed in the
+// metrics and shown on the progress board.
+type phase struct {
+	m   *metrics
+	bd  *board
+	pkg string
+	sp  *span
+}
+
+// phase starts a phase of a package, or of the run if pkg is empty.
+func (b *Builder) phase(pkg, name string) *phase {
+	b.metrics.enter(pkg, name)
+	if b.board != nil && pkg != "" {
+		b.board.enter(pkg, name, filepath.Join(b.logDir(b.specs[pkg]), "log"))
+	}
+	return &phase{m: b.metrics, bd: b.board, pkg: pkg, sp: b.trace.start(pkg, name)}
+}
+
+// finish ends a phase, failed if err is not nil.
+func (p *phase) finish(err error) {
+	if p == nil {
+		return
+	}
+	p.m.leave(p.pkg)
+	p.bd.leave(p.pkg)
+	p.sp.finish(err)
+}
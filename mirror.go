@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// mirror copies the tarballs, manifests and links of the store from, which
+// the store to does not hold.
+// only the given architectures and packages are mirrored, if any.
+func (b *Builder) mirror(w io.Writer, from, to string, archs, pkgs []string) error {
+	src, err := b.openStore(from, false)
+	if err != nil {
+		return err
+	}
+	dst, err := b.openStore(to, true)
+	if err != nil {
+		return err
+	}
+	if src == nil || dst == nil {
+		return fmt.Errorf("mirror needs a source and a destination store (use -from and -to)")
+	}
+
+	msg.Infof("listing store [%s]...\n", src.URL())
+	walk, err := walkStore(b.ctx, src)
+	if err != nil {
+		return err
+	}
+	files := mirrorSelect(walk, archs, pkgs)
+
+	// the files the destination already holds are not copied.
+	var have map[string]bool
+	if dwalk, err := walkStore(b.ctx, dst); err == nil {
+		have = make(map[string]bool)
+		for _, fs := range dwalk.tarballs {
+			for _, f := range fs {
+				have[f] = true
+			}
+		}
+		for _, link := range dwalk.links {
+			have[link] = true
+		}
+	}
+
+	var todo []mirrorCopy
+	n := 0
+	for _, fs := range files {
+		var missing []string
+		for _, f := range fs {
+			if have != nil {
+				if !have[f] {
+					missing = append(missing, f)
+				}
+				continue
+			}
+			ok, err := dst.Exists(b.ctx, f)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				missing = append(missing, f)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		// links are uploaded with their tarball, if they are copies of it.
+		fetch := missing
+		if missing[0] != fs[0] {
+			fetch = append([]string{fs[0]}, missing...)
+		}
+		todo = append(todo, mirrorCopy{fetch: fetch, upload: missing})
+		n += len(missing)
+	}
+	if len(todo) == 0 {
+		fmt.Fprintf(w, "store [%s] is up to date with [%s]\n", dst.URL(), src.URL())
+		return nil
+	}
+
+	// files are copied through a directory next to the local store, to be
+	// hard linked from, and into, directory stores.
+	err = os.MkdirAll(filepath.Join(b.cfg.wdir, "TARS"), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(b.cfg.wdir, "TARS"), ".mirror-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	msg.Infof("copying %d files from [%s] to [%s]...\n", n, src.URL(), dst.URL())
+	prog := newProgress(os.Stderr, len(todo))
+	for _, c := range todo {
+		err := b.mirrorFiles(src, dst, tmp, c, prog)
+		if err != nil {
+			prog.close()
+			return err
+		}
+		prog.done()
+	}
+	prog.close()
+	fmt.Fprintf(w, "copied %d files from [%s] to [%s]\n", n, src.URL(), dst.URL())
+	return nil
+}
+
+// mirrorCopy describes the files of a tarball copied between stores.
+type mirrorCopy struct {
+	fetch  []string // files fetched from the source store
+	upload []string // files uploaded to the destination store
+}
+
+// mirrorFiles copies the files of a tarball from the store src to the store
+// dst, through the directory tmp.
+func (b *Builder) mirrorFiles(src, dst store.Store, tmp string, c mirrorCopy, prog store.Progress) error {
+	if err := canceled(b.ctx); err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range c.fetch {
+			os.Remove(filepath.Join(tmp, filepath.FromSlash(f)))
+		}
+	}()
+	err := src.Fetch(b.ctx, tmp, c.fetch, prog)
+	if err != nil {
+		return fmt.Errorf("could not fetch %v from [%s]: %v", c.fetch, src.URL(), err)
+	}
+	err = dst.Upload(b.ctx, tmp, c.upload)
+	if err != nil {
+		return fmt.Errorf("could not upload %v to [%s]: %v", c.upload, dst.URL(), err)
+	}
+	return nil
+}
+
+// openStore returns the named store, given by its URL or by its name in the
+// configuration file.
+func (b *Builder) openStore(name string, rw bool) (store.Store, error) {
+	url, _ := store.Parse(name)
+	return b.newStore(b.cfg.storeConfig(url), rw)
+}
+
+// mirrorSelect returns the files of a store to mirror, grouped by tarball: a
+// tarball with its companion files, followed by its links.
+// the tarballs of the given architectures (all if none) and packages (all if
+// none) are selected: the packages of the tarballs are those of their links.
+func mirrorSelect(walk storeWalk, archs, pkgs []string) [][]string {
+	keep := func(list []string, v string) bool {
+		if len(list) == 0 {
+			return true
+		}
+		for _, x := range list {
+			if x == v {
+				return true
+			}
+		}
+		return false
+	}
+
+	// links by arch and tarball name.
+	links := make(map[string][]string)
+	for _, link := range walk.links {
+		// TARS/<arch>/<package>/<tarball>
+		parts := strings.Split(link, "/")
+		if len(parts) != 4 || !keep(archs, parts[1]) || !keep(pkgs, parts[2]) {
+			continue
+		}
+		key := parts[1] + "/" + parts[3]
+		links[key] = append(links[key], link)
+	}
+
+	tarballs := make([]string, 0, len(walk.tarballs))
+	for tarball := range walk.tarballs {
+		tarballs = append(tarballs, tarball)
+	}
+	sort.Strings(tarballs)
+
+	var files [][]string
+	for _, tarball := range tarballs {
+		// TARS/<arch>/store/<hh>/<hash>/<tarball>
+		arch := strings.Split(tarball, "/")[1]
+		if !keep(archs, arch) {
+			continue
+		}
+		ls := links[arch+"/"+path.Base(tarball)]
+		if len(pkgs) > 0 && len(ls) == 0 {
+			continue
+		}
+		fs := append([]string(nil), walk.tarballs[tarball]...)
+		sort.Strings(fs)
+		files = append(files, append(fs, ls...))
+	}
+	return files
+}
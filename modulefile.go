@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// modulefilesDir returns the directory holding the modulefiles of the
+// packages installed for an architecture.
+func (b *Builder) modulefilesDir(arch string) string {
+	return filepath.Join(b.cfg.wdir, arch, "modulefiles")
+}
+
+// writeModulefile writes the Environment Modules modulefile of an installed
+// spec, under modulefilesDir.
+//
+// the modulefile sets up the runtime environment of the spec: it only loads
+// the modulefiles of its runtime requirements (which load their own), so
+// build-only tools do not leak into runtime environments.
+func (b *Builder) writeModulefile(spec *Spec) error {
+	root := b.installDir(spec)
+	name := spec.Version + "-" + spec.Revision
+
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "#%%Module1.0\n")
+	fmt.Fprintf(o, "## %s %s (%s), generated by aligot.\n", spec.Package, name, spec.Hash)
+	fmt.Fprintf(o, "module-whatis \"%s %s\"\n", spec.Package, name)
+	for _, dep := range spec.RuntimeRequires {
+		ds, ok := b.specs[dep]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(o, "module load %s/%s-%s\n", ds.Package, ds.Version, ds.Revision)
+	}
+	fmt.Fprintf(o, "setenv %s_ROOT %s\n", envName(spec.Package), root)
+	fmt.Fprintf(o, "setenv %s_VERSION %s\n", envName(spec.Package), spec.Version)
+
+	keys := make([]string, 0, len(spec.Env))
+	for k := range spec.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(o, "setenv %s {%s}\n", k, spec.Env[k])
+	}
+	for _, k := range spec.Unset {
+		fmt.Fprintf(o, "unsetenv %s\n", k)
+	}
+
+	for _, v := range searchPaths {
+		if _, err := os.Stat(filepath.Join(root, v[1])); err == nil {
+			fmt.Fprintf(o, "prepend-path %s %s\n", v[0], filepath.Join(root, v[1]))
+		}
+	}
+
+	fname := filepath.Join(b.modulefilesDir(spec.arch), spec.Package, name)
+	err := os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, o.Bytes(), 0644)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// rePlaceholder matches the placeholders of versions, e.g. %(year)s.
+var rePlaceholder = regexp.MustCompile(`%\(([a-z_]+)\)s`)
+
+// expandVersion substitutes the placeholders of the version of a spec, as
+// used by nightly recipes (e.g. nightly-%(year)s%(month)s%(day)s), so that
+// their packages are distinct each day:
+//   - year, month, day, hour: the date of the run, in UTC,
+//   - commit_hash, short_hash: the commit of the sources, and its first 10
+//     characters,
+//   - tag: the tag of the sources,
+//   - defaults_upper: the defaults, uppercased and prefixed with _, or
+//     nothing for the release defaults.
+func (b *Builder) expandVersion(spec *Spec, now time.Time) error {
+	if !strings.Contains(spec.Version, "%(") {
+		return nil
+	}
+	now = now.UTC()
+	short := spec.CommitHash
+	if len(short) > 10 {
+		short = short[:10]
+	}
+	defaults := ""
+	if b.cfg.defaults != "release" {
+		defaults = "_" + strings.ToUpper(strings.Replace(b.cfg.defaults, "-", "_", -1))
+	}
+	vars := map[string]string{
+		"year":           now.Format("2006"),
+		"month":          now.Format("01"),
+		"day":            now.Format("02"),
+		"hour":           now.Format("15"),
+		"commit_hash":    spec.CommitHash,
+		"short_hash":     short,
+		"tag":            spec.Tag,
+		"defaults_upper": defaults,
+	}
+
+	var err error
+	version := rePlaceholder.ReplaceAllStringFunc(spec.Version, func(s string) string {
+		name := rePlaceholder.FindStringSubmatch(s)[1]
+		v, ok := vars[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown placeholder %s in version %q of %s", s, spec.Version, spec.Package)
+		}
+		return v
+	})
+	if err != nil {
+		return err
+	}
+	spec.Version = strings.Replace(version, "/", "_", -1)
+	return nil
+}
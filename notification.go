@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// logExcerptLines is the number of lines of the build log of a failed
+// package included in the notifications.
+const logExcerptLines = 20
+
+// notifyRun notifies the configured channels of the outcome of a run
+// started at start.
+func (b *Builder) notifyRun(start time.Time, err error) {
+	n := b.cfg.notifications
+	if n.Slack == "" && n.Mattermost == "" && len(n.Email.To) == 0 {
+		return
+	}
+
+	spec := b.specs[b.pkgs[0]]
+	o := new(bytes.Buffer)
+	subject := fmt.Sprintf("aligot: %s@%s built", spec.Package, spec.Version)
+	if err != nil {
+		subject = fmt.Sprintf("aligot: %s@%s FAILED", spec.Package, spec.Version)
+	}
+	fmt.Fprintf(o, "%s\n\n", subject)
+	fmt.Fprintf(o, "package:  %s@%s (%s)\n", spec.Package, spec.Version, spec.Hash)
+	fmt.Fprintf(o, "arch:     %s\n", spec.arch)
+	fmt.Fprintf(o, "defaults: %s\n", b.cfg.defaults)
+	fmt.Fprintf(o, "duration: %v\n", time.Since(start).Round(time.Second))
+
+	var failed []string
+	for _, p := range b.order {
+		if b.status[p] == statusFailed {
+			failed = append(failed, p)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(o, "error:    %v\n", err)
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(o, "failed:   %s\n", strings.Join(failed, ", "))
+		for _, p := range failed {
+			excerpt := logExcerpt(filepath.Join(b.logDir(b.specs[p]), "log"), logExcerptLines)
+			if excerpt != "" {
+				fmt.Fprintf(o, "\nlast lines of the build log of %s:\n%s\n", p, excerpt)
+			}
+		}
+	}
+	b.sendNotification(subject, o.String())
+}
+
+// notifyMilestone notifies the configured channels, if requested, that the
+// main package of the run was built.
+func (b *Builder) notifyMilestone(spec *Spec) {
+	if !b.cfg.notifications.Milestones {
+		return
+	}
+	subject := fmt.Sprintf("aligot: %s@%s built", spec.Package, spec.Version)
+	text := fmt.Sprintf("%s (%s, %s), while building %s\n",
+		subject, spec.Hash, spec.arch, b.pkgs[0],
+	)
+	b.sendNotification(subject, text)
+}
+
+// sendNotification sends a notification to all the configured channels.
+// failures to notify are not fatal.
+func (b *Builder) sendNotification(subject, text string) {
+	n := b.cfg.notifications
+	for _, hook := range []struct {
+		name string
+		url  string
+	}{
+		{"Slack", n.Slack},
+		{"Mattermost", n.Mattermost},
+	} {
+		if hook.url == "" {
+			continue
+		}
+		err := postWebhook(hook.url, text)
+		if err != nil {
+			msg.Warnf("could not notify %s: %v\n", hook.name, err)
+		}
+	}
+
+	if len(n.Email.To) > 0 {
+		err := sendMail(n, subject, text)
+		if err != nil {
+			msg.Warnf("could not send notification email: %v\n", err)
+		}
+	}
+}
+
+// postWebhook posts a message to a Slack or Mattermost incoming webhook.
+func postWebhook(url, text string) error {
+	buf, err := json.Marshal(map[string]string{
+		"text": "```\n" + text + "```",
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s\n%s", resp.Status, body)
+	}
+	return nil
+}
+
+// sendMail sends a notification email.
+func sendMail(n NotifyConfig, subject, text string) error {
+	if n.Email.SMTP == "" || n.Email.From == "" {
+		return fmt.Errorf("no SMTP server or sender configured")
+	}
+	var auth smtp.Auth
+	if n.Email.User != "" {
+		host := n.Email.SMTP
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.Email.User, n.Email.Password, host)
+	}
+
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "From: %s\r\n", n.Email.From)
+	fmt.Fprintf(o, "To: %s\r\n", strings.Join(n.Email.To, ", "))
+	fmt.Fprintf(o, "Subject: %s\r\n", subject)
+	fmt.Fprintf(o, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	o.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+	return smtp.SendMail(n.Email.SMTP, auth, n.Email.From, n.Email.To, o.Bytes())
+}
+
+// logExcerpt returns the last n lines of the named log file.
+func logExcerpt(fname string, n int) string {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
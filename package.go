@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pkgFormat describes a binary package format.
+type pkgFormat struct {
+	name string // name of the format
+	dir  string // output directory, relative to the work directory
+
+	// create creates the binary package of a spec under outdir and
+	// returns its file name.
+	create func(b *Builder, spec *Spec, opts pkgOptions, outdir string) (string, error)
+}
+
+// pkgOptions holds the options of the package action.
+type pkgOptions struct {
+	closure bool   // also package the runtime closure
+	prefix  string // installation prefix of the packages
+}
+
+// packageAs converts the requested packages (and optionally their runtime
+// closure) into binary packages of the given format.
+func (b *Builder) packageAs(format pkgFormat, opts pkgOptions) error {
+	outdir := filepath.Join(b.cfg.wdir, format.dir, b.cfg.arch)
+	err := os.MkdirAll(outdir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var pkgs []string
+	switch {
+	case opts.closure:
+		seen := make(map[string]bool)
+		for _, pkg := range b.pkgs {
+			for _, p := range b.runtimeClosure(pkg) {
+				if !seen[p] {
+					seen[p] = true
+					pkgs = append(pkgs, p)
+				}
+			}
+		}
+	default:
+		pkgs = b.pkgs
+	}
+
+	for _, p := range pkgs {
+		spec, ok := b.specs[p]
+		if !ok {
+			return fmt.Errorf("no such package %q", p)
+		}
+		fname, err := format.create(b, spec, opts, outdir)
+		if err != nil {
+			return fmt.Errorf("could not package %s: %v", p, err)
+		}
+		msg.Infof("created %s package [%s]\n", format.name, fname)
+	}
+	return nil
+}
+
+// pkgName returns the name of the binary package of a spec.
+func pkgName(spec *Spec) string {
+	return "alisw-" + strings.ToLower(spec.Package)
+}
+
+// pkgDeps returns the specs a spec needs at runtime.
+func (b *Builder) pkgDeps(spec *Spec) []*Spec {
+	var deps []*Spec
+	for _, p := range spec.RuntimeRequires {
+		if dep, ok := b.specs[p]; ok {
+			deps = append(deps, dep)
+		}
+	}
+	return deps
+}
+
+// pkgInstallPath returns the installation path of a spec, relative to the
+// installation prefix.
+func pkgInstallPath(spec *Spec) string {
+	return filepath.Join(spec.arch, spec.Package, spec.Version+"-"+spec.Revision)
+}
+
+// relocScript returns a shell snippet relocating the text files of an
+// installed spec from the work directory to the installation prefix held in
+// the named shell variable.
+func (b *Builder) relocScript(spec *Spec, prefix string) string {
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "dir=\"$%s/%s\"\n", prefix, pkgInstallPath(spec))
+	fmt.Fprintf(o, "grep -rlI -F %q \"$dir\" | while read f; do\n", b.cfg.wdir)
+	fmt.Fprintf(o, "  sed -i -e \"s|%s|$%s|g\" \"$f\"\n", b.cfg.wdir, prefix)
+	fmt.Fprintf(o, "done\n")
+	fmt.Fprintf(o, "echo \"$dir\" > \"$dir/%s\"\n", installRootFile)
+	return o.String()
+}
@@ -0,0 +1,33 @@
+package main
+
+import "sync"
+
+// forEach calls f(i) for each i in [0, n), from at most workers concurrent
+// goroutines, and waits for all the calls to complete.
+func forEach(n, workers int, f func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		wg  sync.WaitGroup
+		idx = make(chan int)
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+// patchesDigest returns the digest of the patches of a spec, "" if it has
+// none: the checksums of their contents, and how they are applied.
+func patchesDigest(spec *Spec) string {
+	if len(spec.Patches) == 0 {
+		return ""
+	}
+	var vs []string
+	for _, p := range spec.Patches {
+		vs = append(vs, p.Digest, strconv.Itoa(p.Strip))
+	}
+	return digest(vs...)
+}
+
+// patchNames returns the names of the patches of a spec.
+func patchNames(spec *Spec) []string {
+	var names []string
+	for _, p := range spec.Patches {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// applyPatches applies the patches of a spec to its sources in dir, in order.
+func (b *Builder) applyPatches(spec *Spec, dir string) error {
+	for _, p := range spec.Patches {
+		fname, err := filepath.Abs(p.Path)
+		if p.URL != "" {
+			fname, err = b.fetchCached(p.URL, p.Digest)
+		}
+		if err != nil {
+			return err
+		}
+		msg.Infof("applying patch [%s] to %s\n", p.Name(), spec.Package)
+		err = b.run(dir, "patch", "--batch", "--forward", "-p"+strconv.Itoa(p.Strip), "-i", fname)
+		if err != nil {
+			return fmt.Errorf("could not apply patch [%s] to %s: %v", p.Name(), spec.Package, err)
+		}
+	}
+	return nil
+}
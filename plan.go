@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// plan returns the packages needed to build the requested packages.
+//
+// packages available from the local or the remote store are only
+// downloaded: their build requirements are not needed, unless another
+// package to be built needs them.
+// the remote store is queried for all the packages of the graph upfront.
+func (b *Builder) plan() map[string]bool {
+	avail := make([]bool, len(b.order))
+	forEach(len(b.order), b.storeJobs(), func(i int) {
+		spec := b.specs[b.order[i]]
+		native := spec.arch
+		for _, arch := range b.archCandidates(spec) {
+			b.setArch(spec, arch)
+			spec.Revision = b.revision(spec)
+			if b.locate(spec) || b.inRemote(spec) {
+				avail[i] = true
+				break
+			}
+		}
+		b.setArch(spec, native)
+		spec.Revision = b.revision(spec)
+	})
+	available := make(map[string]bool, len(b.order))
+	for i, p := range b.order {
+		available[p] = avail[i]
+	}
+
+	needed := make(map[string]bool, len(b.order))
+	var visit func(p string)
+	visit = func(p string) {
+		spec, ok := b.specs[p]
+		if !ok || needed[p] {
+			return
+		}
+		needed[p] = true
+		deps := spec.Requires
+		if available[p] {
+			deps = spec.RuntimeRequires
+		}
+		for _, dep := range deps {
+			visit(dep)
+		}
+	}
+	for _, p := range b.pkgs {
+		visit(p)
+	}
+
+	if n := len(b.order) - len(needed); n > 0 {
+		msg.Infof("%d packages not needed: their dependents are available from the stores\n", n)
+	}
+	return needed
+}
+
+// inRemote reports whether the remote store holds the tarball of a spec,
+// without downloading it.
+// stores which can not be queried are assumed not to hold it.
+func (b *Builder) inRemote(spec *Spec) bool {
+	if b.remote == nil {
+		return false
+	}
+	defer func() { spec.tar.compression = b.tarCompressions()[0] }()
+
+	names, listed, err := b.remote.List(b.ctx, spec.tar.storePath)
+	if err != nil {
+		msg.Debugf("could not list remote store for %s: %v\n", spec.Package, err)
+		return false
+	}
+	files := make(map[string]bool, len(names))
+	for _, name := range names {
+		files[name] = true
+	}
+
+	for _, c := range b.tarCompressions() {
+		spec.tar.compression = c
+		name := b.tarball(spec)
+		if listed {
+			if files[name] {
+				return true
+			}
+			continue
+		}
+		if ok, err := b.remote.Exists(b.ctx, filepath.Join(spec.tar.storePath, name)); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPrebuilt checks that the tarballs of all the needed packages are
+// available from the local store, once fetched from the remote store, and
+// reports the missing ones.
+func (b *Builder) checkPrebuilt(needed map[string]bool) error {
+	var missing []string
+	for _, p := range b.order {
+		spec := b.specs[p]
+		if !needed[p] || b.locate(spec) {
+			continue
+		}
+		missing = append(missing, fmt.Sprintf("%s@%s (hash=%s, arch=%s)",
+			spec.Package, spec.Version, spec.Hash, spec.arch,
+		))
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	store := b.cfg.remoteStore
+	if store == "" {
+		store = "none"
+	}
+	return fmt.Errorf(
+		"no prebuilt tarball for %d package(s) in the stores (remote store: %s), and local builds are disabled:\n\t%s",
+		len(missing), store, strings.Join(missing, "\n\t"),
+	)
+}
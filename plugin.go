@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// pluginPrefix is the prefix of the names of the plugin executables.
+const pluginPrefix = "aligot-"
+
+// plugins extend aligot with store backends, source fetchers and notifiers,
+// without changes to aligot itself.
+//
+// a plugin is an executable named aligot-<name>, found in $PATH.
+// plugins handling stores and sources are selected by the scheme of the URL
+// of the store or of the source: e.g. the root://eos.example.org//store store
+// is handled by aligot-root.
+// notifiers are selected by name, with the -notify flag.
+//
+// aligot runs the plugin once per request: the request is written, as a JSON
+// encoded PluginRequest, on the standard input of the plugin, and the plugin
+// writes a JSON encoded PluginResponse on its standard output.
+// the standard error of the plugin is reported when it exits with an error.
+//
+// store requests are:
+//   - fetch: downloads Files, relative to URL, into the local store Dir.
+//     the response lists the Files actually found in the store.
+//   - upload: uploads Files, relative to the local store Dir, under URL.
+//
+// source requests are:
+//   - checkout: checks out the revision Tag of the sources at URL into Dir.
+//
+// notify requests are:
+//   - build: reports the Status of the build of Package at Version, with Hash.
+
+// PluginRequest is a request sent to a plugin.
+type PluginRequest struct {
+	Kind   string `json:"kind"`   // store, source or notify
+	Action string `json:"action"` // action requested from the plugin
+
+	URL   string   `json:"url,omitempty"`   // URL of the store or of the sources
+	Dir   string   `json:"dir,omitempty"`   // local directory
+	Files []string `json:"files,omitempty"` // files, relative to URL and Dir
+	Tag   string   `json:"tag,omitempty"`   // revision of the sources
+
+	User   string `json:"user,omitempty"`   // credentials of the store
+	Secret string `json:"secret,omitempty"` // password, or token, of the store
+
+	Package string `json:"package,omitempty"`
+	Version string `json:"version,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Status  string `json:"status,omitempty"`
+}
+
+// PluginResponse is the response of a plugin to a request.
+type PluginResponse struct {
+	Error string   `json:"error,omitempty"` // error message, if the request failed
+	Files []string `json:"files,omitempty"` // files handled by the plugin
+}
+
+// builtinSchemes lists the URL schemes handled by aligot itself, never by
+// plugins.
+var builtinSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"ssh":   true,
+	"git":   true,
+	"file":  true,
+	"gs":    true,
+	"az":    true,
+}
+
+// findPlugin returns the path to the named plugin, or "" if it is not
+// installed.
+func findPlugin(name string) string {
+	path, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// schemePlugin returns the path to the plugin handling the scheme of a URL,
+// or "" if the URL is handled by aligot itself.
+func schemePlugin(url string) string {
+	i := strings.Index(url, "://")
+	if i <= 0 {
+		return ""
+	}
+	scheme := url[:i]
+	if builtinSchemes[scheme] {
+		return ""
+	}
+	return findPlugin(scheme)
+}
+
+// runPlugin sends a request to a plugin, run with x, and returns its
+// response.
+// the plugin is killed when ctx is canceled.
+func runPlugin(ctx context.Context, x Executor, plugin string, req PluginRequest) (PluginResponse, error) {
+	var resp PluginResponse
+	buf, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, plugin)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = runCmd(x, cmd)
+	if err != nil {
+		return resp, fmt.Errorf("error running plugin [%s]: %v\n%s", plugin, err, stderr.Bytes())
+	}
+
+	err = json.Unmarshal(stdout.Bytes(), &resp)
+	if err != nil {
+		return resp, fmt.Errorf("invalid response from plugin [%s]: %v", plugin, err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("plugin [%s] failed to %s: %s", plugin, req.Action, resp.Error)
+	}
+	return resp, nil
+}
+
+// notify reports the status of the build of a spec to the configured
+// notifiers.
+// notifiers failures are not fatal.
+func (b *Builder) notify(spec *Spec, status string) {
+	for _, name := range b.cfg.notifiers {
+		plugin := findPlugin(name)
+		if plugin == "" {
+			msg.Warnf("no notifier plugin %s%s in $PATH\n", pluginPrefix, name)
+			continue
+		}
+		_, err := runPlugin(b.ctx, b.exec, plugin, PluginRequest{
+			Kind:    "notify",
+			Action:  "build",
+			Package: spec.Package,
+			Version: spec.Version,
+			Hash:    spec.Hash,
+			Status:  status,
+		})
+		if err != nil {
+			msg.Warnf("could not notify %s: %v\n", name, err)
+		}
+	}
+}
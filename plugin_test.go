@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+// fakePlugin returns a simulation of a plugin, decoding its request into req
+// and replying with out, or failing with err.
+func fakePlugin(req *PluginRequest, out string, err error) func(cmd *exec.Cmd) error {
+	return func(cmd *exec.Cmd) error {
+		buf, e := ioutil.ReadAll(cmd.Stdin)
+		if e != nil {
+			return e
+		}
+		e = json.Unmarshal(buf, req)
+		if e != nil {
+			return e
+		}
+		if err != nil {
+			io.WriteString(cmd.Stderr, "plugin crashed")
+			return err
+		}
+		_, e = io.WriteString(cmd.Stdout, out)
+		return e
+	}
+}
+
+func TestRunPlugin(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		err  error
+		want string // error
+	}{
+		{name: "ok", out: `{"files": ["a.tar.gz"]}`},
+		{name: "plugin-error", out: `{"error": "no such bucket"}`, want: "failed to fetch: no such bucket"},
+		{name: "invalid-response", out: `{`, want: "invalid response"},
+		{name: "exit-error", err: fmt.Errorf("exit status 1"), want: "exit status 1\nplugin crashed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				x   = newFakeExecutor()
+				req PluginRequest
+			)
+			x.fn = fakePlugin(&req, tc.out, tc.err)
+			resp, err := runPlugin(context.Background(), x, "/bin/aligot-root", PluginRequest{
+				Kind:   "store",
+				Action: "fetch",
+				Files:  []string{"a.tar.gz"},
+			})
+			switch {
+			case tc.want == "" && err != nil:
+				t.Fatalf("could not run plugin: %+v", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Fatalf("invalid error: got=%v, want=%q", err, tc.want)
+			}
+			if got, want := x.commands(), []string{"/bin/aligot-root"}; len(got) != 1 || got[0] != want[0] {
+				t.Fatalf("invalid commands: got=%q, want=%q", got, want)
+			}
+			if req.Kind != "store" || req.Action != "fetch" {
+				t.Fatalf("invalid request: %+v", req)
+			}
+			if tc.want == "" && (len(resp.Files) != 1 || resp.Files[0] != "a.tar.gz") {
+				t.Fatalf("invalid response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir := t.TempDir()
+	plugin := filepath.Join(dir, pluginPrefix+"chat")
+	err := ioutil.WriteFile(plugin, []byte("#!/bin/sh\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	b, x, _ := newTestBuilder(t, Config{notifiers: []string{"chat", "missing"}}, nil)
+	var req PluginRequest
+	x.fn = fakePlugin(&req, `{"error": "chat is down"}`, nil)
+	spec := &Spec{Spec: recipe.Spec{Package: "app", Version: "v1", Hash: "1234"}}
+
+	// failures of the notifiers are not fatal.
+	b.notify(spec, statusBuilt)
+	if got, want := x.commands(), []string{plugin}; len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("invalid commands: got=%q, want=%q", got, want)
+	}
+	want := PluginRequest{
+		Kind:    "notify",
+		Action:  "build",
+		Package: "app",
+		Version: "v1",
+		Hash:    "1234",
+		Status:  statusBuilt,
+	}
+	if !reflect.DeepEqual(req, want) {
+		t.Fatalf("invalid request:\ngot= %+v\nwant=%+v", req, want)
+	}
+}
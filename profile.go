@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// initScript is the path, relative to the installation directory of a
+// package, of the script setting up its runtime environment.
+const initScript = "etc/profile.d/init.sh"
+
+// writeRuntimeEnv writes the modulefile and the init script of an installed
+// spec.
+func (b *Builder) writeRuntimeEnv(spec *Spec) error {
+	err := b.writeModulefile(spec)
+	if err != nil {
+		return err
+	}
+	return b.writeInitScript(spec)
+}
+
+// writeInitScript writes the init script of an installed spec, under its
+// installation directory.
+//
+// the init script is sourced to set up the runtime environment of the
+// spec, without the modules system: it sources the init scripts of its
+// runtime requirements not already set up.
+// installations are found under $WORK_DIR, which defaults to the work
+// directory.
+func (b *Builder) writeInitScript(spec *Spec) error {
+	rel := func(s *Spec) string {
+		return filepath.Join(s.arch, s.Package, s.Version+"-"+s.Revision)
+	}
+	name := envName(spec.Package)
+
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "# %s %s-%s (%s), generated by aligot.\n", spec.Package, spec.Version, spec.Revision, spec.Hash)
+	fmt.Fprintf(o, "export WORK_DIR=\"${WORK_DIR:-%s}\"\n", b.cfg.wdir)
+	for _, dep := range spec.RuntimeRequires {
+		ds, ok := b.specs[dep]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(o, "[ -n \"${%s_REVISION:-}\" ] || . \"$WORK_DIR/%s/%s\"\n",
+			envName(ds.Package), rel(ds), initScript,
+		)
+	}
+
+	for _, kv := range [][2]string{
+		{"ROOT", "$WORK_DIR/" + rel(spec)},
+		{"VERSION", spec.Version},
+		{"REVISION", spec.Revision},
+		{"HASH", spec.Hash},
+	} {
+		fmt.Fprintf(o, "export %s_%s=\"%s\"\n", name, kv[0], kv[1])
+	}
+	keys := make([]string, 0, len(spec.Env))
+	for k := range spec.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(o, "export %s=\"%s\"\n", k, spec.Env[k])
+	}
+	for _, k := range spec.Unset {
+		fmt.Fprintf(o, "unset %s\n", k)
+	}
+
+	root := b.installDir(spec)
+	for _, v := range searchPaths {
+		if _, err := os.Stat(filepath.Join(root, v[1])); err == nil {
+			fmt.Fprintf(o, "export %[1]s=\"$%[2]s_ROOT/%[3]s${%[1]s:+:$%[1]s}\"\n", v[0], name, v[1])
+		}
+	}
+
+	fname := filepath.Join(root, initScript)
+	err := b.fs.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	return b.fs.WriteFile(fname, o.Bytes(), 0644)
+}
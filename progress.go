@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progress reports the aggregate progress of concurrent downloads.
+// progress is an io.Writer counting the downloaded bytes.
+type progress struct {
+	mu    sync.Mutex
+	w     io.Writer
+	tty   bool // whether w is a terminal
+	start time.Time
+	last  time.Time // time of the last report
+
+	files int   // number of files to download
+	ndone int   // number of files downloaded
+	total int64 // number of bytes to download, as far as known
+	bytes int64 // number of bytes downloaded
+
+	metrics *metrics // metrics the downloaded bytes are also reported to
+}
+
+// newProgress returns a progress writing its reports to f, for the given
+// number of files.
+func newProgress(f *os.File, files int) *progress {
+	now := time.Now()
+	return &progress{w: f, tty: isTerminal(f), start: now, last: now, files: files}
+}
+
+// Expect declares n more bytes to download.
+func (p *progress) Expect(n int64) {
+	if n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.total += n
+	p.mu.Unlock()
+}
+
+// Add records n bytes downloaded at once.
+func (p *progress) Add(n int64) {
+	p.mu.Lock()
+	p.total += n
+	p.bytes += n
+	p.mu.Unlock()
+	p.metrics.addDownloaded(n)
+}
+
+// done records the completion of the fetch of a file.
+func (p *progress) done() {
+	p.mu.Lock()
+	p.ndone++
+	p.report(false)
+	p.mu.Unlock()
+}
+
+func (p *progress) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	p.bytes += int64(len(data))
+	p.report(false)
+	p.mu.Unlock()
+	p.metrics.addDownloaded(int64(len(data)))
+	return len(data), nil
+}
+
+// close writes the final report.
+func (p *progress) close() {
+	p.mu.Lock()
+	p.report(true)
+	if p.tty {
+		fmt.Fprintf(p.w, "\n")
+	}
+	p.mu.Unlock()
+}
+
+// report writes the current progress, at most every half-second on a
+// terminal and every 10 seconds otherwise.
+func (p *progress) report(force bool) {
+	now := time.Now()
+	every := 10 * time.Second
+	if p.tty {
+		every = 500 * time.Millisecond
+	}
+	if !force && now.Sub(p.last) < every {
+		return
+	}
+	p.last = now
+
+	eta := "?"
+	elapsed := now.Sub(p.start).Seconds()
+	if p.bytes > 0 && p.total >= p.bytes && elapsed > 0 {
+		rate := float64(p.bytes) / elapsed
+		eta = (time.Duration(float64(p.total-p.bytes)/rate) * time.Second).String()
+	}
+	line := fmt.Sprintf("fetched %d/%d tarballs, %s/%s, ETA %s",
+		p.ndone, p.files, humanBytes(p.bytes), humanBytes(p.total), eta,
+	)
+	switch {
+	case p.tty:
+		fmt.Fprintf(p.w, "\r\x1b[K%s", line)
+	default:
+		fmt.Fprintf(p.w, "%s\n", line)
+	}
+}
+
+// humanBytes returns a human readable size.
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
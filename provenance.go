@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// provenanceExt is the extension of the provenance attestation stored next
+// to each tarball.
+const provenanceExt = ".intoto.json"
+
+// Statement is an in-toto attestation statement.
+// See https://github.com/in-toto/attestation/blob/main/spec/v1/statement.md
+type Statement struct {
+	Type          string     `json:"_type"`
+	Subject       []Resource `json:"subject"`
+	PredicateType string     `json:"predicateType"`
+	Predicate     Provenance `json:"predicate"`
+}
+
+// Resource describes an artifact, identified by its name and digests.
+type Resource struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Provenance is a SLSA provenance predicate.
+// See https://slsa.dev/spec/v1.0/provenance
+type Provenance struct {
+	BuildDefinition struct {
+		BuildType            string            `json:"buildType"`
+		ExternalParameters   map[string]string `json:"externalParameters"`
+		InternalParameters   map[string]string `json:"internalParameters"`
+		ResolvedDependencies []Resource        `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string    `json:"invocationId"`
+			StartedOn    time.Time `json:"startedOn"`
+			FinishedOn   time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// builderID returns the identity of the entity running aligot.
+func builderID() string {
+	name := "unknown"
+	if usr, err := user.Current(); err == nil {
+		name = usr.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return fmt.Sprintf("aligot://%s@%s", name, host)
+}
+
+// attest writes the provenance attestation of the tarball of a spec next to
+// that tarball, in the local store.
+func (b *Builder) attest(spec *Spec, start, end time.Time) error {
+	name := b.tarball(spec)
+	tarball := filepath.Join(spec.tar.hashDir, name)
+	sum, err := sha256File(b.fs, tarball)
+	if err != nil {
+		return err
+	}
+
+	stmt := Statement{
+		Type: "https://in-toto.io/Statement/v1",
+		Subject: []Resource{{
+			Name:   name,
+			Digest: map[string]string{"sha256": sum},
+		}},
+		PredicateType: "https://slsa.dev/provenance/v1",
+	}
+
+	pred := &stmt.Predicate
+	pred.BuildDefinition.BuildType = "https://github.com/sbinet/aligot/build@v1"
+	pred.BuildDefinition.ExternalParameters = map[string]string{
+		"package":      spec.Package,
+		"version":      spec.Version,
+		"revision":     spec.Revision,
+		"architecture": spec.arch,
+		"defaults":     b.cfg.defaults,
+	}
+	pred.BuildDefinition.InternalParameters = map[string]string{
+		"hash":        spec.Hash,
+		"compression": spec.tar.compression.Name,
+	}
+
+	deps := []Resource{{
+		URI:    "git+file://" + b.cfg.cfgdir,
+		Digest: map[string]string{"gitCommit": b.cfghash},
+	}}
+	if spec.Source != "" {
+		deps = append(deps, Resource{
+			URI:    "git+" + spec.Source + "@" + spec.Tag,
+			Digest: map[string]string{"gitCommit": spec.CommitHash},
+		})
+	}
+	reqs := append([]string(nil), spec.Requires...)
+	sort.Strings(reqs)
+	for _, req := range reqs {
+		dep, ok := b.specs[req]
+		if !ok {
+			continue
+		}
+		res := Resource{
+			Name:        b.tarball(dep),
+			Digest:      make(map[string]string),
+			Annotations: map[string]string{"hash": dep.Hash},
+		}
+		if sum, err := sha256File(b.fs, filepath.Join(dep.tar.hashDir, res.Name)); err == nil {
+			res.Digest["sha256"] = sum
+		}
+		deps = append(deps, res)
+	}
+	pred.BuildDefinition.ResolvedDependencies = deps
+
+	pred.RunDetails.Builder.ID = builderID()
+	pred.RunDetails.Metadata.InvocationID = spec.Hash + "-" + spec.Revision
+	pred.RunDetails.Metadata.StartedOn = start.UTC()
+	pred.RunDetails.Metadata.FinishedOn = end.UTC()
+
+	buf, err := json.MarshalIndent(stmt, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.fs.WriteFile(tarball+provenanceExt, buf, 0644)
+}
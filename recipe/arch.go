@@ -0,0 +1,100 @@
+package recipe
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FilterByArch returns the requirements applying to an architecture, without
+// their architecture matchers.
+//
+// a requirement is a package name, optionally followed by ":" and the
+// pattern of the architectures it applies to, e.g. "GCC-Toolchain:(?!osx)".
+func FilterByArch(arch string, reqs []string) ([]string, error) {
+	o := make([]string, 0, len(reqs))
+	for _, v := range reqs {
+		req := v
+		pattern := ".*"
+		if strings.Index(v, ":") > -1 {
+			s := strings.SplitN(v, ":", 2)
+			req = s[0]
+			pattern = s[1]
+		}
+		ok, err := MatchArch(pattern, arch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid architecture matcher for requirement [%s]: %v", v, err)
+		}
+		if ok {
+			o = append(o, req)
+		}
+	}
+	return o, nil
+}
+
+// MatchArch reports whether an architecture matches the pattern of an
+// architecture-dependent requirement.
+//
+// patterns are regular expressions anchored at the start of the architecture
+// string.
+// a leading negative lookahead, as in "(?!osx)" or "(?!alpine|osx).*", is
+// supported, even though Go regular expressions do not support lookaheads.
+func MatchArch(pattern, arch string) (bool, error) {
+	if strings.HasPrefix(pattern, "^") {
+		pattern = pattern[1:]
+	}
+	if strings.HasPrefix(pattern, "(?!") {
+		end := closingParen(pattern)
+		if end < 0 {
+			return false, fmt.Errorf("unbalanced negative lookahead in %q", pattern)
+		}
+		neg, err := regexp.Compile("^(?:" + pattern[len("(?!"):end] + ")")
+		if err != nil {
+			return false, err
+		}
+		if neg.MatchString(arch) {
+			return false, nil
+		}
+		pattern = pattern[end+1:]
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")")
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(arch), nil
+}
+
+// closingParen returns the index of the parenthesis closing the group opened
+// at the start of pattern, or -1 if it is unbalanced.
+// escaped characters and character classes are skipped.
+func closingParen(pattern string) int {
+	depth := 0
+	class := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case class:
+			if c == ']' {
+				class = false
+			}
+		case c == '[':
+			class = true
+			// a leading ']' (or '^]') is a literal.
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+			}
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
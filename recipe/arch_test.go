@@ -0,0 +1,43 @@
+package recipe
+
+import "testing"
+
+func TestMatchArch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		arch    string
+		want    bool
+	}{
+		{".*", "slc7_x86-64", true},
+		{"osx", "osx_arm64", true},
+		{"osx", "slc7_x86-64", false},
+		{"^slc", "slc7_x86-64", true},
+		{"(?!osx)", "slc7_x86-64", true},
+		{"(?!osx)", "osx_arm64", false},
+		{"(?!alpine|osx).*", "alpine_x86-64", false},
+		{"(?!(slc|ubuntu))", "slc7_x86-64", false},
+		{"(?!(slc|ubuntu))", "ubuntu2204_x86-64", false},
+		{"(?!(slc|ubuntu))", "osx_arm64", true},
+		{"(?!(slc|ubuntu)).*_x86-64", "osx_x86-64", true},
+		{"(?!(slc|ubuntu)).*_x86-64", "osx_arm64", false},
+		{"(?![)]x)", ")x_x86-64", false},
+		{`(?!\)x)`, ")x_x86-64", false},
+		{`(?!\)x)`, "osx_x86-64", true},
+	} {
+		got, err := MatchArch(tc.pattern, tc.arch)
+		if err != nil {
+			t.Errorf("could not match %q against %q: %+v", tc.arch, tc.pattern, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("invalid match of %q against %q: got=%v, want=%v", tc.arch, tc.pattern, got, tc.want)
+		}
+	}
+
+	for _, pattern := range []string{"(?!osx", "(?!(slc|ubuntu)"} {
+		_, err := MatchArch(pattern, "osx_arm64")
+		if err == nil {
+			t.Errorf("expected an error for %q", pattern)
+		}
+	}
+}
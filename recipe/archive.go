@@ -0,0 +1,48 @@
+package recipe
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Archive is a source archive of a package, downloaded from an URL into its
+// source directory, besides its git sources, if any.
+// archives are verified against their SHA-256 checksum, when given.
+//
+// archives are given by their URL, or by a mapping:
+//
+//	sources:
+//	  - https://ftp.gnu.org/gnu/gsl/gsl-2.7.tar.gz
+//	  - url: https://zlib.net/zlib-1.3.1.tar.gz
+//	    sha256: 9a93...
+type Archive struct {
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256"` // checksum of the archive, if known
+}
+
+// UnmarshalYAML decodes an archive from its URL, or from a mapping.
+func (a *Archive) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var url string
+	if err := unmarshal(&url); err == nil {
+		*a = Archive{URL: url}
+		return nil
+	}
+	type archive Archive
+	var v archive
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	*a = Archive(v)
+	return nil
+}
+
+// check returns the problem of an archive, if any.
+func (a Archive) check() error {
+	switch {
+	case a.URL == "":
+		return fmt.Errorf("source archive without url")
+	case a.SHA256 != "" && !reSHA256.MatchString(strings.ToLower(a.SHA256)):
+		return fmt.Errorf("source archive %q with an invalid sha256 checksum", a.URL)
+	}
+	return nil
+}
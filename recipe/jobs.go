@@ -0,0 +1,28 @@
+package recipe
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ScaleJobs applies the jobs of a spec, a number of jobs or a percentage, to
+// n jobs.
+func ScaleJobs(jobs string, n int) (int, error) {
+	switch {
+	case jobs == "":
+		return n, nil
+	case strings.HasSuffix(jobs, "%"):
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(jobs, "%"), 64)
+		if err != nil || pct <= 0 {
+			return 0, fmt.Errorf("invalid percentage %q", jobs)
+		}
+		return int(float64(n) * pct / 100), nil
+	default:
+		v, err := strconv.Atoi(jobs)
+		if err != nil || v < 1 {
+			return 0, fmt.Errorf("invalid number of jobs %q", jobs)
+		}
+		return v, nil
+	}
+}
@@ -0,0 +1,229 @@
+package recipe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Loader loads the recipes of a configuration directory, resolving the
+// recipes they extend and the files they include.
+//
+// a recipe extending another one inherits the keys of its YAML header it
+// does not set, and its body when its own is empty; env is merged, and the
+// included files of both recipes are included.
+//
+// the recipes and included files of the override directory, if any, shadow
+// those of the configuration directory with the same name.
+type Loader struct {
+	Dir       string                            // configuration directory
+	Overrides string                            // override directory, if any
+	ReadFile  func(name string) ([]byte, error) // reads the files of Dir (default: ioutil.ReadFile)
+	Lenient   bool                              // return the problems of the recipes as warnings
+}
+
+// Load loads the recipe of the named package, and returns the warnings of
+// its recipes in lenient mode.
+func (l *Loader) Load(pkg string) (*Spec, []Diagnostic, error) {
+	return l.load(pkg, nil)
+}
+
+func (l *Loader) readFile(name string) ([]byte, error) {
+	if l.ReadFile == nil {
+		return ioutil.ReadFile(name)
+	}
+	return l.ReadFile(name)
+}
+
+// CheckName checks the name of a package, or of the recipe it extends, names
+// a recipe of the configuration directory: it may not hold a path.
+func CheckName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid package name %q", name)
+	}
+	return nil
+}
+
+// checkPath checks the relative path of an included file, or of a patch,
+// stays under the configuration directory.
+func checkPath(name string) error {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path [%s] outside of the configuration directory", name)
+	}
+	return nil
+}
+
+// open reads the named file of the configuration directory, or the file
+// shadowing it in the override directory, and returns the name of the file
+// read, and whether it is an override.
+func (l *Loader) open(name string) (string, []byte, bool, error) {
+	if err := checkPath(name); err != nil {
+		return name, nil, false, err
+	}
+	if l.Overrides != "" {
+		fname := filepath.Join(l.Overrides, name)
+		buf, err := l.readFile(fname)
+		if err == nil || !os.IsNotExist(err) {
+			return fname, buf, true, err
+		}
+	}
+	fname := filepath.Join(l.Dir, name)
+	buf, err := l.readFile(fname)
+	return fname, buf, false, err
+}
+
+func (l *Loader) load(name string, seen []string) (*Spec, []Diagnostic, error) {
+	if err := CheckName(name); err != nil {
+		return nil, nil, err
+	}
+	fname, buf, override, err := l.open(strings.ToLower(name) + ".sh")
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read file [%s]: %v", fname, err)
+	}
+	for _, v := range seen {
+		if v == fname {
+			return nil, nil, &ParseError{Diags: []Diagnostic{{
+				File: fname,
+				Msg:  fmt.Sprintf("recipe extends itself: %s", strings.Join(append(seen, fname), " -> ")),
+			}}}
+		}
+	}
+	seen = append(seen, fname)
+
+	var (
+		spec  *Spec
+		diags []Diagnostic
+	)
+	if l.Lenient {
+		spec, diags, err = ParseLenient(fname, buf)
+	} else {
+		spec, err = Parse(fname, buf)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if override {
+		spec.Overrides = append(spec.Overrides, fname)
+	}
+
+	if spec.Extends != "" {
+		base, warns, err := l.load(spec.Extends, seen)
+		diags = append(diags, warns...)
+		if err != nil {
+			return nil, diags, err
+		}
+		spec.extend(base)
+	}
+
+	// included files are resolved once, by the recipe of the package.
+	if len(seen) == 1 {
+		var body []string
+		for _, inc := range spec.Include {
+			name, buf, override, err := l.open(inc)
+			if err != nil {
+				return nil, diags, &ParseError{Diags: []Diagnostic{{
+					File: fname,
+					Msg:  fmt.Sprintf("could not include [%s]: %v", inc, err),
+				}}}
+			}
+			if override {
+				spec.Overrides = append(spec.Overrides, name)
+			}
+			body = append(body, strings.TrimRight(string(buf), "\n"))
+		}
+		if len(body) > 0 {
+			spec.Recipe = strings.Join(body, "\n") + "\n" + spec.Recipe
+		}
+
+		// patch files are read with the recipe, as their contents enter
+		// its hash.
+		patches := make([]Patch, len(spec.Patches))
+		for i, p := range spec.Patches {
+			switch {
+			case p.File != "":
+				name, buf, override, err := l.open(p.File)
+				if err != nil {
+					return nil, diags, &ParseError{Diags: []Diagnostic{{
+						File: fname,
+						Msg:  fmt.Sprintf("could not read patch [%s]: %v", p.File, err),
+					}}}
+				}
+				if override {
+					spec.Overrides = append(spec.Overrides, name)
+				}
+				sum := sha256.Sum256(buf)
+				p.Path = name
+				p.Digest = hex.EncodeToString(sum[:])
+			default:
+				p.Digest = strings.ToLower(p.SHA256)
+			}
+			patches[i] = p
+		}
+		spec.Patches = patches
+	}
+	return spec, diags, nil
+}
+
+// extend makes spec inherit the keys it does not set from base.
+func (spec *Spec) extend(base *Spec) {
+	sv := reflect.ValueOf(spec).Elem()
+	bv := reflect.ValueOf(base).Elem()
+	for i := 0; i < sv.NumField(); i++ {
+		key := strings.Split(sv.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || spec.keys[key] || !base.keys[key] {
+			continue
+		}
+		sv.Field(i).Set(bv.Field(i))
+	}
+
+	// the keys derived from others are inherited with them.
+	if !spec.keys["tag"] && !spec.keys["version"] {
+		spec.Tag = base.Tag
+	}
+	if !spec.keys["test_recipe"] && !spec.keys["check"] {
+		spec.TestRecipe = base.TestRecipe
+	}
+
+	if spec.keys["env"] && len(base.Env) > 0 {
+		env := make(map[string]string, len(base.Env)+len(spec.Env))
+		for k, v := range base.Env {
+			env[k] = v
+		}
+		for k, v := range spec.Env {
+			env[k] = v
+		}
+		spec.Env = env
+	}
+	if spec.keys["include"] {
+		include := append([]string(nil), base.Include...)
+		for _, inc := range spec.Include {
+			if !contains(include, inc) {
+				include = append(include, inc)
+			}
+		}
+		spec.Include = include
+	}
+	if strings.TrimSpace(spec.Recipe) == "" {
+		spec.Recipe = base.Recipe
+	}
+	spec.Overrides = append(spec.Overrides, base.Overrides...)
+
+	for k := range base.keys {
+		spec.keys[k] = true
+	}
+}
+
+func contains(vs []string, v string) bool {
+	for _, s := range vs {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
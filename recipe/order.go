@@ -0,0 +1,32 @@
+package recipe
+
+import "sort"
+
+// BuildOrder does a topological sort of packages, given the requirements
+// of each of them, to have the correct build order.
+//
+// adapted from gopl.io/ch5/toposort
+func BuildOrder(requires map[string][]string) []string {
+	var order []string
+	seen := make(map[string]bool)
+	var visitAll func(items []string)
+
+	visitAll = func(items []string) {
+		for _, item := range items {
+			if !seen[item] {
+				seen[item] = true
+				visitAll(requires[item])
+				order = append(order, item)
+			}
+		}
+	}
+
+	var keys []string
+	for key := range requires {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	visitAll(keys)
+	return order
+}
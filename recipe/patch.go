@@ -0,0 +1,70 @@
+package recipe
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Patch is a patch applied to the sources of a package, once checked out:
+// a file of the configuration directory, or a file downloaded from an URL
+// and verified against its SHA-256 checksum.
+//
+// patches are given by the name of their file, or by a mapping:
+//
+//	patches:
+//	  - patches/root-fix-lzma.patch
+//	  - url: https://github.com/root-project/root/pull/1234.patch
+//	    sha256: 1f2c...
+//	    strip: 0
+type Patch struct {
+	File   string `yaml:"file"`   // file of the configuration directory
+	URL    string `yaml:"url"`    // URL of the patch, when not a file
+	SHA256 string `yaml:"sha256"` // checksum of the patch downloaded from URL
+	Strip  int    `yaml:"strip"`  // leading path components stripped from the file names (default: 1)
+
+	Path   string `yaml:"-"` // file the patch was read from, for files
+	Digest string `yaml:"-"` // SHA-256 of the contents of the patch, once loaded
+}
+
+// UnmarshalYAML decodes a patch from the name of its file, or from a
+// mapping.
+func (p *Patch) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var file string
+	if err := unmarshal(&file); err == nil {
+		*p = Patch{File: file, Strip: 1}
+		return nil
+	}
+	type patch Patch
+	v := patch{Strip: 1}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	*p = Patch(v)
+	return nil
+}
+
+// Name returns the name of the patch: its file, or its URL.
+func (p Patch) Name() string {
+	if p.File != "" {
+		return p.File
+	}
+	return p.URL
+}
+
+var reSHA256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// check returns the problem of a patch, if any.
+func (p Patch) check() error {
+	switch {
+	case p.File == "" && p.URL == "":
+		return fmt.Errorf("patch without file nor url")
+	case p.File != "" && p.URL != "":
+		return fmt.Errorf("patch %q with both a file and an url", p.File)
+	case p.URL != "" && !reSHA256.MatchString(strings.ToLower(p.SHA256)):
+		return fmt.Errorf("patch %q without a valid sha256 checksum", p.URL)
+	case p.Strip < 0:
+		return fmt.Errorf("patch %q with a negative strip", p.Name())
+	}
+	return nil
+}
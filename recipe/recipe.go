@@ -0,0 +1,263 @@
+// Package recipe reads and parses the recipes of aligot, the build
+// instructions of packages in an alidist-like configuration directory.
+//
+// a recipe is a YAML header describing the package, followed by "---" and
+// the shell script building it.
+package recipe
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Spec is the description of a package, as given by its recipe.
+type Spec struct {
+	Package           string            `yaml:"package"`
+	Version           string            `yaml:"version"`
+	Requires          []string          `yaml:"requires"`
+	BuildRequires     []string          `yaml:"build_requires"`
+	RuntimeRequires   []string          `yaml:"runtime_requires"`
+	Env               map[string]string `yaml:"env"`
+	Unset             []string          `yaml:"unset"`    // variables removed from the environment
+	KeepEnv           []string          `yaml:"keep_env"` // variables kept from the environment in hermetic mode, besides -keep-env
+	Source            string            `yaml:"source"`
+	CommitHash        string            `yaml:"commit_hash"`
+	WriteRepo         string            `yaml:"write_repo"`
+	Tag               string            `yaml:"tag"`
+	TagPattern        string            `yaml:"tag_pattern"` // sources at the latest tag matching this pattern (e.g. v6-32-*)
+	Recipe            string            `yaml:"recipe"`
+	IncrementalRecipe string            `yaml:"incremental_recipe"`
+	Hash              string            `yaml:"hash"`
+	Revision          string            `yaml:"revision"`
+	License           string            `yaml:"license"`
+	NoStrip           bool              `yaml:"no_strip"` // never strip the binaries of the package
+	ValidDefaults     []string          `yaml:"valid_defaults"`
+	RelocatePaths     []string          `yaml:"relocate_paths"` // files always relocated, even binary ones
+	TestRecipe        string            `yaml:"test_recipe"`    // tests of the installed package
+	Check             string            `yaml:"check"`          // alias of test_recipe
+	Jobs              string            `yaml:"jobs"`           // number of jobs (e.g. 4), or scale of -j (e.g. 50%)
+	MaxJobs           int               `yaml:"max_jobs"`       // maximum number of jobs
+	Extends           string            `yaml:"extends"`        // base recipe, whose keys and body are inherited
+	Include           []string          `yaml:"include"`        // files of the configuration directory prepended to the body
+	Overrides         []string          `yaml:"-"`              // files of the override directory the recipe was read from
+	Aliases           map[string]string `yaml:"aliases"`        // alternative names of packages, in defaults recipes
+	Scratch           string            `yaml:"scratch"`        // scratch directory of the build (tmpfs), if not the work directory
+	Sources           []Archive         `yaml:"sources"`        // archives downloaded into the source directory
+	Patches           []Patch           `yaml:"patches"`        // patches applied to the sources, once checked out
+
+	// system requirements: packages the system must provide, on the
+	// architectures matching SystemRequirement.
+	SystemRequirement        string              `yaml:"system_requirement"`         // pattern of the architectures the package is a system requirement on
+	SystemRequirementCheck   string              `yaml:"system_requirement_check"`   // shell snippet checking the system provides the package
+	SystemRequirementMissing string              `yaml:"system_requirement_missing"` // how to install the package, when the checks fail
+	PkgConfig                []string            `yaml:"pkg_config"`                 // pkg-config modules checked, with an optional minimum version (e.g. "openssl >= 1.1")
+	CMakeConfig              []string            `yaml:"cmake_config"`               // CMake packages checked, with an optional minimum version (e.g. "ZLIB >= 1.2")
+	Homebrew                 []string            `yaml:"homebrew"`                   // Homebrew formulae providing the package on macOS (e.g. openssl@3)
+	SystemPackages           map[string][]string `yaml:"system_packages"`            // packages of the distributions (alma, fedora, ubuntu, arch) providing the package
+
+	// transitive closures of the requirements, in build order.
+	FullRequires        []string `yaml:"full_requires"`
+	FullRuntimeRequires []string `yaml:"full_runtime_requires"`
+	FullBuildRequires   []string `yaml:"full_build_requires"`
+
+	keys map[string]bool // keys set by the YAML header
+}
+
+// ignoredKeys are the keys of alidist recipes aligot does not handle, and
+// accepts without diagnostics.
+var ignoredKeys = map[string]bool{
+	"append_path":                     true,
+	"prepend_path":                    true,
+	"prefer_system":                   true,
+	"prefer_system_check":             true,
+	"prefer_system_replacement_specs": true,
+	"variables":                       true,
+	"overrides":                       true,
+	"disable":                         true,
+	"force_rebuild":                   true,
+}
+
+// Diagnostic is a problem of a recipe, at a line of its file.
+type Diagnostic struct {
+	File string
+	Line int // 0 when the problem is not at a specific line
+	Msg  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return d.File + ": " + d.Msg
+	}
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Msg)
+}
+
+// ParseError is the error of a recipe which could not be parsed.
+type ParseError struct {
+	Diags []Diagnostic
+}
+
+func (e *ParseError) Error() string {
+	lines := make([]string, len(e.Diags))
+	for i, d := range e.Diags {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Read reads and parses the named recipe file.
+func Read(fname string) (*Spec, error) {
+	buf, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file [%s]: %v", fname, err)
+	}
+	return Parse(fname, buf)
+}
+
+// Parse parses a recipe, read from the named file.
+//
+// unknown keys, duplicate keys, and values of the wrong type, are errors:
+// the returned error is then a *ParseError listing all of them, with their
+// line.
+//
+// the tag of the sources defaults to the version, and the test recipe to
+// the check of the spec.
+// the requirements are returned as written: they still hold their
+// architecture matchers.
+func Parse(name string, buf []byte) (*Spec, error) {
+	spec, diags, err := ParseLenient(name, buf)
+	if err != nil {
+		return nil, err
+	}
+	if len(diags) > 0 {
+		return nil, &ParseError{Diags: diags}
+	}
+	return spec, nil
+}
+
+// ParseLenient parses a recipe, read from the named file, as Parse does, but
+// returns its unknown keys, duplicate keys, and values of the wrong type, as
+// warnings: such keys and values are ignored.
+// the returned error, if any, is a *ParseError.
+func ParseLenient(name string, buf []byte) (*Spec, []Diagnostic, error) {
+	tokens := bytes.Split(buf, []byte("---"))
+	if len(tokens) < 2 {
+		return nil, nil, &ParseError{Diags: []Diagnostic{{
+			File: name,
+			Msg:  "missing \"---\" separator between the YAML header and the recipe",
+		}}}
+	}
+	hdr := tokens[0]
+	recipe := tokens[1]
+
+	var diags []Diagnostic
+	err := yaml.UnmarshalStrict(hdr, new(Spec))
+	switch err := err.(type) {
+	case nil:
+	case *yaml.TypeError:
+		for _, e := range err.Errors {
+			if d, ok := diagnostic(name, e); ok {
+				diags = append(diags, d)
+			}
+		}
+	default:
+		return nil, nil, &ParseError{Diags: []Diagnostic{syntaxError(name, err)}}
+	}
+
+	// values of the wrong type are left unset.
+	var spec Spec
+	err = yaml.Unmarshal(hdr, &spec)
+	if _, ok := err.(*yaml.TypeError); err != nil && !ok {
+		return nil, nil, &ParseError{Diags: []Diagnostic{syntaxError(name, err)}}
+	}
+	var keys map[string]interface{}
+	yaml.Unmarshal(hdr, &keys)
+	spec.keys = make(map[string]bool, len(keys))
+	for k := range keys {
+		spec.keys[k] = true
+	}
+
+	if spec.Tag == "" {
+		spec.Tag = spec.Version
+	}
+	spec.Version = strings.Replace(spec.Version, "/", "_", -1)
+	spec.Recipe = string(recipe)
+	if spec.TestRecipe == "" {
+		spec.TestRecipe = spec.Check
+	}
+	if _, err := ScaleJobs(spec.Jobs, 1); err != nil {
+		return nil, nil, &ParseError{Diags: []Diagnostic{{
+			File: name,
+			Line: keyLine(hdr, "jobs"),
+			Msg:  fmt.Sprintf("invalid jobs: %v", err),
+		}}}
+	}
+	for _, a := range spec.Sources {
+		if err := a.check(); err != nil {
+			return nil, nil, &ParseError{Diags: []Diagnostic{{
+				File: name,
+				Line: keyLine(hdr, "sources"),
+				Msg:  fmt.Sprintf("invalid sources: %v", err),
+			}}}
+		}
+	}
+	for _, p := range spec.Patches {
+		if err := p.check(); err != nil {
+			return nil, nil, &ParseError{Diags: []Diagnostic{{
+				File: name,
+				Line: keyLine(hdr, "patches"),
+				Msg:  fmt.Sprintf("invalid patches: %v", err),
+			}}}
+		}
+	}
+	return &spec, diags, nil
+}
+
+var (
+	reErrLine      = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	reUnknownField = regexp.MustCompile(`^field (\S+) not found in type`)
+	reDuplicateKey = regexp.MustCompile(`^key (".*") already set in map$`)
+)
+
+// diagnostic converts an error of the YAML decoder into a diagnostic.
+// diagnostic reports false for the ignored keys.
+func diagnostic(name, e string) (Diagnostic, bool) {
+	d := Diagnostic{File: name, Msg: e}
+	if m := reErrLine.FindStringSubmatch(e); m != nil {
+		d.Line, _ = strconv.Atoi(m[1])
+		d.Msg = m[2]
+	}
+	if m := reUnknownField.FindStringSubmatch(d.Msg); m != nil {
+		if ignoredKeys[m[1]] {
+			return d, false
+		}
+		d.Msg = fmt.Sprintf("unknown key %q", m[1])
+	}
+	if m := reDuplicateKey.FindStringSubmatch(d.Msg); m != nil {
+		d.Msg = "duplicate key " + m[1]
+	}
+	return d, true
+}
+
+// syntaxError converts a syntax error of the YAML decoder into a diagnostic.
+func syntaxError(name string, err error) Diagnostic {
+	d, _ := diagnostic(name, err.Error())
+	d.Msg = strings.TrimPrefix(d.Msg, "yaml: ")
+	return d
+}
+
+// keyLine returns the line of the YAML header hdr holding the top-level key,
+// or 0.
+func keyLine(hdr []byte, key string) int {
+	for i, line := range strings.Split(string(hdr), "\n") {
+		if strings.HasPrefix(line, key+":") {
+			return i + 1
+		}
+	}
+	return 0
+}
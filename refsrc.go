@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mirrorDir returns the reference mirror of the sources of a spec.
+func (b *Builder) mirrorDir(spec *Spec) string {
+	return filepath.Join(b.cfg.refsrc, strings.ToLower(spec.Package))
+}
+
+// updateMirror creates the bare reference mirror of the git sources of a
+// spec if missing, or else fetches its new commits, with -fetch-mirrors.
+// sources which can not be mirrored are cloned without their mirror: the
+// problem is only reported as a warning.
+func (b *Builder) updateMirror(spec *Spec) {
+	if !b.cfg.fetchMirrors || b.cfg.refsrc == "" || spec.Source == "" ||
+		schemePlugin(spec.Source) != "" || b.isDevel(spec.Package) {
+		return
+	}
+	env, err := b.gitEnv(spec.Source)
+	if err != nil {
+		msg.Warnf("could not update mirror of %s: %v\n", spec.Package, err)
+		return
+	}
+
+	mirror := b.mirrorDir(spec)
+	if _, err := b.fs.Stat(mirror); err == nil {
+		if b.warm.mirrorFresh(mirror) {
+			return
+		}
+		msg.Debugf("updating mirror of %s [%s]...\n", spec.Package, mirror)
+		err = runWithEnv(b.ctx, b.exec, mirror, env, "git", "fetch", "-q", "--prune", "origin")
+		if err != nil {
+			msg.Warnf("could not update mirror of %s: %v\n", spec.Package, err)
+		}
+		return
+	}
+
+	msg.Infof("creating mirror of %s [%s]...\n", spec.Package, mirror)
+	err = b.fs.MkdirAll(b.cfg.refsrc, 0755)
+	if err != nil {
+		msg.Warnf("could not create mirror of %s: %v\n", spec.Package, err)
+		return
+	}
+	// the mirror is cloned aside, so that an interrupted clone is not
+	// mistaken for a mirror.
+	tmp := mirror + ".tmp"
+	os.RemoveAll(tmp)
+	err = runWithEnv(b.ctx, b.exec, "", env, "git", "clone", "-q", "--mirror", spec.Source, tmp)
+	if err == nil {
+		err = os.Rename(tmp, mirror)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		msg.Warnf("could not create mirror of %s: %v\n", spec.Package, err)
+	}
+}
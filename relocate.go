@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// installRootFile is the file, at the top of each installed package, holding
+// the directory where its recipe installed it.
+const installRootFile = ".aligot-install-root"
+
+// installHashFile is the file, at the top of each installed package, holding
+// the hash of the installed build.
+const installHashFile = ".build-hash"
+
+// relocate rewrites the paths hard-coded in the installed files of a spec,
+// from the directory where its recipe installed them to its final location.
+//
+// text files are rewritten in place.
+// the run-time search paths of binaries are updated with patchelf on linux,
+// and the install names and run-time search paths of binaries are updated
+// with install_name_tool on macOS.
+//
+// the files matching the relocate_paths patterns of the spec, relative to the
+// installation directory, are always relocated: the paths held in their
+// binary content are rewritten in place, and their symbolic links retargeted.
+func (b *Builder) relocate(spec *Spec) error {
+	dir := b.installDir(spec)
+	buf, err := b.fs.ReadFile(filepath.Join(dir, installRootFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	from := strings.TrimSpace(string(buf))
+	if from == dir {
+		return nil
+	}
+	msg.Debugf("relocating %s from [%s] to [%s]...\n", spec.Package, from, dir)
+
+	old := []byte(from)
+	err = walkFS(b.fs, dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		forced, err := matchAny(spec.RelocatePaths, rel)
+		if err != nil {
+			return err
+		}
+		if forced && fi.Mode()&os.ModeSymlink != 0 {
+			return relocateSymlink(b.fs, path, from, dir)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		buf, err := b.fs.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(buf, old) {
+			return nil
+		}
+		switch {
+		case isMachO(buf) || isELF(buf):
+			relocateBin := b.relocateELF
+			if isMachO(buf) {
+				relocateBin = b.relocateMachO
+			}
+			err = relocateBin(path, from, dir)
+			if err != nil || !forced {
+				return err
+			}
+			// the search paths of the binary may have changed.
+			buf, err = b.fs.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return relocateBinary(b.fs, path, buf, fi.Mode(), from, dir)
+		case bytes.IndexByte(buf, 0) >= 0:
+			if forced {
+				return relocateBinary(b.fs, path, buf, fi.Mode(), from, dir)
+			}
+			msg.Debugf("not relocating binary file [%s]\n", path)
+			return nil
+		}
+		buf = bytes.Replace(buf, old, []byte(dir), -1)
+		return b.fs.WriteFile(path, buf, fi.Mode())
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.fs.WriteFile(filepath.Join(dir, installRootFile), []byte(dir+"\n"), 0644)
+}
+
+// walkFS walks the file tree of fs rooted at root, as filepath.Walk does:
+// symbolic links are not followed.
+// fn may not return filepath.SkipDir.
+func walkFS(fs FS, root string, fn filepath.WalkFunc) error {
+	fi, err := fs.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	return walkDir(fs, root, fi, fn)
+}
+
+func walkDir(fs FS, path string, fi os.FileInfo, fn filepath.WalkFunc) error {
+	err := fn(path, fi, nil)
+	if err != nil || !fi.IsDir() {
+		return err
+	}
+	fis, err := fs.ReadDir(path)
+	if err != nil {
+		return fn(path, fi, err)
+	}
+	for _, fi := range fis {
+		err = walkDir(fs, filepath.Join(path, fi.Name()), fi, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchAny reports whether the path matches one of the patterns.
+func matchAny(patterns []string, path string) (bool, error) {
+	for _, pattern := range patterns {
+		ok, err := filepath.Match(pattern, path)
+		if err != nil {
+			return false, fmt.Errorf("invalid relocate_paths pattern %q: %v", pattern, err)
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// relocateSymlink retargets a symbolic link pointing under from.
+func relocateSymlink(fs FS, fname, from, to string) error {
+	dst, err := fs.Readlink(fname)
+	if err != nil {
+		return err
+	}
+	if dst != from && !strings.HasPrefix(dst, from+"/") {
+		return nil
+	}
+	err = fs.Remove(fname)
+	if err != nil {
+		return err
+	}
+	return fs.Symlink(to+strings.TrimPrefix(dst, from), fname)
+}
+
+// relocateBinary rewrites the paths held in the NUL-terminated strings of a
+// binary file, keeping the offsets of its content: the rewritten strings are
+// padded with NUL bytes.
+// relocateBinary fails if the new location is longer than the old one.
+func relocateBinary(fs FS, fname string, buf []byte, mode os.FileMode, from, to string) error {
+	if len(to) > len(from) {
+		return fmt.Errorf("could not relocate binary file [%s]: [%s] is longer than [%s]", fname, to, from)
+	}
+	old := []byte(from)
+	n := 0
+	for i := bytes.Index(buf, old); i >= 0; {
+		end := bytes.IndexByte(buf[i:], 0)
+		if end < 0 {
+			end = len(buf) - i
+		}
+		str := buf[i : i+end]
+		repl := bytes.Replace(str, old, []byte(to), -1)
+		copy(str, repl)
+		for j := len(repl); j < len(str); j++ {
+			str[j] = 0
+		}
+		n++
+		next := bytes.Index(buf[i+end:], old)
+		if next < 0 {
+			break
+		}
+		i += end + next
+	}
+	if n == 0 {
+		return nil
+	}
+	msg.Debugf("relocated %d strings of binary file [%s]\n", n, fname)
+	return fs.WriteFile(fname, buf, mode)
+}
+
+func isELF(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte("\x7fELF"))
+}
+
+func isMachO(buf []byte) bool {
+	for _, magic := range []string{
+		"\xfe\xed\xfa\xce", "\xce\xfa\xed\xfe", // 32b
+		"\xfe\xed\xfa\xcf", "\xcf\xfa\xed\xfe", // 64b
+		"\xca\xfe\xba\xbe", // universal
+	} {
+		if bytes.HasPrefix(buf, []byte(magic)) {
+			return true
+		}
+	}
+	return false
+}
+
+// relocateELF rewrites the run-time search path of an ELF binary.
+func (b *Builder) relocateELF(fname, from, to string) error {
+	out, err := output(b.exec, exec.CommandContext(b.ctx, "patchelf", "--print-rpath", fname))
+	if err != nil {
+		msg.Debugf("could not read RPATH of [%s]: %v\n", fname, err)
+		return nil
+	}
+	rpath := strings.TrimSpace(string(out))
+	if !strings.Contains(rpath, from) {
+		return nil
+	}
+	return runWith(b.ctx, b.exec, "", "patchelf", "--set-rpath", strings.Replace(rpath, from, to, -1), fname)
+}
+
+// relocateMachO rewrites the install name, the names of the dependent
+// libraries and the run-time search paths of a Mach-O binary.
+func (b *Builder) relocateMachO(fname, from, to string) error {
+	var args []string
+	repl := func(s string) string {
+		return strings.Replace(s, from, to, -1)
+	}
+
+	out, err := output(b.exec, exec.CommandContext(b.ctx, "otool", "-D", fname))
+	if err != nil {
+		msg.Debugf("could not read install name of [%s]: %v\n", fname, err)
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) > 1 && strings.Contains(lines[1], from) {
+		args = append(args, "-id", repl(lines[1]))
+	}
+
+	out, err = output(b.exec, exec.CommandContext(b.ctx, "otool", "-L", fname))
+	if err != nil {
+		return err
+	}
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if !strings.HasPrefix(line, from) {
+			continue
+		}
+		lib := strings.Fields(line)[0]
+		args = append(args, "-change", lib, repl(lib))
+	}
+
+	out, err = output(b.exec, exec.CommandContext(b.ctx, "otool", "-l", fname))
+	if err != nil {
+		return err
+	}
+	scan = bufio.NewScanner(bytes.NewReader(out))
+	rpath := false
+	for scan.Scan() {
+		toks := strings.Fields(scan.Text())
+		switch {
+		case len(toks) == 2 && toks[0] == "cmd":
+			rpath = toks[1] == "LC_RPATH"
+		case rpath && len(toks) > 1 && toks[0] == "path" && strings.Contains(toks[1], from):
+			args = append(args, "-rpath", toks[1], repl(toks[1]))
+		}
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+	args = append(args, fname)
+	return runWith(b.ctx, b.exec, "", "install_name_tool", args...)
+}
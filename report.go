@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// reportPackage is a package of the HTML report of a run.
+type reportPackage struct {
+	Name      string
+	Version   string
+	Hash      string
+	Status    string
+	Duration  string
+	Requires  []string
+	Log       string   // URL of the build log, if any
+	Cache     string   // compiler cache hit rate, if any
+	Overrides []string // files of the override directory the recipe was read from
+}
+
+// reportData is the content of the HTML report of a run.
+type reportData struct {
+	Title    string
+	Error    string
+	Started  string
+	Finished string
+	Duration string
+	Env      [][2]string
+	Counts   [][2]string
+	Layers   [][]reportPackage
+	Packages []reportPackage
+}
+
+// writeReport writes the self-contained HTML report of a run started at
+// start, ended with err, into the configured file.
+func (b *Builder) writeReport(start time.Time, err error) error {
+	spec := b.specs[b.pkgs[0]]
+	end := time.Now()
+	data := reportData{
+		Title:    fmt.Sprintf("%s@%s", spec.Package, spec.Version),
+		Started:  start.Format(time.RFC3339),
+		Finished: end.Format(time.RFC3339),
+		Duration: end.Sub(start).Round(time.Second).String(),
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	for _, kv := range [][2]string{
+		{"architecture", b.targetArch()},
+		{"defaults", b.cfg.defaults},
+		{"work directory", b.cfg.wdir},
+		{"recipes", b.cfg.cfgdir + " (" + b.cfghash + ")"},
+		{"builder", builderID()},
+		{"host", runtime.GOOS + "/" + runtime.GOARCH},
+		{"jobs", fmt.Sprintf("%d", b.cfg.njobs)},
+		{"docker image", b.cfg.docker},
+		{"toolchain", b.cfg.toolchain},
+		{"build type", b.cfg.buildType},
+		{"sanitizers", strings.Join(b.cfg.sanitizers, ",")},
+		{"compiler cache", b.cfg.compilerCache},
+		{"remote store", b.cfg.remoteStore},
+		{"write store", b.cfg.writeStore},
+		{"development packages", strings.Join(b.cfg.devel, ",")},
+		{"recipe overrides", b.cfg.overrides},
+	} {
+		if kv[1] != "" {
+			data.Env = append(data.Env, kv)
+		}
+	}
+
+	counts := make(map[string]int)
+	pkgs := make(map[string]reportPackage, len(b.order))
+	for _, p := range b.order {
+		ps := b.specs[p]
+		rp := reportPackage{
+			Name:      ps.Package,
+			Version:   ps.Version,
+			Hash:      ps.Hash,
+			Status:    b.status[p],
+			Requires:  ps.Requires,
+			Overrides: ps.Overrides,
+		}
+		if rp.Status == "" {
+			rp.Status = "pending"
+		}
+		counts[rp.Status]++
+		if d, ok := b.took[p]; ok {
+			rp.Duration = d.Round(time.Second).String()
+		}
+		if log := filepath.Join(b.logDir(ps), "log"); rp.Status != statusCached && exists(log) {
+			rp.Log = "file://" + filepath.ToSlash(log)
+		}
+		if st, ok := b.ccStats[p]; ok {
+			rp.Cache = fmt.Sprintf("%.1f%%", st.rate())
+		}
+		pkgs[p] = rp
+		data.Packages = append(data.Packages, rp)
+	}
+	for _, layer := range b.layers() {
+		var row []reportPackage
+		for _, p := range layer {
+			row = append(row, pkgs[p])
+		}
+		data.Layers = append(data.Layers, row)
+	}
+	for _, st := range []string{statusBuilt, statusCached, statusPruned, statusFailed, statusStopped, "pending"} {
+		if counts[st] > 0 {
+			data.Counts = append(data.Counts, [2]string{st, fmt.Sprintf("%d", counts[st])})
+		}
+	}
+	if n := counts[statusBuilt] + counts[statusCached]; n > 0 {
+		data.Counts = append(data.Counts, [2]string{
+			"store hit rate", fmt.Sprintf("%.1f%%", 100*float64(counts[statusCached])/float64(n)),
+		})
+	}
+
+	o := new(bytes.Buffer)
+	err = reportTemplate.Execute(o, data)
+	if err != nil {
+		return err
+	}
+	fname := b.cfg.report
+	err = b.fs.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return err
+	}
+	return b.fs.WriteFile(fname, o.Bytes(), 0644)
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>aligot: {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; }
+code { font-size: 0.9em; }
+.error { color: #b00; font-weight: bold; white-space: pre-wrap; }
+.layer { display: flex; flex-wrap: wrap; gap: 0.5em; margin-bottom: 0.5em; }
+.pkg { border: 1px solid #888; border-radius: 4px; padding: 0.3em 0.6em; }
+.built { background: #cfc; }
+.cached, .shared { background: #cdf; }
+.pruned, .pending { background: #eee; color: #777; }
+.FAILED { background: #fcc; }
+.interrupted { background: #fec; }
+.override { color: #b60; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>aligot: {{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<table>
+<tr><th>started</th><td>{{.Started}}</td></tr>
+<tr><th>finished</th><td>{{.Finished}}</td></tr>
+<tr><th>duration</th><td>{{.Duration}}</td></tr>
+{{range .Counts}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+
+<h2>Dependency graph</h2>
+{{range .Layers}}<div class="layer">
+{{range .}}<a class="pkg {{.Status}}" href="#{{.Name}}" title="requires: {{range $i, $r := .Requires}}{{if $i}}, {{end}}{{$r}}{{end}}">{{.Name}}</a>
+{{end}}</div>
+{{end}}
+<h2>Packages</h2>
+<table>
+<tr><th>package</th><th>version</th><th>hash</th><th>status</th><th>duration</th><th>compiler cache</th><th>requires</th><th>log</th></tr>
+{{range .Packages}}<tr id="{{.Name}}" class="{{.Status}}">
+<td>{{.Name}}{{if .Overrides}} <span class="override" title="{{range $i, $f := .Overrides}}{{if $i}}, {{end}}{{$f}}{{end}}">(overridden)</span>{{end}}</td><td>{{.Version}}</td><td><code>{{.Hash}}</code></td><td>{{.Status}}</td><td>{{.Duration}}</td><td>{{.Cache}}</td>
+<td>{{range $i, $r := .Requires}}{{if $i}}, {{end}}<a href="#{{$r}}">{{$r}}</a>{{end}}</td>
+<td>{{if .Log}}<a href="{{.Log}}">log</a>{{end}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Environment</h2>
+<table>
+{{range .Env}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
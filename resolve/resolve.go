@@ -0,0 +1,512 @@
+// Package resolve resolves the dependency graphs of aligot packages: it loads
+// the recipes of the requested packages and of all their requirements,
+// selects the requirements of each package for the architecture it is built
+// for, and orders the packages for their builds.
+package resolve
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+// Resolver resolves the dependency graphs of packages.
+//
+// the requested packages and their runtime requirements are built for the
+// target architecture, and the build requirements, with all their own
+// requirements, for the host: the requirements of each package are selected
+// for the architecture it is built for.
+// packages are named case-insensitively.
+type Resolver struct {
+	Arch      string              // target architecture
+	HostArch  string              // architecture of the build host
+	Defaults  string              // defaults the packages are built with, from the defaults-<name> recipe
+	Aliases   map[string]string   // alternative names of packages, on top of the ones of the defaults recipe
+	Disable   map[string]struct{} // disabled packages, removed from the requirements
+	Toolchain string              // package of the toolchain, a build requirement of all the packages it does not need
+
+	// Load loads the recipe of the named package, and returns a nil spec for
+	// disabled packages.
+	// Load is called concurrently.
+	Load func(pkg string) (*recipe.Spec, error)
+
+	// Jobs is the number of recipes loaded concurrently (default: the number
+	// of CPUs).
+	Jobs int
+}
+
+// Graph is a resolved dependency graph.
+//
+// the requirements of its specs are named as in their recipe, and their
+// FullRequires, FullRuntimeRequires and FullBuildRequires closures are
+// computed, in build order.
+type Graph struct {
+	Packages  []string                // requested packages, named as in their recipe
+	Defaults  string                  // package of the defaults
+	Toolchain string                  // package of the toolchain, if any
+	Specs     map[string]*recipe.Spec // specs of the packages, by name
+	Order     []string                // build order of the packages
+	Aliases   map[string]string       // packages of the aliases, by lowercase alias
+	Names     map[string]string       // names of the packages, by lowercase name
+}
+
+// Aliases returns the alternative names of the packages, from the given
+// aliases and from the defaults recipe, keyed by their lowercase name.
+// the given aliases take precedence over those of the defaults.
+func Aliases(aliases map[string]string, defaults *recipe.Spec) map[string]string {
+	o := make(map[string]string)
+	if defaults != nil {
+		for k, v := range defaults.Aliases {
+			o[strings.ToLower(k)] = v
+		}
+	}
+	for k, v := range aliases {
+		o[strings.ToLower(k)] = v
+	}
+	return o
+}
+
+// Alias returns the name of the package the named package stands for, or
+// the named package itself when it is not an alias.
+func (g *Graph) Alias(pkg string) string {
+	if p, ok := g.Aliases[strings.ToLower(pkg)]; ok {
+		return p
+	}
+	return pkg
+}
+
+// Canonical returns the name of the named package or alias, as set by the
+// recipe of the package.
+func (g *Graph) Canonical(pkg string) string {
+	if p, ok := g.Names[strings.ToLower(g.Alias(pkg))]; ok {
+		return p
+	}
+	return pkg
+}
+
+// InOrder returns the packages of a set, in build order.
+func (g *Graph) InOrder(set map[string]bool) []string {
+	o := make([]string, 0, len(set))
+	for _, p := range g.Order {
+		if set[p] {
+			o = append(o, p)
+		}
+	}
+	return o
+}
+
+// resolution is the state of the resolution of a graph.
+type resolution struct {
+	*Resolver
+	g *Graph
+
+	mu  sync.Mutex
+	raw map[*recipe.Spec][2][]string // requirements and build requirements of the recipes
+}
+
+// Resolve resolves the dependency graph of the named packages.
+func (r *Resolver) Resolve(pkgs ...string) (*Graph, error) {
+	res := &resolution{
+		Resolver: r,
+		g: &Graph{
+			Specs: make(map[string]*recipe.Spec),
+			Names: make(map[string]string),
+		},
+		raw: make(map[*recipe.Spec][2][]string),
+	}
+	return res.resolve(pkgs)
+}
+
+func (r *resolution) resolve(pkgs []string) (*Graph, error) {
+	g := r.g
+	type node struct {
+		pkg  string
+		host bool // whether the package is needed on the host
+	}
+	var (
+		specs = make(map[string]*recipe.Spec) // loaded recipes, nil for disabled packages
+		host  = make(map[string]bool)         // whether each visited package is only needed on the host
+	)
+	visit := func(name string, spec *recipe.Spec, onHost bool) ([]node, error) {
+		key := strings.ToLower(name)
+		host[key] = onHost
+		if spec == nil {
+			return nil, nil
+		}
+		err := r.selectRequires(spec, onHost)
+		if err != nil {
+			return nil, err
+		}
+		g.Specs[spec.Package] = spec
+		g.Names[key] = spec.Package
+		g.Names[strings.ToLower(spec.Package)] = spec.Package
+
+		var next []node
+		for _, dep := range spec.RuntimeRequires {
+			next = append(next, node{dep, onHost})
+		}
+		for _, dep := range spec.BuildRequires {
+			next = append(next, node{dep, true})
+		}
+		return next, nil
+	}
+
+	// the aliases of the defaults apply to the requirements of all the
+	// recipes.
+	name := "defaults-" + r.Defaults
+	defaults, err := r.load(name)
+	if err != nil {
+		return nil, err
+	}
+	specs[strings.ToLower(name)] = defaults
+	next, err := visit(name, defaults, true)
+	if err != nil {
+		return nil, err
+	}
+	g.Aliases = Aliases(r.Aliases, defaults)
+	var nodes []node
+	for _, pkg := range pkgs {
+		nodes = append(nodes, node{pkg, false})
+	}
+	nodes = append(nodes, next...)
+	if r.Toolchain != "" {
+		nodes = append(nodes, node{r.Toolchain, true})
+	}
+
+	// recipes are read and parsed concurrently, one layer of the dependency
+	// graph at a time.
+	// packages first visited on the host are visited again when they are
+	// also needed on the target.
+	for len(nodes) > 0 {
+		var (
+			keys  []string
+			layer = make(map[string]node)
+		)
+		for _, n := range nodes {
+			n.pkg = g.Alias(n.pkg)
+			key := strings.ToLower(n.pkg)
+			if h, ok := host[key]; ok && (!h || n.host) {
+				continue
+			}
+			if m, ok := layer[key]; ok {
+				m.host = m.host && n.host
+				layer[key] = m
+				continue
+			}
+			layer[key] = n
+			keys = append(keys, key)
+		}
+
+		var todo []string
+		for _, key := range keys {
+			if _, ok := specs[key]; !ok {
+				todo = append(todo, key)
+			}
+		}
+		loaded := make([]*recipe.Spec, len(todo))
+		errs := make([]error, len(todo))
+		r.forEach(len(todo), func(i int) {
+			loaded[i], errs[i] = r.load(layer[todo[i]].pkg)
+		})
+		for i, key := range todo {
+			if errs[i] != nil {
+				return nil, errs[i]
+			}
+			specs[key] = loaded[i]
+		}
+
+		nodes = nil
+		for _, key := range keys {
+			n := layer[key]
+			next, err := visit(n.pkg, specs[key], n.host)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, next...)
+		}
+	}
+
+	// the requested packages are named as in their recipe.
+	for _, pkg := range pkgs {
+		g.Packages = append(g.Packages, g.Canonical(pkg))
+	}
+	r.canonicalize()
+	g.Defaults = g.Canonical(name)
+	roots := append([]string{g.Defaults}, g.Packages...)
+	if r.Toolchain != "" {
+		g.Toolchain = g.Canonical(r.Toolchain)
+		roots = append(roots, g.Toolchain)
+	}
+	r.prune(roots)
+	r.useToolchain()
+
+	err = r.checkDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	requires := make(map[string][]string, len(g.Specs))
+	for p, spec := range g.Specs {
+		requires[p] = spec.Requires
+	}
+	g.Order = recipe.BuildOrder(requires)
+	r.closures()
+	return g, nil
+}
+
+// load loads the recipe of the named package, keeping its requirements
+// before their selection.
+func (r *resolution) load(pkg string) (*recipe.Spec, error) {
+	spec, err := r.Load(pkg)
+	if err != nil || spec == nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.raw[spec] = [2][]string{spec.Requires, spec.BuildRequires}
+	r.mu.Unlock()
+	return spec, nil
+}
+
+// forEach calls f for each index in [0, n), concurrently.
+func (r *resolution) forEach(n int, f func(i int)) {
+	workers := r.Jobs
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if workers > n {
+		workers = n
+	}
+
+	var (
+		wg  sync.WaitGroup
+		idx = make(chan int)
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+}
+
+// selectRequires selects the requirements of a spec for the architectures
+// they are built for: the build requirements run on the host, and so do all
+// the requirements of host packages, only needed at build time.
+//
+// Requires holds both the runtime and the build requirements, while
+// RuntimeRequires only holds the former.
+func (r *resolution) selectRequires(spec *recipe.Spec, host bool) error {
+	fn := func(arch string, args []string) ([]string, error) {
+		archs, err := recipe.FilterByArch(arch, args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", spec.Package, err)
+		}
+		o := make([]string, 0, len(archs))
+		for _, v := range archs {
+			if _, ok := r.Disable[v]; !ok {
+				o = append(o, v)
+			}
+		}
+		return o, nil
+	}
+	arch := r.Arch
+	if host {
+		arch = r.HostArch
+	}
+	raw := r.raw[spec]
+	requires, err := fn(arch, raw[0])
+	if err != nil {
+		return err
+	}
+	buildRequires, err := fn(r.HostArch, raw[1])
+	if err != nil {
+		return err
+	}
+	if spec.Package != "defaults-"+r.Defaults {
+		buildRequires = append(buildRequires, "defaults-"+r.Defaults)
+	}
+	spec.RuntimeRequires = requires
+	spec.BuildRequires = buildRequires
+	spec.Requires = append(append([]string{}, requires...), buildRequires...)
+	return nil
+}
+
+// canonicalize names the requirements of the specs as their recipes do.
+func (r *resolution) canonicalize() {
+	g := r.g
+	for _, spec := range g.Specs {
+		for _, deps := range []*[]string{&spec.Requires, &spec.BuildRequires, &spec.RuntimeRequires} {
+			for i, dep := range *deps {
+				(*deps)[i] = g.Canonical(dep)
+			}
+			*deps = uniq(*deps)
+		}
+	}
+}
+
+// uniq returns the strings of a slice, without their duplicates, in order.
+func uniq(vs []string) []string {
+	seen := make(map[string]bool, len(vs))
+	o := make([]string, 0, len(vs))
+	for _, v := range vs {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		o = append(o, v)
+	}
+	return o
+}
+
+// prune removes the packages not needed by the roots: the packages only
+// named by the requirements selected for the host of a package, before it
+// was also needed on the target.
+func (r *resolution) prune(roots []string) {
+	g := r.g
+	needed := make(map[string]bool, len(g.Specs))
+	var mark func(pkg string)
+	mark = func(pkg string) {
+		spec, ok := g.Specs[pkg]
+		if !ok || needed[pkg] {
+			return
+		}
+		needed[pkg] = true
+		for _, dep := range spec.Requires {
+			mark(dep)
+		}
+	}
+	for _, pkg := range roots {
+		mark(pkg)
+	}
+	for pkg := range g.Specs {
+		if !needed[pkg] {
+			delete(g.Specs, pkg)
+		}
+	}
+	for name, pkg := range g.Names {
+		if !needed[pkg] {
+			delete(g.Names, name)
+		}
+	}
+}
+
+// useToolchain adds the package of the toolchain, if any, to the build
+// requirements of all the packages but the ones the toolchain itself needs.
+func (r *resolution) useToolchain() {
+	g := r.g
+	if g.Toolchain == "" {
+		return
+	}
+	bootstrap := make(map[string]bool)
+	var visit func(pkg string)
+	visit = func(pkg string) {
+		if bootstrap[pkg] {
+			return
+		}
+		bootstrap[pkg] = true
+		if spec, ok := g.Specs[pkg]; ok {
+			for _, dep := range spec.Requires {
+				visit(dep)
+			}
+		}
+	}
+	visit(g.Toolchain)
+
+	for _, spec := range g.Specs {
+		if bootstrap[spec.Package] {
+			continue
+		}
+		spec.BuildRequires = append(spec.BuildRequires, g.Toolchain)
+		spec.Requires = append(spec.Requires, g.Toolchain)
+	}
+}
+
+// checkDefaults checks that the selected defaults are supported by all the
+// packages whose recipe restricts them.
+func (r *resolution) checkDefaults() error {
+	g := r.g
+	var pkgs []string
+	for pkg := range g.Specs {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+
+	var errs []string
+	for _, pkg := range pkgs {
+		spec := g.Specs[pkg]
+		if len(spec.ValidDefaults) == 0 {
+			continue
+		}
+		ok := false
+		for _, v := range spec.ValidDefaults {
+			if v == r.Defaults {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s supports defaults: %s",
+				pkg, strings.Join(spec.ValidDefaults, ", "),
+			))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("defaults %q not supported by all packages:\n\t%s",
+			r.Defaults, strings.Join(errs, "\n\t"),
+		)
+	}
+	return nil
+}
+
+// closures computes the full set of requirements of the specs,
+// FullRequires, including BuildRequires, and the subset of them which are
+// needed at runtime, FullRuntimeRequires.
+// this is done in build order so that the closures of the dependencies are
+// computed first.
+func (r *resolution) closures() {
+	g := r.g
+	for _, p := range g.Order {
+		spec := g.Specs[p]
+		full := make(map[string]bool)
+		runtime := make(map[string]bool)
+		for _, v := range []struct {
+			deps []string
+			set  map[string]bool
+			full func(*recipe.Spec) []string
+		}{
+			{spec.Requires, full, func(s *recipe.Spec) []string { return s.FullRequires }},
+			{spec.RuntimeRequires, runtime, func(s *recipe.Spec) []string { return s.FullRuntimeRequires }},
+		} {
+			for _, dep := range v.deps {
+				ds, ok := g.Specs[dep]
+				if !ok {
+					continue
+				}
+				v.set[dep] = true
+				for _, d := range v.full(ds) {
+					v.set[d] = true
+				}
+			}
+		}
+		spec.FullRequires = g.InOrder(full)
+		spec.FullRuntimeRequires = g.InOrder(runtime)
+		spec.FullBuildRequires = nil
+		for _, dep := range spec.FullRequires {
+			if !runtime[dep] {
+				spec.FullBuildRequires = append(spec.FullBuildRequires, dep)
+			}
+		}
+	}
+}
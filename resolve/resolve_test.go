@@ -0,0 +1,182 @@
+package resolve
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+func TestResolve(t *testing.T) {
+	type want struct {
+		order   []string
+		full    map[string]string // FullRequires of packages, comma-separated
+		runtime map[string]string // FullRuntimeRequires of packages, comma-separated
+		err     string
+	}
+	for _, tc := range []struct {
+		name    string
+		r       Resolver
+		recipes []recipe.Spec
+		pkg     string
+		want    want
+	}{
+		{
+			name: "simple",
+			recipes: []recipe.Spec{
+				{Package: "App", Requires: []string{"zlib"}, BuildRequires: []string{"cmake"}},
+				{Package: "zlib"},
+				{Package: "cmake"},
+			},
+			pkg: "app",
+			want: want{
+				order: []string{"defaults-release", "zlib", "cmake", "App"},
+				full: map[string]string{
+					"App":  "defaults-release,zlib,cmake",
+					"zlib": "defaults-release",
+				},
+				runtime: map[string]string{"App": "zlib", "zlib": ""},
+			},
+		},
+		{
+			name: "arch",
+			r:    Resolver{Arch: "slc7_aarch64", HostArch: "slc7_x86-64"},
+			recipes: []recipe.Spec{
+				{Package: "app", Requires: []string{"zlib:slc7_aarch64", "bz2:osx"}, BuildRequires: []string{"cmake"}},
+				{Package: "cmake", Requires: []string{"ssl:slc7_x86-64", "xz:slc7_aarch64"}},
+				{Package: "zlib"},
+				{Package: "bz2"},
+				{Package: "ssl"},
+				{Package: "xz"},
+			},
+			pkg: "app",
+			want: want{
+				order: []string{"defaults-release", "zlib", "ssl", "cmake", "app"},
+				full: map[string]string{
+					"app":   "defaults-release,zlib,ssl,cmake",
+					"cmake": "defaults-release,ssl",
+				},
+			},
+		},
+		{
+			name: "aliases",
+			r:    Resolver{Aliases: map[string]string{"Compress": "zlib"}},
+			recipes: []recipe.Spec{
+				{Package: "defaults-release", Aliases: map[string]string{"ssl": "OpenSSL"}},
+				{Package: "app", Requires: []string{"compress", "SSL"}},
+				{Package: "zlib"},
+				{Package: "OpenSSL"},
+			},
+			pkg: "app",
+			want: want{
+				order: []string{"defaults-release", "OpenSSL", "zlib", "app"},
+				full:  map[string]string{"app": "defaults-release,OpenSSL,zlib"},
+			},
+		},
+		{
+			name: "disabled",
+			r:    Resolver{Disable: map[string]struct{}{"zlib": {}}},
+			recipes: []recipe.Spec{
+				{Package: "app", Requires: []string{"zlib", "bz2"}},
+				{Package: "zlib"},
+				{Package: "bz2"},
+			},
+			pkg: "app",
+			want: want{
+				order: []string{"defaults-release", "bz2", "app"},
+				full:  map[string]string{"app": "defaults-release,bz2"},
+			},
+		},
+		{
+			name: "toolchain",
+			r:    Resolver{Toolchain: "GCC-Toolchain"},
+			recipes: []recipe.Spec{
+				{Package: "app", Requires: []string{"zlib"}},
+				{Package: "zlib"},
+				{Package: "GCC-Toolchain", BuildRequires: []string{"autotools"}},
+				{Package: "autotools"},
+			},
+			pkg: "app",
+			want: want{
+				order: []string{"defaults-release", "autotools", "GCC-Toolchain", "zlib", "app"},
+				full: map[string]string{
+					"app":           "defaults-release,autotools,GCC-Toolchain,zlib",
+					"GCC-Toolchain": "defaults-release,autotools",
+					"autotools":     "defaults-release",
+				},
+			},
+		},
+		{
+			name: "valid-defaults",
+			recipes: []recipe.Spec{
+				{Package: "app", Requires: []string{"zlib"}},
+				{Package: "zlib", ValidDefaults: []string{"o2", "alice"}},
+			},
+			pkg: "app",
+			want: want{
+				err: "defaults \"release\" not supported by all packages:\n\tzlib supports defaults: o2, alice",
+			},
+		},
+		{
+			name: "missing",
+			recipes: []recipe.Spec{
+				{Package: "app", Requires: []string{"zlib"}},
+			},
+			pkg: "app",
+			want: want{
+				err: "no recipe for zlib",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recipes := map[string]recipe.Spec{
+				"defaults-release": {Package: "defaults-release"},
+			}
+			for _, spec := range tc.recipes {
+				recipes[strings.ToLower(spec.Package)] = spec
+			}
+			r := tc.r
+			if r.Arch == "" {
+				r.Arch = "slc7_x86-64"
+				r.HostArch = "slc7_x86-64"
+			}
+			r.Defaults = "release"
+			r.Load = func(pkg string) (*recipe.Spec, error) {
+				spec, ok := recipes[strings.ToLower(pkg)]
+				if !ok {
+					return nil, fmt.Errorf("no recipe for %s", pkg)
+				}
+				if _, ok := r.Disable[spec.Package]; ok {
+					return nil, nil
+				}
+				return &spec, nil
+			}
+
+			g, err := r.Resolve(tc.pkg)
+			if tc.want.err != "" {
+				if err == nil || err.Error() != tc.want.err {
+					t.Fatalf("invalid error: got=%v, want=%q", err, tc.want.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not resolve: %v", err)
+			}
+			if !reflect.DeepEqual(g.Order, tc.want.order) {
+				t.Fatalf("invalid order:\ngot= %q\nwant=%q", g.Order, tc.want.order)
+			}
+			for pkg, want := range tc.want.full {
+				if got := strings.Join(g.Specs[pkg].FullRequires, ","); got != want {
+					t.Errorf("invalid full requires of %s:\ngot= %q\nwant=%q", pkg, got, want)
+				}
+			}
+			for pkg, want := range tc.want.runtime {
+				if got := strings.Join(g.Specs[pkg].FullRuntimeRequires, ","); got != want {
+					t.Errorf("invalid full runtime requires of %s:\ngot= %q\nwant=%q", pkg, got, want)
+				}
+			}
+		})
+	}
+}
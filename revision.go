@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// revisions caches the revisions of the packages of a run, by package and
+// architecture.
+type revisions struct {
+	mu   sync.Mutex
+	revs map[string]string
+}
+
+// revision returns the revision of a spec, for its architecture: the
+// revision of its tarball in the local or the remote store, when its hash was
+// already built, or else the revision following the last one of the same
+// version of the package in the stores.
+func (b *Builder) revision(spec *Spec) string {
+	key := spec.Package + "@" + spec.arch
+	b.revs.mu.Lock()
+	rev, ok := b.revs.revs[key]
+	b.revs.mu.Unlock()
+	if ok {
+		return rev
+	}
+
+	rev, built := b.storeRevision(spec)
+	if b.matrix != nil {
+		rev = b.matrix.claim(spec, rev, built)
+	}
+	b.revs.mu.Lock()
+	if b.revs.revs == nil {
+		b.revs.revs = make(map[string]string)
+	}
+	b.revs.revs[key] = rev
+	b.revs.mu.Unlock()
+	return rev
+}
+
+// storeRevision returns the revision of a spec in the stores, and whether its
+// hash was already built.
+func (b *Builder) storeRevision(spec *Spec) (string, bool) {
+	if revs := b.storeRevisions(spec, spec.tar.hashDir, spec.tar.storePath); len(revs) > 0 {
+		return strconv.Itoa(revs[len(revs)-1]), true
+	}
+	last := 0
+	if revs := b.storeRevisions(spec, spec.tar.linkDir, spec.tar.linksPath); len(revs) > 0 {
+		last = revs[len(revs)-1]
+	}
+	return strconv.Itoa(last + 1), false
+}
+
+// matrixRevisions holds the revisions claimed by the builds of a matrix, so
+// that different hashes of the same version of a package, built under
+// different defaults, never share a revision: they would replace each other's
+// tarball, installation directory and latest links.
+type matrixRevisions struct {
+	mu     sync.Mutex
+	hashes map[string]string // hash claiming each arch/package-version-revision
+}
+
+// claim claims the revision rev of a spec, and returns it.
+// a revision not yet built is moved past the ones claimed by other hashes.
+func (m *matrixRevisions) claim(spec *Spec, rev string, built bool) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hashes == nil {
+		m.hashes = make(map[string]string)
+	}
+	key := func(rev string) string {
+		return spec.arch + "/" + spec.Package + "-" + spec.Version + "-" + rev
+	}
+	n, err := strconv.Atoi(rev)
+	if built || err != nil {
+		if _, ok := m.hashes[key(rev)]; !ok {
+			m.hashes[key(rev)] = spec.Hash
+		}
+		return rev
+	}
+	for {
+		hash, ok := m.hashes[key(rev)]
+		if !ok || hash == spec.Hash {
+			m.hashes[key(rev)] = spec.Hash
+			return rev
+		}
+		n++
+		rev = strconv.Itoa(n)
+	}
+}
+
+// storeRevisions returns the sorted revisions of the tarballs of the version
+// of a spec, in the local store directory dir, and in the directory of the
+// remote store at path.
+func (b *Builder) storeRevisions(spec *Spec, dir, path string) []int {
+	names := b.remoteFiles(path)
+	if fis, err := b.fs.ReadDir(dir); err == nil {
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+	}
+
+	prefix := spec.Package + "-" + spec.Version + "-"
+	seen := make(map[int]bool)
+	var revs []int
+	for _, name := range names {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		i := strings.Index(rest, "."+spec.arch+".tar")
+		if i < 0 {
+			continue
+		}
+		rev, err := strconv.Atoi(rest[:i])
+		if err != nil || seen[rev] {
+			continue
+		}
+		seen[rev] = true
+		revs = append(revs, rev)
+	}
+	sort.Ints(revs)
+	return revs
+}
+
+// remoteFiles returns the names of the files of the remote store in the
+// directory at path, when it can be listed.
+func (b *Builder) remoteFiles(path string) []string {
+	if b.remote == nil {
+		return nil
+	}
+	names, _, err := b.remote.List(b.ctx, path)
+	if err != nil {
+		msg.Debugf("could not list remote store [%s]: %v\n", path, err)
+		return nil
+	}
+	return names
+}
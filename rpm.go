@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var rpmFormat = pkgFormat{
+	name:   "RPM",
+	dir:    "RPMS",
+	create: (*Builder).createRPM,
+}
+
+// rpmVersion returns a version string valid for RPM.
+func rpmVersion(v string) string {
+	return strings.Replace(v, "-", "_", -1)
+}
+
+// createRPM creates a relocatable RPM holding the installed files of a spec.
+func (b *Builder) createRPM(spec *Spec, opts pkgOptions, outdir string) (string, error) {
+	top := filepath.Join(outdir, ".build", spec.Package)
+	err := os.RemoveAll(top)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(top, 0755)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(top)
+
+	path := pkgInstallPath(spec)
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "%%define debug_package %%{nil}\n")
+	fmt.Fprintf(o, "%%define __os_install_post %%{nil}\n")
+	fmt.Fprintf(o, "Name: %s\n", pkgName(spec))
+	fmt.Fprintf(o, "Version: %s\n", rpmVersion(spec.Version))
+	fmt.Fprintf(o, "Release: %s\n", spec.Revision)
+	fmt.Fprintf(o, "Summary: %s %s built with aligot (%s)\n", spec.Package, spec.Version, spec.Hash)
+	fmt.Fprintf(o, "License: %s\n", orNone(spec.License))
+	fmt.Fprintf(o, "Prefix: %s\n", opts.prefix)
+	fmt.Fprintf(o, "AutoReqProv: no\n")
+	for _, dep := range b.pkgDeps(spec) {
+		fmt.Fprintf(o, "Requires: %s = %s-%s\n", pkgName(dep), rpmVersion(dep.Version), dep.Revision)
+	}
+	fmt.Fprintf(o, "\n%%description\n%s %s, hash %s.\n", spec.Package, spec.Version, spec.Hash)
+	fmt.Fprintf(o, "\n%%install\n")
+	fmt.Fprintf(o, "mkdir -p %%{buildroot}%s/%s\n", opts.prefix, filepath.Dir(path))
+	fmt.Fprintf(o, "cp -a %s %%{buildroot}%s/%s\n", b.installDir(spec), opts.prefix, path)
+	fmt.Fprintf(o, "\n%%post\n%s", b.relocScript(spec, "RPM_INSTALL_PREFIX"))
+	fmt.Fprintf(o, "\n%%files\n%s/%s\n", opts.prefix, path)
+
+	fname := filepath.Join(top, spec.Package+".spec")
+	err = ioutil.WriteFile(fname, o.Bytes(), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	err = b.run(top, "rpmbuild", "-bb",
+		"--define", "_topdir "+top,
+		"--define", "_rpmdir "+outdir,
+		"--define", "_build_name_fmt %{NAME}-%{VERSION}-%{RELEASE}.%{ARCH}.rpm",
+		fname,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(
+		outdir,
+		fmt.Sprintf("%s-%s-%s.*.rpm", pkgName(spec), rpmVersion(spec.Version), spec.Revision),
+	))
+	if err != nil || len(matches) == 0 {
+		return "", fmt.Errorf("could not find RPM for %s", spec.Package)
+	}
+	return matches[0], nil
+}
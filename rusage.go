@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// resourceUsage is the resource usage of the recipe of a package.
+type resourceUsage struct {
+	UserCPU    float64 `json:"user_cpu"`    // in seconds
+	SystemCPU  float64 `json:"system_cpu"`  // in seconds
+	MaxRSS     int64   `json:"max_rss"`     // in bytes, of the largest process
+	ReadBytes  int64   `json:"read_bytes"`  // read from the block devices
+	WriteBytes int64   `json:"write_bytes"` // written to the block devices
+}
+
+// cpu returns the CPU time of a resource usage.
+func (u resourceUsage) cpu() time.Duration {
+	return time.Duration((u.UserCPU + u.SystemCPU) * float64(time.Second))
+}
+
+// usageFile returns the file where the recipe of a spec, run in a container,
+// reports the resource usage of its cgroup.
+func (b *Builder) usageFile(spec *Spec) string {
+	return filepath.Join(b.logDir(spec), "rusage")
+}
+
+// cgroupUsageScript wraps the recipe run in a container ($1), writing the
+// statistics of the cgroup of the container (v2) to $2 once it exits: the
+// resource usage of the docker client says nothing of the recipe.
+const cgroupUsageScript = `bash -e -x "$1"; rc=$?
+{
+  cat /sys/fs/cgroup/cpu.stat /sys/fs/cgroup/io.stat
+  echo "memory.peak $(cat /sys/fs/cgroup/memory.peak)"
+} > "$2" 2>/dev/null
+exit $rc`
+
+// recordUsage records the resource usage of the recipe of a spec, run by
+// cmd: from its rusage when run natively, from the statistics of its cgroup
+// when run in a container.
+func (b *Builder) recordUsage(spec *Spec, cmd *exec.Cmd) {
+	var (
+		u   resourceUsage
+		ok  bool
+		err error
+	)
+	switch b.cfg.docker {
+	case "":
+		u, ok = processUsage(cmd.ProcessState)
+	default:
+		u, ok, err = cgroupUsage(b.usageFile(spec))
+		if err != nil {
+			msg.Debugf("could not read resource usage of %s: %v\n", spec.Package, err)
+		}
+	}
+	if ok {
+		b.usage[spec.Package] = u
+	}
+}
+
+// processUsage returns the resource usage of an exited process, and of its
+// descendants it waited for.
+func processUsage(ps *os.ProcessState) (resourceUsage, bool) {
+	if ps == nil {
+		return resourceUsage{}, false
+	}
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return resourceUsage{}, false
+	}
+	u := resourceUsage{
+		UserCPU:   ps.UserTime().Seconds(),
+		SystemCPU: ps.SystemTime().Seconds(),
+		MaxRSS:    int64(ru.Maxrss),
+		// blocks of 512 bytes.
+		ReadBytes:  int64(ru.Inblock) * 512,
+		WriteBytes: int64(ru.Oublock) * 512,
+	}
+	// the maximum resident set size is in kilobytes, but on macOS.
+	if runtime.GOOS != "darwin" {
+		u.MaxRSS *= 1024
+	}
+	return u, true
+}
+
+// cgroupUsage returns the resource usage read from the statistics of a cgroup
+// written to fname by cgroupUsageScript.
+func cgroupUsage(fname string) (resourceUsage, bool, error) {
+	var u resourceUsage
+	f, err := os.Open(fname)
+	if err != nil {
+		return u, false, err
+	}
+	defer f.Close()
+
+	ok := false
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "user_usec":
+			v, _ := strconv.ParseInt(fields[1], 10, 64)
+			u.UserCPU, ok = float64(v)/1e6, true
+		case "system_usec":
+			v, _ := strconv.ParseInt(fields[1], 10, 64)
+			u.SystemCPU, ok = float64(v)/1e6, true
+		case "memory.peak":
+			u.MaxRSS, _ = strconv.ParseInt(fields[1], 10, 64)
+		default:
+			// io.stat: <major>:<minor> rbytes=N wbytes=N ...
+			for _, kv := range fields[1:] {
+				switch {
+				case strings.HasPrefix(kv, "rbytes="):
+					v, _ := strconv.ParseInt(kv[len("rbytes="):], 10, 64)
+					u.ReadBytes += v
+				case strings.HasPrefix(kv, "wbytes="):
+					v, _ := strconv.ParseInt(kv[len("wbytes="):], 10, 64)
+					u.WriteBytes += v
+				}
+			}
+		}
+	}
+	return u, ok, scan.Err()
+}
+
+// usageSummary reports the resource usage of the recipes of the packages
+// built during the run, the most CPU-hungry first.
+func (b *Builder) usageSummary() {
+	if len(b.usage) == 0 {
+		return
+	}
+	var pkgs []string
+	var total resourceUsage
+	for _, p := range b.order {
+		u, ok := b.usage[p]
+		if !ok {
+			continue
+		}
+		pkgs = append(pkgs, p)
+		total.UserCPU += u.UserCPU
+		total.SystemCPU += u.SystemCPU
+		total.ReadBytes += u.ReadBytes
+		total.WriteBytes += u.WriteBytes
+		if u.MaxRSS > total.MaxRSS {
+			total.MaxRSS = u.MaxRSS
+		}
+	}
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return b.usage[pkgs[i]].cpu() > b.usage[pkgs[j]].cpu()
+	})
+	msg.Infof("resource usage:\n")
+	line := func(name string, u resourceUsage) {
+		msg.Infof("  %-24s cpu=%-10v max-rss=%-10s read=%-10s written=%s\n",
+			name, u.cpu().Round(10*time.Millisecond), humanBytes(u.MaxRSS),
+			humanBytes(u.ReadBytes), humanBytes(u.WriteBytes),
+		)
+	}
+	for _, p := range pkgs {
+		line(p, b.usage[p])
+	}
+	if len(pkgs) > 1 {
+		line("total", total)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// sandboxArgs wraps the command line running the recipe of a spec so that it
+// runs inside a sandbox.
+//
+// with bubblewrap, the whole filesystem is mounted read-only except for the
+// build and install directories of the spec, the directory of the compiler
+// cache, if enabled (and a private /tmp.)
+// without bubblewrap, only the network can be disabled, with unshare.
+func (b *Builder) sandboxArgs(spec *Spec, args []string) ([]string, error) {
+	if bwrap, err := exec.LookPath("bwrap"); err == nil {
+		o := []string{
+			bwrap,
+			"--die-with-parent",
+			"--ro-bind", "/", "/",
+			"--dev", "/dev",
+			"--proc", "/proc",
+			"--tmpfs", "/tmp",
+		}
+		if b.cfg.sandbox {
+			dirs := []string{b.buildDir(spec), b.recipeInstallRoot(spec)}
+			if b.cfg.compilerCache != "" {
+				// the cache must exist to be mounted.
+				dir := b.compilerCacheDir()
+				err := b.fs.MkdirAll(dir, 0755)
+				if err != nil {
+					return nil, err
+				}
+				dirs = append(dirs, dir)
+			}
+			for _, dir := range dirs {
+				o = append(o, "--bind", dir, dir)
+			}
+		} else {
+			o = append(o, "--bind", b.cfg.wdir, b.cfg.wdir)
+			if dir := b.scratchDir(spec); dir != b.cfg.wdir {
+				o = append(o, "--bind", dir, dir)
+			}
+		}
+		if b.cfg.noNetwork {
+			o = append(o, "--unshare-net")
+		}
+		return append(o, args...), nil
+	}
+
+	if b.cfg.sandbox {
+		return nil, fmt.Errorf("sandboxed builds need bubblewrap (bwrap) to be installed")
+	}
+
+	unshare, err := exec.LookPath("unshare")
+	if err != nil {
+		return nil, fmt.Errorf("disabling network needs bubblewrap (bwrap) or unshare to be installed")
+	}
+	o := []string{unshare, "--net", "--map-root-user"}
+	return append(o, args...), nil
+}
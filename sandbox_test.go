@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+func TestSandboxArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		tools []string // tools installed in $PATH
+		want  func(b *Builder, spec *Spec) []string
+		err   string
+	}{
+		{
+			name:  "sandbox",
+			cfg:   Config{sandbox: true},
+			tools: []string{"bwrap"},
+			want: func(b *Builder, spec *Spec) []string {
+				return []string{
+					"--bind", b.buildDir(spec), b.buildDir(spec),
+					"--bind", b.recipeInstallRoot(spec), b.recipeInstallRoot(spec),
+				}
+			},
+		},
+		{
+			name:  "sandbox-ccache",
+			cfg:   Config{sandbox: true, compilerCache: "ccache"},
+			tools: []string{"bwrap"},
+			want: func(b *Builder, spec *Spec) []string {
+				return []string{
+					"--bind", b.buildDir(spec), b.buildDir(spec),
+					"--bind", b.recipeInstallRoot(spec), b.recipeInstallRoot(spec),
+					"--bind", filepath.Join(b.cfg.wdir, "CCACHE"), filepath.Join(b.cfg.wdir, "CCACHE"),
+				}
+			},
+		},
+		{
+			name:  "sandbox-sccache-no-network",
+			cfg:   Config{sandbox: true, noNetwork: true, compilerCache: "sccache"},
+			tools: []string{"bwrap"},
+			want: func(b *Builder, spec *Spec) []string {
+				return []string{
+					"--bind", b.buildDir(spec), b.buildDir(spec),
+					"--bind", b.recipeInstallRoot(spec), b.recipeInstallRoot(spec),
+					"--bind", filepath.Join(b.cfg.wdir, "SCCACHE"), filepath.Join(b.cfg.wdir, "SCCACHE"),
+					"--unshare-net",
+				}
+			},
+		},
+		{
+			name:  "no-network",
+			cfg:   Config{noNetwork: true, compilerCache: "ccache"},
+			tools: []string{"bwrap"},
+			want: func(b *Builder, spec *Spec) []string {
+				return []string{"--bind", b.cfg.wdir, b.cfg.wdir, "--unshare-net"}
+			},
+		},
+		{
+			name:  "no-network-unshare",
+			cfg:   Config{noNetwork: true},
+			tools: []string{"unshare"},
+			want: func(b *Builder, spec *Spec) []string {
+				return []string{"--net", "--map-root-user"}
+			},
+		},
+		{
+			name:  "sandbox-no-bwrap",
+			cfg:   Config{sandbox: true},
+			tools: []string{"unshare"},
+			err:   "sandboxed builds need bubblewrap (bwrap) to be installed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bin := t.TempDir()
+			for _, tool := range tc.tools {
+				err := ioutil.WriteFile(filepath.Join(bin, tool), []byte("#!/bin/sh\n"), 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", bin)
+
+			b, _, fs := newTestBuilder(t, tc.cfg, nil)
+			spec := &Spec{Spec: recipe.Spec{Package: "app", Version: "v1", Revision: "1", Hash: "abcdef"}}
+			b.setArch(spec, b.cfg.arch)
+
+			args, err := b.sandboxArgs(spec, []string{"bash", "-e", "-x", "build.sh"})
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("invalid error: got=%v, want=%q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not create sandbox: %+v", err)
+			}
+
+			tool := filepath.Join(bin, tc.tools[0])
+			var want []string
+			if strings.HasSuffix(tool, "bwrap") {
+				want = []string{tool, "--die-with-parent", "--ro-bind", "/", "/", "--dev", "/dev", "--proc", "/proc", "--tmpfs", "/tmp"}
+			} else {
+				want = []string{tool}
+			}
+			want = append(append(want, tc.want(b, spec)...), "bash", "-e", "-x", "build.sh")
+			if !reflect.DeepEqual(args, want) {
+				t.Fatalf("invalid arguments:\ngot= %q\nwant=%q", args, want)
+			}
+
+			if tc.cfg.sandbox && tc.cfg.compilerCache != "" {
+				if fi, err := fs.Stat(b.compilerCacheDir()); err != nil || !fi.IsDir() {
+					t.Fatalf("compiler cache not created: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// sanitizerFlags holds the compiler and linker flags of the supported
+// sanitizers.
+var sanitizerFlags = map[string]string{
+	"asan":  "-fsanitize=address -fno-omit-frame-pointer",
+	"tsan":  "-fsanitize=thread",
+	"ubsan": "-fsanitize=undefined",
+}
+
+// parseSanitizers parses a comma-separated list of sanitizers.
+func parseSanitizers(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var (
+		sans []string
+		seen = make(map[string]bool)
+	)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if _, ok := sanitizerFlags[v]; !ok {
+			return nil, fmt.Errorf("unknown sanitizer %q (valid sanitizers: asan, tsan, ubsan)", v)
+		}
+		if !seen[v] {
+			seen[v] = true
+			sans = append(sans, v)
+		}
+	}
+	if seen["asan"] && seen["tsan"] {
+		return nil, fmt.Errorf("asan and tsan can not be combined")
+	}
+	return sans, nil
+}
+
+// sanitizerSuffix returns the suffix of the architecture of the packages
+// built with the given sanitizers, e.g. -asan-ubsan.
+// sanitized packages are thus installed, and stored, apart from the others.
+func sanitizerSuffix(sans []string) string {
+	if len(sans) == 0 {
+		return ""
+	}
+	return "-" + strings.Join(sans, "-")
+}
+
+// baseArch returns the architecture of an architecture of sanitized
+// packages, without its sanitizers and build type suffixes.
+func baseArch(arch string) string {
+	for {
+		trimmed := arch
+		for san := range sanitizerFlags {
+			trimmed = strings.TrimSuffix(trimmed, "-"+san)
+		}
+		for _, bt := range buildTypes {
+			trimmed = strings.TrimSuffix(trimmed, buildTypeSuffix(bt))
+		}
+		if trimmed == arch {
+			return arch
+		}
+		arch = trimmed
+	}
+}
+
+// targetArch returns the architecture the requested packages and their
+// runtime requirements are built for.
+func (b *Builder) targetArch() string {
+	return b.cfg.arch + buildTypeSuffix(b.cfg.buildType) + sanitizerSuffix(b.cfg.sanitizers)
+}
+
+// sanitized reports whether a spec is built with the sanitizers.
+// only the packages built for the target architecture are: the packages only
+// needed at build time are shared with the builds without sanitizers.
+func (b *Builder) sanitized(spec *Spec) bool {
+	return len(b.cfg.sanitizers) > 0 && spec.arch == b.targetArch()
+}
+
+// exportSanitizerEnv writes the shell commands adding the flags of the
+// sanitizers to the compiler and linker flags of a sanitized spec.
+func (b *Builder) exportSanitizerEnv(o io.Writer, spec *Spec) {
+	if !b.sanitized(spec) {
+		return
+	}
+	flags := make([]string, 0, len(b.cfg.sanitizers))
+	for _, san := range b.cfg.sanitizers {
+		flags = append(flags, sanitizerFlags[san])
+	}
+	fmt.Fprintf(o, "export SANITIZERS=%q\n", strings.Join(b.cfg.sanitizers, ","))
+	for _, k := range []string{"CFLAGS", "CXXFLAGS", "FFLAGS", "LDFLAGS"} {
+		fmt.Fprintf(o, "export %[1]s=\"${%[1]s:+$%[1]s }%[2]s\"\n", k, strings.Join(flags, " "))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// tmpfsDir is the scratch directory of the recipes built on tmpfs.
+const tmpfsDir = "/dev/shm/aligot"
+
+// scratchDir returns the directory where the recipe of a spec is compiled
+// and installs its files: tmpfs for recipes with "scratch: tmpfs", the
+// directory given with -build-dir, or else the work directory.
+// the sources, the install trees and the tarballs remain in the work
+// directory.
+func (b *Builder) scratchDir(spec *Spec) string {
+	switch {
+	case spec.Scratch == "tmpfs":
+		return tmpfsDir
+	case b.cfg.buildDir != "":
+		return b.cfg.buildDir
+	}
+	return b.cfg.wdir
+}
+
+// checkScratch checks the scratch directory requested by the recipe of a
+// spec.
+func checkScratch(spec *Spec) error {
+	switch spec.Scratch {
+	case "", "tmpfs":
+		return nil
+	}
+	return fmt.Errorf("%s: invalid scratch %q (valid scratch directories: tmpfs)", spec.Package, spec.Scratch)
+}
+
+// recipeInstallRoot returns the directory where the recipe of a spec
+// installs its files, in its scratch directory.
+func (b *Builder) recipeInstallRoot(spec *Spec) string {
+	root := b.installRoot(spec)
+	rel, err := filepath.Rel(b.cfg.wdir, root)
+	if err != nil {
+		return root
+	}
+	return filepath.Join(b.scratchDir(spec), rel)
+}
+
+// copyBack moves the files installed by the recipe of a spec in its scratch
+// directory to its install root, in the work directory.
+func (b *Builder) copyBack(spec *Spec) error {
+	src, dst := b.recipeInstallRoot(spec), b.installRoot(spec)
+	if src == dst {
+		return nil
+	}
+	err := b.run("", "cp", "-a", src+"/.", dst)
+	if err != nil {
+		return err
+	}
+	return b.fs.RemoveAll(filepath.Join(b.scratchDir(spec), "INSTALLROOT", spec.Hash))
+}
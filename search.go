@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// search writes the name, version and summary of the recipes of the
+// configuration directory matching the regular expression expr, by package
+// name, source repository, or recipe body.
+func (b *Builder) search(w io.Writer, expr string) error {
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return fmt.Errorf("invalid search expression %q: %v", expr, err)
+	}
+	fnames, err := filepath.Glob(filepath.Join(b.cfg.cfgdir, "*.sh"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(fnames)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	n := 0
+	for _, fname := range fnames {
+		pkg := strings.TrimSuffix(filepath.Base(fname), ".sh")
+		spec, err := b.loadSpec(pkg)
+		if err != nil {
+			msg.Warnf("%v\n", err)
+			continue
+		}
+		if spec == nil {
+			continue
+		}
+		if !re.MatchString(spec.Package) && !re.MatchString(spec.Source) && !re.MatchString(spec.Recipe) {
+			continue
+		}
+		n++
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", spec.Package, spec.Version, recipeSummary(spec))
+	}
+	if n == 0 {
+		return fmt.Errorf("no recipe matching %q in [%s]", expr, b.cfg.cfgdir)
+	}
+	return tw.Flush()
+}
+
+// recipeSummary returns a one-line description of a recipe: its first
+// comment line, or else its source repository.
+func recipeSummary(spec *Spec) string {
+	for _, line := range strings.Split(spec.Recipe, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") || strings.HasPrefix(line, "#!") {
+			continue
+		}
+		if line = strings.TrimSpace(strings.TrimLeft(line, "#")); line != "" {
+			return line
+		}
+	}
+	if spec.Source != "" {
+		return spec.Source
+	}
+	return "-"
+}
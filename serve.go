@@ -0,0 +1,492 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+// states of the build requests submitted to the server.
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// server serves the aligot HTTP API:
+//
+//	GET  /plan?package=P[&defaults=D]   resolved build plan of P
+//	POST /builds                        submits a build request ({"package": P, "defaults": D})
+//	GET  /builds                        lists the build requests
+//	GET  /builds/<id>                   status of a build request
+//	GET  /builds/<id>/logs/<pkg>        streams the build log of a package of a build request
+//	GET  /store                         lists the packages of the local store
+//	GET  /store/<pkg>                   lists the tarballs of a package in the local store
+//	GET  /metrics                       Prometheus metrics of the build requests
+//
+// the requests resolving plans and submitting builds must hold the token of
+// the server, as an "Authorization: Bearer <token>" header.
+//
+// build requests share the work directory of the server: they are run one at
+// a time, in the order they were submitted.
+type server struct {
+	cfg     Config
+	token   string   // bearer token of the requests resolving plans and submitting builds
+	metrics *metrics // metrics of the build requests
+	exec    Executor // runs the external commands of the builders
+	fs      FS       // file system of the builders
+
+	mu    sync.Mutex
+	jobs  []*buildJob
+	queue chan *buildJob
+}
+
+// buildJob is a build request submitted to the server.
+type buildJob struct {
+	ID        int               `json:"id"`
+	Package   string            `json:"package"`
+	Defaults  string            `json:"defaults"`
+	State     string            `json:"state"`
+	Error     string            `json:"error,omitempty"`
+	Submitted time.Time         `json:"submitted"`
+	Started   time.Time         `json:"started"`
+	Finished  time.Time         `json:"finished"`
+	Packages  map[string]string `json:"packages,omitempty"` // status of each package
+
+	builder *Builder
+}
+
+// planEntry describes a package of a resolved build plan.
+type planEntry struct {
+	Package         string   `json:"package"`
+	Version         string   `json:"version"`
+	Hash            string   `json:"hash"`
+	Requires        []string `json:"requires,omitempty"`
+	RuntimeRequires []string `json:"runtime_requires,omitempty"`
+	Cached          bool     `json:"cached"` // available from the local store
+}
+
+// storeEntry describes a tarball of the local store.
+type storeEntry struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// serve runs the aligot HTTP API on addr.
+//
+// plans are only resolved, and builds submitted, with the given token: a
+// random one is generated and logged when it is empty.
+func serve(cfg Config, addr, token string) error {
+	if token == "" {
+		var err error
+		token, err = randomToken()
+		if err != nil {
+			return err
+		}
+		msg.Infof("token of the aligot API: %s\n", token)
+	}
+	srv := &server{
+		cfg:     cfg,
+		token:   token,
+		metrics: newMetrics(),
+		exec:    hostExecutor{},
+		fs:      hostFS{},
+		queue:   make(chan *buildJob, 64),
+	}
+	go srv.run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plan", srv.handlePlan)
+	mux.HandleFunc("/builds", srv.handleBuilds)
+	mux.HandleFunc("/builds/", srv.handleBuild)
+	mux.HandleFunc("/store", srv.handleStore)
+	mux.HandleFunc("/store/", srv.handleStore)
+	mux.Handle("/metrics", srv.metrics)
+
+	msg.Infof("serving the aligot API on [%s]...\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// randomToken returns a random token, of 128 bits.
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// authorized returns whether a request holds the token of the server.
+func (srv *server) authorized(r *http.Request) bool {
+	tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(tok), []byte(srv.token)) == 1
+}
+
+// unauthorized replies to a request not holding the token of the server.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// checkPackage checks the name of a package requested from the server.
+func checkPackage(pkg string) error {
+	if pkg == "" {
+		return fmt.Errorf("no package")
+	}
+	return recipe.CheckName(pkg)
+}
+
+// builder returns a resolved builder of the named package, with the given
+// defaults.
+// the reference mirrors of the sources are only updated when fetch is true.
+func (srv *server) builder(pkg, defaults string, fetch bool) (*Builder, error) {
+	if err := checkPackage(pkg); err != nil {
+		return nil, err
+	}
+	cfg := srv.cfg
+	cfg.pkgs = []string{pkg}
+	if defaults != "" {
+		cfg.defaults = defaults
+	}
+	cfg.fetchMirrors = cfg.fetchMirrors && fetch
+	b := newBuilder(cfg)
+	b.exec = srv.exec
+	b.fs = srv.fs
+	err := b.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// run runs the submitted build requests, one at a time.
+func (srv *server) run() {
+	for job := range srv.queue {
+		srv.mu.Lock()
+		job.State = jobRunning
+		job.Started = time.Now()
+		srv.mu.Unlock()
+
+		err := srv.runJob(job)
+
+		srv.mu.Lock()
+		job.State = jobDone
+		if err != nil {
+			job.State = jobFailed
+			job.Error = err.Error()
+		}
+		job.Finished = time.Now()
+		srv.mu.Unlock()
+		msg.Infof("build request #%d (%s): %s\n", job.ID, job.Package, job.State)
+	}
+}
+
+func (srv *server) runJob(job *buildJob) error {
+	b, err := srv.builder(job.Package, job.Defaults, true)
+	if err != nil {
+		return err
+	}
+	b.metrics = srv.metrics
+	b.onStatus = func(spec *Spec, status string) {
+		srv.mu.Lock()
+		job.Packages[spec.Package] = status
+		srv.mu.Unlock()
+	}
+
+	srv.mu.Lock()
+	job.builder = b
+	srv.mu.Unlock()
+	return b.build()
+}
+
+// get returns a snapshot of the build request with the given id.
+func (srv *server) get(id int) (buildJob, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if id < 1 || id > len(srv.jobs) {
+		return buildJob{}, false
+	}
+	job := *srv.jobs[id-1]
+	job.Packages = make(map[string]string, len(srv.jobs[id-1].Packages))
+	for k, v := range srv.jobs[id-1].Packages {
+		job.Packages[k] = v
+	}
+	return job, true
+}
+
+func (srv *server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !srv.authorized(r) {
+		unauthorized(w)
+		return
+	}
+	pkg := r.FormValue("package")
+	if err := checkPackage(pkg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// plans do not update the reference mirrors: only builds do.
+	b, err := srv.builder(pkg, r.FormValue("defaults"), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	plan := make([]planEntry, 0, len(b.order))
+	for _, p := range b.order {
+		spec := b.specs[p]
+		plan = append(plan, planEntry{
+			Package:         spec.Package,
+			Version:         spec.Version,
+			Hash:            spec.Hash,
+			Requires:        spec.Requires,
+			RuntimeRequires: spec.RuntimeRequires,
+			Cached:          b.locate(spec),
+		})
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+func (srv *server) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		srv.mu.Lock()
+		n := len(srv.jobs)
+		srv.mu.Unlock()
+		jobs := make([]buildJob, n)
+		for i := range jobs {
+			jobs[i], _ = srv.get(i + 1)
+		}
+		writeJSON(w, http.StatusOK, jobs)
+
+	case "POST":
+		if !srv.authorized(r) {
+			unauthorized(w)
+			return
+		}
+		var req struct {
+			Package  string `json:"package"`
+			Defaults string `json:"defaults"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "invalid build request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkPackage(req.Package); err != nil {
+			http.Error(w, "invalid build request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Defaults == "" {
+			req.Defaults = srv.cfg.defaults
+		}
+
+		srv.mu.Lock()
+		job := &buildJob{
+			ID:        len(srv.jobs) + 1,
+			Package:   req.Package,
+			Defaults:  req.Defaults,
+			State:     jobQueued,
+			Submitted: time.Now(),
+			Packages:  make(map[string]string),
+		}
+		srv.jobs = append(srv.jobs, job)
+		srv.mu.Unlock()
+
+		select {
+		case srv.queue <- job:
+		default:
+			srv.mu.Lock()
+			job.State = jobFailed
+			job.Error = "too many pending build requests"
+			srv.mu.Unlock()
+			http.Error(w, job.Error, http.StatusServiceUnavailable)
+			return
+		}
+		msg.Infof("build request #%d (%s) submitted\n", job.ID, job.Package)
+		snap, _ := srv.get(job.ID)
+		writeJSON(w, http.StatusAccepted, snap)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (srv *server) handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	toks := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/builds/"), "/"), "/")
+	id, err := strconv.Atoi(toks[0])
+	if err != nil {
+		http.Error(w, "invalid build request id", http.StatusBadRequest)
+		return
+	}
+	job, ok := srv.get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(toks) == 1:
+		writeJSON(w, http.StatusOK, job)
+	case len(toks) == 3 && toks[1] == "logs":
+		srv.streamLog(w, r, id, toks[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamLog writes the build log of a package of a build request, following
+// it until the build of the package completes.
+func (srv *server) streamLog(w http.ResponseWriter, r *http.Request, id int, pkg string) {
+	var (
+		f     *os.File
+		flush = func() {}
+	)
+	if fl, ok := w.(http.Flusher); ok {
+		flush = fl.Flush
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for {
+		job, _ := srv.get(id)
+		status := job.Packages[pkg]
+		done := job.State == jobDone || job.State == jobFailed ||
+			(status != "" && status != statusBuilding)
+
+		if f == nil && job.builder != nil {
+			if spec, ok := job.builder.specs[pkg]; ok {
+				var err error
+				f, err = os.Open(filepath.Join(job.builder.logDir(spec), "log"))
+				if err != nil && !os.IsNotExist(err) {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if err == nil {
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				}
+			} else {
+				http.Error(w, fmt.Sprintf("no package %s in build request #%d", pkg, id), http.StatusNotFound)
+				return
+			}
+		}
+
+		if f != nil {
+			_, err := io.Copy(w, f)
+			if err != nil {
+				return
+			}
+			flush()
+		}
+
+		if done {
+			if f == nil {
+				http.Error(w, fmt.Sprintf("no build log for %s", pkg), http.StatusNotFound)
+			}
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (srv *server) handleStore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dir := filepath.Join(srv.cfg.wdir, "TARS", srv.cfg.arch)
+	pkg := strings.Trim(strings.TrimPrefix(r.URL.Path, "/store"), "/")
+	if pkg == "" {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		pkgs := []string{}
+		for _, e := range entries {
+			if e.IsDir() && e.Name() != "store" {
+				pkgs = append(pkgs, e.Name())
+			}
+		}
+		writeJSON(w, http.StatusOK, pkgs)
+		return
+	}
+	if strings.Contains(pkg, "/") || pkg == "store" {
+		http.NotFound(w, r)
+		return
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(dir, pkg))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tars := []storeEntry{}
+	for _, e := range entries {
+		fname := filepath.Join(dir, pkg, e.Name())
+		dst, err := os.Readlink(fname)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(fname)
+		if err != nil {
+			continue
+		}
+		tars = append(tars, storeEntry{
+			Name: e.Name(),
+			Hash: filepath.Base(filepath.Dir(dst)),
+			Size: fi.Size(),
+		})
+	}
+	sort.Slice(tars, func(i, j int) bool { return tars[i].Name < tars[j].Name })
+	writeJSON(w, http.StatusOK, tars)
+}
+
+// writeJSON writes the JSON encoding of v as the response, with the given
+// status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		msg.Warnf("could not encode response: %v\n", err)
+	}
+}
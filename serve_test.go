@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer(t *testing.T, cfg Config, recipes map[string]string) (*server, *fakeExecutor) {
+	t.Helper()
+	cfg = newTestConfig(t, cfg)
+	x := newFakeExecutor()
+	srv := &server{
+		cfg:     cfg,
+		token:   "s3cr3t",
+		metrics: newMetrics(),
+		exec:    x,
+		fs:      newTestFS(t, cfg, recipes),
+		queue:   make(chan *buildJob, 64),
+	}
+	return srv, x
+}
+
+func TestServePlan(t *testing.T) {
+	recipes := map[string]string{
+		"defaults-release": testDefaults,
+		"app": testRecipe("app", "v1", []string{
+			"tag: v1",
+			"source: https://example.org/app.git",
+			"requires: [lib]",
+		}, "make\n"),
+		"lib": testRecipe("lib", "v1", nil, "make\n"),
+	}
+	for _, tc := range []struct {
+		name   string
+		query  string
+		token  string
+		gitErr bool // whether the recipes are not in a git repository
+		code   int
+		want   string
+	}{
+		{name: "ok", query: "package=app", token: "s3cr3t", code: http.StatusOK},
+		{name: "no-token", query: "package=app", code: http.StatusUnauthorized},
+		{name: "bad-token", query: "package=app", token: "guess", code: http.StatusUnauthorized},
+		{name: "no-package", token: "s3cr3t", code: http.StatusBadRequest, want: "no package"},
+		{name: "bad-package", query: "package=../app", token: "s3cr3t", code: http.StatusBadRequest},
+		{name: "unknown-package", query: "package=nope", token: "s3cr3t", code: http.StatusInternalServerError},
+		{name: "no-git", query: "package=app", token: "s3cr3t", gitErr: true, code: http.StatusInternalServerError, want: "could not identify the recipes"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, x := newTestServer(t, Config{refsrc: "/mirror", fetchMirrors: true}, recipes)
+			if tc.gitErr {
+				x.errs["git rev-parse HEAD"] = fmt.Errorf("not a git repository")
+			}
+			req := httptest.NewRequest("GET", "/plan?"+tc.query, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			srv.handlePlan(w, req)
+
+			if got, want := w.Code, tc.code; got != want {
+				t.Fatalf("invalid status: got=%d, want=%d (%s)", got, want, w.Body)
+			}
+			if tc.want != "" && !strings.Contains(w.Body.String(), tc.want) {
+				t.Fatalf("invalid response: got=%q, want=%q", w.Body, tc.want)
+			}
+			for _, cmd := range x.commands() {
+				if strings.Contains(cmd, "git clone") || strings.Contains(cmd, "git fetch") {
+					t.Errorf("plan updated the mirrors: %s", cmd)
+				}
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			var plan []planEntry
+			err := json.Unmarshal(w.Body.Bytes(), &plan)
+			if err != nil {
+				t.Fatalf("could not decode plan: %+v", err)
+			}
+			var pkgs []string
+			for _, e := range plan {
+				pkgs = append(pkgs, e.Package)
+			}
+			if got, want := strings.Join(pkgs, ","), "defaults-release,lib,app"; got != want {
+				t.Fatalf("invalid plan: got=%q, want=%q", got, want)
+			}
+		})
+	}
+}
+
+func TestServeBuilds(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		body  string
+		token string
+		code  int
+	}{
+		{name: "ok", body: `{"package": "app"}`, token: "s3cr3t", code: http.StatusAccepted},
+		{name: "no-token", body: `{"package": "app"}`, code: http.StatusUnauthorized},
+		{name: "bad-token", body: `{"package": "app"}`, token: "guess", code: http.StatusUnauthorized},
+		{name: "no-package", body: `{}`, token: "s3cr3t", code: http.StatusBadRequest},
+		{name: "bad-package", body: `{"package": "a/../../b"}`, token: "s3cr3t", code: http.StatusBadRequest},
+		{name: "bad-json", body: `{`, token: "s3cr3t", code: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, _ := newTestServer(t, Config{}, nil)
+			req := httptest.NewRequest("POST", "/builds", strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			srv.handleBuilds(w, req)
+			if got, want := w.Code, tc.code; got != want {
+				t.Fatalf("invalid status: got=%d, want=%d (%s)", got, want, w.Body)
+			}
+
+			n := 0
+			if tc.code == http.StatusAccepted {
+				n = 1
+				var job buildJob
+				err := json.Unmarshal(w.Body.Bytes(), &job)
+				if err != nil {
+					t.Fatalf("could not decode build request: %+v", err)
+				}
+				if job.ID != 1 || job.Package != "app" || job.Defaults != "release" || job.State != jobQueued {
+					t.Fatalf("invalid build request: %+v", job)
+				}
+			}
+			if got, want := len(srv.queue), n; got != want {
+				t.Fatalf("invalid number of queued builds: got=%d, want=%d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// signTarball creates an ASCII-armored detached signature of the named
+// tarball with the GPG key of the build, and returns the name of the
+// signature file.
+// an already existing signature is replaced: it may be the one of a previous
+// build of the tarball.
+func (b *Builder) signTarball(fname string) (string, error) {
+	sig := fname + ".asc"
+	msg.Debugf("signing [%s] with key %q...\n", fname, b.cfg.signKey)
+	err := b.run("", "gpg",
+		"--batch", "--yes", "--armor",
+		"--local-user", b.cfg.signKey,
+		"--output", sig,
+		"--detach-sign", fname,
+	)
+	if err != nil {
+		b.fs.Remove(sig)
+		return "", err
+	}
+	return sig, nil
+}
+
+// verifyTarball checks the named tarball against the trust set.
+//
+// a tarball with a detached signature must have been signed by one of the
+// trusted keys (or by a key of the default GPG keyring, if no trusted keyring
+// was configured.)
+// otherwise, its SHA-256 digest must be listed among the trusted digests.
+// tarballs which could not be verified are refused in require-signed mode.
+func (b *Builder) verifyTarball(fname string) error {
+	sig := fname + ".asc"
+	if _, err := b.fs.Stat(sig); err == nil {
+		args := []string{"--batch"}
+		if b.cfg.trustedKeys != "" {
+			keyring, err := filepath.Abs(b.cfg.trustedKeys)
+			if err != nil {
+				return err
+			}
+			args = append(args, "--no-default-keyring", "--keyring", keyring)
+		}
+		args = append(args, "--verify", sig, fname)
+		err = b.run("", "gpg", args...)
+		if err != nil {
+			return fmt.Errorf("invalid signature for [%s]: %v", fname, err)
+		}
+		msg.Debugf("signature of [%s] verified\n", fname)
+		return nil
+	}
+
+	if b.cfg.trustedDigests != "" {
+		digests, err := loadDigests(b.cfg.trustedDigests)
+		if err != nil {
+			return err
+		}
+		sum, err := sha256File(b.fs, fname)
+		if err != nil {
+			return err
+		}
+		if _, ok := digests[sum]; ok {
+			msg.Debugf("digest of [%s] verified\n", fname)
+			return nil
+		}
+	}
+
+	if b.cfg.requireSigned {
+		return fmt.Errorf("refusing unsigned tarball [%s]", filepath.Base(fname))
+	}
+	msg.Warnf("could not verify tarball [%s]\n", filepath.Base(fname))
+	return nil
+}
+
+// loadDigests reads a file in the sha256sum format and returns the set of
+// digests it holds.
+func loadDigests(fname string) (map[string]struct{}, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := make(map[string]struct{})
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		toks := strings.Fields(scan.Text())
+		if len(toks) == 0 || strings.HasPrefix(toks[0], "#") {
+			continue
+		}
+		set[strings.ToLower(toks[0])] = struct{}{}
+	}
+	return set, scan.Err()
+}
+
+// sha256File returns the hex-encoded SHA-256 digest of the named file.
+func sha256File(fs FS, fname string) (string, error) {
+	f, err := fs.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignTarball(t *testing.T) {
+	b, x, fs := newTestBuilder(t, Config{signKey: "builder@example.org"}, nil)
+	err := fs.MkdirAll("/store", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the signature of a previous build of the tarball.
+	err = fs.WriteFile("/store/pkg.tar.gz.asc", []byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := b.signTarball("/store/pkg.tar.gz")
+	if err != nil {
+		t.Fatalf("could not sign: %+v", err)
+	}
+	if got, want := sig, "/store/pkg.tar.gz.asc"; got != want {
+		t.Fatalf("invalid signature: got=%q, want=%q", got, want)
+	}
+	want := "gpg --batch --yes --armor --local-user builder@example.org --output /store/pkg.tar.gz.asc --detach-sign /store/pkg.tar.gz"
+	if got := x.commands(); len(got) != 1 || got[0] != want {
+		t.Fatalf("invalid commands:\ngot= %q\nwant=%q", got, want)
+	}
+
+	x.errs[want] = fmt.Errorf("no secret key")
+	_, err = b.signTarball("/store/pkg.tar.gz")
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if _, err := fs.Stat(sig); err == nil {
+		t.Fatalf("signature of a failed signing not removed")
+	}
+}
+
+func TestVerifyTarball(t *testing.T) {
+	const (
+		tarball = "/store/pkg.tar.gz"
+		data    = "tarball"
+	)
+	digests := filepath.Join(t.TempDir(), "digests")
+	for _, tc := range []struct {
+		name     string
+		sig      bool
+		gpgErr   error
+		digests  string
+		required bool
+		want     string // error
+		verify   bool   // whether the signature is checked
+	}{
+		{name: "signed", sig: true, verify: true},
+		{name: "bad-signature", sig: true, gpgErr: fmt.Errorf("BAD signature"), verify: true, want: "invalid signature"},
+		{name: "trusted-digest", digests: "%s  pkg.tar.gz\n", required: true},
+		{name: "untrusted-digest", digests: "0000  pkg.tar.gz\n", required: true, want: "refusing unsigned tarball"},
+		{name: "unverified"},
+		{name: "unsigned", required: true, want: "refusing unsigned tarball"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{requireSigned: tc.required}
+			if tc.digests != "" {
+				sum := sha256.Sum256([]byte(data))
+				err := ioutil.WriteFile(digests, []byte(strings.Replace(tc.digests, "%s", hex.EncodeToString(sum[:]), 1)), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg.trustedDigests = digests
+			}
+			b, x, fs := newTestBuilder(t, cfg, nil)
+			err := fs.MkdirAll("/store", 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fs.WriteFile(tarball, []byte(data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.sig {
+				err = fs.WriteFile(tarball+".asc", []byte("signature"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tc.gpgErr != nil {
+				x.errs["gpg --batch --verify "+tarball+".asc "+tarball] = tc.gpgErr
+			}
+
+			err = b.verifyTarball(tarball)
+			switch {
+			case tc.want == "" && err != nil:
+				t.Fatalf("could not verify: %+v", err)
+			case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+				t.Fatalf("invalid error: got=%v, want=%q", err, tc.want)
+			}
+			if got := len(x.commands()) == 1; got != tc.verify {
+				t.Fatalf("invalid verification of the signature: got=%v, want=%v (%q)", got, tc.verify, x.commands())
+			}
+		})
+	}
+}
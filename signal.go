@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// stopGrace is the delay given to interrupted recipes to terminate, before
+// they are killed.
+const stopGrace = 10 * time.Second
+
+var (
+	errInterrupted = errors.New("interrupted")
+	errTimedOut    = errors.New("timed out")
+)
+
+// interrupter holds the context of the run, canceled when aligot is
+// interrupted: the builders derive their contexts from it, so that their
+// commands and downloads are stopped.
+type interrupter struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var interrupts = newInterrupter()
+
+func newInterrupter() *interrupter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &interrupter{ctx: ctx, cancel: cancel}
+}
+
+// handleSignals makes SIGINT and SIGTERM interrupt the run: no new package
+// is built, and the running recipes are terminated.
+// a second signal exits immediately.
+func handleSignals() {
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		msg.Warnf("received %v: stopping the build (again to exit immediately)...\n", sig)
+		interrupts.interrupt()
+		sig = <-ch
+		msg.Errorf("received %v: exiting\n", sig)
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// interrupted reports whether the run was interrupted.
+func (it *interrupter) interrupted() bool {
+	return it.ctx.Err() != nil
+}
+
+// interrupt interrupts the run, and terminates the running recipes.
+func (it *interrupter) interrupt() {
+	it.cancel()
+}
+
+// canceled returns the reason why ctx was canceled, if it was: the run was
+// interrupted, or timed out.
+func canceled(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return errTimedOut
+	default:
+		return errInterrupted
+	}
+}
+
+// terminate stops a recipe, and the processes it started: its container, or
+// its process group.
+// the processes are killed when the recipe has not exited after stopGrace.
+func (it *interrupter) terminate(x Executor, cmd *exec.Cmd, container string, exited <-chan struct{}) {
+	if container != "" {
+		err := runCmd(x, exec.Command("docker", "stop", "-t", "10", container))
+		if err != nil {
+			msg.Warnf("could not stop container %s: %v\n", container, err)
+		}
+	}
+	if cmd.Process == nil {
+		// not run on the host.
+		return
+	}
+	pgid := -cmd.Process.Pid
+	syscall.Kill(pgid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(stopGrace):
+		syscall.Kill(pgid, syscall.SIGKILL)
+	}
+}
+
+// run runs a recipe with x in its own process group, until it exits or ctx
+// is canceled.
+// run returns errInterrupted when the run is interrupted, and errTimedOut
+// when ctx times out.
+func (it *interrupter) run(ctx context.Context, x Executor, cmd *exec.Cmd, container string) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := canceled(ctx); err != nil {
+		return err
+	}
+	err := x.Start(cmd)
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			it.terminate(x, cmd, container, exited)
+		case <-exited:
+		}
+	}()
+	err = x.Wait(cmd)
+	close(exited)
+	<-stopped
+
+	if err := canceled(ctx); err != nil {
+		return err
+	}
+	return err
+}
+
+// runState is the progress of an interrupted run.
+type runState struct {
+	Package     string            `json:"package"`
+	Defaults    string            `json:"defaults"`
+	Arch        string            `json:"arch"`
+	Interrupted time.Time         `json:"interrupted"`
+	Status      map[string]string `json:"status"`
+}
+
+// stateFile returns the file holding the progress of an interrupted run.
+func (b *Builder) stateFile() string {
+	return filepath.Join(b.cfg.wdir, "BUILD", "."+b.pkgs[0]+"-"+b.cfg.defaults+".state.json")
+}
+
+// saveState persists the progress of an interrupted run.
+// packages already built are in the store, and are not rebuilt when the run
+// is resumed.
+func (b *Builder) saveState() error {
+	buf, err := json.MarshalIndent(runState{
+		Package:     b.pkgs[0],
+		Defaults:    b.cfg.defaults,
+		Arch:        b.targetArch(),
+		Interrupted: time.Now().UTC(),
+		Status:      b.status,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(b.stateFile()), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(b.stateFile(), buf, 0644)
+}
+
+// resumeState reports the progress of a previously interrupted run of the
+// same package, if any.
+func (b *Builder) resumeState() {
+	buf, err := ioutil.ReadFile(b.stateFile())
+	if err != nil {
+		return
+	}
+	var st runState
+	err = json.Unmarshal(buf, &st)
+	if err != nil {
+		msg.Warnf("could not read state of interrupted run [%s]: %v\n", b.stateFile(), err)
+		return
+	}
+	n := 0
+	for _, s := range st.Status {
+		if s == statusBuilt || s == statusCached {
+			n++
+		}
+	}
+	msg.Infof("resuming run of %s interrupted at %s (%d/%d packages done)\n",
+		st.Package, st.Interrupted.Local().Format(time.RFC3339), n, len(b.order),
+	)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var reGitCommit = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// spackName returns the Spack name of a package.
+func spackName(pkg string) string {
+	return strings.Replace(strings.ToLower(pkg), "_", "-", -1)
+}
+
+// spackClass returns the name of the Spack class of a package.
+func spackClass(pkg string) string {
+	o := new(bytes.Buffer)
+	for _, tok := range strings.Split(spackName(pkg), "-") {
+		if tok == "" {
+			continue
+		}
+		o.WriteString(strings.ToUpper(tok[:1]) + tok[1:])
+	}
+	name := o.String()
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// spackNode describes a package of the resolved graph in a spec.yaml file.
+type spackNode struct {
+	Name         string           `yaml:"name"`
+	Version      string           `yaml:"version"`
+	Tag          string           `yaml:"tag,omitempty"`
+	Commit       string           `yaml:"commit,omitempty"`
+	Source       string           `yaml:"source,omitempty"`
+	Hash         string           `yaml:"hash"`
+	Dependencies []spackNodeDepnd `yaml:"dependencies,omitempty"`
+}
+
+type spackNodeDepnd struct {
+	Name string   `yaml:"name"`
+	Type []string `yaml:"type"`
+}
+
+// exportSpack writes a Spack repository with one package recipe per package
+// of the resolved graph, together with a spec.yaml file describing the
+// resolved graph of each requested package.
+func (b *Builder) exportSpack(dir string) error {
+	err := os.MkdirAll(filepath.Join(dir, "packages"), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "repo.yaml"),
+		[]byte("repo:\n  namespace: alisw\n"),
+		0644,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range b.order {
+		spec := b.specs[p]
+		pdir := filepath.Join(dir, "packages", spackName(p))
+		err = os.MkdirAll(pdir, 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(pdir, "package.py"), b.spackRecipe(spec), 0644)
+		if err != nil {
+			return fmt.Errorf("could not write Spack recipe of %s: %v", p, err)
+		}
+	}
+
+	for _, pkg := range b.pkgs {
+		var nodes []spackNode
+		for _, p := range b.closure(pkg) {
+			spec := b.specs[p]
+			node := spackNode{
+				Name:    spackName(p),
+				Version: spec.Version,
+				Source:  spec.Source,
+				Hash:    spec.Hash,
+			}
+			if spec.Source != "" {
+				node.Tag = spec.Tag
+				node.Commit = spec.CommitHash
+			}
+			for _, dep := range b.spackDeps(spec) {
+				node.Dependencies = append(node.Dependencies, spackNodeDepnd{
+					Name: spackName(dep[0]),
+					Type: strings.Split(dep[1], ","),
+				})
+			}
+			nodes = append(nodes, node)
+		}
+		buf, err := yaml.Marshal(map[string]interface{}{
+			"spec": map[string]interface{}{
+				"_meta": map[string]int{"version": 4},
+				"nodes": nodes,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		fname := filepath.Join(dir, spackName(pkg)+".spec.yaml")
+		err = ioutil.WriteFile(fname, buf, 0644)
+		if err != nil {
+			return err
+		}
+		msg.Infof("exported Spack graph of %s to [%s]\n", pkg, fname)
+	}
+
+	return nil
+}
+
+// spackDeps returns the dependencies of a spec, together with their Spack
+// dependency types.
+func (b *Builder) spackDeps(spec *Spec) [][2]string {
+	var deps [][2]string
+	runtime := make(map[string]bool)
+	for _, p := range spec.RuntimeRequires {
+		runtime[p] = true
+	}
+	for _, p := range spec.Requires {
+		if _, ok := b.specs[p]; !ok {
+			continue
+		}
+		switch {
+		case runtime[p]:
+			deps = append(deps, [2]string{p, "build,link,run"})
+		default:
+			deps = append(deps, [2]string{p, "build"})
+		}
+	}
+	return deps
+}
+
+// spackRecipe returns the content of the Spack package.py recipe of a spec.
+// the recipe runs the aligot recipe of the spec, pinned at its resolved tag
+// or commit.
+func (b *Builder) spackRecipe(spec *Spec) []byte {
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "# generated by aligot from %s@%s. DO NOT EDIT.\n\n", b.cfg.cfgdir, b.cfghash)
+	fmt.Fprintf(o, "from spack.package import *\n\n\n")
+	fmt.Fprintf(o, "class %s(Package):\n", spackClass(spec.Package))
+	fmt.Fprintf(o, "    \"\"\"%s, exported from aligot (hash %s).\"\"\"\n\n", spec.Package, spec.Hash)
+
+	switch spec.Source {
+	case "":
+		fmt.Fprintf(o, "    has_code = False\n\n")
+		fmt.Fprintf(o, "    version(%q)\n", spec.Version)
+	default:
+		fmt.Fprintf(o, "    git = %q\n\n", spec.Source)
+		if reGitCommit.MatchString(spec.CommitHash) {
+			fmt.Fprintf(o, "    version(%q, commit=%q)\n", spec.Version, spec.CommitHash)
+		} else {
+			fmt.Fprintf(o, "    version(%q, tag=%q)\n", spec.Version, spec.Tag)
+		}
+	}
+	if spec.License != "" {
+		fmt.Fprintf(o, "\n    license(%q)\n", spec.License)
+	}
+
+	deps := b.spackDeps(spec)
+	if len(deps) > 0 {
+		fmt.Fprintf(o, "\n")
+	}
+	for _, dep := range deps {
+		types := strings.Split(dep[1], ",")
+		for i, v := range types {
+			types[i] = fmt.Sprintf("%q", v)
+		}
+		typ := types[0]
+		if len(types) > 1 {
+			typ = "(" + strings.Join(types, ", ") + ")"
+		}
+		fmt.Fprintf(o, "    depends_on(%q, type=%s)\n", spackName(dep[0]), typ)
+	}
+
+	// JSON strings are valid Python string literals.
+	recipe, _ := json.Marshal(spec.Recipe)
+	fmt.Fprintf(o, "\n    def install(self, spec, prefix):\n")
+	fmt.Fprintf(o, "        env[\"PKGNAME\"] = %q\n", spec.Package)
+	fmt.Fprintf(o, "        env[\"PKGVERSION\"] = %q\n", spec.Version)
+	fmt.Fprintf(o, "        env[\"INSTALLROOT\"] = prefix\n")
+	fmt.Fprintf(o, "        env[\"SOURCEDIR\"] = self.stage.source_path\n")
+	fmt.Fprintf(o, "        env[\"BUILDDIR\"] = self.stage.source_path\n")
+	fmt.Fprintf(o, "        env[\"JOBS\"] = str(make_jobs)\n")
+	for _, dep := range deps {
+		fmt.Fprintf(o, "        env[%q] = spec[%q].prefix\n", envName(dep[0])+"_ROOT", spackName(dep[0]))
+	}
+	fmt.Fprintf(o, "        with working_dir(self.stage.source_path):\n")
+	fmt.Fprintf(o, "            which(\"bash\")(\"-e\", \"-c\", %s)\n", recipe)
+	return o.Bytes()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// storeStats describes the content of a store.
+type storeStats struct {
+	Store    string         `json:"store"`
+	Archs    []archStats    `json:"archs"`
+	Packages []packageStats `json:"packages"`
+	Orphans  storeOrphans   `json:"orphans"`
+}
+
+// archStats describes the tarballs of an architecture in a store.
+type archStats struct {
+	Arch     string `json:"arch"`
+	Packages int    `json:"packages"`
+	Tarballs int    `json:"tarballs"`
+	Size     int64  `json:"size"` // total size of the tarballs with a manifest
+}
+
+// packageStats describes the tarballs of a package, for an architecture, in
+// a store.
+type packageStats struct {
+	Package  string    `json:"package"`
+	Arch     string    `json:"arch"`
+	Tarballs int       `json:"tarballs"`
+	Size     int64     `json:"size"`            // total size of the tarballs with a manifest
+	Oldest   string    `json:"oldest"`          // version-revision of the oldest tarball
+	Newest   string    `json:"newest"`          // version-revision of the newest tarball
+	Built    time.Time `json:"built,omitempty"` // when the newest tarball was built, if known
+}
+
+// storeOrphans lists the files of a store not reachable from the packages.
+type storeOrphans struct {
+	Unlinked   []string `json:"unlinked"`   // tarballs no package links to
+	Dangling   []string `json:"dangling"`   // links to tarballs missing from the store
+	Companions []string `json:"companions"` // signatures and manifests of missing tarballs
+}
+
+// statStore returns the statistics of the named store, or of the local
+// store when name is empty.
+// the sizes and build dates of the tarballs are read from their manifests.
+func (b *Builder) statStore(name string) (storeStats, error) {
+	// empty lists, rather than null, in the JSON output.
+	stats := storeStats{
+		Archs:    []archStats{},
+		Packages: []packageStats{},
+		Orphans:  storeOrphans{Unlinked: []string{}, Dangling: []string{}, Companions: []string{}},
+	}
+	var s store.Store = store.NewDir(b.cfg.wdir, false, b.fs)
+	if name != "" {
+		var err error
+		s, err = b.openStore(name, false)
+		if err != nil {
+			return stats, err
+		}
+	}
+	stats.Store = s.URL()
+
+	walk, err := walkStore(b.ctx, s)
+	if err != nil {
+		return stats, err
+	}
+
+	err = os.MkdirAll(filepath.Join(b.cfg.wdir, "TARS"), 0755)
+	if err != nil {
+		return stats, err
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(b.cfg.wdir, "TARS"), ".stats-")
+	if err != nil {
+		return stats, err
+	}
+	defer os.RemoveAll(tmp)
+
+	// tarballs by arch and name.
+	type tarball struct {
+		path     string
+		manifest *Manifest
+		linked   bool
+	}
+	tarballs := make(map[string]*tarball)
+	var paths []string
+	for p := range walk.tarballs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		files := walk.tarballs[p]
+		if !contains(files, p) {
+			stats.Orphans.Companions = append(stats.Orphans.Companions, files...)
+			continue
+		}
+		t := &tarball{path: p}
+		if contains(files, p+manifestExt) {
+			err := s.Fetch(b.ctx, tmp, []string{p + manifestExt}, nil)
+			if err != nil {
+				return stats, err
+			}
+			if m, err := readManifest(hostFS{}, filepath.Join(tmp, filepath.FromSlash(p+manifestExt))); err == nil {
+				t.manifest = &m
+			}
+		}
+		arch := strings.Split(p, "/")[1]
+		tarballs[arch+"/"+path.Base(p)] = t
+	}
+
+	type key struct{ pkg, arch string }
+	pkgs := make(map[key][]*tarball)
+	for _, link := range walk.links {
+		// TARS/<arch>/<package>/<tarball>
+		parts := strings.Split(link, "/")
+		if len(parts) != 4 {
+			continue
+		}
+		t, ok := tarballs[parts[1]+"/"+parts[3]]
+		if !ok {
+			stats.Orphans.Dangling = append(stats.Orphans.Dangling, link)
+			continue
+		}
+		t.linked = true
+		k := key{pkg: parts[2], arch: parts[1]}
+		pkgs[k] = append(pkgs[k], t)
+	}
+	for _, p := range paths {
+		arch := strings.Split(p, "/")[1]
+		if t, ok := tarballs[arch+"/"+path.Base(p)]; ok && !t.linked {
+			stats.Orphans.Unlinked = append(stats.Orphans.Unlinked, p)
+		}
+	}
+
+	var keys []key
+	for k := range pkgs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].arch != keys[j].arch {
+			return keys[i].arch < keys[j].arch
+		}
+		return keys[i].pkg < keys[j].pkg
+	})
+	archs := make(map[string]*archStats)
+	var order []string
+	for _, k := range keys {
+		ts := pkgs[k]
+		// tarballs are ordered by build date, when known, and by version
+		// and revision.
+		verRev := func(t *tarball) string {
+			v := strings.TrimPrefix(path.Base(t.path), k.pkg+"-")
+			if i := strings.Index(v, "."+k.arch); i >= 0 {
+				v = v[:i]
+			}
+			return v
+		}
+		sort.SliceStable(ts, func(i, j int) bool {
+			mi, mj := ts[i].manifest, ts[j].manifest
+			if mi != nil && mj != nil && !mi.FinishedOn.Equal(mj.FinishedOn) {
+				return mi.FinishedOn.Before(mj.FinishedOn)
+			}
+			return versionLess(verRev(ts[i]), verRev(ts[j]))
+		})
+		ps := packageStats{
+			Package:  k.pkg,
+			Arch:     k.arch,
+			Tarballs: len(ts),
+			Oldest:   verRev(ts[0]),
+			Newest:   verRev(ts[len(ts)-1]),
+		}
+		for _, t := range ts {
+			if t.manifest != nil {
+				ps.Size += t.manifest.Size
+			}
+		}
+		if m := ts[len(ts)-1].manifest; m != nil {
+			ps.Built = m.FinishedOn
+		}
+		stats.Packages = append(stats.Packages, ps)
+
+		as, ok := archs[k.arch]
+		if !ok {
+			as = &archStats{Arch: k.arch}
+			archs[k.arch] = as
+			order = append(order, k.arch)
+		}
+		as.Packages++
+		as.Tarballs += ps.Tarballs
+		as.Size += ps.Size
+	}
+	for _, arch := range order {
+		stats.Archs = append(stats.Archs, *archs[arch])
+	}
+	return stats, nil
+}
+
+// printStoreStats writes the statistics of the named store to w, as JSON if
+// asJSON is true.
+func (b *Builder) printStoreStats(w io.Writer, name string, asJSON bool) error {
+	stats, err := b.statStore(name)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		buf, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", buf)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "store:\t%s\n\n", stats.Store)
+	fmt.Fprintf(tw, "ARCH\tPACKAGES\tTARBALLS\tSIZE\n")
+	for _, a := range stats.Archs {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", a.Arch, a.Packages, a.Tarballs, humanBytes(a.Size))
+	}
+	fmt.Fprintf(tw, "\nPACKAGE\tARCH\tTARBALLS\tSIZE\tOLDEST\tNEWEST\tBUILT\n")
+	for _, p := range stats.Packages {
+		built := "-"
+		if !p.Built.IsZero() {
+			built = p.Built.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			p.Package, p.Arch, p.Tarballs, humanBytes(p.Size), p.Oldest, p.Newest, built,
+		)
+	}
+	fmt.Fprintf(tw, "\norphans:\t%d unlinked tarballs, %d dangling links, %d companion files\n",
+		len(stats.Orphans.Unlinked), len(stats.Orphans.Dangling), len(stats.Orphans.Companions),
+	)
+	return tw.Flush()
+}
+
+// contains returns whether list holds v.
+func contains(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// states of the commit statuses.
+const (
+	commitPending = "pending"
+	commitSuccess = "success"
+	commitFailure = "failure"
+)
+
+var reCommitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// statusCommit returns the commit of the sources of a spec whose status is
+// reported to its repository, or "" if none.
+// statuses are only reported for the development packages, and for the
+// packages whose tag is a commit.
+func (b *Builder) statusCommit(spec *Spec) string {
+	if reCommitHash.MatchString(spec.Tag) {
+		return spec.Tag
+	}
+	if !b.isDevel(spec.Package) {
+		return ""
+	}
+	dir := b.sourceDir(spec)
+	if _, err := b.fs.Stat(dir); err != nil {
+		return ""
+	}
+	cmd := exec.CommandContext(b.ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := output(b.exec, cmd)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// repoPath returns the host and the path of the repository of a source URL,
+// e.g. github.com and alisw/ROOT for https://github.com/alisw/ROOT.git or
+// git@github.com:alisw/ROOT.git.
+func repoPath(source string) (string, string) {
+	var host, path string
+	switch {
+	case strings.Contains(source, "://"):
+		u, err := url.Parse(source)
+		if err != nil {
+			return "", ""
+		}
+		host, path = u.Hostname(), u.Path
+	case strings.Contains(source, ":"):
+		// scp-like syntax.
+		i := strings.Index(source, ":")
+		host, path = source[:i], source[i+1:]
+		if j := strings.Index(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+	default:
+		return "", ""
+	}
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return host, path
+}
+
+// logURL returns the link to the build log of a spec, if configured.
+func (b *Builder) logURL(spec *Spec) string {
+	return strings.NewReplacer(
+		"{arch}", spec.arch,
+		"{package}", spec.Package,
+		"{version}", spec.Version,
+		"{hash}", spec.Hash,
+	).Replace(b.cfg.statusLogURL)
+}
+
+// commitStatus reports the state of the build of a spec to the GitHub or
+// GitLab repository of its sources, when a token is configured for it.
+// failures to report the status are not fatal.
+func (b *Builder) commitStatus(spec *Spec, state string) {
+	if spec.Source == "" || (b.cfg.githubToken == "" && b.cfg.gitlabToken == "") {
+		return
+	}
+	host, path := repoPath(spec.Source)
+	if host == "" || path == "" {
+		return
+	}
+
+	var post func(sha, path string, spec *Spec, state string) error
+	switch {
+	case host == "github.com" && b.cfg.githubToken != "":
+		post = b.postGitHubStatus
+	case b.cfg.gitlabToken != "" && (host == "gitlab.com" || b.isGitLabHost(host)):
+		post = func(sha, path string, spec *Spec, state string) error {
+			return b.postGitLabStatus(host, sha, path, spec, state)
+		}
+	default:
+		return
+	}
+
+	sha := b.statusCommit(spec)
+	if sha == "" {
+		return
+	}
+	err := post(sha, path, spec, state)
+	if err != nil {
+		msg.Warnf("could not report %s status of %s to [%s]: %v\n", state, spec.Package, host, err)
+		return
+	}
+	msg.Debugf("reported %s status of %s@%s to [%s/%s]\n", state, spec.Package, sha, host, path)
+}
+
+func (b *Builder) isGitLabHost(host string) bool {
+	for _, h := range b.cfg.gitlabHosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// statusContext returns the name identifying the statuses of aligot builds.
+func (b *Builder) statusContext(spec *Spec) string {
+	return "aligot/" + spec.arch + "/" + b.cfg.defaults
+}
+
+func (b *Builder) postGitHubStatus(sha, path string, spec *Spec, state string) error {
+	body, err := json.Marshal(map[string]string{
+		"state":       state,
+		"target_url":  b.logURL(spec),
+		"description": fmt.Sprintf("%s@%s (%s): %s", spec.Package, spec.Version, spec.Hash[:7], state),
+		"context":     b.statusContext(spec),
+	})
+	if err != nil {
+		return err
+	}
+
+	api := b.cfg.githubAPI
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	req, err := http.NewRequest(
+		"POST", strings.TrimSuffix(api, "/")+"/repos/"+path+"/statuses/"+sha,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+b.cfg.githubToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	return doStatus(req)
+}
+
+func (b *Builder) postGitLabStatus(host, sha, path string, spec *Spec, state string) error {
+	// GitLab names the states of the statuses differently.
+	switch state {
+	case commitPending:
+		state = "running"
+	case commitFailure:
+		state = "failed"
+	}
+	q := url.Values{}
+	q.Set("state", state)
+	q.Set("name", b.statusContext(spec))
+	q.Set("description", fmt.Sprintf("%s@%s (%s)", spec.Package, spec.Version, spec.Hash[:7]))
+	if u := b.logURL(spec); u != "" {
+		q.Set("target_url", u)
+	}
+
+	req, err := http.NewRequest(
+		"POST",
+		"https://"+host+"/api/v4/projects/"+url.PathEscape(path)+"/statuses/"+sha+"?"+q.Encode(),
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("PRIVATE-TOKEN", b.cfg.gitlabToken)
+	return doStatus(req)
+}
+
+func doStatus(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s\n%s", resp.Status, body)
+	}
+	return nil
+}
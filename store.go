@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// upload syncs the tarball of a spec, together with its link and its
+// signature (if any), to the write store.
+func (b *Builder) upload(spec *Spec) error {
+	if b.write == nil {
+		return nil
+	}
+
+	name := b.tarball(spec)
+	tarball := filepath.Join(spec.tar.storePath, name)
+	files := []string{
+		tarball,
+		filepath.Join(spec.tar.linksPath, name),
+	}
+	for _, ext := range []string{provenanceExt, manifestExt} {
+		if _, err := b.fs.Stat(filepath.Join(b.cfg.wdir, tarball+ext)); err == nil {
+			files = append(files, tarball+ext)
+		}
+	}
+
+	tarballs := []string{tarball}
+	dbg := filepath.Join(spec.tar.storePath, b.debugTarball(spec))
+	if _, err := b.fs.Stat(filepath.Join(b.cfg.wdir, dbg)); err == nil {
+		files = append(files, dbg)
+		tarballs = append(tarballs, dbg)
+	}
+
+	if b.cfg.signKey != "" {
+		for _, fname := range tarballs {
+			sig, err := b.signTarball(filepath.Join(b.cfg.wdir, fname))
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.Join(spec.tar.storePath, filepath.Base(sig)))
+		}
+	}
+
+	msg.Infof("uploading %s to [%s]...\n", name, b.write.URL())
+	err := b.write.Upload(b.ctx, b.cfg.wdir, files)
+	if err != nil {
+		return err
+	}
+	for _, fname := range files {
+		if fi, err := b.fs.Stat(filepath.Join(b.cfg.wdir, fname)); err == nil {
+			b.metrics.addUploaded(fi.Size())
+		}
+	}
+	return nil
+}
+
+// prefetch concurrently fetches from the remote store the tarballs of all the
+// needed packages which are not available locally.
+func (b *Builder) prefetch(needed map[string]bool) error {
+	var todo []*Spec
+	for _, p := range b.order {
+		if !needed[p] {
+			continue
+		}
+		spec := b.specs[p]
+		spec.Revision = b.revision(spec)
+		if !b.locate(spec) {
+			todo = append(todo, spec)
+		}
+	}
+	if len(todo) == 0 {
+		return nil
+	}
+
+	msg.Infof("checking %d packages in remote store [%s]...\n", len(todo), b.cfg.remoteStore)
+	prog := newProgress(os.Stderr, len(todo))
+	prog.metrics = b.metrics
+	if b.board != nil {
+		// the downloads are shown on the board.
+		prog.w = ioutil.Discard
+	}
+	errs := make([]error, len(todo))
+	forEach(len(todo), b.storeJobs(), func(i int) {
+		ph := b.phase(todo[i].Package, "download")
+		errs[i] = b.fetch(todo[i], prog)
+		ph.sp.set("aligot.found", strconv.FormatBool(b.locate(todo[i])))
+		ph.finish(errs[i])
+		prog.done()
+	})
+	prog.close()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("could not fetch %s from remote store [%s]: %v",
+				todo[i].Package, b.cfg.remoteStore, err,
+			)
+		}
+		if b.locate(todo[i]) {
+			b.fetched[todo[i].Package] = true
+		}
+	}
+	return nil
+}
+
+// fetch retrieves the tarball of a spec, and its signature if any, from the
+// remote store into the local store, reporting the downloaded bytes to prog.
+// fetch does nothing if the tarball is already available locally or if it is
+// not available from the remote store.
+// the retrieved tarball is verified before being linked into the local store.
+//
+// when the remote store holds no tarball for the architecture of the spec,
+// the tarballs of the compatible architectures are used: the spec then gets
+// their architecture.
+func (b *Builder) fetch(spec *Spec, prog store.Progress) error {
+	if b.locate(spec) {
+		return nil
+	}
+
+	native := spec.arch
+	for _, arch := range b.archCandidates(spec) {
+		b.setArch(spec, arch)
+		spec.Revision = b.revision(spec)
+		ok := b.locate(spec)
+		if !ok {
+			var err error
+			ok, err = b.fetchArch(spec, prog)
+			if err != nil {
+				b.setArch(spec, native)
+				spec.Revision = b.revision(spec)
+				return err
+			}
+		}
+		if !ok {
+			continue
+		}
+		if arch != native {
+			return b.recordFallback(spec, native)
+		}
+		return nil
+	}
+	b.setArch(spec, native)
+	spec.Revision = b.revision(spec)
+	msg.Debugf("no tarball for %s@%s in remote store\n", spec.Package, spec.Hash)
+	return nil
+}
+
+// fetchArch retrieves the tarball of a spec, for its current architecture,
+// and reports whether the remote store holds it.
+func (b *Builder) fetchArch(spec *Spec, prog store.Progress) (bool, error) {
+	err := b.fs.MkdirAll(spec.tar.hashDir, 0755)
+	if err != nil {
+		return false, err
+	}
+
+	// the listing of the store directory, when available, avoids
+	// (re-)requesting missing files.
+	var files map[string]bool
+	names, ok, err := b.remote.List(b.ctx, spec.tar.storePath)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		files = make(map[string]bool, len(names))
+		for _, name := range names {
+			files[name] = true
+		}
+	}
+
+	// the remote store may hold a tarball of any compression.
+	for _, c := range b.tarCompressions() {
+		spec.tar.compression = c
+		if files != nil && !files[b.tarball(spec)] {
+			continue
+		}
+		ok, err := b.fetchTarball(spec, files, prog)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	spec.tar.compression = b.tarCompressions()[0]
+	return false, nil
+}
+
+// fetchTarball retrieves the tarball of a spec, with its current compression,
+// and reports whether the remote store holds it.
+// files is the listing of the remote store directory of the spec, if known.
+func (b *Builder) fetchTarball(spec *Spec, files map[string]bool, prog store.Progress) (bool, error) {
+	name := b.tarball(spec)
+	tarball := filepath.Join(spec.tar.hashDir, name)
+
+	var names []string
+	for _, ext := range []string{"", ".asc", provenanceExt, manifestExt} {
+		// the companions of a previous download of the tarball must not be
+		// checked against the new one.
+		if ext != "" {
+			b.fs.Remove(tarball + ext)
+		}
+		if files != nil && !files[name+ext] {
+			continue
+		}
+		names = append(names, filepath.Join(spec.tar.storePath, name+ext))
+	}
+	err := b.remote.Fetch(b.ctx, b.cfg.wdir, names, prog)
+	if err != nil {
+		return false, err
+	}
+	if _, err := b.fs.Stat(tarball); err != nil {
+		return false, nil
+	}
+
+	msg.Debugf("fetched %s from [%s]\n", name, b.remote.URL())
+	err = checkDigest(tarball)
+	if err == nil {
+		err = b.verifyTarball(tarball)
+	}
+	if err != nil {
+		b.fs.Remove(tarball)
+		b.fs.Remove(tarball + ".asc")
+		return false, err
+	}
+
+	return true, b.link(spec)
+}
+
+// fetchFile retrieves the named file of the store directory of a spec, and
+// its signature if any, from the remote store.
+// fetchFile reports whether the remote store holds the file.
+func (b *Builder) fetchFile(spec *Spec, name string) (bool, error) {
+	err := b.fs.MkdirAll(spec.tar.hashDir, 0755)
+	if err != nil {
+		return false, err
+	}
+
+	b.fs.Remove(filepath.Join(spec.tar.hashDir, name+".asc"))
+	fname := filepath.Join(spec.tar.storePath, name)
+	err = b.remote.Fetch(b.ctx, b.cfg.wdir, []string{fname, fname + ".asc"}, nil)
+	if err != nil {
+		return false, err
+	}
+	_, err = b.fs.Stat(filepath.Join(spec.tar.hashDir, name))
+	return err == nil, nil
+}
+
+// exists returns whether the named file exists.
+func exists(fname string) bool {
+	_, err := os.Stat(fname)
+	return err == nil
+}
+
+// checkDigest checks a downloaded tarball against the digest of its manifest,
+// if any.
+func checkDigest(tarball string) error {
+	m, err := readManifest(hostFS{}, tarball+manifestExt)
+	if err != nil || m.SHA256 == "" {
+		return nil
+	}
+	sum, err := sha256File(hostFS{}, tarball)
+	if err != nil {
+		return err
+	}
+	if sum != m.SHA256 {
+		return fmt.Errorf("corrupted tarball [%s]: sha256 is %s, manifest has %s", filepath.Base(tarball), sum, m.SHA256)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Bandwidth limits the rate of the uploads: it is shared by the concurrent
+// uploads.
+type Bandwidth struct {
+	rate int64 // bytes per second, 0 if unlimited
+
+	mu   sync.Mutex
+	next time.Time // when the next bytes may be sent
+}
+
+// NewBandwidth returns a bandwidth of rate bytes per second, unlimited if
+// rate is 0.
+func NewBandwidth(rate int64) *Bandwidth {
+	return &Bandwidth{rate: rate}
+}
+
+// wait waits until n more bytes may be sent.
+func (bw *Bandwidth) wait(ctx context.Context, n int) error {
+	if bw == nil || bw.rate <= 0 || n <= 0 {
+		return nil
+	}
+	bw.mu.Lock()
+	now := time.Now()
+	if bw.next.Before(now) {
+		bw.next = now
+	}
+	at := bw.next
+	bw.next = bw.next.Add(time.Duration(int64(n) * int64(time.Second) / bw.rate))
+	bw.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Reader returns a reader of r limited to the bandwidth.
+func (bw *Bandwidth) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if bw == nil || bw.rate <= 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, bw: bw}
+}
+
+// limitedReader is a reader limited to a bandwidth.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	bw  *Bandwidth
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	const chunk = 32 << 10
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	if werr := r.bw.wait(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
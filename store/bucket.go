@@ -0,0 +1,338 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// azureVersion is the version of the Azure Blob Storage API used by the
+// stores.
+const azureVersion = "2021-08-06"
+
+// Bucket is a store in a bucket of a cloud object storage: Google Cloud
+// Storage (gs://bucket/prefix) or Azure Blob Storage
+// (az://account/container/prefix).
+//
+// the objects are named by the prefix of the store, and the path of the
+// files relative to the store.
+// Google Cloud Storage is accessed with an OAuth2 token, Azure Blob Storage
+// with a SAS token or an OAuth2 token, given by the credentials of the store
+// (e.g. the output of gcloud auth print-access-token).
+// public buckets are accessed anonymously.
+type Bucket struct {
+	url    string
+	kind   string // gs or az
+	bucket string // URL of the bucket, or of the container
+	prefix string
+	rw     bool
+	client *http.Client
+	bw     *Bandwidth // bandwidth of the uploads, if limited
+}
+
+// NewBucket returns the store in the bucket at url, accessed with creds
+// through endpoint (the default endpoint of the cloud if empty).
+// the uploads are limited to the bandwidth bw, if not nil.
+func NewBucket(url, endpoint string, rw bool, creds Credentials, bw *Bandwidth) (*Bucket, error) {
+	i := strings.Index(url, "://")
+	if i < 0 || !IsBucket(url) {
+		return nil, fmt.Errorf("invalid store [%s]: not a bucket", url)
+	}
+	s := &Bucket{url: url, kind: url[:i], rw: rw, bw: bw}
+	parts := strings.SplitN(strings.Trim(url[i+len("://"):], "/"), "/", 3)
+	switch s.kind {
+	case "gs":
+		if endpoint == "" {
+			endpoint = "https://storage.googleapis.com"
+		}
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid store [%s]: no bucket (want gs://bucket[/prefix])", url)
+		}
+		s.bucket = strings.TrimSuffix(endpoint, "/") + "/" + parts[0]
+		s.prefix = strings.Join(parts[1:], "/")
+		s.client = &http.Client{Transport: &AuthTransport{Creds: creds, Base: http.DefaultTransport}}
+	case "az":
+		if len(parts) < 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid store [%s]: no container (want az://account/container[/prefix])", url)
+		}
+		if endpoint == "" {
+			endpoint = "https://" + parts[0] + ".blob.core.windows.net"
+		}
+		s.bucket = strings.TrimSuffix(endpoint, "/") + "/" + parts[1]
+		s.prefix = strings.Join(parts[2:], "/")
+		s.client = &http.Client{Transport: &azureTransport{creds: creds, base: http.DefaultTransport}}
+	}
+	return s, nil
+}
+
+func (s *Bucket) URL() string    { return s.url }
+func (s *Bucket) Writable() bool { return s.rw }
+
+// object returns the name of the object of the named file.
+func (s *Bucket) object(name string) string {
+	return path.Join(s.prefix, filepath.ToSlash(name))
+}
+
+// objectURL returns the URL of the object of the named file.
+func (s *Bucket) objectURL(name string) string {
+	obj := strings.Split(s.object(name), "/")
+	for i, v := range obj {
+		obj[i] = url.PathEscape(v)
+	}
+	return s.bucket + "/" + strings.Join(obj, "/")
+}
+
+func (s *Bucket) List(ctx context.Context, dir string) ([]string, bool, error) {
+	prefix := s.object(dir) + "/"
+	var (
+		names []string
+		err   error
+	)
+	switch s.kind {
+	case "gs":
+		names, err = s.listGCS(ctx, prefix)
+	case "az":
+		names, err = s.listAzure(ctx, prefix)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return names, true, nil
+}
+
+// listGCS lists the objects of a Google Cloud Storage bucket under prefix.
+func (s *Bucket) listGCS(ctx context.Context, prefix string) ([]string, error) {
+	i := strings.LastIndex(s.bucket, "/")
+	api := s.bucket[:i] + "/storage/v1/b/" + s.bucket[i+1:] + "/o"
+	var names []string
+	token := ""
+	for {
+		q := url.Values{"prefix": {prefix}, "delimiter": {"/"}, "fields": {"items(name),prefixes,nextPageToken"}}
+		if token != "" {
+			q.Set("pageToken", token)
+		}
+		var page struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			Prefixes      []string `json:"prefixes"`
+			NextPageToken string   `json:"nextPageToken"`
+		}
+		err := s.get(ctx, api+"?"+q.Encode(), func(r io.Reader) error {
+			return json.NewDecoder(r).Decode(&page)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			names = append(names, strings.TrimPrefix(item.Name, prefix))
+		}
+		for _, p := range page.Prefixes {
+			names = append(names, strings.TrimPrefix(p, prefix))
+		}
+		token = page.NextPageToken
+		if token == "" {
+			return names, nil
+		}
+	}
+}
+
+// listAzure lists the blobs of an Azure Blob Storage container under prefix.
+func (s *Bucket) listAzure(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		var page struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			Prefixes []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>BlobPrefix"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err := s.get(ctx, s.bucket+"?"+q.Encode(), func(r io.Reader) error {
+			return xml.NewDecoder(r).Decode(&page)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Blobs {
+			names = append(names, strings.TrimPrefix(blob.Name, prefix))
+		}
+		for _, p := range page.Prefixes {
+			names = append(names, strings.TrimPrefix(p.Name, prefix))
+		}
+		marker = page.NextMarker
+		if marker == "" {
+			return names, nil
+		}
+	}
+}
+
+// get decodes the response to a GET request at url with decode.
+func (s *Bucket) get(ctx context.Context, url string, decode func(r io.Reader) error) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not list store [%s]: %s", s.url, resp.Status)
+	}
+	return decode(resp.Body)
+}
+
+func (s *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	req, err := http.NewRequest("HEAD", s.objectURL(name), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("could not query store [%s]: %s", s.url, resp.Status)
+	}
+}
+
+func (s *Bucket) Fetch(ctx context.Context, dir string, names []string, prog Progress) error {
+	for _, name := range names {
+		dst := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		var p Progress
+		if IsTarball(name) {
+			p = prog
+		}
+		err = get(ctx, s.client, s.objectURL(name), dst, p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Bucket) Upload(ctx context.Context, dir string, names []string) error {
+	if !s.rw {
+		return fmt.Errorf("store [%s] is read-only", s.url)
+	}
+	for _, name := range names {
+		err := s.put(ctx, filepath.Join(dir, name), s.objectURL(name))
+		if err != nil {
+			return fmt.Errorf("could not upload [%s] to store [%s]: %v", name, s.url, err)
+		}
+	}
+	return nil
+}
+
+// Remove removes the objects of the named files.
+func (s *Bucket) Remove(ctx context.Context, names []string) error {
+	if !s.rw {
+		return fmt.Errorf("store [%s] is read-only", s.url)
+	}
+	for _, name := range names {
+		req, err := http.NewRequest("DELETE", s.objectURL(name), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusNotFound:
+			// ok
+		default:
+			return fmt.Errorf("could not remove [%s] from store [%s]: %s", name, s.url, resp.Status)
+		}
+	}
+	return nil
+}
+
+// put uploads the named file to the object at url.
+func (s *Bucket) put(ctx context.Context, fname, url string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", url, s.bw.Reader(ctx, f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if s.kind == "az" {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// azureTransport authenticates the requests to Azure Blob Storage: SAS
+// tokens are added to the query of the requests, other tokens are used as
+// bearer tokens.
+type azureTransport struct {
+	creds Credentials
+	base  http.RoundTripper
+}
+
+func (t *azureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, token, err := t.creds.Get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("x-ms-version", azureVersion)
+	switch sas := strings.TrimPrefix(token, "?"); {
+	case token == "":
+		// anonymous access.
+	case strings.Contains(sas, "sig="):
+		if req.URL.RawQuery != "" {
+			sas = req.URL.RawQuery + "&" + sas
+		}
+		req.URL.RawQuery = sas
+	default:
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.base.RoundTrip(req)
+}
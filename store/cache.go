@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// cache is an on-disk cache of HTTP responses, revalidated with
+// conditional requests.
+// cache is meant for the (small) listings and metadata files of remote
+// stores, not for tarballs.
+type cache struct {
+	dir    string
+	client *http.Client
+}
+
+// cacheEntry describes a cached response.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+	ContentType  string `json:"content-type,omitempty"`
+}
+
+// newCache returns a cache of the HTTP responses to client, stored under
+// dir.
+func newCache(dir string, client *http.Client) *cache {
+	return &cache{dir: dir, client: client}
+}
+
+// get returns the content of the resource at url, from the cache if the
+// server reports it did not change.
+// get returns a nil content for missing resources.
+func (c *cache) get(ctx context.Context, url string) ([]byte, cacheEntry, error) {
+	sum := sha1.Sum([]byte(url))
+	key := filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+
+	var entry cacheEntry
+	body, err := ioutil.ReadFile(key + ".body")
+	if err == nil {
+		buf, err := ioutil.ReadFile(key + ".json")
+		if err == nil {
+			err = json.Unmarshal(buf, &entry)
+		}
+		if err != nil || entry.URL != url {
+			body = nil
+			entry = cacheEntry{}
+		}
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, entry, err
+	}
+	if body != nil {
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, entry, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if body != nil {
+			Log.Debugf("using cached [%s]\n", url)
+			return body, entry, nil
+		}
+		return nil, entry, fmt.Errorf("could not download [%s]: unexpected %s", url, resp.Status)
+	case http.StatusNotFound:
+		os.Remove(key + ".body")
+		os.Remove(key + ".json")
+		return nil, cacheEntry{URL: url}, nil
+	case http.StatusOK:
+		// ok
+	default:
+		return nil, entry, fmt.Errorf("could not download [%s]: %s", url, resp.Status)
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, entry, err
+	}
+	entry = cacheEntry{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+	}
+	if entry.ETag == "" && entry.LastModified == "" {
+		// can not be revalidated.
+		return body, entry, nil
+	}
+
+	err = c.store(key, body, entry)
+	if err != nil {
+		Log.Warnf("could not cache [%s]: %v\n", url, err)
+	}
+	return body, entry, nil
+}
+
+// store writes a response into the cache.
+func (c *cache) store(key string, body []byte, entry cacheEntry) error {
+	err := os.MkdirAll(c.dir, 0755)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	for _, v := range []struct {
+		fname string
+		data  []byte
+	}{
+		{key + ".body", body},
+		{key + ".json", buf},
+	} {
+		err = ioutil.WriteFile(v.fname+".tmp", v.data, 0644)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(v.fname+".tmp", v.fname)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var reHref = regexp.MustCompile(`href="([^"?#]+)"`)
+
+// list returns the set of the names of the files listed in the HTML index of
+// the directory dir.
+// the names of the subdirectories end with a slash.
+// list returns a nil set if the server provides no such index.
+func (c *cache) list(ctx context.Context, dir string) (map[string]bool, error) {
+	body, entry, err := c.get(ctx, strings.TrimSuffix(dir, "/")+"/")
+	if err != nil || body == nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(entry.ContentType, "text/html") {
+		return nil, nil
+	}
+
+	files := make(map[string]bool)
+	for _, m := range reHref.FindAllSubmatch(body, -1) {
+		name, err := url.PathUnescape(string(m[1]))
+		if err != nil || strings.Contains(strings.TrimSuffix(name, "/"), "/") || name == "../" {
+			continue
+		}
+		files[name] = true
+	}
+	return files, nil
+}
+
+// fetchFile downloads the resource at url into the named file, through the
+// cache.
+// a missing resource is not an error, and creates no file.
+func (c *cache) fetchFile(ctx context.Context, url, fname string) error {
+	body, _, err := c.get(ctx, url)
+	if err != nil || body == nil {
+		return err
+	}
+	return ioutil.WriteFile(fname, body, 0644)
+}
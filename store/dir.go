@@ -0,0 +1,113 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Dir is a store in a directory of the machine: files are hard linked
+// between the local store and the store, when they are on the same file
+// system.
+type Dir struct {
+	dir string
+	rw  bool
+	fs  FS
+}
+
+// NewDir returns the store in the directory dir, accessed through fs.
+func NewDir(dir string, rw bool, fs FS) *Dir {
+	return &Dir{dir: dir, rw: rw, fs: fs}
+}
+
+func (s *Dir) URL() string    { return s.dir }
+func (s *Dir) Writable() bool { return s.rw }
+
+func (s *Dir) List(ctx context.Context, dir string) ([]string, bool, error) {
+	fis, err := s.fs.ReadDir(filepath.Join(s.dir, dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+		if fi.IsDir() {
+			names[i] += "/"
+		}
+	}
+	return names, true, nil
+}
+
+func (s *Dir) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.fs.Stat(filepath.Join(s.dir, name))
+	return err == nil, nil
+}
+
+func (s *Dir) Fetch(ctx context.Context, dir string, names []string, prog Progress) error {
+	for _, name := range names {
+		src := filepath.Join(s.dir, name)
+		if _, err := s.fs.Stat(src); err != nil {
+			continue
+		}
+		err := link(ctx, src, filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	AddSizes(prog, dir, names)
+	return nil
+}
+
+func (s *Dir) Upload(ctx context.Context, dir string, names []string) error {
+	if !s.rw {
+		return fmt.Errorf("store [%s] is read-only", s.dir)
+	}
+	for _, name := range names {
+		err := link(ctx, filepath.Join(dir, name), filepath.Join(s.dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the named files of the store.
+func (s *Dir) Remove(ctx context.Context, names []string) error {
+	for _, name := range names {
+		err := s.fs.Remove(filepath.Join(s.dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Readlink returns the target of the named symbolic link of the store.
+func (s *Dir) Readlink(ctx context.Context, name string) (string, error) {
+	return os.Readlink(filepath.Join(s.dir, name))
+}
+
+// link hard links the file src to dst, or copies it when they are on
+// different file systems.
+func link(ctx context.Context, src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return runWith(ctx, hostExecutor{}, "", "cp", "-a", src, dst)
+}
+
+// hostExecutor runs commands on the host.
+type hostExecutor struct{}
+
+func (hostExecutor) Start(cmd *exec.Cmd) error { return cmd.Start() }
+func (hostExecutor) Wait(cmd *exec.Cmd) error  { return cmd.Wait() }
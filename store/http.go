@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HTTP is a read-only store served over HTTP.
+// the companion files of the tarballs are fetched through the cache of the
+// metadata of the store.
+type HTTP struct {
+	url    string
+	client *http.Client
+	cache  *cache
+}
+
+// NewHTTP returns the store at url, accessed with client, whose metadata is
+// cached in the directory cacheDir.
+func NewHTTP(url string, client *http.Client, cacheDir string) *HTTP {
+	return &HTTP{
+		url:    strings.TrimSuffix(url, "/"),
+		client: client,
+		cache:  newCache(cacheDir, client),
+	}
+}
+
+func (s *HTTP) URL() string    { return s.url }
+func (s *HTTP) Writable() bool { return false }
+
+func (s *HTTP) List(ctx context.Context, dir string) ([]string, bool, error) {
+	files, err := s.cache.list(ctx, s.url+"/"+filepath.ToSlash(dir))
+	if err != nil || files == nil {
+		return nil, false, err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	return names, true, nil
+}
+
+func (s *HTTP) Exists(ctx context.Context, name string) (bool, error) {
+	req, err := http.NewRequest("HEAD", s.url+"/"+filepath.ToSlash(name), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+func (s *HTTP) Fetch(ctx context.Context, dir string, names []string, prog Progress) error {
+	for _, name := range names {
+		url := s.url + "/" + filepath.ToSlash(name)
+		dst := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(dst), 0755)
+		if err != nil {
+			return err
+		}
+		if IsTarball(name) {
+			err = get(ctx, s.client, url, dst, prog)
+		} else {
+			err = s.cache.fetchFile(ctx, url, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *HTTP) Upload(ctx context.Context, dir string, names []string) error {
+	return fmt.Errorf("store [%s] is read-only: HTTP stores can not be uploaded to", s.url)
+}
+
+// AuthTransport authenticates the requests to an HTTP server, with basic
+// authentication when the credentials have a user, and with a bearer token
+// otherwise.
+type AuthTransport struct {
+	Creds Credentials
+	Base  http.RoundTripper
+}
+
+func (t *AuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	user, secret, err := t.Creds.Get(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	switch {
+	case user != "":
+		req.SetBasicAuth(user, secret)
+	case secret != "":
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// get downloads the resource at url into the named file, reporting the
+// downloaded bytes to prog if not nil.
+// a missing resource is not an error, and creates no file.
+// a download shorter or longer than announced by the server is an error.
+// the download is aborted when ctx is canceled.
+//
+// interrupted downloads are resumed from their partial file, with a range
+// request, when the server identifies the resource with an ETag or a
+// modification date.
+func get(ctx context.Context, client *http.Client, url, fname string, prog Progress) error {
+	part := fname + PartialExt
+	info, offset := resumable(part, url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", info.validator())
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		if start, ok := rangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			removePartial(part)
+			return fmt.Errorf("could not resume download of [%s]: unexpected range %q", url, resp.Header.Get("Content-Range"))
+		}
+		Log.Infof("resuming download of [%s] at %d bytes\n", url, offset)
+	case http.StatusRequestedRangeNotSatisfiable:
+		// stale partial file.
+		removePartial(part)
+		resp.Body.Close()
+		return get(ctx, client, url, fname, prog)
+	case http.StatusNotFound:
+		removePartial(part)
+		return nil
+	default:
+		return fmt.Errorf("could not download [%s]: %s", url, resp.Status)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	} else {
+		err = writePartial(part, partialInfo{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if prog != nil {
+		prog.Expect(resp.ContentLength)
+		w = io.MultiWriter(f, prog)
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("could not download [%s]: got %d bytes, expected %d",
+			url, n, resp.ContentLength,
+		)
+		if n > resp.ContentLength {
+			removePartial(part)
+		}
+	}
+	if err != nil {
+		// the partial file is kept, to resume the download.
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		removePartial(part)
+		return err
+	}
+	os.Remove(part + ".json")
+	return os.Rename(part, fname)
+}
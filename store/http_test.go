@@ -0,0 +1,125 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var fixedTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// progress counts the downloaded bytes.
+type progress struct {
+	total, bytes int64
+}
+
+func (p *progress) Write(data []byte) (int, error) {
+	p.bytes += int64(len(data))
+	return len(data), nil
+}
+
+func (p *progress) Expect(n int64) { p.total += n }
+func (p *progress) Add(n int64)    { p.total += n; p.bytes += n }
+
+func TestGet(t *testing.T) {
+	const content = "0123456789"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "file", fixedTime, strings.NewReader(content))
+		case "/weak":
+			w.Header().Set("ETag", `W/"v1"`)
+			http.ServeContent(w, r, "weak", fixedTime, strings.NewReader(content))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		partial string // content of a partial file of a previous download
+		info    string // bookkeeping of the partial file
+		want    string // content of the downloaded file, none if empty
+		bytes   int64  // bytes reported to the progress
+	}{
+		{
+			name:  "full",
+			path:  "/file",
+			want:  content,
+			bytes: 10,
+		},
+		{
+			name:    "resumed",
+			path:    "/file",
+			partial: "0123",
+			info:    `{"url":"URL/file","etag":"\"v1\""}`,
+			want:    content,
+			bytes:   6,
+		},
+		{
+			name:    "other-resource",
+			path:    "/file",
+			partial: "abcd",
+			info:    `{"url":"URL/other","etag":"\"v1\""}`,
+			want:    content,
+			bytes:   10,
+		},
+		{
+			name:    "weak-etag",
+			path:    "/weak",
+			partial: "abcd",
+			info:    `{"url":"URL/weak","etag":"W/\"v1\""}`,
+			want:    content,
+			bytes:   10,
+		},
+		{
+			name: "missing",
+			path: "/missing",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fname := filepath.Join(t.TempDir(), "file")
+			if tc.partial != "" {
+				err := ioutil.WriteFile(fname+PartialExt, []byte(tc.partial), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				info := strings.Replace(tc.info, "URL", srv.URL, -1)
+				err = ioutil.WriteFile(fname+PartialExt+".json", []byte(info), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			prog := new(progress)
+			err := get(context.Background(), srv.Client(), srv.URL+tc.path, fname, prog)
+			if err != nil {
+				t.Fatalf("could not download: %+v", err)
+			}
+			buf, err := ioutil.ReadFile(fname)
+			switch {
+			case tc.want == "" && err == nil:
+				t.Fatalf("unexpected file %q", buf)
+			case tc.want != "" && string(buf) != tc.want:
+				t.Fatalf("invalid content: got=%q, want=%q (%v)", buf, tc.want, err)
+			}
+			if prog.bytes != tc.bytes {
+				t.Fatalf("invalid progress: got=%d, want=%d", prog.bytes, tc.bytes)
+			}
+			for _, f := range []string{fname + PartialExt, fname + PartialExt + ".json"} {
+				if _, err := os.Stat(f); err == nil {
+					t.Fatalf("partial file %s not removed", filepath.Base(f))
+				}
+			}
+		})
+	}
+}
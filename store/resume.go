@@ -0,0 +1,74 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PartialExt is the extension of the partial files of the downloads.
+// the bookkeeping of a partial file is stored next to it, with a .json
+// extension.
+const PartialExt = ".part"
+
+// partialInfo identifies the resource downloaded into a partial file.
+type partialInfo struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+}
+
+// validator returns the validator of the resource, for If-Range requests.
+func (p partialInfo) validator() string {
+	if p.ETag != "" {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// resumable returns the bookkeeping of the named partial file, and the offset
+// at which the download of url can be resumed.
+// partial files of other resources, or of resources which can not be
+// identified, are not resumed.
+func resumable(part, url string) (partialInfo, int64) {
+	var info partialInfo
+	buf, err := ioutil.ReadFile(part + ".json")
+	if err == nil {
+		err = json.Unmarshal(buf, &info)
+	}
+	fi, ferr := os.Stat(part)
+	if err != nil || ferr != nil || info.URL != url || info.validator() == "" || strings.HasPrefix(info.ETag, "W/") {
+		removePartial(part)
+		return partialInfo{}, 0
+	}
+	return info, fi.Size()
+}
+
+// writePartial writes the bookkeeping of the named partial file.
+func writePartial(part string, info partialInfo) error {
+	buf, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(part+".json", buf, 0644)
+}
+
+// removePartial removes the named partial file, and its bookkeeping.
+func removePartial(part string) {
+	os.Remove(part)
+	os.Remove(part + ".json")
+}
+
+// rangeStart returns the first byte of a Content-Range header
+// (bytes first-last/size).
+func rangeStart(hdr string) (int64, bool) {
+	v := strings.TrimPrefix(hdr, "bytes ")
+	i := strings.Index(v, "-")
+	if v == hdr || i < 0 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(v[:i], 10, 64)
+	return start, err == nil
+}
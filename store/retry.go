@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Retry retries the failed transfers of a store.
+type Retry struct {
+	Store
+	retries int
+	delay   time.Duration
+}
+
+// NewRetry returns the store s, whose failed transfers are retried at most
+// retries times, after delay.
+func NewRetry(s Store, retries int, delay time.Duration) *Retry {
+	return &Retry{Store: s, retries: retries, delay: delay}
+}
+
+// retry calls f until it succeeds, at most 1+s.retries times.
+// retry gives up when ctx is canceled.
+func (s *Retry) retry(ctx context.Context, action string, f func() error) error {
+	err := f()
+	for i := 0; err != nil && i < s.retries; i++ {
+		if ctx.Err() != nil {
+			return err
+		}
+		Log.Warnf("could not %s [%s] (attempt %d/%d): %v\n", action, s.URL(), i+1, s.retries+1, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(s.delay):
+		}
+		err = f()
+	}
+	return err
+}
+
+func (s *Retry) List(ctx context.Context, dir string) ([]string, bool, error) {
+	var (
+		names []string
+		ok    bool
+	)
+	err := s.retry(ctx, "list", func() error {
+		var err error
+		names, ok, err = s.Store.List(ctx, dir)
+		return err
+	})
+	return names, ok, err
+}
+
+func (s *Retry) Exists(ctx context.Context, name string) (bool, error) {
+	var ok bool
+	err := s.retry(ctx, "query", func() error {
+		var err error
+		ok, err = s.Store.Exists(ctx, name)
+		return err
+	})
+	return ok, err
+}
+
+func (s *Retry) Fetch(ctx context.Context, dir string, names []string, prog Progress) error {
+	return s.retry(ctx, "fetch from", func() error {
+		return s.Store.Fetch(ctx, dir, names, prog)
+	})
+}
+
+func (s *Retry) Upload(ctx context.Context, dir string, names []string) error {
+	return s.retry(ctx, "upload to", func() error {
+		return s.Store.Upload(ctx, dir, names)
+	})
+}
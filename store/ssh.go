@@ -0,0 +1,129 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SSH is a store in a directory of an ssh host, reached with rsync.
+type SSH struct {
+	dest     string // [user@]host:dir
+	identity string // private key, if not the default one
+	rw       bool
+	exec     Executor
+	bwlimit  int64 // bandwidth of each upload, in KiB/s (0 if unlimited)
+}
+
+// NewSSH returns the store in the directory of an ssh host dest
+// ([user@]host:dir), reached with the private key identity (the default one
+// if empty) and the commands run by x.
+// the uploads are limited to bwlimit KiB/s each, unless bwlimit is 0.
+func NewSSH(dest, identity string, rw bool, x Executor, bwlimit int64) *SSH {
+	return &SSH{dest: dest, identity: identity, rw: rw, exec: x, bwlimit: bwlimit}
+}
+
+func (s *SSH) URL() string    { return s.dest }
+func (s *SSH) Writable() bool { return s.rw }
+
+func (s *SSH) List(ctx context.Context, dir string) ([]string, bool, error) {
+	out, err := output(s.exec, exec.CommandContext(ctx, "rsync", s.args("--list-only", s.dest+"/"+filepath.ToSlash(dir)+"/")...))
+	if err != nil {
+		// missing directories can not be told apart from other failures.
+		return nil, false, nil
+	}
+	// entries are listed as: mode size date time name [-> target].
+	var names []string
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		name := strings.Join(fields[4:], " ")
+		if i := strings.Index(name, " -> "); i >= 0 {
+			name = name[:i]
+		}
+		if name == "." {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "d") {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	return names, true, scan.Err()
+}
+
+func (s *SSH) Exists(ctx context.Context, name string) (bool, error) {
+	err := run(s.exec, exec.CommandContext(ctx, "rsync", s.args("--list-only", s.dest+"/"+filepath.ToSlash(name))...))
+	return err == nil, nil
+}
+
+func (s *SSH) Fetch(ctx context.Context, dir string, names []string, prog Progress) error {
+	// files are fetched with one rsync per directory.
+	var (
+		dirs  []string
+		files = make(map[string][]string)
+	)
+	for _, name := range names {
+		d := filepath.Dir(name)
+		if _, ok := files[d]; !ok {
+			dirs = append(dirs, d)
+		}
+		files[d] = append(files[d], s.dest+"/"+filepath.ToSlash(name))
+	}
+	for _, d := range dirs {
+		dst := filepath.Join(dir, d)
+		err := os.MkdirAll(dst, 0755)
+		if err != nil {
+			return err
+		}
+		args := s.args(append([]string{"-a", "--ignore-missing-args"}, files[d]...)...)
+		err = runWith(ctx, s.exec, "", "rsync", append(args, dst+"/")...)
+		if err != nil {
+			return err
+		}
+	}
+	AddSizes(prog, dir, names)
+	return nil
+}
+
+func (s *SSH) Upload(ctx context.Context, dir string, names []string) error {
+	if !s.rw {
+		return fmt.Errorf("store [%s] is read-only", s.dest)
+	}
+	args := s.args(append([]string{"-a", "--relative"}, names...)...)
+	if s.bwlimit > 0 {
+		args = append([]string{fmt.Sprintf("--bwlimit=%d", s.bwlimit)}, args...)
+	}
+	return runWith(ctx, s.exec, dir, "rsync", append(args, s.dest+"/")...)
+}
+
+// Remove removes the named files of the store.
+func (s *SSH) Remove(ctx context.Context, names []string) error {
+	i := strings.Index(s.dest, ":")
+	host, dir := s.dest[:i], s.dest[i+1:]
+	args := []string{host, "rm", "-f", "--"}
+	if s.identity != "" {
+		args = append([]string{"-i", s.identity}, args...)
+	}
+	for _, name := range names {
+		args = append(args, shellQuote(path.Join(dir, filepath.ToSlash(name))))
+	}
+	return runWith(ctx, s.exec, "", "ssh", args...)
+}
+
+// args returns the arguments of rsync, with the ssh key of the store.
+func (s *SSH) args(args ...string) []string {
+	if s.identity == "" {
+		return args
+	}
+	return append([]string{"-e", "ssh -i " + s.identity}, args...)
+}
@@ -0,0 +1,195 @@
+// Package store gives access to the stores of tarballs shared by aligot
+// builders: directories, directories of ssh hosts, HTTP servers and buckets
+// of cloud object storages.
+//
+// the files of a store are named by their path relative to its root, e.g.
+// TARS/<arch>/store/<hh>/<hash>/<tarball>: stores have the layout of the
+// local store of the work directory.
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Store is a store of tarballs.
+type Store interface {
+	// URL returns the location of the store.
+	URL() string
+	// Writable reports whether files can be uploaded to the store.
+	Writable() bool
+	// List returns the names of the files of the named directory, and
+	// reports whether the store can be listed.
+	// the names of the subdirectories end with a slash.
+	List(ctx context.Context, dir string) ([]string, bool, error)
+	// Exists reports whether the store holds the named file.
+	Exists(ctx context.Context, name string) (bool, error)
+	// Fetch downloads the named files the store holds into the local
+	// store dir, reporting the downloaded bytes to prog if not nil.
+	Fetch(ctx context.Context, dir string, names []string, prog Progress) error
+	// Upload uploads the named files of the local store dir.
+	Upload(ctx context.Context, dir string, names []string) error
+}
+
+// Remover is implemented by the stores whose files can be removed.
+type Remover interface {
+	Remove(ctx context.Context, names []string) error
+}
+
+// Linker is implemented by the stores holding the links of the packages as
+// symbolic links.
+type Linker interface {
+	Readlink(ctx context.Context, name string) (string, error)
+}
+
+// Progress receives the progress of downloads: the downloaded bytes are
+// written to it.
+type Progress interface {
+	io.Writer
+	// Expect declares n more bytes to download.
+	Expect(n int64)
+	// Add records n bytes downloaded at once.
+	Add(n int64)
+}
+
+// Credentials gives the credentials of a store.
+type Credentials interface {
+	// Get returns the user and the secret (password, or token when there
+	// is no user) of the store.
+	Get(ctx context.Context) (string, string, error)
+}
+
+// Executor runs the external commands of the stores: rsync and ssh.
+type Executor interface {
+	// Start starts cmd, without waiting for it to exit.
+	Start(cmd *exec.Cmd) error
+	// Wait waits for cmd, started with Start, to exit.
+	Wait(cmd *exec.Cmd) error
+}
+
+// FS gives access to the files of directory stores.
+type FS interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Remove(name string) error
+}
+
+// Logger reports what the stores do.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// Log is the logger of the stores: its messages are discarded, unless it is
+// set by the program.
+var Log Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debugf(format string, args ...interface{}) {}
+func (discard) Infof(format string, args ...interface{})  {}
+func (discard) Warnf(format string, args ...interface{})  {}
+
+// Parse parses the URL of a store, and its role: stores are read-only,
+// unless their URL ends with ::rw, and then are also the write store.
+// the ssh:// and file:// prefixes are removed: ssh stores are named
+// host:dir, and directory stores by their path.
+func Parse(url string) (string, bool) {
+	rw := strings.HasSuffix(url, "::rw")
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "::rw"), "::ro")
+	url = strings.TrimPrefix(url, "ssh://")
+	url = strings.TrimPrefix(url, "file://")
+	return url, rw
+}
+
+// IsHTTP returns whether a store is accessed over HTTP.
+func IsHTTP(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// IsBucket returns whether a store is a bucket of a cloud object storage.
+func IsBucket(url string) bool {
+	return strings.HasPrefix(url, "gs://") || strings.HasPrefix(url, "az://")
+}
+
+// IsDir returns whether a store is a directory of the machine.
+func IsDir(url string) bool {
+	return !strings.Contains(url, ":")
+}
+
+// IsTarball reports whether the named file is a tarball.
+func IsTarball(name string) bool {
+	return strings.Contains(filepath.Base(name), ".tar")
+}
+
+// AddSizes reports to prog, if not nil, the sizes of the named tarballs
+// fetched into dir, by stores which do not report their progress.
+func AddSizes(prog Progress, dir string, names []string) {
+	if prog == nil {
+		return
+	}
+	for _, name := range names {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && IsTarball(name) {
+			prog.Add(fi.Size())
+		}
+	}
+}
+
+// Unwrap returns the backend of a store, for the operations only some
+// backends implement.
+func Unwrap(s Store) Store {
+	if r, ok := s.(*Retry); ok {
+		return r.Store
+	}
+	return s
+}
+
+// run runs cmd with x, and waits for it to exit.
+func run(x Executor, cmd *exec.Cmd) error {
+	err := x.Start(cmd)
+	if err != nil {
+		return err
+	}
+	return x.Wait(cmd)
+}
+
+// output runs cmd with x, and returns its standard output.
+func output(x Executor, cmd *exec.Cmd) ([]byte, error) {
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	err := run(x, cmd)
+	return out.Bytes(), err
+}
+
+// runWith runs the named command with the given arguments in directory dir,
+// with x, until it exits or ctx is canceled.
+// the returned error holds the output of the command, if it failed.
+func runWith(ctx context.Context, x Executor, dir, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := run(x, cmd)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error running '%s %s': %v\n%s",
+			name, strings.Join(args, " "), err, out.Bytes(),
+		)
+	}
+	return nil
+}
+
+// shellQuote quotes s for the shell of an ssh host.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
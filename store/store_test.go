@@ -0,0 +1,133 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		want string
+		rw   bool
+	}{
+		{"/data/store", "/data/store", false},
+		{"file:///data/store::rw", "/data/store", true},
+		{"ssh://host:/data/store::ro", "host:/data/store", false},
+		{"https://example.org/store", "https://example.org/store", false},
+		{"gs://bucket/prefix::rw", "gs://bucket/prefix", true},
+	} {
+		got, rw := Parse(tc.url)
+		if got != tc.want || rw != tc.rw {
+			t.Errorf("invalid store %q: got=(%q, %v), want=(%q, %v)", tc.url, got, rw, tc.want, tc.rw)
+		}
+	}
+}
+
+func TestNewBucket(t *testing.T) {
+	const name = "TARS/slc7_x86-64/store/ab/abcdef/lib v1.tar.gz"
+	for _, tc := range []struct {
+		url      string
+		endpoint string
+		want     string // URL of the object of name
+		err      string
+	}{
+		{
+			url:  "gs://bucket",
+			want: "https://storage.googleapis.com/bucket/TARS/slc7_x86-64/store/ab/abcdef/lib%20v1.tar.gz",
+		},
+		{
+			url:      "gs://bucket/a/b/",
+			endpoint: "http://localhost:4443/",
+			want:     "http://localhost:4443/bucket/a/b/TARS/slc7_x86-64/store/ab/abcdef/lib%20v1.tar.gz",
+		},
+		{
+			url:  "az://account/container/prefix",
+			want: "https://account.blob.core.windows.net/container/prefix/TARS/slc7_x86-64/store/ab/abcdef/lib%20v1.tar.gz",
+		},
+		{
+			url: "gs://",
+			err: "invalid store [gs://]: no bucket (want gs://bucket[/prefix])",
+		},
+		{
+			url: "az://account",
+			err: "invalid store [az://account]: no container (want az://account/container[/prefix])",
+		},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			s, err := NewBucket(tc.url, tc.endpoint, false, nil, nil)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("invalid error: got=%v, want=%q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not create store: %+v", err)
+			}
+			if got := s.objectURL(name); got != tc.want {
+				t.Fatalf("invalid object URL:\ngot= %q\nwant=%q", got, tc.want)
+			}
+		})
+	}
+}
+
+// flakyStore is a store whose transfers fail a number of times.
+type flakyStore struct {
+	Store
+	fails int // number of failures left
+	calls int
+}
+
+func (s *flakyStore) URL() string { return "flaky://store" }
+
+func (s *flakyStore) Fetch(ctx context.Context, dir string, names []string, prog Progress) error {
+	s.calls++
+	if s.fails > 0 {
+		s.fails--
+		return fmt.Errorf("failure %d", s.calls)
+	}
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		fails   int
+		retries int
+		cancel  bool
+		calls   int
+		err     string
+	}{
+		{name: "ok", fails: 0, retries: 2, calls: 1},
+		{name: "retried", fails: 2, retries: 2, calls: 3},
+		{name: "failed", fails: 3, retries: 2, calls: 3, err: "failure 3"},
+		{name: "no-retries", fails: 1, retries: 0, calls: 1, err: "failure 1"},
+		{name: "canceled", fails: 1, retries: 2, cancel: true, calls: 1, err: "failure 1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				cancel()
+			}
+			fs := &flakyStore{fails: tc.fails}
+			s := NewRetry(fs, tc.retries, time.Millisecond)
+			err := s.Fetch(ctx, t.TempDir(), []string{"f"}, nil)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("could not fetch: %+v", err)
+			case tc.err != "" && (err == nil || err.Error() != tc.err):
+				t.Fatalf("invalid error: got=%v, want=%q", err, tc.err)
+			}
+			if fs.calls != tc.calls {
+				t.Fatalf("invalid number of attempts: got=%d, want=%d", fs.calls, tc.calls)
+			}
+			if Unwrap(s) != Store(fs) {
+				t.Fatalf("invalid backend")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/sbinet/aligot/recipe"
+	"github.com/sbinet/aligot/store"
+)
+
+// memStore is a remote store holding files of a memFS.
+type memStore struct {
+	fs    *memFS
+	files map[string]string // content of the files of the store, by name
+}
+
+func (s *memStore) URL() string    { return "mem://store" }
+func (s *memStore) Writable() bool { return false }
+
+func (s *memStore) List(ctx context.Context, dir string) ([]string, bool, error) {
+	return nil, false, nil
+}
+
+func (s *memStore) Exists(ctx context.Context, name string) (bool, error) {
+	_, ok := s.files[name]
+	return ok, nil
+}
+
+func (s *memStore) Fetch(ctx context.Context, dir string, names []string, prog store.Progress) error {
+	for _, name := range names {
+		data, ok := s.files[name]
+		if !ok {
+			continue
+		}
+		err := s.fs.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Upload(ctx context.Context, dir string, names []string) error {
+	return nil
+}
+
+func TestFetchTarball(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		remote []string // extensions of the files of the remote store
+		stale  []string // extensions of the files of a previous download
+		want   []string // extensions of the fetched files
+	}{
+		{
+			name:   "signed",
+			remote: []string{"", ".asc"},
+			want:   []string{"", ".asc"},
+		},
+		{
+			name:   "stale-signature",
+			remote: []string{""},
+			stale:  []string{".asc", manifestExt},
+			want:   []string{""},
+		},
+		{
+			name:   "new-signature",
+			remote: []string{"", ".asc"},
+			stale:  []string{".asc"},
+			want:   []string{"", ".asc"},
+		},
+		{
+			name:  "missing",
+			stale: []string{".asc"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, x, fs := newTestBuilder(t, Config{}, nil)
+			spec := &Spec{Spec: recipe.Spec{Package: "lib", Version: "v1", Revision: "1", Hash: "abcdef"}}
+			b.setArch(spec, b.cfg.arch)
+			name := b.tarball(spec)
+			tarball := filepath.Join(spec.tar.hashDir, name)
+
+			store := &memStore{fs: fs, files: make(map[string]string)}
+			for _, ext := range tc.remote {
+				store.files[filepath.Join(spec.tar.storePath, name+ext)] = "new" + ext
+			}
+			b.remote = store
+			err := fs.MkdirAll(spec.tar.hashDir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ext := range tc.stale {
+				err := fs.WriteFile(tarball+ext, []byte("old"+ext), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ok, err := b.fetchTarball(spec, nil, nil)
+			if err != nil {
+				t.Fatalf("could not fetch: %+v", err)
+			}
+			if got, want := ok, len(tc.want) > 0; got != want {
+				t.Fatalf("invalid fetch: got=%v, want=%v", got, want)
+			}
+			for _, ext := range []string{"", ".asc", provenanceExt, manifestExt} {
+				want := ""
+				for _, e := range tc.want {
+					if e == ext {
+						want = "new" + ext
+					}
+				}
+				buf, err := fs.ReadFile(tarball + ext)
+				if got := string(buf); got != want || (want == "") != (err != nil) {
+					t.Errorf("invalid file %s: got=%q, want=%q", name+ext, got, want)
+				}
+			}
+			if _, err := fs.Readlink(filepath.Join(spec.tar.linkDir, name)); ok && err != nil {
+				t.Errorf("tarball not linked: %+v", err)
+			}
+			// only the signature fetched with the tarball is verified.
+			signed := len(tc.want) > 1
+			if got, want := len(x.commands()) == 1, signed; got != want {
+				t.Errorf("invalid verification of the signature: got=%v, want=%v (%q)", got, want, x.commands())
+			}
+		})
+	}
+}
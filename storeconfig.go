@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// defaultRetryDelay is the delay between the attempts of failed transfers.
+const defaultRetryDelay = time.Second
+
+// storeConfig returns the configuration of a store, given its name in the
+// configuration file or its URL.
+// stores missing from the configuration file are accessed anonymously.
+func (cfg Config) storeConfig(name string) StoreConfig {
+	if sc, ok := cfg.stores[name]; ok {
+		sc.URL, _ = store.Parse(sc.URL)
+		return sc
+	}
+	for _, sc := range cfg.stores {
+		if url, _ := store.Parse(sc.URL); url == name && url != "" {
+			sc.URL = url
+			return sc
+		}
+	}
+	return StoreConfig{URL: name}
+}
+
+// credentials are the credentials of a store.
+// the secret given by the credential helper is only requested on first use.
+type credentials struct {
+	cfg   StoreConfig
+	exec  Executor
+	hosts *hostCredentials // credentials of the host of the store, when the store has none
+
+	once   sync.Once
+	secret string
+	err    error
+}
+
+// Get returns the user and the secret (password, or token when there is no
+// user) of the store.
+func (c *credentials) Get(ctx context.Context) (string, string, error) {
+	c.once.Do(func() {
+		sc := c.cfg
+		if sc.User == "" && sc.Password == "" && sc.Token == "" && sc.CredentialHelper == "" && store.IsHTTP(sc.URL) {
+			c.cfg.User, c.secret, _, c.err = c.hosts.lookup(ctx, urlHost(sc.URL))
+			return
+		}
+		c.secret = c.cfg.Password
+		if c.cfg.User == "" {
+			c.secret = c.cfg.Token
+		}
+		if c.cfg.CredentialHelper == "" {
+			return
+		}
+		out, err := output(c.exec, exec.CommandContext(ctx, "/bin/sh", "-c", c.cfg.CredentialHelper))
+		if err != nil {
+			c.err = fmt.Errorf("could not get credentials of store [%s]: %v", c.cfg.URL, err)
+			return
+		}
+		c.secret = strings.TrimSpace(string(out))
+	})
+	return c.cfg.User, c.secret, c.err
+}
+
+// storeJobs returns the number of concurrent downloads from the remote
+// store.
+func (b *Builder) storeJobs() int {
+	if sc := b.cfg.storeConfig(b.cfg.remoteStore); sc.Concurrency > 0 {
+		return sc.Concurrency
+	}
+	return b.cfg.fetchJobs
+}
@@ -0,0 +1,28 @@
+package main
+
+// stripped returns whether the binaries of a spec are stripped.
+func (b *Builder) stripped(spec *Spec) bool {
+	return b.cfg.strip && !spec.NoStrip
+}
+
+// strip strips the binaries and shared libraries installed by the recipe of a
+// spec from their symbols not needed at run-time.
+func (b *Builder) strip(spec *Spec) error {
+	n := 0
+	err := walkBinaries(b.installRoot(spec), func(path string, macho bool) error {
+		var err error
+		switch {
+		case macho:
+			err = b.run("", "strip", "-x", path)
+		default:
+			err = b.run("", "strip", "--strip-unneeded", path)
+		}
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	msg.Debugf("stripped %d binaries of %s\n", n, spec.Package)
+	return err
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// digest returns the hash of the given strings.
+func digest(vs ...string) string {
+	h := sha1.New()
+	for _, v := range vs {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// rebuildReason returns why a spec, missing from the stores, is built: what
+// changed since its previous build in the local store.
+func (b *Builder) rebuildReason(spec *Spec) string {
+	m, ok := b.previousManifest(spec)
+	if !ok {
+		return "first build"
+	}
+	if m.Hash == spec.Hash {
+		return "tarball missing from the stores"
+	}
+
+	var reasons []string
+	if m.Version != spec.Version {
+		reasons = append(reasons, fmt.Sprintf("version changed (%s -> %s)", m.Version, spec.Version))
+	}
+	if m.RecipeHash != "" && m.RecipeHash != digest(spec.Recipe) {
+		reasons = append(reasons, "recipe changed")
+	}
+	if spec.Source != "" && m.Commit != "" && m.Commit != spec.CommitHash {
+		reasons = append(reasons, fmt.Sprintf("source changed (%s -> %s)", shortHash(m.Commit), shortHash(spec.CommitHash)))
+	}
+	if m.OptionsHash != "" && m.OptionsHash != digest(b.hashOptions(spec)...) {
+		reasons = append(reasons, "build options changed")
+	}
+	var deps []string
+	for _, dep := range spec.FullRequires {
+		ds, ok := b.specs[dep]
+		if !ok {
+			continue
+		}
+		if h, ok := m.Dependencies[dep]; !ok || h != ds.Hash {
+			deps = append(deps, dep)
+		}
+	}
+	for dep := range m.Dependencies {
+		if _, ok := b.specs[dep]; !ok {
+			deps = append(deps, dep)
+		}
+	}
+	if len(deps) > 0 {
+		sort.Strings(deps)
+		reasons = append(reasons, "dependency changed ("+strings.Join(deps, ", ")+")")
+	}
+	if len(reasons) == 0 {
+		return fmt.Sprintf("hash changed (%s -> %s)", shortHash(m.Hash), shortHash(spec.Hash))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// previousManifest returns the manifest of the latest build of the package of
+// a spec, for its architecture, linked from the local store.
+func (b *Builder) previousManifest(spec *Spec) (Manifest, bool) {
+	var (
+		latest Manifest
+		found  bool
+	)
+	fis, err := b.fs.ReadDir(spec.tar.linkDir)
+	if err != nil {
+		return latest, false
+	}
+	for _, fi := range fis {
+		if !store.IsTarball(fi.Name()) {
+			continue
+		}
+		tarball, err := b.fs.Readlink(filepath.Join(spec.tar.linkDir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		if !filepath.IsAbs(tarball) {
+			tarball = filepath.Join(spec.tar.linkDir, tarball)
+		}
+		m, err := readManifest(b.fs, tarball+manifestExt)
+		if err != nil {
+			continue
+		}
+		if !found || m.FinishedOn.After(latest.FinishedOn) {
+			latest, found = m, true
+		}
+	}
+	return latest, found
+}
+
+// shortHash returns the abbreviated form of a commit or hash.
+func shortHash(h string) string {
+	if len(h) > 7 {
+		return h[:7]
+	}
+	return h
+}
+
+// cacheSummary reports how the packages of the run were obtained: reused from
+// the local store, downloaded from the remote store, or rebuilt, and why.
+func (b *Builder) cacheSummary() {
+	var local, remote, built, failed int
+	for _, p := range b.order {
+		switch b.status[p] {
+		case statusCached:
+			if b.fetched[p] {
+				remote++
+			} else {
+				local++
+			}
+		case statusBuilt:
+			built++
+		case statusFailed:
+			failed++
+		}
+	}
+	if local+remote+built+failed == 0 {
+		return
+	}
+
+	line := fmt.Sprintf("%d reused locally, %d downloaded", local, remote)
+	if b.remote != nil {
+		line += " from [" + b.remote.URL() + "]"
+	}
+	line += fmt.Sprintf(", %d rebuilt", built)
+	if failed > 0 {
+		line += fmt.Sprintf(" (%d failed)", failed)
+	}
+	msg.Infof("cache summary: %s\n", line)
+	for _, p := range b.order {
+		reason, ok := b.rebuilt[p]
+		if !ok {
+			continue
+		}
+		switch b.status[p] {
+		case statusBuilt, statusFailed:
+			msg.Infof("  %-24s %s\n", p, reason)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRebuildReason(t *testing.T) {
+	recipes := map[string]string{
+		"defaults-release": testDefaults,
+		"app":              testRecipe("app", "v2", []string{"requires: [lib]"}, "make\n"),
+		"lib":              testRecipe("lib", "v1", nil, "make\n"),
+	}
+	for _, tc := range []struct {
+		name string
+		prev func(m *Manifest, b *Builder) // previous build, if any
+		want string
+	}{
+		{
+			name: "first-build",
+			want: "first build",
+		},
+		{
+			name: "missing",
+			prev: func(m *Manifest, b *Builder) { m.Hash = b.specs["app"].Hash },
+			want: "tarball missing from the stores",
+		},
+		{
+			name: "version",
+			prev: func(m *Manifest, b *Builder) { m.Version = "v1" },
+			want: "version changed (v1 -> v2)",
+		},
+		{
+			name: "recipe",
+			prev: func(m *Manifest, b *Builder) { m.RecipeHash = digest("make -j1\n") },
+			want: "recipe changed",
+		},
+		{
+			name: "build-options",
+			prev: func(m *Manifest, b *Builder) { m.OptionsHash = digest("split-debug") },
+			want: "build options changed",
+		},
+		{
+			name: "dependency",
+			prev: func(m *Manifest, b *Builder) { m.Dependencies["lib"] = "0123456789" },
+			want: "dependency changed (lib)",
+		},
+		{
+			name: "removed-dependency",
+			prev: func(m *Manifest, b *Builder) { m.Dependencies["zlib"] = "0123456789" },
+			want: "dependency changed (zlib)",
+		},
+		{
+			name: "several",
+			prev: func(m *Manifest, b *Builder) {
+				m.Version = "v1"
+				m.OptionsHash = digest("strip")
+			},
+			want: "version changed (v1 -> v2), build options changed",
+		},
+		{
+			name: "unknown",
+			prev: func(m *Manifest, b *Builder) {},
+			want: "hash changed (0123456 -> %s)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _, fs := newTestBuilder(t, Config{}, recipes)
+			err := b.resolve()
+			if err != nil {
+				t.Fatalf("could not resolve: %+v", err)
+			}
+			spec := b.specs["app"]
+			spec.Revision = "1"
+
+			if tc.prev != nil {
+				m := Manifest{
+					Package:      spec.Package,
+					Version:      spec.Version,
+					Hash:         "0123456789",
+					RecipeHash:   digest(spec.Recipe),
+					OptionsHash:  digest(b.hashOptions(spec)...),
+					Dependencies: make(map[string]string),
+					FinishedOn:   time.Now(),
+				}
+				for _, dep := range spec.FullRequires {
+					m.Dependencies[dep] = b.specs[dep].Hash
+				}
+				tc.prev(&m, b)
+				writeTestManifest(t, b, fs, spec, m)
+			}
+
+			want := strings.Replace(tc.want, "%s", spec.Hash[:7], 1)
+			if got := b.rebuildReason(spec); got != want {
+				t.Fatalf("invalid reason: got=%q, want=%q", got, want)
+			}
+		})
+	}
+}
+
+// writeTestManifest writes the manifest m of a previous build of a spec, and
+// links its tarball from the local store.
+func writeTestManifest(t *testing.T, b *Builder, fs *memFS, spec *Spec, m Manifest) {
+	t.Helper()
+	name := b.tarball(spec)
+	dir := filepath.Join(b.cfg.wdir, "TARS", spec.arch, "store", m.Hash[:2], m.Hash)
+	buf, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{dir, spec.tar.linkDir} {
+		err := fs.MkdirAll(d, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = fs.WriteFile(filepath.Join(dir, name+manifestExt), buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := filepath.Rel(spec.tar.linkDir, filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Symlink(dst, filepath.Join(spec.tar.linkDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sbinet/aligot/recipe"
+)
+
+// sysProbe is a check of a system requirement, and its outcome.
+type sysProbe struct {
+	Kind    string `json:"kind"`                  // pkg-config, cmake or script
+	Module  string `json:"module,omitempty"`      // pkg-config module, or CMake package
+	Min     string `json:"min_version,omitempty"` // minimum version of the module
+	Found   bool   `json:"found"`
+	Version string `json:"version,omitempty"` // version of the module found on the system
+	Error   string `json:"error,omitempty"`   // why the check failed
+}
+
+func (p sysProbe) String() string {
+	switch {
+	case p.Module == "":
+		return p.Kind
+	case p.Min == "":
+		return p.Kind + " " + p.Module
+	}
+	return p.Kind + " " + p.Module + " >= " + p.Min
+}
+
+// sysResult is the outcome of the checks of a system requirement.
+type sysResult struct {
+	Package string     `json:"package"`
+	OK      bool       `json:"ok"`
+	Checks  []sysProbe `json:"checks"`
+	Missing string     `json:"missing,omitempty"` // how to install the package, from its recipe
+
+	Prefixes       []string `json:"prefixes,omitempty"`        // prefixes of the Homebrew formulae providing the package
+	DistroPackages []string `json:"distro_packages,omitempty"` // packages of the distribution to install, when missing
+}
+
+// isSystemRequirement reports whether the system must provide a spec, on its
+// architecture.
+func isSystemRequirement(spec *Spec) (bool, error) {
+	if spec.SystemRequirement == "" {
+		return false, nil
+	}
+	ok, err := recipe.MatchArch(spec.SystemRequirement, spec.arch)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid system_requirement %q: %v", spec.Package, spec.SystemRequirement, err)
+	}
+	return ok, nil
+}
+
+// checkSystem checks the system requirements of the build, in build order.
+// the outcome of each check is recorded in b.system.
+func (b *Builder) checkSystem() ([]sysResult, error) {
+	var res []sysResult
+	b.system = make(map[string]sysResult)
+	for _, p := range b.order {
+		spec := b.specs[p]
+		ok, err := isSystemRequirement(spec)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		r, err := b.checkRequirement(spec)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+		b.system[p] = r
+	}
+	return res, nil
+}
+
+// checkRequirement runs the Homebrew, pkg-config, CMake and script checks of
+// a system requirement.
+// the other checks see the Homebrew formulae providing the requirement.
+// checkRequirement only fails when the checks could not be run.
+func (b *Builder) checkRequirement(spec *Spec) (sysResult, error) {
+	r := sysResult{Package: spec.Package, OK: true, Missing: strings.TrimSpace(spec.SystemRequirementMissing)}
+	var env []string
+	if brew := b.homebrew(); brew != nil {
+		for _, f := range brew.brewFormulae(spec) {
+			probe := brew.probeHomebrew(f)
+			if probe.Found {
+				r.Prefixes = append(r.Prefixes, brew.optDir(f))
+			}
+			r.Checks = append(r.Checks, probe)
+		}
+		env = homebrewEnv(r.Prefixes)
+	}
+	for _, v := range spec.PkgConfig {
+		mod, min, err := parseModule(v)
+		if err != nil {
+			return r, fmt.Errorf("%s: invalid pkg_config: %v", spec.Package, err)
+		}
+		r.Checks = append(r.Checks, b.probePkgConfig(mod, min, env))
+	}
+	for _, v := range spec.CMakeConfig {
+		mod, min, err := parseModule(v)
+		if err != nil {
+			return r, fmt.Errorf("%s: invalid cmake_config: %v", spec.Package, err)
+		}
+		probe, err := b.probeCMake(mod, min, env)
+		if err != nil {
+			return r, err
+		}
+		r.Checks = append(r.Checks, probe)
+	}
+	if spec.SystemRequirementCheck != "" {
+		r.Checks = append(r.Checks, b.probeScript(spec.SystemRequirementCheck, env))
+	}
+	for _, c := range r.Checks {
+		r.OK = r.OK && c.Found
+	}
+	if !r.OK {
+		r.DistroPackages = distroPackagesOf(spec, b.distro())
+	}
+	if err := canceled(b.ctx); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+var reModule = regexp.MustCompile(`^([^\s<>=]+)\s*(?:>=\s*(\S+))?$`)
+
+// parseModule parses a module with an optional minimum version, as in
+// "openssl >= 1.1".
+func parseModule(v string) (string, string, error) {
+	m := reModule.FindStringSubmatch(strings.TrimSpace(v))
+	if m == nil {
+		return "", "", fmt.Errorf("%q is not a module with an optional minimum version (e.g. \"openssl >= 1.1\")", v)
+	}
+	return m[1], m[2], nil
+}
+
+// probePkgConfig looks for a pkg-config module on the system, with the
+// environment env (the inherited one if nil).
+func (b *Builder) probePkgConfig(mod, min string, env []string) sysProbe {
+	probe := sysProbe{Kind: "pkg-config", Module: mod, Min: min}
+	if _, err := exec.LookPath("pkg-config"); err != nil {
+		probe.Error = "pkg-config not found"
+		return probe
+	}
+	cmd := exec.CommandContext(b.ctx, "pkg-config", "--modversion", mod)
+	cmd.Env = env
+	out, err := combinedOutput(b.exec, cmd)
+	if err != nil {
+		probe.Error = "not found"
+		if line := lastLine(out); line != "" {
+			probe.Error = line
+		}
+		return probe
+	}
+	probe.Version = lastLine(out)
+	return checkVersion(probe)
+}
+
+// cmakeProbe is the project looking for a CMake package, in config mode.
+const cmakeProbe = `cmake_minimum_required(VERSION 3.5)
+project(aligot_probe NONE)
+find_package(%[1]s CONFIG REQUIRED)
+message(STATUS "aligot-probe-version: ${%[1]s_VERSION}")
+`
+
+// probeCMake looks for a CMake package, with its CMake config file, on the
+// system, with the environment env (the inherited one if nil).
+func (b *Builder) probeCMake(mod, min string, env []string) (sysProbe, error) {
+	probe := sysProbe{Kind: "cmake", Module: mod, Min: min}
+	if _, err := exec.LookPath("cmake"); err != nil {
+		probe.Error = "cmake not found"
+		return probe, nil
+	}
+	dir, err := ioutil.TempDir("", "aligot-cmake-")
+	if err != nil {
+		return probe, err
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "CMakeLists.txt"), []byte(fmt.Sprintf(cmakeProbe, mod)), 0644)
+	if err != nil {
+		return probe, err
+	}
+	cmd := exec.CommandContext(b.ctx, "cmake", "-S", dir, "-B", filepath.Join(dir, "build"))
+	cmd.Env = env
+	out, err := combinedOutput(b.exec, cmd)
+	if err != nil {
+		probe.Error = "not found"
+		return probe, nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, "aligot-probe-version: "); i >= 0 {
+			probe.Version = strings.TrimSpace(line[i+len("aligot-probe-version: "):])
+		}
+	}
+	return checkVersion(probe), nil
+}
+
+// probeScript runs the system_requirement_check snippet of a recipe, with the
+// environment env (the inherited one if nil).
+func (b *Builder) probeScript(script string, env []string) sysProbe {
+	probe := sysProbe{Kind: "script"}
+	cmd := exec.CommandContext(b.ctx, "/bin/bash", "-c", script)
+	cmd.Env = env
+	out, err := combinedOutput(b.exec, cmd)
+	if err != nil {
+		probe.Error = err.Error()
+		if line := lastLine(out); line != "" {
+			probe.Error += ": " + line
+		}
+		return probe
+	}
+	probe.Found = true
+	return probe
+}
+
+// checkVersion checks the version of a module found on the system against
+// the minimum version of the probe.
+func checkVersion(probe sysProbe) sysProbe {
+	if probe.Min != "" && probe.Version != "" && versionLess(probe.Version, probe.Min) {
+		probe.Error = fmt.Sprintf("version %s is older than %s", probe.Version, probe.Min)
+		return probe
+	}
+	probe.Found = true
+	return probe
+}
+
+// combinedOutput runs cmd with x, and returns its standard output and error.
+func combinedOutput(x Executor, cmd *exec.Cmd) ([]byte, error) {
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := runCmd(x, cmd)
+	return out.Bytes(), err
+}
+
+// lastLine returns the last non-empty line of out.
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// systemError returns the error describing the failed checks of the system
+// requirements, if any, with the command installing them.
+func (b *Builder) systemError(res []sysResult) error {
+	var missing []string
+	for _, r := range res {
+		if r.OK {
+			continue
+		}
+		for _, c := range r.Checks {
+			if !c.Found {
+				missing = append(missing, fmt.Sprintf("%s: %s: %s", r.Package, c, c.Error))
+			}
+		}
+		if r.Missing != "" {
+			missing = append(missing, r.Package+": "+strings.Replace(r.Missing, "\n", "\n\t  ", -1))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if hint, _ := installHint(res, b.distro()); hint != "" {
+		missing = append(missing, "to install them, run:\n\t  "+hint)
+	}
+	return fmt.Errorf("missing system requirements (see aligot doctor):\n\t%s", strings.Join(missing, "\n\t"))
+}
+
+// doctor writes the report of the system requirement checks of the build to
+// w, as JSON if asJSON is true, and fails if any check failed.
+func (b *Builder) doctor(w io.Writer, asJSON bool) error {
+	res, err := b.checkSystem()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if res == nil {
+			res = []sysResult{}
+		}
+		buf, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", buf)
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "PACKAGE\tCHECK\tSTATUS\n")
+		for _, r := range res {
+			if len(r.Checks) == 0 {
+				fmt.Fprintf(tw, "%s\t-\tok (no check)\n", r.Package)
+			}
+			for _, c := range r.Checks {
+				status := "ok"
+				switch {
+				case !c.Found:
+					status = "MISSING: " + c.Error
+				case c.Version != "":
+					status = "ok (" + c.Version + ")"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Package, c, status)
+			}
+		}
+		tw.Flush()
+
+		hint, unknown := installHint(res, b.distro())
+		if hint != "" {
+			fmt.Fprintf(w, "\nto install the missing system requirements, run:\n\t%s\n", hint)
+		}
+		if len(unknown) > 0 {
+			fmt.Fprintf(w, "\nno known package provides: %s (use system_packages in their recipe)\n", strings.Join(unknown, ", "))
+		}
+	}
+
+	var failed []string
+	for _, r := range res {
+		if !r.OK {
+			failed = append(failed, r.Package)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("missing system requirements: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
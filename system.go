@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Executor runs the external commands of a build: git, docker, tar, rsync
+// and the recipes themselves.
+type Executor interface {
+	// Start starts cmd, without waiting for it to exit.
+	Start(cmd *exec.Cmd) error
+	// Wait waits for cmd, started with Start, to exit.
+	Wait(cmd *exec.Cmd) error
+}
+
+// FS gives access to the files of a build: the recipes, the work directory
+// and the local store.
+type FS interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	ReadFile(name string) ([]byte, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
+	Symlink(oldname, newname string) error
+	Readlink(name string) (string, error)
+}
+
+// hostExecutor runs commands on the host.
+type hostExecutor struct{}
+
+func (hostExecutor) Start(cmd *exec.Cmd) error { return cmd.Start() }
+func (hostExecutor) Wait(cmd *exec.Cmd) error  { return cmd.Wait() }
+
+// hostFS is the file system of the host.
+type hostFS struct{}
+
+func (hostFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (hostFS) Open(name string) (io.ReadCloser, error)      { return os.Open(name) }
+func (hostFS) ReadFile(name string) ([]byte, error)         { return ioutil.ReadFile(name) }
+func (hostFS) ReadDir(name string) ([]os.FileInfo, error)   { return ioutil.ReadDir(name) }
+func (hostFS) Create(name string) (io.WriteCloser, error)   { return os.Create(name) }
+func (hostFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (hostFS) Remove(name string) error                     { return os.Remove(name) }
+func (hostFS) RemoveAll(path string) error                  { return os.RemoveAll(path) }
+func (hostFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (hostFS) Symlink(oldname, newname string) error        { return os.Symlink(oldname, newname) }
+func (hostFS) Readlink(name string) (string, error)         { return os.Readlink(name) }
+
+func (hostFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+// runCmd runs cmd with x, and waits for it to exit.
+func runCmd(x Executor, cmd *exec.Cmd) error {
+	err := x.Start(cmd)
+	if err != nil {
+		return err
+	}
+	return x.Wait(cmd)
+}
+
+// output runs cmd with x, and returns its standard output.
+func output(x Executor, cmd *exec.Cmd) ([]byte, error) {
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	err := runCmd(x, cmd)
+	return out.Bytes(), err
+}
+
+// runWith runs the named command with the given arguments in directory dir,
+// with x, until it exits or ctx is canceled.
+// the returned error holds the output of the command, if it failed.
+func runWith(ctx context.Context, x Executor, dir, name string, args ...string) error {
+	return runWithEnv(ctx, x, dir, nil, name, args...)
+}
+
+// runWithEnv runs the named command as runWith does, with the environment
+// env (the inherited one if nil).
+func runWithEnv(ctx context.Context, x Executor, dir string, env []string, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out := new(bytes.Buffer)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := runCmd(x, cmd)
+	if err := canceled(ctx); err != nil {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error running '%s %s': %v\n%s",
+			name, strings.Join(args, " "), err, out.Bytes(),
+		)
+	}
+	return nil
+}
+
+// run runs the named command with the given arguments in directory dir, on
+// the host, until it exits or the run is interrupted.
+func run(dir, name string, args ...string) error {
+	return runWith(interrupts.ctx, hostExecutor{}, dir, name, args...)
+}
+
+// run runs the named command with the given arguments in directory dir,
+// with the executor of the builder.
+func (b *Builder) run(dir, name string, args ...string) error {
+	return runWith(b.ctx, b.exec, dir, name, args...)
+}
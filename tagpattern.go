@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// tagPattern returns the pattern of the tags of the sources of a spec, if
+// any: its tag_pattern key, or its tag when it holds wildcards (e.g.
+// v6-32-*).
+func tagPattern(spec *Spec) string {
+	if spec.TagPattern != "" {
+		return spec.TagPattern
+	}
+	if strings.ContainsAny(spec.Tag, "*?[") {
+		return spec.Tag
+	}
+	return ""
+}
+
+// resolveTag sets the tag of the sources of a spec, and its commit, to the
+// latest tag of its repository matching its tag pattern.
+// a version derived from the pattern is the resolved tag.
+func (b *Builder) resolveTag(spec *Spec, pattern string) error {
+	out, ok := b.warm.getRefs(spec.Source)
+	if !ok {
+		cmd := exec.CommandContext(b.ctx, "git", "ls-remote", "--tags", spec.Source)
+		env, err := b.gitEnv(spec.Source)
+		if err != nil {
+			return err
+		}
+		cmd.Env = env
+		out, err = output(b.exec, cmd)
+		if err != nil {
+			return fmt.Errorf("could not list tags of %s [%s]: %v", spec.Package, spec.Source, err)
+		}
+		b.warm.putRefs(spec.Source, out)
+	}
+	tags, err := matchTags(out, pattern)
+	if err != nil {
+		return fmt.Errorf("invalid tag pattern %q of %s: %v", pattern, spec.Package, err)
+	}
+	var latest string
+	for tag := range tags {
+		if latest == "" || versionLess(latest, tag) {
+			latest = tag
+		}
+	}
+	if latest == "" {
+		return fmt.Errorf("no tag of %s [%s] matching %q", spec.Package, spec.Source, pattern)
+	}
+
+	msg.Infof("%s: tag pattern %q resolved to %s (%s)\n", spec.Package, pattern, latest, tags[latest])
+	if spec.Version == strings.Replace(pattern, "/", "_", -1) {
+		spec.Version = strings.Replace(latest, "/", "_", -1)
+	}
+	spec.Tag = latest
+	spec.CommitHash = tags[latest]
+	return nil
+}
+
+// matchTags returns the commits of the tags listed by git ls-remote
+// matching pattern.
+// annotated tags are resolved to the commit they tag.
+func matchTags(out []byte, pattern string) (map[string]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	scan := bufio.NewScanner(bytes.NewReader(out))
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "refs/tags/") {
+			continue
+		}
+		tag := strings.TrimPrefix(fields[1], "refs/tags/")
+		peeled := strings.HasSuffix(tag, "^{}")
+		tag = strings.TrimSuffix(tag, "^{}")
+		if ok, _ := path.Match(pattern, tag); !ok {
+			continue
+		}
+		if _, dup := tags[tag]; dup && !peeled {
+			continue
+		}
+		tags[tag] = fields[0]
+	}
+	return tags, scan.Err()
+}
+
+// versionLess reports whether version a sorts before version b: their runs
+// of digits are compared numerically, and the rest lexically.
+func versionLess(a, b string) bool {
+	for a != "" && b != "" {
+		ca, ra := versionChunk(a)
+		cb, rb := versionChunk(b)
+		if ca != cb {
+			if isDigit(ca[0]) && isDigit(cb[0]) {
+				na := strings.TrimLeft(ca, "0")
+				nb := strings.TrimLeft(cb, "0")
+				if len(na) != len(nb) {
+					return len(na) < len(nb)
+				}
+				if na != nb {
+					return na < nb
+				}
+			} else {
+				return ca < cb
+			}
+		}
+		a, b = ra, rb
+	}
+	return len(a) < len(b)
+}
+
+// versionChunk splits the leading run of digits, or of non-digits, of v.
+func versionChunk(v string) (string, string) {
+	digit := isDigit(v[0])
+	i := 1
+	for i < len(v) && isDigit(v[i]) == digit {
+		i++
+	}
+	return v[:i], v[i:]
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
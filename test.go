@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// testResult is the outcome of the tests of a package.
+type testResult struct {
+	spec     *Spec
+	err      error
+	log      string
+	duration time.Duration
+}
+
+// testDir returns the directory where the tests of a spec are run.
+func (b *Builder) testDir(spec *Spec) string {
+	return filepath.Join(b.buildDir(spec), "test")
+}
+
+// runTests runs the tests of the requested package and of its runtime
+// dependencies, for those whose recipe has a test_recipe, and writes the
+// results to w.
+//
+// tests are run against the installed packages, in their runtime
+// environment.
+func (b *Builder) runTests(w io.Writer) error {
+	var (
+		results []testResult
+		nfailed int
+	)
+	for _, p := range b.runtimeClosure(b.pkgs[0]) {
+		spec := b.specs[p]
+		if spec.TestRecipe == "" {
+			continue
+		}
+		msg.Infof("testing %s@%s...\n", spec.Package, spec.Version)
+		start := time.Now()
+		log, err := b.runTest(spec)
+		if err == errInterrupted || err == errTimedOut {
+			return err
+		}
+		if err != nil {
+			msg.Errorf("tests of %s failed: %v\n", spec.Package, err)
+			nfailed++
+		}
+		results = append(results, testResult{
+			spec:     spec,
+			err:      err,
+			log:      log,
+			duration: time.Since(start),
+		})
+	}
+
+	b.tests = results
+	if b.cfg.junit != "" {
+		if err := b.writeJUnit(b.start); err != nil {
+			msg.Warnf("could not write JUnit report [%s]: %v\n", b.cfg.junit, err)
+		}
+	}
+
+	if len(results) == 0 {
+		msg.Infof("no tests for %s and its runtime dependencies\n", b.pkgs[0])
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PACKAGE\tVERSION\tRESULT\tDURATION\tLOG\n")
+	for _, r := range results {
+		result := "pass"
+		if r.err != nil {
+			result = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\n",
+			r.spec.Package, r.spec.Version, result,
+			r.duration.Round(time.Millisecond), r.log,
+		)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if nfailed > 0 {
+		return fmt.Errorf("tests of %d package(s) failed (out of %d)", nfailed, len(results))
+	}
+	return nil
+}
+
+// runTest runs the test recipe of an installed spec, and returns the name
+// of its log file.
+func (b *Builder) runTest(spec *Spec) (string, error) {
+	dir := b.testDir(spec)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	o := new(bytes.Buffer)
+	fmt.Fprintf(o, "#!/bin/bash -e\n")
+	for _, kv := range [][2]string{
+		{"ARCHITECTURE", spec.arch},
+		{"WORK_DIR", b.cfg.wdir},
+		{"PKGNAME", spec.Package},
+		{"PKGVERSION", spec.Version},
+		{"PKGREVISION", spec.Revision},
+		{"PKGHASH", spec.Hash},
+		{"SOURCEDIR", b.sourceDir(spec)},
+		{"INSTALLDIR", b.installDir(spec)},
+		{"TESTDIR", dir},
+	} {
+		fmt.Fprintf(o, "export %s=%q\n", kv[0], kv[1])
+	}
+	b.exportEnv(o, spec, b.runtimeClosure(spec.Package))
+	fmt.Fprintf(o, "cd \"$TESTDIR\"\n")
+	fmt.Fprintf(o, "%s\n", spec.TestRecipe)
+
+	script := filepath.Join(b.sdir, spec.arch, spec.Package, spec.Version+"-"+spec.Revision, "test.sh")
+	err = b.fs.MkdirAll(filepath.Dir(script), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = b.fs.WriteFile(script, o.Bytes(), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	fname := filepath.Join(b.logDir(spec), "test.log")
+	log, err := b.fs.Create(fname)
+	if err != nil {
+		return "", err
+	}
+	defer log.Close()
+
+	cmd := exec.Command("bash", "-e", "-x", script)
+	cmd.Env = b.recipeEnviron(spec)
+	var out io.Writer = log
+	if b.cfg.debug {
+		out = io.MultiWriter(log, os.Stdout)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = interrupts.run(b.ctx, b.exec, cmd, "")
+	if err == errInterrupted || err == errTimedOut {
+		return fname, err
+	}
+	if err != nil {
+		return fname, fmt.Errorf("see log [%s]: %v", fname, err)
+	}
+	return fname, nil
+}
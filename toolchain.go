@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var reToolchain = regexp.MustCompile(`^(gcc|clang)([0-9]+)$`)
+
+// toolchain is the compiler the packages are built with.
+type toolchain struct {
+	name string // name of the toolchain, e.g. gcc13
+	pkg  string // package providing the compiler, if built from a recipe
+	cc   string // C compiler
+	cxx  string // C++ compiler
+	id   string // identity of the system compiler
+}
+
+// newToolchain selects the named toolchain.
+//
+// the system toolchain uses the cc and c++ compilers of the build host.
+// a gccNN or clangNN toolchain is built from the recipe of the same name,
+// when the configuration directory has one, and is else looked up on the
+// build host as gcc-NN or clang-NN.
+func newToolchain(cfg Config, x Executor) (*toolchain, error) {
+	switch cfg.toolchain {
+	case "":
+		return nil, nil
+	case "system":
+		tc := &toolchain{name: "system", cc: "cc", cxx: "c++"}
+		return tc, tc.identify(x)
+	}
+
+	m := reToolchain.FindStringSubmatch(cfg.toolchain)
+	if m == nil {
+		return nil, fmt.Errorf("unknown toolchain %q (valid toolchains: system, gccNN, clangNN)", cfg.toolchain)
+	}
+	tc := &toolchain{name: cfg.toolchain}
+	switch m[1] {
+	case "gcc":
+		tc.cc, tc.cxx = "gcc", "g++"
+	case "clang":
+		tc.cc, tc.cxx = "clang", "clang++"
+	}
+
+	fname := filepath.Join(cfg.cfgdir, tc.name+".sh")
+	if _, err := os.Stat(fname); err == nil {
+		tc.pkg = tc.name
+		return tc, nil
+	}
+
+	tc.cc += "-" + m[2]
+	tc.cxx += "-" + m[2]
+	return tc, tc.identify(x)
+}
+
+// identify records the identity of a system toolchain, from the version of
+// its compilers.
+func (tc *toolchain) identify(x Executor) error {
+	var ids []string
+	for _, name := range []string{tc.cc, tc.cxx} {
+		out, err := output(x, exec.Command(name, "--version"))
+		if err != nil {
+			return fmt.Errorf("could not find compiler %q of toolchain %s: %v", name, tc.name, err)
+		}
+		ids = append(ids, strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0])
+	}
+	tc.id = strings.Join(ids, ";")
+	return nil
+}
+
+// bootstrap returns the package of the toolchain and the packages it needs,
+// which are built with the compilers of the build host.
+func (b *Builder) bootstrap() map[string]bool {
+	set := make(map[string]bool)
+	if b.toolchain == nil || b.toolchain.pkg == "" {
+		return set
+	}
+	var visit func(pkg string)
+	visit = func(pkg string) {
+		if set[pkg] {
+			return
+		}
+		set[pkg] = true
+		if spec, ok := b.specs[pkg]; ok {
+			for _, dep := range spec.Requires {
+				visit(dep)
+			}
+		}
+	}
+	visit(b.toolchain.pkg)
+	return set
+}
+
+// usesToolchain reports whether a spec is built with the selected toolchain.
+func (b *Builder) usesToolchain(spec *Spec) bool {
+	if b.toolchain == nil {
+		return false
+	}
+	return !b.bootstrap()[spec.Package]
+}
+
+// toolchainID returns the identity of the selected toolchain, folded into
+// the hashes of the packages built with it.
+func (b *Builder) toolchainID() string {
+	tc := b.toolchain
+	if tc.pkg != "" {
+		return tc.name + ":" + b.specs[tc.pkg].Hash
+	}
+	return tc.name + ":" + tc.id
+}
+
+// exportToolchainEnv writes the shell commands selecting the compilers of
+// the toolchain a spec is built with.
+// cross-compiled specs with a -cross-prefix keep their cross compilers.
+func (b *Builder) exportToolchainEnv(o io.Writer, spec *Spec) {
+	if !b.usesToolchain(spec) || (b.crossCompiled(spec) && b.cfg.crossPrefix != "") {
+		return
+	}
+	fmt.Fprintf(o, "export TOOLCHAIN=%q\n", b.toolchain.name)
+	fmt.Fprintf(o, "export CC=%q\n", b.toolchain.cc)
+	fmt.Fprintf(o, "export CXX=%q\n", b.toolchain.cxx)
+}
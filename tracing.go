@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracer records the spans of the phases of a run (resolution, hashing, and
+// the downloads, checkouts, recipes, packing and uploads of each package),
+// exported with OTLP over HTTP to an OpenTelemetry collector.
+//
+// the phases of a package are children of the span of the package, itself a
+// child of the span of the run. the run joins the trace of the W3C
+// TRACEPARENT of its environment, if any, e.g. that of a CI pipeline.
+//
+// a nil tracer records nothing.
+type tracer struct {
+	url     string            // OTLP/HTTP traces endpoint
+	headers map[string]string // headers of the export requests
+	service string
+	client  *http.Client
+
+	mu    sync.Mutex
+	root  *span
+	pkgs  map[string]*span // spans of the packages
+	spans []*span          // ended spans, not yet exported
+}
+
+// span is a timed phase of a run.
+type span struct {
+	t      *tracer
+	trace  string
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+	err    string
+}
+
+// newTracer returns the tracer of a run, nil if tracing is disabled.
+//
+// the endpoint is -otlp-endpoint, or else given by the standard
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT
+// variables, together with OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME.
+func newTracer(cfg Config) *tracer {
+	url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	base := cfg.otlpEndpoint
+	if base == "" && url == "" {
+		base = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if base != "" {
+		url = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if url == "" {
+		return nil
+	}
+
+	t := &tracer{
+		url:     url,
+		headers: make(map[string]string),
+		service: "aligot",
+		client:  &http.Client{Timeout: 30 * time.Second},
+		pkgs:    make(map[string]*span),
+	}
+	if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" {
+		t.service = v
+	}
+	for _, kv := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		t.headers[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+
+	t.root = &span{
+		t:     t,
+		trace: randomID(16),
+		id:    randomID(8),
+		name:  strings.TrimSpace("aligot " + cfg.action + " " + cfg.pkgs[0]),
+		start: time.Now(),
+		attrs: map[string]string{
+			"aligot.action":   cfg.action,
+			"aligot.package":  cfg.pkgs[0],
+			"aligot.defaults": cfg.defaults,
+			"aligot.arch":     cfg.arch,
+		},
+	}
+	if host, err := os.Hostname(); err == nil {
+		t.root.attrs["host.name"] = host
+	}
+	// traceparent: version-traceid-parentid-flags
+	if tp := strings.Split(os.Getenv("TRACEPARENT"), "-"); len(tp) == 4 && len(tp[1]) == 32 && len(tp[2]) == 16 {
+		t.root.trace, t.root.parent = tp[1], tp[2]
+	}
+	return t
+}
+
+// start starts the span of a phase of a package, or of the run if pkg is
+// empty.
+func (t *tracer) start(pkg, name string) *span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent := t.root
+	if pkg != "" {
+		parent = t.pkgs[pkg]
+		if parent == nil {
+			parent = &span{
+				t:      t,
+				trace:  t.root.trace,
+				id:     randomID(8),
+				parent: t.root.id,
+				name:   pkg,
+				start:  time.Now(),
+				attrs:  map[string]string{"aligot.package": pkg},
+			}
+			t.pkgs[pkg] = parent
+		}
+	}
+	return &span{
+		t:      t,
+		trace:  parent.trace,
+		id:     randomID(8),
+		parent: parent.id,
+		name:   name,
+		start:  time.Now(),
+		attrs:  map[string]string{"aligot.package": pkg},
+	}
+}
+
+// set sets an attribute of a span.
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.t.mu.Lock()
+	s.attrs[key] = value
+	s.t.mu.Unlock()
+}
+
+// finish ends a span, failed if err is not nil.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	t := s.t
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	t.spans = append(t.spans, s)
+	// the span of a package lasts until the end of its last phase.
+	if pkg := t.pkgs[s.attrs["aligot.package"]]; pkg != nil && pkg.id == s.parent {
+		pkg.end = s.end
+		if err != nil {
+			pkg.err = s.err
+		}
+	}
+}
+
+// export sends the spans recorded so far to the collector, ending the span
+// of the run with err.
+// spans of packages are sent with their last phase so far: their later
+// phases, as with -watch, are sent by the next export, in new spans.
+func (t *tracer) export(err error) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	root := *t.root
+	root.end = time.Now()
+	if err != nil {
+		root.err = err.Error()
+	}
+	spans = append(spans, &root)
+	for name, pkg := range t.pkgs {
+		if !pkg.end.IsZero() {
+			spans = append(spans, pkg)
+		}
+		delete(t.pkgs, name)
+	}
+	type otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	type otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	type otlpStatus struct {
+		Code    int    `json:"code"` // 1: ok, 2: error
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"` // 1: internal
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes"`
+		Status       otlpStatus `json:"status"`
+	}
+	attrs := func(m map[string]string) []otlpAttr {
+		vs := []otlpAttr{}
+		for k, v := range m {
+			if v != "" {
+				vs = append(vs, otlpAttr{k, otlpValue{v}})
+			}
+		}
+		sort.Slice(vs, func(i, j int) bool { return vs[i].Key < vs[j].Key })
+		return vs
+	}
+	var out []otlpSpan
+	for _, s := range spans {
+		st := otlpStatus{Code: 1}
+		if s.err != "" {
+			st = otlpStatus{Code: 2, Message: s.err}
+		}
+		out = append(out, otlpSpan{
+			TraceID:      s.trace,
+			SpanID:       s.id,
+			ParentSpanID: s.parent,
+			Name:         s.name,
+			Kind:         1,
+			Start:        strconv.FormatInt(s.start.UnixNano(), 10),
+			End:          strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:   attrs(s.attrs),
+			Status:       st,
+		})
+	}
+	service := attrs(map[string]string{"service.name": t.service})
+	t.mu.Unlock()
+
+	buf, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": service},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "aligot"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s\n%s", resp.Status, body)
+	}
+	msg.Debugf("exported %d spans to [%s]\n", len(out), t.url)
+	return nil
+}
+
+// exportTrace exports the spans of the run, ended with err: failures to
+// export are not fatal.
+func (b *Builder) exportTrace(err error) {
+	if err := b.trace.export(err); err != nil {
+		msg.Warnf("could not export trace to [%s]: %v\n", b.trace.url, err)
+	}
+}
+
+// randomID returns a random identifier of n bytes, hex encoded.
+func randomID(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// fetchRepos fast-forwards the checkout of the recipes repository, and those
+// of the development packages, to their upstream branch, running git with x.
+// the commits before and after the update are reported, so that the logs
+// tell which recipes a run used.
+func fetchRepos(cfg Config, x Executor) error {
+	dirs := []string{cfg.cfgdir}
+	for _, p := range cfg.devel {
+		dirs = append(dirs, develDir(p))
+	}
+	for _, dir := range dirs {
+		old, cur, err := fastForward(interrupts.ctx, x, dir)
+		if err != nil {
+			return fmt.Errorf("could not update [%s]: %v", dir, err)
+		}
+		if old == cur {
+			msg.Infof("[%s] already up to date (%s)\n", dir, cur)
+			continue
+		}
+		msg.Infof("updated [%s]: %s -> %s\n", dir, old, cur)
+	}
+	return nil
+}
+
+// fastForward fast-forwards the git checkout in dir to its upstream branch,
+// with x, and returns the commits of its HEAD before and after.
+func fastForward(ctx context.Context, x Executor, dir string) (old, cur string, err error) {
+	old, err = headCommit(ctx, x, dir)
+	if err != nil {
+		return "", "", err
+	}
+	err = runWith(ctx, x, dir, "git", "pull", "--ff-only", "--quiet")
+	if err != nil {
+		return "", "", err
+	}
+	cur, err = headCommit(ctx, x, dir)
+	return old, cur, err
+}
+
+// headCommit returns the commit of the HEAD of the git checkout in dir, with
+// x.
+func headCommit(ctx context.Context, x Executor, dir string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := output(x, cmd)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestFastForward(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		heads   []string
+		pullErr error
+		old     string
+		cur     string
+		want    []string
+	}{
+		{
+			name:  "updated",
+			heads: []string{"aaa", "bbb"},
+			old:   "aaa",
+			cur:   "bbb",
+			want: []string{
+				"(cd /alidist && git rev-parse HEAD)",
+				"(cd /alidist && git pull --ff-only --quiet)",
+				"(cd /alidist && git rev-parse HEAD)",
+			},
+		},
+		{
+			name:  "up-to-date",
+			heads: []string{"aaa", "aaa"},
+			old:   "aaa",
+			cur:   "aaa",
+			want: []string{
+				"(cd /alidist && git rev-parse HEAD)",
+				"(cd /alidist && git pull --ff-only --quiet)",
+				"(cd /alidist && git rev-parse HEAD)",
+			},
+		},
+		{
+			name:    "diverged",
+			heads:   []string{"aaa"},
+			pullErr: fmt.Errorf("fatal: Not possible to fast-forward"),
+			want: []string{
+				"(cd /alidist && git rev-parse HEAD)",
+				"(cd /alidist && git pull --ff-only --quiet)",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			x := newFakeExecutor()
+			heads := tc.heads
+			x.fn = func(cmd *exec.Cmd) error {
+				if cmd.Args[1] == "pull" {
+					return tc.pullErr
+				}
+				io.WriteString(cmd.Stdout, heads[0]+"\n")
+				heads = heads[1:]
+				return nil
+			}
+
+			old, cur, err := fastForward(context.Background(), x, "/alidist")
+			switch {
+			case tc.pullErr == nil && err != nil:
+				t.Fatalf("could not fast-forward: %+v", err)
+			case tc.pullErr != nil && err == nil:
+				t.Fatalf("expected an error")
+			}
+			if old != tc.old || cur != tc.cur {
+				t.Fatalf("invalid commits: got=%s..%s, want=%s..%s", old, cur, tc.old, tc.cur)
+			}
+			if got, want := x.commands(), tc.want; !reflect.DeepEqual(got, want) {
+				t.Fatalf("invalid commands:\ngot= %q\nwant=%q", got, want)
+			}
+		})
+	}
+}
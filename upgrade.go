@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// upgradeEntry describes how a package of the run is upgraded.
+type upgradeEntry struct {
+	spec      *Spec
+	installed string // version-revision installed, "" if none
+	reason    string // why it is rebuilt, or reinstalled
+}
+
+// installedBuild returns the version-revision and hash of the latest build
+// of the package of a spec installed in the work directory, for its
+// architecture.
+func (b *Builder) installedBuild(spec *Spec) (version, hash string, ok bool) {
+	dir := filepath.Join(b.cfg.wdir, spec.arch, spec.Package)
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", "", false
+	}
+	var latest os.FileInfo
+	for _, fi := range fis {
+		fname := filepath.Join(dir, fi.Name(), installHashFile)
+		hfi, err := os.Stat(fname)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		buf, err := ioutil.ReadFile(fname)
+		if err != nil {
+			continue
+		}
+		h := strings.TrimSpace(string(buf))
+		if h == spec.Hash {
+			return fi.Name(), h, true
+		}
+		if latest == nil || hfi.ModTime().After(latest.ModTime()) {
+			latest, version, hash = hfi, fi.Name(), h
+		}
+	}
+	return version, hash, latest != nil
+}
+
+// upgradePlan returns the packages of the run whose hash changed since their
+// installation, or which are not installed, in build order.
+// since the hash of a package covers the hashes of its dependencies, the
+// dependents of the changed packages are part of the plan.
+func (b *Builder) upgradePlan() []upgradeEntry {
+	var plan []upgradeEntry
+	for _, p := range b.order {
+		spec := b.specs[p]
+		version, hash, ok := b.installedBuild(spec)
+		if ok && hash == spec.Hash {
+			continue
+		}
+		e := upgradeEntry{spec: spec, installed: version}
+		spec.Revision = b.revision(spec)
+		switch {
+		case b.locate(spec):
+			e.reason = "available from the stores"
+		default:
+			e.reason = b.rebuildReason(spec)
+		}
+		plan = append(plan, e)
+	}
+	return plan
+}
+
+// upgrade rebuilds, or reinstalls from the stores, the packages of the run
+// which changed since their installation, typically after an update of the
+// recipes, once the plan of the upgrade is written to w and, on a terminal,
+// confirmed unless yes.
+func (b *Builder) upgrade(w io.Writer, yes bool) error {
+	plan := b.upgradePlan()
+	if len(plan) == 0 {
+		fmt.Fprintf(w, "%s and its dependencies are up to date\n", b.pkgs[0])
+		return nil
+	}
+
+	fmt.Fprintf(w, "%d packages to upgrade:\n", len(plan))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PACKAGE\tINSTALLED\tNEW\tREASON\n")
+	for _, e := range plan {
+		installed := e.installed
+		if installed == "" {
+			installed = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n",
+			e.spec.Package, installed, e.spec.Version+" ("+shortHash(e.spec.Hash)+")", e.reason,
+		)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	if !yes && isTerminal(os.Stdin) {
+		fmt.Fprintf(w, "proceed with the upgrade? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+		default:
+			return fmt.Errorf("upgrade canceled")
+		}
+	}
+	return b.build()
+}
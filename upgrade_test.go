@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpgradePlan(t *testing.T) {
+	recipes := map[string]string{
+		"defaults-release": testDefaults,
+		"app":              testRecipe("app", "v1", []string{"requires: [lib]"}, "make\n"),
+		"lib":              testRecipe("lib", "v1", nil, "make\n"),
+	}
+	for _, tc := range []struct {
+		name      string
+		installed map[string][]string // installed builds of each package, as version-revision:hash ("" for the current hash)
+		stored    []string            // packages whose tarball is in the local store
+		want      []string            // plan, as package installed reason
+	}{
+		{
+			name: "not-installed",
+			want: []string{
+				"defaults-release - first build",
+				"lib - first build",
+				"app - first build",
+			},
+		},
+		{
+			name: "up-to-date",
+			installed: map[string][]string{
+				"defaults-release": {"v1-1:"},
+				"lib":              {"v1-1:"},
+				"app":              {"v1-1:"},
+			},
+		},
+		{
+			name: "changed",
+			installed: map[string][]string{
+				"defaults-release": {"v1-1:"},
+				"lib":              {"v1-1:0123456789"},
+				"app":              {"v1-1:abcdef0123"},
+			},
+			want: []string{
+				"lib v1-1 first build",
+				"app v1-1 first build",
+			},
+		},
+		{
+			name: "older-build",
+			installed: map[string][]string{
+				"defaults-release": {"v1-1:"},
+				"lib":              {"v1-1:", "v1-2:0123456789"},
+				"app":              {"v1-1:"},
+			},
+		},
+		{
+			name: "from-stores",
+			installed: map[string][]string{
+				"defaults-release": {"v1-1:"},
+				"lib":              {"v1-1:"},
+			},
+			stored: []string{"app"},
+			want: []string{
+				"app - available from the stores",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _, fs := newTestBuilder(t, Config{}, recipes)
+			err := b.resolve()
+			if err != nil {
+				t.Fatalf("could not resolve: %+v", err)
+			}
+			for pkg, builds := range tc.installed {
+				spec := b.specs[pkg]
+				for _, build := range builds {
+					i := strings.Index(build, ":")
+					hash := build[i+1:]
+					if hash == "" {
+						hash = spec.Hash
+					}
+					dir := filepath.Join(b.cfg.wdir, spec.arch, spec.Package, build[:i])
+					err := os.MkdirAll(dir, 0755)
+					if err != nil {
+						t.Fatal(err)
+					}
+					err = ioutil.WriteFile(filepath.Join(dir, installHashFile), []byte(hash+"\n"), 0644)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, pkg := range tc.stored {
+				spec := b.specs[pkg]
+				spec.Revision = b.revision(spec)
+				err := fs.MkdirAll(spec.tar.hashDir, 0755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = fs.WriteFile(filepath.Join(spec.tar.hashDir, b.tarball(spec)), nil, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			for _, e := range b.upgradePlan() {
+				installed := e.installed
+				if installed == "" {
+					installed = "-"
+				}
+				got = append(got, e.spec.Package+" "+installed+" "+e.reason)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("invalid plan:\ngot= %q\nwant=%q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// uploadQueue uploads the tarballs of the built packages in the background,
+// while the next packages are built.
+type uploadQueue struct {
+	sem chan struct{} // limits the concurrent uploads
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	pending int
+	failed  []*Spec
+	errs    []error
+}
+
+// queueUpload uploads the tarball of a spec to the write store, and publishes
+// it to the grid, in the background.
+func (b *Builder) queueUpload(spec *Spec) {
+	if b.uploads == nil {
+		jobs := b.cfg.uploadJobs
+		if jobs < 1 {
+			jobs = 1
+		}
+		b.uploads = &uploadQueue{sem: make(chan struct{}, jobs)}
+	}
+	q := b.uploads
+	q.mu.Lock()
+	q.pending++
+	q.mu.Unlock()
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		q.sem <- struct{}{}
+		defer func() { <-q.sem }()
+
+		var ph *phase
+		if b.write != nil {
+			ph = b.phase(spec.Package, "upload")
+		}
+		err := b.upload(spec)
+		ph.finish(err)
+		if err != nil {
+			err = failure(exitUpload, fmt.Errorf("could not upload %s to write store [%s]: %v",
+				spec.Package, b.cfg.writeStore, err,
+			))
+		} else {
+			err = b.publishGrid(spec)
+			if err != nil {
+				err = fmt.Errorf("could not publish %s to the grid: %v", spec.Package, err)
+			}
+		}
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.pending--
+		if err != nil {
+			q.failed = append(q.failed, spec)
+			q.errs = append(q.errs, err)
+		}
+	}()
+}
+
+// waitUploads waits for the uploads queued by the run, and returns the first
+// error.
+// the packages whose upload failed are marked as failed.
+func (b *Builder) waitUploads() error {
+	q := b.uploads
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	n := q.pending
+	q.mu.Unlock()
+	if n > 0 {
+		msg.Infof("waiting for %d uploads to the write store...\n", n)
+	}
+	q.wg.Wait()
+	b.uploads = nil
+	for i, spec := range q.failed {
+		b.setStatus(spec, statusFailed)
+		if i > 0 {
+			msg.Errorf("%v\n", q.errs[i])
+		}
+	}
+	if len(q.errs) > 0 {
+		return q.errs[0]
+	}
+	return nil
+}
+
+// parseRate parses a rate in bytes per second, with an optional k, M or G
+// (binary) suffix, e.g. 10M.
+func parseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	unit := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q (want e.g. 500k, 10M)", s)
+	}
+	return int64(v * float64(unit)), nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sbinet/aligot/store"
+)
+
+// storeProblem is an inconsistency of a store.
+type storeProblem struct {
+	name   string   // file of the store
+	reason string   // what is wrong with it
+	remove []string // files removed to repair it
+}
+
+// storeWalk is the content of a store: its tarballs, and the links of the
+// packages to them.
+type storeWalk struct {
+	tarballs map[string][]string // companion files of the tarballs in the store directories, by tarball
+	links    []string            // links in the package directories
+}
+
+// walkStore lists the tarballs and the links of a store.
+// the store directories hold TARS/<arch>/store/<hh>/<hash>/<tarball>, the
+// package directories TARS/<arch>/<package>/<tarball>.
+func walkStore(ctx context.Context, s store.Store) (storeWalk, error) {
+	walk := storeWalk{tarballs: make(map[string][]string)}
+	list := func(dir string) ([]string, []string, error) {
+		names, ok, err := s.List(ctx, dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("store [%s] can not be listed", s.URL())
+		}
+		var dirs, files []string
+		for _, name := range names {
+			switch {
+			case strings.HasPrefix(name, "."):
+				// caches and temporary files.
+			case strings.HasSuffix(name, "/"):
+				dirs = append(dirs, strings.TrimSuffix(name, "/"))
+			default:
+				files = append(files, name)
+			}
+		}
+		sort.Strings(dirs)
+		sort.Strings(files)
+		return dirs, files, nil
+	}
+
+	archs, _, err := list("TARS")
+	if err != nil {
+		return walk, err
+	}
+	for _, arch := range archs {
+		top := path.Join("TARS", arch)
+		dirs, _, err := list(top)
+		if err != nil {
+			return walk, err
+		}
+		for _, dir := range dirs {
+			if dir != "store" {
+				_, links, err := list(path.Join(top, dir))
+				if err != nil {
+					return walk, err
+				}
+				for _, link := range links {
+					walk.links = append(walk.links, path.Join(top, dir, link))
+				}
+				continue
+			}
+			prefixes, _, err := list(path.Join(top, "store"))
+			if err != nil {
+				return walk, err
+			}
+			for _, hh := range prefixes {
+				hashes, _, err := list(path.Join(top, "store", hh))
+				if err != nil {
+					return walk, err
+				}
+				for _, hash := range hashes {
+					hdir := path.Join(top, "store", hh, hash)
+					_, files, err := list(hdir)
+					if err != nil {
+						return walk, err
+					}
+					for _, f := range files {
+						if base := tarballOf(f); base != "" {
+							tarball := path.Join(hdir, base)
+							walk.tarballs[tarball] = append(walk.tarballs[tarball], path.Join(hdir, f))
+						}
+					}
+				}
+			}
+		}
+	}
+	return walk, nil
+}
+
+// tarballOf returns the tarball a file of a store directory belongs to: the
+// file itself, or the tarball of a companion file (signature, provenance,
+// manifest).
+func tarballOf(name string) string {
+	if strings.HasSuffix(name, store.PartialExt) || strings.HasSuffix(name, store.PartialExt+".json") {
+		return ""
+	}
+	for _, ext := range []string{".asc", provenanceExt, manifestExt} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if !store.IsTarball(name) {
+		return ""
+	}
+	return name
+}
+
+// verifyStore checks the consistency of the named store, or of the local
+// store when name is empty: the tarballs are checked against the digests of
+// their manifests, and the links of the packages must point at tarballs of
+// the store.
+// inconsistent files are removed when repair is true.
+func (b *Builder) verifyStore(w io.Writer, name string, repair bool) error {
+	var s store.Store = store.NewDir(b.cfg.wdir, true, b.fs)
+	if name != "" {
+		var err error
+		s, err = b.openStore(name, repair)
+		if err != nil {
+			return err
+		}
+	}
+
+	msg.Infof("verifying store [%s]...\n", s.URL())
+	walk, err := walkStore(b.ctx, s)
+	if err != nil {
+		return err
+	}
+
+	// tarballs are downloaded next to the local store, to be hard linked
+	// from it when verifying the local store.
+	err = os.MkdirAll(filepath.Join(b.cfg.wdir, "TARS"), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(b.cfg.wdir, "TARS"), ".verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	var (
+		problems   []storeProblem
+		unverified int
+		tarballs   = make([]string, 0, len(walk.tarballs))
+		names      = make(map[string]bool, len(walk.tarballs))
+	)
+	for tarball := range walk.tarballs {
+		tarballs = append(tarballs, tarball)
+	}
+	sort.Strings(tarballs)
+	for _, tarball := range tarballs {
+		reason, ok, err := b.verifyStoreTarball(s, tmp, tarball, walk.tarballs[tarball])
+		if err != nil {
+			return err
+		}
+		switch {
+		case reason != "":
+			problems = append(problems, storeProblem{name: tarball, reason: reason, remove: walk.tarballs[tarball]})
+			continue
+		case !ok:
+			unverified++
+		}
+		names[path.Base(tarball)] = true
+	}
+
+	valid := make(map[string]bool, len(tarballs))
+	for _, tarball := range tarballs {
+		valid[tarball] = true
+	}
+	for _, p := range problems {
+		delete(valid, p.name)
+	}
+	linker, _ := store.Unwrap(s).(store.Linker)
+	for _, link := range walk.links {
+		if linker == nil {
+			// links are copies of their tarball.
+			if !names[path.Base(link)] {
+				problems = append(problems, storeProblem{name: link, reason: "no such tarball in the store", remove: []string{link}})
+			}
+			continue
+		}
+		dst, err := linker.Readlink(b.ctx, link)
+		if err != nil {
+			problems = append(problems, storeProblem{name: link, reason: "not a link", remove: []string{link}})
+			continue
+		}
+		if target := path.Join(path.Dir(link), filepath.ToSlash(dst)); !valid[target] {
+			problems = append(problems, storeProblem{name: link, reason: "dangling link to " + dst, remove: []string{link}})
+		}
+	}
+
+	for _, p := range problems {
+		fmt.Fprintf(w, "%s: %s\n", p.name, p.reason)
+	}
+	fmt.Fprintf(w, "%d tarballs (%d without manifest), %d links: %d problems\n",
+		len(tarballs), unverified, len(walk.links), len(problems),
+	)
+	if len(problems) == 0 {
+		return nil
+	}
+	if !repair {
+		return fmt.Errorf("store [%s] is inconsistent (use -repair to remove the inconsistent files)", s.URL())
+	}
+
+	rm, ok := store.Unwrap(s).(store.Remover)
+	if !ok || !s.Writable() {
+		return fmt.Errorf("could not repair store [%s]: files can not be removed from this store", s.URL())
+	}
+	for _, p := range problems {
+		msg.Infof("removing %v...\n", p.remove)
+		err = rm.Remove(b.ctx, p.remove)
+		if err != nil {
+			return fmt.Errorf("could not repair store [%s]: %v", s.URL(), err)
+		}
+	}
+	return nil
+}
+
+// verifyStoreTarball checks a tarball of a store against its manifest,
+// downloaded into tmp, and returns what is wrong with it, if anything.
+// verifyStoreTarball reports whether the tarball has a manifest.
+func (b *Builder) verifyStoreTarball(s store.Store, tmp, tarball string, files []string) (string, bool, error) {
+	var hasTarball, hasManifest bool
+	for _, f := range files {
+		switch f {
+		case tarball:
+			hasTarball = true
+		case tarball + manifestExt:
+			hasManifest = true
+		}
+	}
+	switch {
+	case !hasTarball:
+		return "missing tarball", hasManifest, nil
+	case !hasManifest:
+		return "", false, nil
+	}
+	defer os.RemoveAll(filepath.Join(tmp, filepath.FromSlash(path.Dir(tarball))))
+
+	mname := filepath.Join(tmp, filepath.FromSlash(tarball+manifestExt))
+	err := s.Fetch(b.ctx, tmp, []string{tarball + manifestExt}, nil)
+	if err != nil {
+		return "", true, err
+	}
+	m, err := readManifest(hostFS{}, mname)
+	if err != nil {
+		return "unreadable manifest: " + err.Error(), true, nil
+	}
+	if hash := path.Base(path.Dir(tarball)); m.Hash != hash {
+		return fmt.Sprintf("manifest of hash %s in the directory of hash %s", m.Hash, hash), true, nil
+	}
+	if m.Tarball != path.Base(tarball) {
+		return fmt.Sprintf("manifest of tarball %s", m.Tarball), true, nil
+	}
+
+	tname := filepath.Join(tmp, filepath.FromSlash(tarball))
+	err = s.Fetch(b.ctx, tmp, []string{tarball}, nil)
+	if err != nil {
+		return "", true, err
+	}
+	fi, err := os.Stat(tname)
+	if err != nil {
+		return "missing tarball", true, nil
+	}
+	if m.Size != 0 && fi.Size() != m.Size {
+		return fmt.Sprintf("size is %d, manifest has %d", fi.Size(), m.Size), true, nil
+	}
+	sum, err := sha256File(hostFS{}, tname)
+	if err != nil {
+		return "", true, err
+	}
+	if sum != m.SHA256 {
+		return fmt.Sprintf("sha256 is %s, manifest has %s", sum, m.SHA256), true, nil
+	}
+	return "", true, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// incrementalMarker is the file marking the build directory of a development
+// package as holding a complete build, that its incremental recipe can
+// update.
+const incrementalMarker = ".aligot-built"
+
+// incremental reports whether a spec is rebuilt with its incremental recipe:
+// development packages with an incremental recipe, whose build directory
+// already holds a complete build.
+func (b *Builder) incremental(spec *Spec) bool {
+	if !b.isDevel(spec.Package) || spec.IncrementalRecipe == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(b.buildDir(spec), incrementalMarker))
+	return err == nil
+}
+
+// watch builds the requested package, then watches the source trees of the
+// development packages and rebuilds them, and the packages depending on
+// them, whenever they change.
+//
+// watch returns when the run is interrupted.
+func watch(b *Builder, interval time.Duration) error {
+	for {
+		err := b.build()
+		if err == errInterrupted || err == errTimedOut {
+			return err
+		}
+		if err != nil {
+			msg.Errorf("%v\n", err)
+		}
+		msg.Infof("watching development packages %v for changes...\n", b.cfg.devel)
+		b, err = waitChanges(b, interval)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// waitChanges polls the source trees of the development packages until one
+// of them changes, and returns the builder of the changed graph.
+func waitChanges(b *Builder, interval time.Duration) (*Builder, error) {
+	for {
+		select {
+		case <-b.ctx.Done():
+			return nil, canceled(b.ctx)
+		case <-time.After(interval):
+		}
+
+		changed := false
+		for _, p := range b.cfg.devel {
+			spec, ok := b.specs[p]
+			if !ok {
+				continue
+			}
+			hash, err := b.develHash(spec)
+			if err != nil {
+				msg.Warnf("%v\n", err)
+				continue
+			}
+			if hash != spec.CommitHash {
+				msg.Infof("sources of %s changed: rebuilding...\n", spec.Package)
+				spec.CommitHash = hash
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		nb := newBuilder(b.cfg)
+		nb.ctx = b.ctx
+		err := nb.resolve()
+		if err != nil {
+			msg.Errorf("%v\n", err)
+			continue
+		}
+		return nb, nil
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sbinet/aligot/farmpb"
+	"google.golang.org/grpc"
+	grpccreds "google.golang.org/grpc/credentials"
+)
+
+// worker is an agent of the build farm, running the jobs dispatched by a
+// coordinator with the local build pipeline.
+type worker struct {
+	cfg    Config
+	client farmpb.CoordinatorClient
+	id     int32
+}
+
+// work joins the build farm of the coordinator at addr, with the token of the
+// farm, and runs up to capacity of its jobs concurrently, until the
+// coordinator is done.
+// the coordinator is verified with the certificates of the given CA bundle,
+// or with the ones of the system when it is empty.
+//
+// concurrent jobs are run in their own work directory, under the work
+// directory of the worker.
+func work(cfg Config, addr, token, caFile string, capacity int) error {
+	if capacity < 1 {
+		capacity = 1
+	}
+	conn, err := farmDial(addr, token, caFile)
+	if err != nil {
+		return fmt.Errorf("could not join coordinator [%s]: %v", addr, err)
+	}
+	defer conn.Close()
+	client := farmpb.NewCoordinatorClient(conn)
+
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	reg, err := client.Register(interrupts.ctx, &farmpb.RegisterRequest{
+		Host:     host,
+		Arch:     cfg.arch,
+		Capacity: int32(capacity),
+	})
+	if err != nil {
+		return fmt.Errorf("could not register with coordinator [%s]: %v", addr, err)
+	}
+	msg.Infof("joined coordinator [%s] as worker #%d (arch=%s, capacity=%d)\n",
+		addr, reg.WorkerId, cfg.arch, capacity,
+	)
+
+	w := &worker{cfg: cfg, client: client, id: reg.WorkerId}
+	quit := make(chan struct{})
+	defer close(quit)
+	go w.heartbeat(time.Duration(reg.HeartbeatMs)*time.Millisecond, quit)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, capacity)
+	)
+	wg.Add(capacity)
+	for i := 0; i < capacity; i++ {
+		go func(i int) {
+			defer wg.Done()
+			c := cfg
+			if capacity > 1 {
+				c.wdir = filepath.Join(cfg.wdir, fmt.Sprintf("slot-%d", i))
+			}
+			errs[i] = w.loop(c)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	msg.Infof("coordinator [%s] done\n", addr)
+	return nil
+}
+
+// farmDial connects to the coordinator at addr, over TLS, with the token of
+// the farm.
+// the coordinator is verified with the certificates of the given CA bundle,
+// or with the ones of the system when it is empty.
+func farmDial(addr, token, caFile string) (*grpc.ClientConn, error) {
+	tlscfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlscfg.RootCAs = x509.NewCertPool()
+		if !tlscfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in CA bundle [%s]", caFile)
+		}
+	}
+	return grpc.NewClient(addr,
+		grpc.WithTransportCredentials(grpccreds.NewTLS(tlscfg)),
+		grpc.WithPerRPCCredentials(farmToken(token)),
+	)
+}
+
+// heartbeat reports to the coordinator that the worker is alive, until quit
+// is closed.
+func (w *worker) heartbeat(interval time.Duration, quit chan struct{}) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-tick.C:
+		}
+		_, err := w.client.Heartbeat(interrupts.ctx, &farmpb.HeartbeatRequest{WorkerId: w.id})
+		if err != nil {
+			msg.Warnf("could not send heartbeat: %v\n", err)
+		}
+	}
+}
+
+// loop runs the jobs dispatched to the worker, in the work directory of cfg.
+func (w *worker) loop(cfg Config) error {
+	for {
+		if interrupts.interrupted() {
+			return errInterrupted
+		}
+		next, err := w.client.Next(interrupts.ctx, &farmpb.NextRequest{WorkerId: w.id})
+		if err != nil {
+			return fmt.Errorf("could not get job from coordinator: %v", err)
+		}
+		if next.Exit {
+			return nil
+		}
+		if next.Job == nil {
+			continue
+		}
+
+		job := next.Job
+		msg.Infof("building %s (%s)...\n", job.Package, job.Arch)
+		done := &farmpb.DoneRequest{WorkerId: w.id, JobId: job.Id}
+		err = w.run(cfg, job)
+		if err != nil {
+			msg.Errorf("could not build %s: %v\n", job.Package, err)
+			done.Error = err.Error()
+		}
+		_, err = w.client.Done(interrupts.ctx, done)
+		if err != nil {
+			return fmt.Errorf("could not report job to coordinator: %v", err)
+		}
+	}
+}
+
+// run builds the package of a job with the local build pipeline, fetching
+// its dependencies from the store of the job and uploading the package to
+// it, while streaming its build log to the coordinator.
+func (w *worker) run(cfg Config, job *farmpb.Job) error {
+	cfg.pkgs = []string{job.Package}
+	cfg.defaults = job.Defaults
+	cfg.arch = job.Arch
+	cfg.hostArch = job.Arch
+	cfg.toolchain = job.Toolchain
+	cfg.buildType = job.BuildType
+	cfg.sanitizers = job.Sanitizers
+	cfg.remoteStore = job.Store
+	cfg.writeStore = job.Store
+
+	b := newBuilder(cfg)
+	err := b.resolve()
+	if err != nil {
+		return err
+	}
+	spec := b.specs[job.Package]
+	if spec.Hash != job.Hash {
+		return fmt.Errorf(
+			"hash mismatch for %s (worker=%s, coordinator=%s): recipes differ from the ones of the coordinator",
+			job.Package, spec.Hash, job.Hash,
+		)
+	}
+
+	fname := filepath.Join(b.logDir(spec), "log")
+	os.Remove(fname)
+	quit := make(chan struct{})
+	tailed := make(chan struct{})
+	go func() {
+		defer close(tailed)
+		w.streamLog(job, fname, quit)
+	}()
+
+	err = b.build()
+	close(quit)
+	<-tailed
+	return err
+}
+
+// streamLog sends the content of the named log file of a job to the
+// coordinator, as it is written, until quit is closed.
+func (w *worker) streamLog(job *farmpb.Job, fname string, quit chan struct{}) {
+	var (
+		f   *os.File
+		buf = make([]byte, 64*1024)
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	send := func() {
+		if f == nil {
+			var err error
+			f, err = os.Open(fname)
+			if err != nil {
+				return
+			}
+		}
+		for {
+			n, err := f.Read(buf)
+			if n > 0 {
+				req := &farmpb.LogRequest{WorkerId: w.id, JobId: job.Id, Data: buf[:n]}
+				if _, err := w.client.Log(interrupts.ctx, req); err != nil {
+					msg.Warnf("could not stream log of %s: %v\n", job.Package, err)
+				}
+			}
+			if err == io.EOF || n == 0 {
+				return
+			}
+			if err != nil {
+				msg.Warnf("could not read log of %s: %v\n", job.Package, err)
+				return
+			}
+		}
+	}
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-quit:
+			send()
+			return
+		case <-tick.C:
+			send()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// configWorktree returns a checkout of the recipes repository at the given
+// revision (a tag, a branch or a commit), for this run.
+// the revision is checked out in a detached worktree of the work directory,
+// so that the checkout of the user is left alone, and reused by the later
+// runs at the same revision.
+// git is run with x.
+func configWorktree(cfg Config, x Executor, ref string) (string, error) {
+	cmd := exec.CommandContext(interrupts.ctx, "git", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	cmd.Dir = cfg.cfgdir
+	out, err := output(x, cmd)
+	if err != nil {
+		return "", fmt.Errorf("no revision %q in the recipes repository [%s]", ref, cfg.cfgdir)
+	}
+	commit := string(bytes.TrimSpace(out))
+
+	dir := filepath.Join(cfg.wdir, "CONFIG", commit)
+	msg.Infof("using recipes of %s (%s) from [%s]\n", ref, commit, dir)
+	if exists(filepath.Join(dir, ".git")) {
+		return dir, nil
+	}
+	err = runWith(interrupts.ctx, x, cfg.cfgdir, "git", "worktree", "add", "--detach", "--force", dir, commit)
+	if err != nil {
+		return "", fmt.Errorf("could not check out revision %q of the recipes: %v", ref, err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigWorktree(t *testing.T) {
+	const revParse = "git rev-parse --verify --quiet v2^{commit}"
+	for _, tc := range []struct {
+		name string
+		err  error
+		want string // error
+	}{
+		{name: "ok"},
+		{name: "no-revision", err: fmt.Errorf("exit status 1"), want: `no revision "v2" in the recipes repository [/alidist]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newTestConfig(t, Config{})
+			x := newFakeExecutor()
+			x.out[revParse] = "0123abcd\n"
+			if tc.err != nil {
+				delete(x.out, revParse)
+				x.errs[revParse] = tc.err
+			}
+
+			dir, err := configWorktree(cfg, x, "v2")
+			if tc.want != "" {
+				if err == nil || err.Error() != tc.want {
+					t.Fatalf("invalid error: got=%v, want=%q", err, tc.want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not check out the recipes: %+v", err)
+			}
+			if got, want := dir, filepath.Join(cfg.wdir, "CONFIG", "0123abcd"); got != want {
+				t.Fatalf("invalid worktree: got=%q, want=%q", got, want)
+			}
+			want := []string{
+				"(cd /alidist && " + revParse + ")",
+				"(cd /alidist && git worktree add --detach --force " + dir + " 0123abcd)",
+			}
+			if got := x.commands(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("invalid commands:\ngot= %q\nwant=%q", got, want)
+			}
+		})
+	}
+}